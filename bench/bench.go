@@ -0,0 +1,130 @@
+// Package bench runs the benchmarks of tcpchat's packages with `go test -bench` and compares
+// their results against the ones of an earlier run, to catch regressions
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Packages are the packages with benchmarks, relative to the root of the module
+var Packages = []string{"./common", "./server"}
+
+// Result is the mean of the runs of a benchmark
+type Result struct {
+	NsPerOp     float64
+	BytesPerOp  float64
+	AllocsPerOp float64
+	runs        int
+}
+
+// Run runs the benchmarks matching filter count times each, in the module at dir, writing the
+// output of `go test` to w as it comes and returning it for it to be saved or compared
+func Run(w io.Writer, dir, filter string, count int) ([]byte, error) {
+	args := []string{"test", "-run", "^$", "-bench", filter, "-benchmem", "-count", strconv.Itoa(count)}
+	args = append(args, Packages...)
+
+	output := &bytes.Buffer{}
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Stdout = io.MultiWriter(w, output)
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("go %s: %w", strings.Join(args, " "), err)
+	}
+
+	return output.Bytes(), nil
+}
+
+// Parse reads the results out of the output of `go test -bench`, averaging the runs of every
+// benchmark. The suffix with GOMAXPROCS is left out of the names
+func Parse(r io.Reader) (map[string]Result, error) {
+	results := map[string]Result{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		name := fields[0]
+		if i := strings.LastIndexByte(name, '-'); i > 0 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				name = name[:i]
+			}
+		}
+
+		result := results[name]
+		result.runs++
+
+		// after the name and the number of iterations come pairs of a value and its unit
+		for i := 2; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fields[0], err)
+			}
+
+			switch fields[i+1] {
+			case "ns/op":
+				result.NsPerOp += (value - result.NsPerOp) / float64(result.runs)
+			case "B/op":
+				result.BytesPerOp += (value - result.BytesPerOp) / float64(result.runs)
+			case "allocs/op":
+				result.AllocsPerOp += (value - result.AllocsPerOp) / float64(result.runs)
+			}
+		}
+
+		results[name] = result
+	}
+
+	return results, scanner.Err()
+}
+
+// Compare writes a table of the benchmarks run both before and after, with how much their time
+// and allocations changed, and returns how many got slower by more than threshold percent
+func Compare(w io.Writer, before, after map[string]Result, threshold float64) int {
+	names := []string{}
+	for name := range after {
+		if _, ok := before[name]; ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "benchmark\told ns/op\tnew ns/op\tdelta\told allocs/op\tnew allocs/op\t\t")
+
+	regressions := 0
+	for _, name := range names {
+		old, current := before[name], after[name]
+
+		delta := 0.0
+		if old.NsPerOp > 0 {
+			delta = (current.NsPerOp - old.NsPerOp) / old.NsPerOp * 100
+		}
+
+		verdict := ""
+		if delta > threshold {
+			verdict = "regression"
+			regressions++
+		}
+
+		fmt.Fprintf(table, "%s\t%.1f\t%.1f\t%+.1f%%\t%.0f\t%.0f\t%s\t\n",
+			name, old.NsPerOp, current.NsPerOp, delta, old.AllocsPerOp, current.AllocsPerOp, verdict)
+	}
+
+	table.Flush()
+
+	return regressions
+}
@@ -0,0 +1,61 @@
+package bench
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const before = `goos: linux
+goarch: amd64
+pkg: github.com/nikochiko/tcpchat/common
+BenchmarkFrameEncode-8   	 1000000	      1000 ns/op	 150.00 MB/s	     320 B/op	       2 allocs/op
+BenchmarkFrameEncode-8   	 1000000	      1200 ns/op	 140.00 MB/s	     320 B/op	       2 allocs/op
+BenchmarkReadFrame/bytes=256-8	 5000000	       200 ns/op	1280.00 MB/s	       0 B/op	       0 allocs/op
+PASS
+ok  	github.com/nikochiko/tcpchat/common	3.210s
+`
+
+func TestParseAveragesRuns(t *testing.T) {
+	results, err := Parse(strings.NewReader(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %v", len(results), results)
+	}
+
+	encode := results["BenchmarkFrameEncode"]
+	if encode.NsPerOp != 1100 || encode.BytesPerOp != 320 || encode.AllocsPerOp != 2 {
+		t.Errorf("BenchmarkFrameEncode = %+v, want the mean of its runs", encode)
+	}
+
+	if results["BenchmarkReadFrame/bytes=256"].NsPerOp != 200 {
+		t.Errorf("sub-benchmarks keep their names: %v", results)
+	}
+}
+
+func TestCompareCountsRegressions(t *testing.T) {
+	old, err := Parse(strings.NewReader(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := map[string]Result{
+		"BenchmarkFrameEncode":         {NsPerOp: 1500, AllocsPerOp: 2},
+		"BenchmarkReadFrame/bytes=256": {NsPerOp: 190},
+		"BenchmarkNew":                 {NsPerOp: 10},
+	}
+
+	report := &bytes.Buffer{}
+	regressions := Compare(report, old, current, 10)
+
+	if regressions != 1 {
+		t.Errorf("got %d regressions, want 1:\n%s", regressions, report)
+	}
+
+	if !strings.Contains(report.String(), "+36.4%") || strings.Contains(report.String(), "BenchmarkNew") {
+		t.Errorf("unexpected report:\n%s", report)
+	}
+}
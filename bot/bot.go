@@ -0,0 +1,291 @@
+// Package bot is a framework for bots: programs that join conversations and respond to the
+// messages sent to them, without speaking the protocol themselves. Handlers are registered
+// for commands, like "!karma", or for patterns, and called with the messages that match
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/client"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// reconnectDelays are how long the bot waits before every attempt to reconnect to its server,
+// like the client does, after which it gives up
+var reconnectDelays = []time.Duration{
+	time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+	15 * time.Second, 30 * time.Second, 30 * time.Second, 30 * time.Second,
+}
+
+// Message is a message sent to a conversation the bot joined, as its handlers get it
+type Message struct {
+	common.Message
+	// Args is the text after the command, trimmed, for the handlers of commands
+	Args string
+	// Match is the match of the pattern and its submatches, for the handlers of patterns
+	Match []string
+	// State is the state of the conversation, for handlers to keep what they like in it. It
+	// lasts as long as the bot runs, reconnections included
+	State map[string]any
+
+	bot *Bot
+}
+
+// Reply sends text to the conversation the message was sent to
+func (m *Message) Reply(text string) error {
+	return m.bot.Say(m.Conversation, text)
+}
+
+// HandlerFunc handles a message. Handlers are called one at a time, in the order the messages
+// came in, so they needn't lock the State. The errors they return are logged
+type HandlerFunc func(m *Message) error
+
+type route struct {
+	// command is set for the handlers of commands, and pattern for the others
+	command string
+	pattern *regexp.Regexp
+	handle  HandlerFunc
+}
+
+// Bot is a bot, logged in to a server as the user of a client configuration
+type Bot struct {
+	config        *client.Config
+	profile       client.Profile
+	conversations []string
+	routes        []route
+	// states are the states of the conversations by their ID, which renames don't change
+	states map[uuid.UUID]map[string]any
+
+	mu     sync.Mutex
+	conn   *client.Conn
+	bucket *common.TokenBucket
+}
+
+// New returns a bot that logs in to the server of profile as the user of config, like the
+// client does. Bots should have a configuration file, and so an identity, of their own
+func New(config *client.Config, profile client.Profile) *Bot {
+	return &Bot{
+		config:  config,
+		profile: profile,
+		states:  map[uuid.UUID]map[string]any{},
+	}
+}
+
+// Join has the bot join the conversations with the given nicknames when it connects
+func (b *Bot) Join(nicknames ...string) {
+	b.conversations = append(b.conversations, nicknames...)
+}
+
+// Command has handle called for the messages whose first word is command, like "!echo", in
+// any case. The rest of the text is in their Args
+func (b *Bot) Command(command string, handle HandlerFunc) {
+	b.routes = append(b.routes, route{command: command, handle: handle})
+}
+
+// Pattern has handle called for the messages pattern matches
+func (b *Bot) Pattern(pattern *regexp.Regexp, handle HandlerFunc) {
+	b.routes = append(b.routes, route{pattern: pattern, handle: handle})
+}
+
+// Say sends text to conversation, pacing the messages to stay under the server's rate limit
+func (b *Bot) Say(conversation *common.Conversation, text string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		return errors.New("not connected")
+	}
+
+	for {
+		ok, wait := b.bucket.Take(time.Now())
+		if ok {
+			break
+		}
+		time.Sleep(wait)
+	}
+
+	_, err := b.conn.SendMessage(conversation, text)
+
+	return err
+}
+
+// Run connects the bot and handles the messages of its conversations, reconnecting when the
+// connection is lost. It only returns if the bot couldn't connect, or gave up reconnecting
+func (b *Bot) Run() error {
+	err := b.connect()
+	if err != nil {
+		return err
+	}
+
+	for {
+		err := b.serve()
+		log.Printf("Lost the connection to %s, reconnecting: %s\n", b.profile.Alias, err.Error())
+
+		err = b.reconnect()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connect logs in and joins the conversations
+func (b *Bot) connect() error {
+	conn, err := client.Dial(b.config, b.profile)
+	if err != nil {
+		return err
+	}
+
+	conversations, err := conn.List()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	for _, nickname := range b.conversations {
+		// the server hangs up on subscriptions to conversations it doesn't have
+		conversation := findConversation(conversations, nickname)
+		if conversation == nil {
+			common.Errorf("There's no conversation called %s on %s, not joining it\n", nickname, b.profile.Alias)
+			continue
+		}
+
+		err = conn.Send(common.SubscribeOperationType, common.Conversation{Nickname: conversation.Nickname})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	b.conn = conn
+	if b.bucket == nil {
+		b.bucket = common.NewTokenBucket(conn.RateLimit())
+	} else {
+		b.bucket.SetLimit(conn.RateLimit())
+	}
+	b.mu.Unlock()
+
+	log.Printf("Connected to %s as %s\n", b.profile.Alias, conn.Me().Name)
+
+	return nil
+}
+
+func (b *Bot) reconnect() error {
+	b.mu.Lock()
+	b.conn.Close()
+	b.conn = nil
+	b.mu.Unlock()
+
+	for _, delay := range reconnectDelays {
+		time.Sleep(delay)
+
+		err := b.connect()
+		if err == nil {
+			return nil
+		}
+
+		common.Debugf("Couldn't reconnect to %s: %s\n", b.profile.Alias, err.Error())
+	}
+
+	return fmt.Errorf("gave up reconnecting to %s", b.profile.Alias)
+}
+
+// serve handles what the server sends until the connection is lost
+func (b *Bot) serve() error {
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+
+	me := conn.Me()
+
+	for {
+		response, err := conn.Next()
+		if err != nil {
+			return err
+		}
+
+		if response.Status == "error" {
+			if response.Error == nil {
+				continue
+			}
+			if response.Error.Code == common.IdleTimeoutErrorCode {
+				return response.Error
+			}
+
+			// the server hangs up after the errors without a code, which Next will tell
+			common.Errorf("Error from %s: %s\n", b.profile.Alias, response.Error.Message)
+			continue
+		}
+
+		if response.OperationType != common.MessageOperationType || response.Message == nil {
+			continue
+		}
+
+		message := common.Message{}
+		err = json.Unmarshal(*response.Message, &message)
+		if err != nil {
+			common.Errorf("Couldn't read a message from %s: %s\n", b.profile.Alias, err.Error())
+			continue
+		}
+
+		// acknowledgements of our messages have no sender, and our own messages come back to us
+		if message.Sender == nil || message.Sender.ID == me.ID || message.Conversation == nil ||
+			message.Recipient != nil || message.Kind == common.SystemMessageKind {
+			continue
+		}
+
+		b.dispatch(message)
+	}
+}
+
+// dispatch calls the handler of the first route the message matches
+func (b *Bot) dispatch(message common.Message) {
+	state, ok := b.states[message.Conversation.ID]
+	if !ok {
+		state = map[string]any{}
+		b.states[message.Conversation.ID] = state
+	}
+
+	for _, r := range b.routes {
+		m := &Message{Message: message, State: state, bot: b}
+
+		if r.command != "" {
+			first, rest, _ := strings.Cut(strings.TrimSpace(message.Text), " ")
+			if !strings.EqualFold(first, r.command) {
+				continue
+			}
+			m.Args = strings.TrimSpace(rest)
+		} else {
+			m.Match = r.pattern.FindStringSubmatch(message.Text)
+			if m.Match == nil {
+				continue
+			}
+		}
+
+		err := r.handle(m)
+		if err != nil {
+			common.Errorf("Couldn't handle a message in %s: %s\n", message.Conversation.Nickname, err.Error())
+		}
+
+		return
+	}
+}
+
+// findConversation is the conversation with the given nickname, in any case, or nil
+func findConversation(conversations []*common.Conversation, nickname string) *common.Conversation {
+	for _, conversation := range conversations {
+		if strings.EqualFold(conversation.Nickname, nickname) {
+			return conversation
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build chaos
+
+package main
+
+import (
+	"flag"
+
+	"github.com/nikochiko/tcpchat/server"
+)
+
+// addChaosFlag adds the -chaos flag of serve, only in builds with the chaos tag for test
+// servers. The returned function injects the faults the flag asks for, if any
+func addChaosFlag(flags *flag.FlagSet) func() {
+	chaosFile := flags.String("chaos", "", "inject the faults described in the YAML `file` into the TCP connections, for testing clients")
+
+	return func() {
+		if *chaosFile == "" {
+			return
+		}
+
+		chaos, err := server.LoadChaos(*chaosFile)
+		exitOnError(err)
+		server.InjectChaos(chaos)
+	}
+}
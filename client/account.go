@@ -0,0 +1,137 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// accountExportJob collects the pages of the data a server keeps about us until the last one,
+// and then writes them to path
+type accountExportJob struct {
+	path string
+	data common.AccountData
+	// started is set once the first page, with everything but the rest of the messages, came
+	started bool
+}
+
+// chosenServer is the server with the given alias, or the only one we're connected to when
+// alias is empty
+func chosenServer(alias string) (*serverConn, error) {
+	if alias != "" {
+		sc, ok := serverByAlias(alias)
+		if !ok {
+			return nil, fmt.Errorf("not connected to %s", alias)
+		}
+
+		return sc, nil
+	}
+
+	list := connectedServers()
+	if len(list) != 1 {
+		return nil, errors.New("which server? Give its alias last")
+	}
+
+	return list[0], nil
+}
+
+// exportAccount starts saving the data sc keeps about us to the file at path
+func (sc *serverConn) exportAccount(path string) error {
+	path, err := expandHome(path)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	if sc.accountExport != nil {
+		sc.mu.Unlock()
+		return fmt.Errorf("your data on %s is being exported already", sc.profile.Alias)
+	}
+	sc.accountExport = &accountExportJob{path: path}
+	sc.mu.Unlock()
+
+	return sc.sendOperation(common.AccountExportOperationType, common.AccountExport{})
+}
+
+// handleAccountExportResponse adds a page to the export of our data, asking for the next one or
+// writing the file once there are no more
+func (sc *serverConn) handleAccountExportResponse(jsonData *json.RawMessage) {
+	page := common.AccountData{}
+
+	err := json.Unmarshal(*jsonData, &page)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	sc.mu.Lock()
+	job := sc.accountExport
+	if job != nil {
+		if job.started {
+			job.data.Messages = append(job.data.Messages, page.Messages...)
+		} else {
+			job.data, job.started = page, true
+		}
+		if page.NextCursor == "" {
+			sc.accountExport = nil
+		}
+	}
+	sc.mu.Unlock()
+
+	if job == nil {
+		return
+	}
+
+	if page.NextCursor != "" {
+		err := sc.sendOperation(common.AccountExportOperationType, common.AccountExport{Cursor: page.NextCursor})
+		common.CheckErrorAndLog(err)
+		return
+	}
+
+	job.data.NextCursor = ""
+
+	err = writeAccountExport(job)
+	if err != nil {
+		common.CheckErrorAndLog(fmt.Errorf("couldn't export your data on %s to %s: %w", sc.profile.Alias, job.path, err))
+		return
+	}
+
+	notice(fmt.Sprintf("Exported your data on %s, with %d message(s), to %s", sc.profile.Alias, len(job.data.Messages), job.path))
+}
+
+// cancelAccountExport gives up on the export of our data when the server refuses a page
+func (sc *serverConn) cancelAccountExport() {
+	sc.mu.Lock()
+	job := sc.accountExport
+	sc.accountExport = nil
+	sc.mu.Unlock()
+
+	if job != nil {
+		notice("Export of your data on " + sc.profile.Alias + " failed")
+	}
+}
+
+func writeAccountExport(job *accountExportJob) error {
+	f, err := os.OpenFile(job.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+
+	err = encoder.Encode(job.data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// deleteAccount asks sc to delete our account, confirming with name, which must be ours
+func (sc *serverConn) deleteAccount(name string) error {
+	return sc.sendOperation(common.DeleteAccountOperationType, common.DeleteAccount{Confirm: name})
+}
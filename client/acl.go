@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// setACL gives user access to a conversation we own, or takes it away when access is empty.
+// Without a user, it asks for the conversation's ACL
+func (sc *serverConn) setACL(nickname, user, access string) error {
+	return sc.sendOperation(common.ACLOperationType, common.ACL{Nickname: nickname, User: user, Access: access})
+}
+
+// handleACLResponse shows the ACL of a conversation, and forgets our subscription to it when
+// the ACL locked us out
+func (sc *serverConn) handleACLResponse(jsonConversation *json.RawMessage) {
+	conversation := &common.Conversation{}
+
+	err := json.Unmarshal(*jsonConversation, conversation)
+	if common.CheckErrorAndLog(err) || conversation.ID == uuid.Nil {
+		return
+	}
+
+	sc.updateConversation(conversation)
+
+	sc.mu.Lock()
+	lockedOut := sc.subscriptions[conversation.Nickname] && !conversation.Allows(sc.clientInfo.ID, common.ReadAccess)
+	if lockedOut {
+		delete(sc.subscriptions, conversation.Nickname)
+	}
+	sc.mu.Unlock()
+
+	if lockedOut {
+		active.left(sc, conversation.Nickname)
+		notice("You don't have access to " + sc.label(conversation.Nickname) + " anymore")
+		screen.refresh()
+		return
+	}
+
+	if len(conversation.ACL) == 0 {
+		notice(sc.label(conversation.Nickname) + " has no ACL: everyone can read and write in it")
+		return
+	}
+
+	lines := []string{"ACL of " + sc.label(conversation.Nickname) + ":"}
+	for _, entry := range conversation.ACL {
+		lines = append(lines, fmt.Sprintf("  %s (%s): %s", sanitize(entry.Name), entry.ID.String()[:8], entry.Access))
+	}
+
+	notice(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// adminToken is set by UseAdminToken to authenticate admin operations
+var adminToken string
+
+// UseAdminToken makes the admin operations authenticate with token first, so that they may be
+// run from other hosts than the server's
+func UseAdminToken(token string) {
+	adminToken = token
+}
+
+// Drain asks the server at service to migrate its clients to drain.Address and shut down
+// once they've left. It needs the admin token, unless the server trusts local clients
+func Drain(network, service string, drain common.Drain) error {
+	return runAdminOperation(network, service, common.DrainOperationType, drain, nil)
+}
+
+// Announce sends an announcement through the server at service, to all of its clients or to
+// a conversation. It needs the admin token, unless the server trusts local clients
+func Announce(network, service string, announcement common.Announcement) error {
+	return runAdminOperation(network, service, common.AnnounceOperationType, announcement, nil)
+}
+
+// RunAdminCommand runs a command of the admin console of the server at service, like
+// "connections" or "kick bob", and returns its output
+func RunAdminCommand(network, service, command string) (string, error) {
+	result := common.AdminCommand{}
+
+	err := runAdminOperation(network, service, common.AdminOperationType, common.AdminCommand{Command: command}, &result)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Output, nil
+}
+
+// runAdminOperation connects to the server, authenticates if there is an admin token, sends
+// a single operation and waits for its response, which is unmarshaled into result if it isn't nil
+func runAdminOperation(network, service, operationType string, v interface{}, result interface{}) error {
+	conn, err := dial(network, service)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// "admin" itself is reserved, so the tool takes a name of its own, told apart by its ID
+	aboutMe := initialiseSender("")
+	aboutMe.Name = "admin-" + aboutMe.ID.String()[:8]
+
+	connReader := bufio.NewReader(conn)
+
+	proof, err := answerChallenge(connReader)
+	if err != nil {
+		return err
+	}
+
+	err = sendAboutClient(conn, *aboutMe, common.Login{}, proof)
+	if err != nil {
+		return err
+	}
+
+	if adminToken != "" {
+		err = writeOperationTo(conn, common.AuthOperationType, common.Auth{Token: adminToken})
+		if err != nil {
+			return err
+		}
+
+		// a wrong token closes the connection, so wait to be told before going on
+		_, err = awaitResponse(connReader, common.AuthOperationType)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeOperationTo(conn, operationType, v)
+	if err != nil {
+		return err
+	}
+
+	response, err := awaitResponse(connReader, operationType)
+	if err != nil {
+		return err
+	}
+
+	if result == nil {
+		fmt.Printf("%s: ok\n", operationType)
+		return nil
+	}
+
+	if response.Message == nil {
+		return errors.New("empty response from server")
+	}
+
+	return json.Unmarshal(*response.Message, result)
+}
+
+// answerChallenge waits for the challenge the server opens the connection with, and proves we
+// have the private key of our public key with it
+func answerChallenge(connReader *bufio.Reader) (common.Proof, error) {
+	response, err := awaitResponse(connReader, common.ChallengeOperationType)
+	if err != nil {
+		return common.Proof{}, err
+	}
+
+	challenge := common.Challenge{}
+	if response.Message != nil {
+		err = json.Unmarshal(*response.Message, &challenge)
+	}
+	if err != nil {
+		return common.Proof{}, err
+	}
+
+	return common.Prove(challenge.Nonce, self.PrivateKey), nil
+}
+
+// awaitResponse reads responses until the one to an operation of operationType, skipping the
+// messages and such sent in between. Error responses are returned as errors
+func awaitResponse(connReader *bufio.Reader, operationType string) (*common.Response, error) {
+	for {
+		frame, err := common.ReadUntil(connReader, common.EOFBytes)
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("connection closed by server")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		response := common.Response{}
+		err = json.Unmarshal(frame, &response)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.Status == "error" {
+			if response.Error == nil {
+				return nil, errors.New("unknown error from server")
+			}
+			return nil, errors.New(response.Error.Message)
+		}
+
+		if response.OperationType == operationType {
+			return &response, nil
+		}
+	}
+}
+
+// writeOperationTo sends an operation with v as its message
+func writeOperationTo(conn net.Conn, operationType string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	message := json.RawMessage(b)
+
+	return writeJSONTo(conn, common.Operation{Type: operationType, Message: &message})
+}
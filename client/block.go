@@ -0,0 +1,99 @@
+package client
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// blockState are the names of the users whose messages are hidden. It starts out from the
+// configuration's blocked, and changes are saved back to the configuration file
+type blockState struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+var blocking = &blockState{names: map[string]bool{}}
+
+func (b *blockState) load(names []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.names = map[string]bool{}
+	for _, name := range names {
+		b.names[name] = true
+	}
+}
+
+func (b *blockState) has(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.names[name]
+}
+
+// set blocks or unblocks name, on every server too, and saves the blocked names
+func (b *blockState) set(name string, blocked bool) error {
+	b.mu.Lock()
+	if blocked {
+		b.names[name] = true
+	} else {
+		delete(b.names, name)
+	}
+	names := b.list()
+	b.mu.Unlock()
+
+	for _, sc := range connectedServers() {
+		err := sc.sendOperation(common.BlockOperationType, common.Block{User: name, Blocked: blocked})
+		if err != nil {
+			return err
+		}
+	}
+
+	return settings.save([]string{"blocked"}, names)
+}
+
+// list returns the blocked names, sorted. b.mu must be held
+func (b *blockState) list() []string {
+	names := []string{}
+	for name := range b.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// listBlocks asks sc who it stops delivering messages from
+func (sc *serverConn) listBlocks() error {
+	return sc.sendOperation(common.BlocksOperationType, struct{}{})
+}
+
+func (sc *serverConn) handleBlockListResponse(blockListResponse *json.RawMessage) {
+	blockList := common.BlockList{}
+
+	err := json.Unmarshal(*blockListResponse, &blockList)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	prefix := "Blocked"
+	if len(connectedServers()) > 1 {
+		prefix += " on " + sc.profile.Alias
+	}
+
+	if len(blockList.Users) == 0 {
+		notice(prefix + ": nobody")
+		return
+	}
+
+	names := []string{}
+	for _, sender := range blockList.Users {
+		names = append(names, sender.Name+" ("+sender.ID.String()+")")
+	}
+
+	notice(prefix + ": " + strings.Join(names, ", "))
+}
@@ -2,154 +2,970 @@ package client
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/nikochiko/tcpchat/common"
 )
 
-var globalConversations = []*common.Conversation{}
-var clientInfo = common.ClientAboutMe{}
+// serverConn is the connection to one of the servers we are connected to, with
+// everything we know about that server
+type serverConn struct {
+	profile  Profile
+	outgoing *sendQueue
+	outbox   *outbox
+
+	mu sync.Mutex
+	// conn is the connection to the server, replaced when we reconnect or migrate
+	conn          net.Conn
+	clientInfo    common.ClientAboutMe
+	conversations []*common.Conversation
+	// subscriptions are the nicknames of the conversations we subscribed to, and pendingJoins the
+	// ones to subscribe to once the server lists them (on auto-join, or after migrating to another server)
+	subscriptions map[string]bool
+	pendingJoins  map[string]bool
+	// users are the names of the users we've seen messages from, for completion
+	users map[string]bool
+	// unread counts the messages of every conversation since we last talked in it
+	unread map[string]int
+	// history are the latest messages of every conversation, for /history
+	history map[string]*messageRing
+	// silentLists counts the lists fetched in the background, which aren't shown to the user
+	silentLists int
+	// lastSearch is the search /more continues
+	lastSearch *common.Search
+	// exports are the /exports under way, by the nickname of their conversation
+	exports map[string]*exportJob
+	// lastSeqs are the Seq of the latest message we got of every conversation, by its ID
+	lastSeqs map[uuid.UUID]uint64
+	// directKeys are the users we sent direct messages to, by their lowercased name, and
+	// pendingDirect the messages waiting for the server to tell us who a name is
+	directKeys    map[string]common.Sender
+	pendingDirect map[string][]directMessage
+	// boxKeys are the box keys of the users we first saw, by ID, to notice when they change
+	boxKeys map[uuid.UUID][]byte
+	// groupKeys are the keys of the encrypted conversations, by their ID and epoch
+	groupKeys map[uuid.UUID]map[uint64][]byte
+	// sessions are the sessions we last listed, for /revoke
+	sessions []common.SessionInfo
+	// accountExport is the /mydata under way, if any
+	accountExport *accountExportJob
+	// refused is set when the server refused us for good, like when we're banned, so that
+	// we don't reconnect. It's only used by the goroutine handling the responses
+	refused bool
+}
 
-func Connect(service string) {
-	raddr, err := net.ResolveTCPAddr("tcp4", service)
-	common.CheckError(err)
+// servers are all the servers we're connected to, in the order we connected to them
+var servers = []*serverConn{}
+var serversMu sync.Mutex
 
-	conn, err := net.DialTCP("tcp", nil, raddr)
-	common.CheckError(err)
+// disconnected is signalled when the connection to the last server has closed
+var disconnected = make(chan bool, 1)
 
-	quitConn := make(chan bool)
-	go handleConnection(conn, quitConn)
+// network is the network we dial servers on, one of common.Networks
+var network = "tcp"
 
-	log.Printf("Established connection with %s\n", conn.RemoteAddr().String())
+// settings is the configuration the client was started with
+var settings = defaultConfig()
 
-	for {
-		select {
-		case <-quitConn:
-			conn.Close()
-			log.Printf("Connection with %s closed\n", conn.RemoteAddr().String())
-			return
+// Connect connects to the servers of all the given profiles and starts the chat prompt.
+// Conversations are referred to as <alias>/<nickname> when connected to more than one server.
+// It fails when none of the servers could be connected to
+func Connect(config *Config, profiles []Profile) error {
+	err := common.CheckNetwork(config.Network)
+	if err != nil {
+		return err
+	}
+
+	network = config.Network
+	settings = config
+	useTCP(config.TCP)
+	quiet.load(config.Notifications)
+	blocking.load(config.Blocked)
+	encryptDirect.Store(config.EncryptDirect)
+	common.CheckErrorAndLog(starred.load(config.path))
+
+	loaded, err := loadIdentity(config.path)
+	if common.CheckErrorAndLog(err) {
+		loaded = newIdentity()
+	}
+	self = loaded
+
+	if len(profiles) == 0 {
+		return errors.New("no server to connect to: pass one, or set a default server in the config file")
+	}
+
+	if config.JSON {
+		if config.TUI {
+			return errors.New("the JSON mode and the TUI can't be used together")
 		}
+
+		// the output is for programs, which have no use for colors
+		config.Colors.Enabled = false
+		events = newJSONEvents(os.Stdout)
+		screen = jsonDisplay{}
 	}
-}
 
-func handleConnection(conn net.Conn, quitConn chan bool) {
-	var err error
+	name := config.Name
+	for _, profile := range profiles {
+		if profile.Name == "" && name == "" {
+			// the input is for operations, not for names
+			if config.JSON {
+				return errors.New("the JSON mode needs a name: pass -name, or set one in the config file")
+			}
 
-	defer func() {
-		quitConn <- true
-	}()
+			name, err = getClientName()
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	if config.Transcripts.Dir != "" {
+		transcripts = newTranscriptLog(config.Transcripts)
+		defer transcripts.close()
+	}
+
+	// with the TUI, everything the servers send is shown once it starts
+	var tui *tuiDisplay
+	if config.TUI {
+		tui = newTUIDisplay()
+		screen = tui
+	}
+
+	connectErrs := []error{}
+	for _, profile := range profiles {
+		if profile.Name == "" {
+			profile.Name = name
+		}
 
-	name := getClientName()
+		sc, err := connectServer(profile)
+		if err != nil {
+			connectErrs = append(connectErrs, fmt.Errorf("couldn't connect to %s: %w", profile.Address, err))
+			continue
+		}
+
+		log.Printf("Established connection with %s\n", sc.currentConn().RemoteAddr().String())
+	}
+
+	if len(connectedServers()) == 0 {
+		return errors.Join(connectErrs...)
+	}
+
+	// the other servers are still worth chatting on
+	for _, err := range connectErrs {
+		common.CheckErrorAndLog(err)
+	}
+
+	for _, ref := range config.AutoJoin {
+		err := withConversation(ref, (*serverConn).joinWhenListed)
+		common.CheckErrorAndLog(err)
+	}
 
-	aboutClient := initialiseSender(name)
-	err = sendAboutClient(conn, *aboutClient)
-	common.CheckError(err)
+	go refreshCaches()
+
+	if config.AwayAfter > 0 {
+		go presence.watchIdle()
+	}
 
 	quit := make(chan bool)
-	go handleIncoming(conn, quit)
+	if tui != nil {
+		go tui.run(quit)
+	} else if config.JSON {
+		go handleJSONInput(quit)
+	} else {
+		common.SetLogOutput(userInput)
+		go handleInput(quit)
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+
+	select {
+	case <-quit:
+	case <-disconnected:
+	case <-interrupted:
+	}
+
+	for _, sc := range connectedServers() {
+		conn := sc.currentConn()
+		conn.Close()
+		log.Printf("Connection with %s closed\n", conn.RemoteAddr().String())
+	}
+
+	return nil
+}
+
+// connectServer connects to the server of profile, introduces us and starts handling its responses
+func connectServer(profile Profile) (*serverConn, error) {
+	account, err := credentials(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// codes are only asked for here: reconnecting with an old one would be refused anyway
+	if profile.TOTP && profile.Username != "" {
+		account.TOTPCode, err = askCode(profile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clientInfo := *initialiseSender(profile.Name)
+
+	conn, reader, err := dialIntroduced(profile.Address, clientInfo, account)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &serverConn{
+		profile:       profile,
+		conn:          conn,
+		clientInfo:    clientInfo,
+		subscriptions: map[string]bool{},
+		pendingJoins:  map[string]bool{},
+		users:         map[string]bool{},
+		unread:        map[string]int{},
+		history:       map[string]*messageRing{},
+		exports:       map[string]*exportJob{},
+		lastSeqs:      map[uuid.UUID]uint64{},
+		outbox:        &outbox{},
+		directKeys:    map[string]common.Sender{},
+		pendingDirect: map[string][]directMessage{},
+		boxKeys:       map[uuid.UUID][]byte{},
+		groupKeys:     map[uuid.UUID]map[uint64][]byte{},
+	}
+
+	sc.outgoing = newSendQueue(conn)
+
+	serversMu.Lock()
+	servers = append(servers, sc)
+	serversMu.Unlock()
+
+	events.emit(JSONEvent{Event: ConnectedEvent, Server: profile.Alias})
+
+	go sc.handleIncoming(reader)
+
+	return sc, sc.listConversations()
+}
+
+func connectedServers() []*serverConn {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	list := make([]*serverConn, len(servers))
+	copy(list, servers)
+
+	return list
+}
+
+func removeServer(sc *serverConn) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	for i, other := range servers {
+		if other == sc {
+			servers = append(servers[:i], servers[i+1:]...)
+			break
+		}
+	}
+
+	if len(servers) == 0 {
+		disconnected <- true
+	}
+
+	go screen.refresh()
+}
+
+func serverByAlias(alias string) (*serverConn, bool) {
+	for _, sc := range connectedServers() {
+		if sc.profile.Alias == alias {
+			return sc, true
+		}
+	}
+
+	return nil, false
+}
+
+// resolveConversation finds the server of a conversation referred to as <alias>/<nickname>, or
+// just <nickname> when we're connected to a single server
+func resolveConversation(ref string) (*serverConn, string, error) {
+	if i := strings.Index(ref, "/"); i >= 0 {
+		if sc, ok := serverByAlias(ref[:i]); ok {
+			return sc, ref[i+1:], nil
+		}
+	}
+
+	list := connectedServers()
+	if len(list) == 1 {
+		return list[0], ref, nil
+	}
+
+	aliases := []string{}
+	for _, sc := range list {
+		aliases = append(aliases, sc.profile.Alias)
+	}
+
+	err := fmt.Sprintf("which server is '%s' on? Prefix it with one of %s and a /", ref, strings.Join(aliases, ", "))
+
+	return nil, "", errors.New(err)
+}
+
+// label is how a conversation of this server is shown to the user
+func (sc *serverConn) label(nickname string) string {
+	if len(connectedServers()) > 1 {
+		return sc.profile.Alias + "/" + nickname
+	}
+
+	return nickname
+}
+
+func handleInput(quit chan bool) {
 	defer func() {
 		quit <- true
 	}()
 
-	err = listConversations(conn)
-	common.CheckError(err)
+	notice("Type " + CommandPrefix + "help for the list of commands")
 
 	for {
-		switch operationType := getOperationType(); strings.ToLower(operationType) {
-		case common.CreateOperationType:
-			var name string
-			fmt.Scanf("%s", &name)
-			err = createConversation(conn, name)
-		case common.SubscribeOperationType:
-			var convNickname string
-			fmt.Scanf("%s", &convNickname)
-			err = subscribe(conn, convNickname)
-		case common.MessageOperationType:
-			var convNickname string
-			fmt.Scanf("%s", &convNickname)
-			err = sendMessage(conn, convNickname)
-		case common.ListOperationType:
-			err = listConversations(conn)
+		line, err := userInput.readLine(active.label() + "> ")
+		if err != nil {
+			return
 		}
 
+		err = runInput(line)
+		if err == errQuit {
+			return
+		}
 		if err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			break
+			screen.print("Error: " + err.Error())
 		}
 	}
 }
 
-func handleIncoming(conn net.Conn, quit chan bool) {
+// withConversation runs f on the server of the conversation referred to by ref
+func withConversation(ref string, f func(sc *serverConn, nickname string) error) error {
+	sc, nickname, err := resolveConversation(ref)
+	if err != nil {
+		return err
+	}
+
+	return f(sc, nickname)
+}
+
+// currentConn is the connection to the server, which reconnecting may replace at any time
+func (sc *serverConn) currentConn() net.Conn {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc.conn
+}
+
+// handleIncoming handles the responses of the server, from reader, until the connection is lost
+// for good
+func (sc *serverConn) handleIncoming(reader *frameReader) {
+	conn := sc.currentConn()
+
 	for {
-		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
-		select {
-		case <-quit:
-			return
-		default:
-			response := common.Response{}
+		response := common.Response{}
 
-			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-			err := readJSONFrom(conn, &response)
+		readDeadline := time.Time{}
+		if settings.TCP.ReadTimeout > 0 {
+			readDeadline = time.Now().Add(settings.TCP.ReadTimeout)
+		}
+		conn.SetReadDeadline(readDeadline)
 
-			if errors.Is(err, os.ErrDeadlineExceeded) {
+		err := reader.readJSON(&response)
+		// the server went quiet for too long, so the connection is given up on and reconnected
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			common.Debugf("Nothing from %s for %s\n", sc.profile.Alias, settings.TCP.ReadTimeout)
+			conn.Close()
+		}
+		// a connection we closed ourselves, or a server that won't have us, is left alone
+		if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) && !sc.refused {
+			newConn, newReader, reconnectErr := sc.reconnect()
+			if reconnectErr == nil {
+				conn, reader = newConn, newReader
 				continue
 			}
-			if err != nil {
-				common.CheckError(err)
+		}
+		if err != nil {
+			common.Errorf("Connection with %s closed: %s\n", sc.profile.Alias, err.Error())
+			if unsent := sc.outbox.all(); len(unsent) > 0 {
+				notice(fmt.Sprintf("%d message(s) to %s couldn't be sent", len(unsent), sc.profile.Alias))
+			}
+
+			events.emit(JSONEvent{Event: DisconnectedEvent, Server: sc.profile.Alias, Text: err.Error()})
+			active.forget(sc)
+			removeServer(sc)
+			return
+		}
+
+		events.emit(JSONEvent{Event: ResponseEvent, Server: sc.profile.Alias, Response: &response})
+
+		// the handlers expect both, and a bad frame shouldn't take the whole client down
+		if response.Message == nil {
+			emptyJSON := json.RawMessage("{}")
+			response.Message = &emptyJSON
+		}
+		if response.Status == "error" && response.Error == nil {
+			response.Error = &common.Error{Message: "unknown error"}
+		}
+
+		if response.Status == "ok" {
+			common.Debugf("Received OK response: %s\n", string(*response.Message))
+		} else if response.Status == "error" {
+			err := fmt.Sprintf("got error response from server: %s", sanitize(response.Error.Message))
+			common.CheckErrorAndLog(errors.New(err))
+
+			if response.Error.Code == common.RateLimitedErrorCode {
+				retryAfter := time.Duration(response.Error.RetryAfter * float64(time.Second))
+				sc.outgoing.backOff(retryAfter)
+			}
+
+			// idle clients would only be disconnected again
+			if response.Error.Code == common.BannedErrorCode || response.Error.Code == common.KeyMismatchErrorCode ||
+				response.Error.Code == common.LoginRequiredErrorCode || response.Error.Code == common.IdleTimeoutErrorCode {
+				sc.refused = true
+			}
+
+			if response.Error.Code == common.SessionRevokedErrorCode {
+				sc.refused = true
+			}
+
+			// wrong codes when setting up TOTP don't end the session, only those logging in do
+			if response.Error.Code == common.TOTPRequiredErrorCode && response.OperationType != common.TOTPOperationType {
+				sc.refused = true
+				if !sc.profile.TOTP {
+					notice(fmt.Sprintf("Connect to %s with -totp (or totp: true in the configuration) to give a one-time code", sc.profile.Alias))
+				}
 			}
 
-			if response.Status == "ok" {
-				log.Printf("Received OK response: %s\n", string(*response.Message))
-			} else if response.Status == "error" {
-				err := fmt.Sprintf("got error response from server: %s", response.Error.Message)
-				common.CheckErrorAndLog(errors.New(err))
+			if response.Error.Code == common.LoginRequiredErrorCode {
+				forgetIDToken(sc.profile.OIDC)
+				forgetPassword(sc.profile)
 			}
 
-			handleResponse(response)
+			if response.OperationType == common.ExportOperationType {
+				sc.cancelExports()
+			}
+
+			if response.OperationType == common.AccountExportOperationType {
+				sc.cancelAccountExport()
+			}
+
+			if response.OperationType == common.MessageOperationType {
+				sc.handleMessageRejected(response.Error.Code)
+			}
+
+			if response.OperationType == common.KeysOperationType {
+				sc.forgetDirectKeys()
+			}
+
+			// the error is all there is to a rejected operation
+			continue
+		}
+
+		if response.RateLimit != nil {
+			sc.outgoing.setLimit(*response.RateLimit)
+		}
+
+		if response.OperationType == common.MigrateOperationType {
+			newConn, newReader, err := sc.migrate(response.Message)
+			if common.CheckErrorAndLog(err) {
+				continue
+			}
+
+			conn, reader = newConn, newReader
+			continue
 		}
+
+		sc.handleResponse(response)
 	}
 }
 
-func handleResponse(response common.Response) {
+func (sc *serverConn) handleResponse(response common.Response) {
 	switch response.OperationType {
 	case common.ListOperationType:
-		handleListOperationResponse(response.Message)
+		sc.handleListOperationResponse(response.Message)
 	case common.MessageOperationType:
-		handleMessageOperationResponse(response.Message)
+		sc.handleMessageOperationResponse(response.Message)
 	case common.AboutMeOperationType:
-		handleAboutMeOperationResponse(response.Message)
+		sc.handleAboutMeOperationResponse(response.Message)
+
+		if response.Queued > 0 {
+			notice(fmt.Sprintf("%d message(s) came for you on %s while you were away:", response.Queued, sc.profile.Alias))
+		}
+	case common.SubscribeOperationType:
+		sc.handleConversationResponse(response.Message, false)
+	case common.TopicOperationType:
+		sc.handleConversationResponse(response.Message, true)
+	case common.RenameOperationType:
+		sc.handleRenameResponse(response.Message)
+	case common.ArchiveOperationType:
+		sc.handleArchiveResponse(response.Message)
+	case common.SlowModeOperationType:
+		sc.handleSlowModeResponse(response.Message)
+	case common.ACLOperationType:
+		sc.handleACLResponse(response.Message)
+	case common.InviteOperationType:
+		sc.handleInviteResponse(response.Message)
+	case common.JoinCodeOperationType:
+		sc.handleJoinCodeResponse(response.Message)
+	case common.SearchOperationType:
+		sc.handleSearchResponse(response.Message)
+	case common.ExportOperationType:
+		sc.handleExportPageResponse(response.Message)
+	case common.FetchOperationType:
+		sc.handleFetchResponse(response.Message)
+	case common.ConversationKeyOperationType:
+		sc.handleConversationKeyResponse(response.Message)
+	case common.SyncOperationType:
+		sc.handleSyncResponse(response.Message)
+	case common.KeysOperationType:
+		sc.handleKeysResponse(response.Message)
+	case common.DeleteOperationType:
+		sc.handleDeleteResponse(response.Message)
+	case common.WhoisOperationType:
+		sc.handleWhoisResponse(response.Message)
+	case common.RegisterOperationType:
+		sc.handleRegisterResponse(response.Message)
+	case common.NameOperationType:
+		sc.handleNameResponse(response.Message)
+	case common.ProfileOperationType:
+		sc.handleProfileResponse(response.Message)
+	case common.StatusOperationType:
+		sc.handleStatusResponse(response.Message)
+	case common.MembersOperationType:
+		sc.handleMembersResponse(response.Message)
+	case common.BlockOperationType, common.BlocksOperationType:
+		sc.handleBlockListResponse(response.Message)
+	case common.TOTPOperationType:
+		sc.handleTOTPResponse(response.Message)
+	case common.SessionsOperationType:
+		sc.handleSessionsResponse(response.Message)
+	case common.AccountExportOperationType:
+		sc.handleAccountExportResponse(response.Message)
 		// ignore in all other cases
 	}
 }
 
-func handleAboutMeOperationResponse(aboutMeResponse *json.RawMessage) {
-	err := json.Unmarshal(*aboutMeResponse, &clientInfo)
-	common.CheckError(err)
+func (sc *serverConn) handleAboutMeOperationResponse(aboutMeResponse *json.RawMessage) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	err := json.Unmarshal(*aboutMeResponse, &sc.clientInfo)
+	common.CheckErrorAndLog(err)
 }
 
-func handleListOperationResponse(jsonConversations *json.RawMessage) {
-	err := json.Unmarshal(*jsonConversations, &globalConversations)
-	common.CheckError(err)
+func (sc *serverConn) handleListOperationResponse(jsonConversations *json.RawMessage) {
+	conversations := []*common.Conversation{}
+
+	err := json.Unmarshal(*jsonConversations, &conversations)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	sc.mu.Lock()
+	silent := sc.silentLists > 0
+	if silent {
+		sc.silentLists--
+	}
+	sc.mu.Unlock()
+
+	if !silent {
+		sc.mu.Lock()
+		nicknames := []string{}
+		for _, conversation := range conversations {
+			nickname := sc.label(conversation.Nickname)
+			if conversation.Archived {
+				nickname += " (archived)"
+			}
+			if conversation.Encrypted {
+				nickname += " (encrypted)"
+			}
+			if len(conversation.ACL) > 0 {
+				nickname += " (restricted)"
+			}
+			if quiet.isMuted(sc, conversation.Nickname) {
+				nickname += " (muted)"
+			}
+			// the server counts what came while we were away, and we count what came since
+			if n := max(uint64(sc.unread[conversation.Nickname]), conversation.Unread); n > 0 {
+				nickname += fmt.Sprintf(" (%d unread)", n)
+			}
+			nicknames = append(nicknames, nickname)
+		}
+		sc.mu.Unlock()
+
+		if len(nicknames) == 0 {
+			notice("No conversations on " + sc.profile.Alias + " yet")
+		} else {
+			notice("Conversations: " + strings.Join(nicknames, ", "))
+		}
+	}
+
+	sc.mu.Lock()
+	sc.conversations = conversations
+	sc.mu.Unlock()
+
+	sc.joinPending()
+
+	screen.refresh()
+}
+
+// joinPending subscribes to the conversations we were waiting for that the server has now
+func (sc *serverConn) joinPending() {
+	sc.mu.Lock()
+	pending := []string{}
+	for _, conversation := range sc.conversations {
+		if sc.pendingJoins[conversation.Nickname] {
+			delete(sc.pendingJoins, conversation.Nickname)
+			pending = append(pending, conversation.Nickname)
+		}
+	}
+	sc.mu.Unlock()
+
+	for _, nickname := range pending {
+		common.CheckErrorAndLog(sc.subscribe(nickname))
+	}
+}
+
+// handleConversationResponse updates what we know about the conversation the server sent,
+// and shows its topic. Conversations without a topic are only mentioned if showEmpty is set
+func (sc *serverConn) handleConversationResponse(jsonConversation *json.RawMessage, showEmpty bool) {
+	conversation := &common.Conversation{}
+
+	err := json.Unmarshal(*jsonConversation, conversation)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	// errors and acknowledgements come without a conversation
+	if conversation.ID == uuid.Nil {
+		return
+	}
+
+	sc.updateConversation(conversation)
+	sc.catchUp(conversation)
+
+	switch {
+	case conversation.Topic != "":
+		notice(fmt.Sprintf("Topic of %s: %s", sc.label(conversation.Nickname), conversation.Topic))
+	case showEmpty:
+		notice(sc.label(conversation.Nickname) + " has no topic")
+	}
+
+	screen.refresh()
+}
+
+// updateConversation replaces our copy of a conversation with the one the server sent
+func (sc *serverConn) updateConversation(conversation *common.Conversation) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for i, known := range sc.conversations {
+		if known.ID == conversation.ID {
+			sc.conversations[i] = conversation
+		}
+	}
 }
 
-func handleMessageOperationResponse(jsonMessage *json.RawMessage) {
+// handleRenameResponse moves everything we keep about a conversation over to its new nickname
+func (sc *serverConn) handleRenameResponse(jsonRename *json.RawMessage) {
+	rename := common.Rename{}
+
+	err := json.Unmarshal(*jsonRename, &rename)
+	if common.CheckErrorAndLog(err) || rename.Nickname == "" {
+		return
+	}
+
+	from, to := rename.Nickname, rename.NewNickname
+
+	sc.mu.Lock()
+	for i, conversation := range sc.conversations {
+		if conversation.Nickname == from {
+			renamed := *conversation
+			renamed.Nickname = to
+			sc.conversations[i] = &renamed
+		}
+	}
+	if sc.subscriptions[from] {
+		delete(sc.subscriptions, from)
+		sc.subscriptions[to] = true
+	}
+	if n, ok := sc.unread[from]; ok {
+		delete(sc.unread, from)
+		sc.unread[to] = n
+	}
+	if ring, ok := sc.history[from]; ok {
+		delete(sc.history, from)
+		sc.history[to] = ring
+	}
+	sc.mu.Unlock()
+
+	active.renamed(sc, from, to)
+
+	notice(fmt.Sprintf("%s was renamed to %s", sc.label(from), sc.label(to)))
+	screen.refresh()
+}
+
+func (sc *serverConn) handleArchiveResponse(jsonConversation *json.RawMessage) {
+	conversation := &common.Conversation{}
+
+	err := json.Unmarshal(*jsonConversation, conversation)
+	if common.CheckErrorAndLog(err) || conversation.ID == uuid.Nil {
+		return
+	}
+
+	sc.updateConversation(conversation)
+
+	if conversation.Archived {
+		notice(sc.label(conversation.Nickname) + " was archived, and can't get new messages")
+	} else {
+		notice(sc.label(conversation.Nickname) + " was unarchived")
+	}
+
+	screen.refresh()
+}
+
+// handleSlowModeResponse tells that the slow mode of a conversation changed
+func (sc *serverConn) handleSlowModeResponse(jsonConversation *json.RawMessage) {
+	conversation := &common.Conversation{}
+
+	err := json.Unmarshal(*jsonConversation, conversation)
+	if common.CheckErrorAndLog(err) || conversation.ID == uuid.Nil {
+		return
+	}
+
+	sc.updateConversation(conversation)
+
+	if conversation.SlowMode > 0 {
+		interval := time.Duration(conversation.SlowMode) * time.Second
+		notice(sc.label(conversation.Nickname) + " is in slow mode: one message every " + interval.String())
+	} else {
+		notice("Slow mode is off in " + sc.label(conversation.Nickname))
+	}
+
+	screen.refresh()
+}
+
+// handleDeleteResponse forgets about a deleted conversation
+func (sc *serverConn) handleDeleteResponse(jsonConversation *json.RawMessage) {
+	conversation := &common.Conversation{}
+
+	err := json.Unmarshal(*jsonConversation, conversation)
+	if common.CheckErrorAndLog(err) || conversation.ID == uuid.Nil {
+		return
+	}
+
+	sc.forgetConversation(conversation)
+
+	notice(sc.label(conversation.Nickname) + " was deleted")
+	screen.refresh()
+}
+
+// forgetConversation drops everything we keep about a conversation that was deleted
+func (sc *serverConn) forgetConversation(conversation *common.Conversation) {
+	nickname := conversation.Nickname
+
+	sc.mu.Lock()
+	sc.conversations = slices.DeleteFunc(sc.conversations, func(c *common.Conversation) bool {
+		return c.ID == conversation.ID
+	})
+	delete(sc.subscriptions, nickname)
+	delete(sc.unread, nickname)
+	delete(sc.history, nickname)
+	delete(sc.lastSeqs, conversation.ID)
+	sc.mu.Unlock()
+
+	active.left(sc, nickname)
+}
+
+// migrate moves the client over to the server that a draining server pointed us to
+func (sc *serverConn) migrate(jsonMigrate *json.RawMessage) (net.Conn, *frameReader, error) {
+	migrateTo := common.Migrate{}
+
+	err := json.Unmarshal(*jsonMigrate, &migrateTo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notice(fmt.Sprintf("%s is restarting, moving over to %s", sc.profile.Alias, migrateTo.Address))
+
+	conn, reader, err := sc.switchTo(migrateTo.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the other server has conversations of its own: we rejoin ours once it lists them
+	sc.mu.Lock()
+	for nickname := range sc.subscriptions {
+		sc.pendingJoins[nickname] = true
+	}
+	sc.mu.Unlock()
+
+	err = sc.listConversations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc.resendUnsent()
+
+	return conn, reader, nil
+}
+
+func (sc *serverConn) handleMessageOperationResponse(jsonMessage *json.RawMessage) {
 	message := common.Message{}
 
 	err := json.Unmarshal(*jsonMessage, &message)
-	common.CheckError(err)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	// the acknowledgement of our own messages has nothing but their key
+	if message.Sender == nil {
+		sc.outbox.ack(message.Key)
+		return
+	}
+
+	sc.open(&message)
+
+	if message.Recipient == nil && message.Conversation != nil && message.Seq > 0 {
+		sc.trackSeq(message.Conversation, message.Seq)
+	}
+
+	system := message.Kind == common.SystemMessageKind
+
+	// the server doesn't deliver messages from the users we blocked there, this is for the
+	// servers that don't know, and the users that came back with another ID
+	if !system && blocking.has(message.Sender.Name) {
+		return
+	}
+
+	sc.mu.Lock()
+	me := sc.clientInfo
+	if !system {
+		sc.users[message.Sender.Name] = true
+	}
+	sc.mu.Unlock()
+
+	if !system {
+		notify(sc, message, me)
+	}
+
+	if transcripts != nil {
+		transcripts.record(sc, message)
+	}
+
+	if message.Recipient == nil && message.Conversation != nil {
+		sc.remember(message.Conversation.Nickname, message)
 
-	fmt.Printf("\n\033[1m<@%s>\033[0m: %s\n", message.Sender.Name, message.Text)
+		// our own messages come back to us too, and they're read already
+		activeServer, activeNickname := active.get()
+		if !system && message.Sender.ID != me.ID && (activeServer != sc || activeNickname != message.Conversation.Nickname) {
+			sc.markUnread(message.Conversation.Nickname)
+		}
+	}
+
+	screen.print(sc.formatMessage(message, len(connectedServers()) > 1))
 }
 
-func listConversations(conn net.Conn) error {
+// formatMessage is how a message from sc is shown, prefixed with its time and with its
+// conversation if withConversation is set
+func (sc *serverConn) formatMessage(message common.Message, withConversation bool) string {
+	prefix := ""
+	if timestamp := formatTimestamp(message.Timestamp, time.Now()); timestamp != "" {
+		prefix = colorize(settings.Colors.Notice, timestamp) + " "
+	}
+
+	if message.Kind == common.SystemMessageKind {
+		text := colorize(settings.Colors.Notice, "* "+sanitize(message.Text))
+		if withConversation && message.Conversation != nil {
+			return fmt.Sprintf("%s[%s] %s", prefix, sanitize(sc.label(message.Conversation.Nickname)), text)
+		}
+
+		return prefix + text
+	}
+
+	sc.mu.Lock()
+	me, myID := sc.clientInfo.Name, sc.clientInfo.ID
+	sc.mu.Unlock()
+
+	text := highlightMentions(render(sanitize(message.Text)), me)
+	name := sanitize(message.Sender.Name)
+
+	// the server checked it, unless it's lying to us
+	badSignature := ""
+	if len(message.Signature) > 0 && !common.Verify(message) {
+		badSignature = " " + colorize(settings.Colors.Direct, "(bad signature)")
+	}
+
+	if message.Recipient != nil {
+		label := fmt.Sprintf("<@%s> (direct)", name)
+		if message.Sender.ID == myID {
+			label = fmt.Sprintf("(direct to <@%s>)", sanitize(message.Recipient.Name))
+		}
+		if len(message.Box) > 0 {
+			label += " (encrypted)"
+		}
+
+		return fmt.Sprintf("%s%s%s: %s", prefix, colorize(settings.Colors.Direct, label), badSignature, text)
+	}
+
+	sender := colorize(senderColor(name), "<@"+name+">") + badSignature
+	line := sender + ": " + text
+
+	// actions read as what the sender does, "* alice waves"
+	if message.Kind == common.ActionMessageKind {
+		line = colorize(senderColor(name), "* "+name) + badSignature + " " + text
+	}
+
+	if withConversation && message.Conversation != nil {
+		return fmt.Sprintf("%s[%s] %s", prefix, sanitize(sc.label(message.Conversation.Nickname)), line)
+	}
+
+	return prefix + line
+}
+
+// markUnread counts a message in a conversation we aren't talking in
+func (sc *serverConn) markUnread(nickname string) {
+	sc.mu.Lock()
+	sc.unread[nickname]++
+	sc.mu.Unlock()
+
+	screen.refresh()
+}
+
+// markRead moves the last-read marker of a conversation to its latest message, returning how
+// many messages were unread before
+func (sc *serverConn) markRead(nickname string) int {
+	sc.mu.Lock()
+	n := sc.unread[nickname]
+	delete(sc.unread, nickname)
+	sc.mu.Unlock()
+
+	if n > 0 {
+		screen.refresh()
+	}
+
+	return n
+}
+
+func (sc *serverConn) listConversations() error {
 	emptyJSON := json.RawMessage("{}")
 
 	operation := common.Operation{
@@ -157,16 +973,22 @@ func listConversations(conn net.Conn) error {
 		Message: &emptyJSON,
 	}
 
-	err := writeJSONTo(conn, operation)
-	if err != nil {
-		return err
-	}
+	sc.outgoing.send(operation)
 
 	return nil
 }
 
-func createConversation(conn net.Conn, nickname string) error {
-	newConversation := common.Conversation{Nickname: nickname}
+// refreshConversations fetches the list of conversations without showing it
+func (sc *serverConn) refreshConversations() {
+	sc.mu.Lock()
+	sc.silentLists++
+	sc.mu.Unlock()
+
+	common.CheckErrorAndLog(sc.listConversations())
+}
+
+func (sc *serverConn) createConversation(nickname string, encrypted bool) error {
+	newConversation := common.Conversation{Nickname: nickname, Encrypted: encrypted}
 	marshaled, err := json.Marshal(newConversation)
 	if err != nil {
 		return err
@@ -179,15 +1001,15 @@ func createConversation(conn net.Conn, nickname string) error {
 		Message: &conversationJSON,
 	}
 
-	err = writeJSONTo(conn, operation)
-	if err != nil {
-		return err
-	}
+	sc.outgoing.send(operation)
+
+	// fetch the list again, so the new conversation can be used right away
+	sc.refreshConversations()
 
 	return nil
 }
 
-func subscribe(conn net.Conn, convNickname string) error {
+func (sc *serverConn) subscribe(convNickname string) error {
 	conversation := common.Conversation{Nickname: convNickname}
 
 	marshaled, err := json.Marshal(conversation)
@@ -202,61 +1024,221 @@ func subscribe(conn net.Conn, convNickname string) error {
 		Message: &conversationJSON,
 	}
 
-	err = writeJSONTo(conn, operation)
+	sc.outgoing.send(operation)
+
+	sc.mu.Lock()
+	sc.subscriptions[convNickname] = true
+	sc.mu.Unlock()
+
+	screen.refresh()
+
+	return nil
+}
+
+func (sc *serverConn) unsubscribe(nickname string) error {
+	err := sc.sendOperation(common.UnsubscribeOperationType, common.Conversation{Nickname: nickname})
 	if err != nil {
 		return err
 	}
 
+	sc.mu.Lock()
+	delete(sc.subscriptions, nickname)
+	sc.mu.Unlock()
+
+	active.left(sc, nickname)
+	screen.refresh()
+
 	return nil
 }
 
-func sendAboutClient(conn net.Conn, aboutMe common.ClientAboutMe) error {
-	b, err := json.Marshal(aboutMe)
+// joinWhenListed subscribes to the conversation as soon as the server lists it
+func (sc *serverConn) joinWhenListed(nickname string) error {
+	_, err := sc.getConversationByNickname(nickname)
+	if err == nil {
+		return sc.subscribe(nickname)
+	}
+
+	sc.mu.Lock()
+	sc.pendingJoins[nickname] = true
+	sc.mu.Unlock()
+
+	return nil
+}
+
+// topic asks for the topic of a conversation, or sets it if topic isn't nil
+func (sc *serverConn) topic(nickname string, topic *string) error {
+	marshaled, err := json.Marshal(common.Topic{Nickname: nickname, Topic: topic})
 	if err != nil {
 		return err
 	}
 
-	jsonAboutMe := json.RawMessage(b)
+	topicJSON := json.RawMessage(marshaled)
 
 	operation := common.Operation{
-		Type:    common.AboutMeOperationType,
-		Message: &jsonAboutMe,
+		Type:    common.TopicOperationType,
+		Message: &topicJSON,
 	}
 
-	err = writeJSONTo(conn, operation)
+	sc.outgoing.send(operation)
+
+	return nil
+}
+
+func (sc *serverConn) rename(nickname string, newNickname string) error {
+	return sc.sendOperation(common.RenameOperationType, common.Rename{Nickname: nickname, NewNickname: newNickname})
+}
+
+func (sc *serverConn) archive(nickname string, archived bool) error {
+	return sc.sendOperation(common.ArchiveOperationType, common.Archive{Nickname: nickname, Archived: archived})
+}
+
+func (sc *serverConn) setSlowMode(nickname string, seconds int) error {
+	return sc.sendOperation(common.SlowModeOperationType, common.SlowMode{Nickname: nickname, Seconds: seconds})
+}
+
+func (sc *serverConn) deleteConversation(nickname string) error {
+	return sc.sendOperation(common.DeleteOperationType, common.Conversation{Nickname: nickname})
+}
+
+// sendOperation queues an operation of the given type with v as its message
+func (sc *serverConn) sendOperation(operationType string, v interface{}) error {
+	operation, err := newOperation(operationType, v)
 	if err != nil {
 		return err
 	}
 
+	sc.outgoing.send(operation)
+
 	return nil
 }
 
-func sendMessage(conn net.Conn, convNickname string) error {
-	var text string
-	_, err := fmt.Scanf("%s\r", &text)
+// newOperation returns an operation of the given type with v as its message
+func newOperation(operationType string, v interface{}) (common.Operation, error) {
+	marshaled, err := json.Marshal(v)
+	if err != nil {
+		return common.Operation{}, err
+	}
+
+	message := json.RawMessage(marshaled)
+
+	return common.Operation{Type: operationType, Message: &message}, nil
+}
+
+// setDigest opts in to (or out of) the server's daily digest of what we missed
+func (sc *serverConn) setDigest(enabled bool) error {
+	marshaled, err := json.Marshal(common.DigestSettings{Enabled: enabled})
 	if err != nil {
 		return err
 	}
 
-	conversation, err := getConversationByNickname(convNickname)
-	sender := common.Sender(clientInfo)
+	settingsJSON := json.RawMessage(marshaled)
 
-	message := common.Message{
-		Text:         text,
-		Conversation: conversation,
-		Sender:       &sender,
+	operation := common.Operation{
+		Type:    common.DigestOperationType,
+		Message: &settingsJSON,
+	}
+
+	sc.outgoing.send(operation)
+
+	return nil
+}
+
+// setEmailDigest has the server email address the mentions and direct messages we get while
+// away, or stop emailing us without an address
+func (sc *serverConn) setEmailDigest(address string) error {
+	operation, err := newOperation(common.EmailDigestOperationType, common.EmailDigestSettings{Address: address})
+	if err != nil {
+		return err
+	}
+
+	sc.outgoing.send(operation)
+
+	return nil
+}
+
+// maxRedirects is how many draining servers in a row connecting to a server may be sent on from
+const maxRedirects = 3
+
+// dialIntroduced connects to the server at address and introduces us, following the draining
+// servers that send us on elsewhere. The responses of the connection are read from reader
+func dialIntroduced(address string, aboutMe common.ClientAboutMe, login common.Login) (net.Conn, *frameReader, error) {
+	for range maxRedirects + 1 {
+		conn, err := dial(network, address)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reader := newFrameReader(conn)
+
+		redirect, err := introduce(conn, reader, aboutMe, login)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if redirect == nil {
+			return conn, reader, nil
+		}
+
+		conn.Close()
+		common.Debugf("%s is draining, moving over to %s\n", address, redirect.Address)
+		address = redirect.Address
+	}
+
+	return nil, nil, errors.New("sent on by too many draining servers")
+}
+
+// introduce answers the challenge the server opens the connection with by introducing us with
+// aboutMe, and login if we log in, proving we have the private key of our public key. A
+// draining server sends where to go instead, which is returned
+func introduce(conn net.Conn, reader *frameReader, aboutMe common.ClientAboutMe, login common.Login) (*common.Migrate, error) {
+	response := common.Response{}
+
+	err := reader.readJSON(&response)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Status == "error" && response.Error != nil {
+		return nil, errors.New(sanitize(response.Error.Message))
+	}
+	if response.Message == nil {
+		return nil, errors.New("the server opened the connection with an empty response")
+	}
+
+	switch response.OperationType {
+	case common.MigrateOperationType:
+		migrateTo := &common.Migrate{}
+		return migrateTo, json.Unmarshal(*response.Message, migrateTo)
+	case common.ChallengeOperationType:
+	default:
+		return nil, fmt.Errorf("the server opened the connection with %q instead of a challenge", response.OperationType)
+	}
+
+	challenge := common.Challenge{}
+	err = json.Unmarshal(*response.Message, &challenge)
+	if err != nil {
+		return nil, err
 	}
-	b, err := json.Marshal(message)
+
+	return nil, sendAboutClient(conn, aboutMe, login, common.Prove(challenge.Nonce, self.PrivateKey))
+}
+
+func sendAboutClient(conn net.Conn, aboutMe common.ClientAboutMe, login common.Login, proof common.Proof) error {
+	b, err := json.Marshal(struct {
+		common.ClientAboutMe
+		common.Login
+		common.Device
+		common.Proof
+	}{aboutMe, login, device(), proof})
 	if err != nil {
-		log.Printf("Marhsaling error: %s\n", err.Error())
-		return errors.New("marshaling error")
+		return err
 	}
 
-	jsonMessage := json.RawMessage(b)
+	jsonAboutMe := json.RawMessage(b)
 
 	operation := common.Operation{
-		Type:    common.MessageOperationType,
-		Message: &jsonMessage,
+		Type:    common.AboutMeOperationType,
+		Message: &jsonAboutMe,
 	}
 
 	err = writeJSONTo(conn, operation)
@@ -267,49 +1249,86 @@ func sendMessage(conn net.Conn, convNickname string) error {
 	return nil
 }
 
-func getConversationByNickname(nickname string) (*common.Conversation, error) {
-	for _, conversation := range globalConversations {
+func (sc *serverConn) sendMessage(convNickname string, text string) error {
+	conversation, err := sc.getConversationByNickname(convNickname)
+	if err != nil {
+		return err
+	}
+
+	// talking in a conversation means we've caught up with it
+	sc.markRead(convNickname)
+
+	sc.mu.Lock()
+	sender := common.Sender(sc.clientInfo)
+	sc.mu.Unlock()
+
+	message := common.Message{
+		Text:         text,
+		Conversation: conversation,
+		Sender:       &sender,
+	}
+
+	if conversation.Encrypted {
+		err = sc.seal(&message)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sc.sendKeyed(message)
+}
+
+func (sc *serverConn) getConversationByNickname(nickname string) (*common.Conversation, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, conversation := range sc.conversations {
 		if strings.ToLower(conversation.Nickname) == strings.ToLower(nickname) {
 			return conversation, nil
 		}
 	}
 
 	emptyConversation := common.Conversation{}
-	err := fmt.Sprintf("conversation with nickname %s not found", nickname)
+	err := fmt.Sprintf("conversation with nickname %s not found", sc.label(nickname))
 
 	return &emptyConversation, errors.New(err)
 }
 
+// initialiseSender introduces us with the identity saved in the configuration, or the one
+// kept next to it
 func initialiseSender(name string) *common.ClientAboutMe {
+	id := settings.ID
+	if id == uuid.Nil {
+		id = self.ID
+	}
+
 	aboutMe := &common.ClientAboutMe{
-		Name: name,
-		ID:   uuid.New(),
+		Name:      name,
+		ID:        id,
+		PublicKey: self.PublicKey,
+		BoxKey:    self.BoxPublicKey,
 	}
 
 	return aboutMe
 }
 
-func getClientName() (name string) {
-	fmt.Print("Enter your chat display name: ")
-	fmt.Scan(&name)
-
-	return name
-}
-
-func getOperationType() (operationType string) {
-	fmt.Print("Enter the operation type to execute: ")
-	fmt.Scan(&operationType)
+func getClientName() (string, error) {
+	name, err := userInput.readLine("Enter your chat display name: ")
+	if err != nil {
+		return "", err
+	}
 
-	return operationType
+	return strings.TrimSpace(name), nil
 }
 
 func writeJSONTo(conn net.Conn, v interface{}) error {
-	b, err := json.Marshal(v)
-	if err != nil {
-		return err
+	writeDeadline := time.Time{}
+	if settings.TCP.WriteTimeout > 0 {
+		writeDeadline = time.Now().Add(settings.TCP.WriteTimeout)
 	}
+	conn.SetWriteDeadline(writeDeadline)
 
-	_, err = conn.Write(append(b, common.EOFBytes...))
+	err := common.WriteFrame(conn, v)
 	if err != nil {
 		return err
 	}
@@ -319,18 +1338,38 @@ func writeJSONTo(conn net.Conn, v interface{}) error {
 	return nil
 }
 
-func readJSONFrom(conn net.Conn, v interface{}) error {
-	buf := make([]byte, 1024)
+// frameReader reads the frames sent by the server off a connection. Frames can arrive split over
+// several reads or several in one read (e.g. through a proxy), and a read deadline can pass
+// in the middle of a frame, so partly read frames are kept until the rest comes in
+type frameReader struct {
+	reader  *bufio.Reader
+	partial []byte
+}
 
-	nBytes, err := bufio.NewReader(conn).Read(buf)
-	if err != nil {
-		return err
-	}
+func newFrameReader(conn net.Conn) *frameReader {
+	return &frameReader{reader: bufio.NewReader(conn)}
+}
 
-	err = json.Unmarshal(buf[:nBytes], v)
-	if err != nil {
-		return err
-	}
+// readJSON reads the next frame and unmarshals it into v
+func (fr *frameReader) readJSON(v interface{}) error {
+	for {
+		b, err := fr.reader.ReadBytes(common.EOFBytes[len(common.EOFBytes)-1])
+		fr.partial = append(fr.partial, b...)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		if !bytes.HasSuffix(fr.partial, common.EOFBytes) {
+			continue
+		}
+
+		frame := fr.partial
+		fr.partial = nil
+
+		if len(bytes.TrimSpace(frame)) == 0 {
+			continue
+		}
+
+		return json.Unmarshal(frame, v)
+	}
 }
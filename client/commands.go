@@ -0,0 +1,1150 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// CommandPrefix starts the commands typed in the client, like /join general
+const CommandPrefix = "/"
+
+// errQuit is returned by the /quit command to end the input loop
+var errQuit = errors.New("quit")
+
+// command is one of the client's slash commands
+type command struct {
+	name string
+	// usage are the arguments, and summary what the command does, shown by /help
+	usage   string
+	summary string
+	// run gets everything typed after the command's name
+	run func(args string) error
+}
+
+// commandRouter runs the commands typed by the user. It doesn't know about connections,
+// so it can be set up with any commands
+type commandRouter struct {
+	commands map[string]*command
+}
+
+func newCommandRouter() *commandRouter {
+	return &commandRouter{commands: map[string]*command{}}
+}
+
+func (r *commandRouter) register(c *command) {
+	r.commands[c.name] = c
+}
+
+func (r *commandRouter) has(name string) bool {
+	_, ok := r.commands[name]
+	return ok
+}
+
+// run runs the command typed on line
+func (r *commandRouter) run(line string) error {
+	name, args, ok := parseCommand(line)
+	if !ok {
+		return fmt.Errorf("commands start with %s, try %shelp", CommandPrefix, CommandPrefix)
+	}
+
+	c, ok := r.commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %s%s, try %shelp", CommandPrefix, name, CommandPrefix)
+	}
+
+	return c.run(args)
+}
+
+// help describes every command, in alphabetical order
+func (r *commandRouter) help() string {
+	names := []string{}
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Commands:"}
+	for _, name := range names {
+		c := r.commands[name]
+		lines = append(lines, fmt.Sprintf("  %-28s %s", strings.TrimSpace(CommandPrefix+c.name+" "+c.usage), c.summary))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// parseCommand splits a line like "/msg general hello world" into the command's name ("msg")
+// and its arguments ("general hello world")
+func parseCommand(line string) (name string, args string, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, CommandPrefix) {
+		return "", "", false
+	}
+
+	name, args, _ = strings.Cut(strings.TrimPrefix(line, CommandPrefix), " ")
+
+	return strings.ToLower(name), strings.TrimSpace(args), name != ""
+}
+
+// firstArgument splits args into its first word and the rest
+func firstArgument(args string) (first string, rest string) {
+	first, rest, _ = strings.Cut(strings.TrimSpace(args), " ")
+
+	return first, strings.TrimSpace(rest)
+}
+
+// commands are the commands of the interactive client
+var commands *commandRouter
+
+func init() {
+	commands = newCommandRouter()
+
+	commands.register(&command{
+		name:    "join",
+		usage:   "<conversation>",
+		summary: "subscribe to a conversation",
+		run: func(args string) error {
+			return withConversationArgument(args, (*serverConn).subscribe)
+		},
+	})
+
+	commands.register(&command{
+		name:    "leave",
+		usage:   "<conversation>",
+		summary: "unsubscribe from a conversation",
+		run: func(args string) error {
+			return withConversationArgument(args, (*serverConn).unsubscribe)
+		},
+	})
+
+	commands.register(&command{
+		name:    "create",
+		usage:   "<conversation> [encrypted]",
+		summary: "create a conversation, encrypted end-to-end if asked",
+		run: func(args string) error {
+			ref, rest := firstArgument(args)
+			if ref == "" || (rest != "" && rest != "encrypted") {
+				return errors.New("expected a conversation, and optionally encrypted")
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.createConversation(nickname, rest == "encrypted")
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "list",
+		summary: "list the conversations of every server",
+		run: func(args string) error {
+			for _, sc := range connectedServers() {
+				err := sc.listConversations()
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "msg",
+		usage:   "<conversation> <text>",
+		summary: "send a message to a conversation",
+		run: func(args string) error {
+			ref, text := firstArgument(args)
+			if text == "" {
+				return fmt.Errorf("usage: %smsg <conversation> <text>", CommandPrefix)
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.sendMessage(nickname, text)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "dm",
+		usage:   "<name> <text>",
+		summary: "send a direct message to the user called name, end-to-end encrypted after /encrypt on",
+		run: func(args string) error {
+			ref, text := firstArgument(args)
+			if text == "" {
+				return fmt.Errorf("usage: %sdm <name> <text>", CommandPrefix)
+			}
+
+			sc, name, err := resolveConversation(ref)
+			if err != nil {
+				return err
+			}
+
+			return sc.sendDirect(name, text)
+		},
+	})
+
+	commands.register(&command{
+		name:    "switch",
+		usage:   "<conversation>",
+		summary: "join a conversation and send what you type without a command there",
+		run: func(args string) error {
+			return withConversationArgument(args, active.switchTo)
+		},
+	})
+
+	commands.register(&command{
+		name:    "topic",
+		usage:   "<conversation> [topic]",
+		summary: "show the topic of a conversation, or set it if you own or moderate it",
+		run: func(args string) error {
+			ref, text := firstArgument(args)
+			if ref == "" {
+				return fmt.Errorf("usage: %stopic <conversation> [topic]", CommandPrefix)
+			}
+
+			var topic *string
+			if text != "" {
+				topic = &text
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.topic(nickname, topic)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "rename",
+		usage:   "<conversation> <new nickname>",
+		summary: "rename a conversation you own",
+		run: func(args string) error {
+			ref, newNickname := firstArgument(args)
+			if newNickname == "" || strings.Contains(newNickname, " ") {
+				return fmt.Errorf("usage: %srename <conversation> <new nickname>", CommandPrefix)
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.rename(nickname, newNickname)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "archive",
+		usage:   "<conversation>",
+		summary: "archive a conversation you own, so that it gets no new messages",
+		run: func(args string) error {
+			return withConversationArgument(args, func(sc *serverConn, nickname string) error {
+				return sc.archive(nickname, true)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "unarchive",
+		usage:   "<conversation>",
+		summary: "unarchive a conversation you own",
+		run: func(args string) error {
+			return withConversationArgument(args, func(sc *serverConn, nickname string) error {
+				return sc.archive(nickname, false)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "slowmode",
+		usage:   "<conversation> <seconds|duration|off>",
+		summary: "let members send a message every so often only, in a conversation you own or moderate",
+		run: func(args string) error {
+			ref, interval := firstArgument(args)
+			seconds, err := parseSlowMode(interval)
+			if ref == "" || err != nil {
+				return fmt.Errorf("usage: %sslowmode <conversation> <seconds|duration|off>", CommandPrefix)
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.setSlowMode(nickname, seconds)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "acl",
+		usage:   "<conversation> [<user> read|write|moderate|none]",
+		summary: "show who may do what in a conversation, or change it in one you own",
+		run: func(args string) error {
+			usage := fmt.Errorf("usage: %sacl <conversation> [<user> read|write|moderate|none]", CommandPrefix)
+
+			ref, rest := firstArgument(args)
+			user, access := firstArgument(rest)
+			access = strings.ToLower(access)
+			if ref == "" || (user != "" && access != "none" && !slices.Contains(common.AccessLevels, access)) {
+				return usage
+			}
+
+			if access == "none" {
+				access = ""
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.setACL(nickname, strings.TrimPrefix(user, "@"), access)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "invite",
+		usage:   "<conversation> [read|write|moderate] [uses] [expiry]",
+		summary: "make a code others can join a conversation you own with",
+		run: func(args string) error {
+			ref, rest := firstArgument(args)
+			if ref == "" {
+				return fmt.Errorf("usage: %sinvite <conversation> [read|write|moderate] [uses] [expiry]", CommandPrefix)
+			}
+
+			access, uses, expiry, err := parseInvite(rest)
+			if err != nil {
+				return err
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.invite(nickname, access, uses, expiry)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "join-code",
+		usage:   "<code> [server]",
+		summary: "join the conversation of an invite code",
+		run: func(args string) error {
+			code, alias := firstArgument(args)
+			if code == "" {
+				return fmt.Errorf("usage: %sjoin-code <code> [server]", CommandPrefix)
+			}
+
+			sc, err := chosenServer(alias)
+			if err != nil {
+				return err
+			}
+
+			return sc.joinCode(code)
+		},
+	})
+
+	commands.register(&command{
+		name:    "delete",
+		usage:   "<conversation>",
+		summary: "delete a conversation you own",
+		run: func(args string) error {
+			return withConversationArgument(args, func(sc *serverConn, nickname string) error {
+				if !screen.confirm("Delete " + sc.label(nickname) + " for everyone?") {
+					notice("Cancelled")
+					return nil
+				}
+
+				return sc.deleteConversation(nickname)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "history",
+		usage:   "<conversation> [n]",
+		summary: "show the last n (default 20) messages of a conversation",
+		run: func(args string) error {
+			ref, count := firstArgument(args)
+			if ref == "" {
+				return fmt.Errorf("usage: %shistory <conversation> [n]", CommandPrefix)
+			}
+
+			n := defaultHistoryCount
+			if count != "" {
+				parsed, err := strconv.Atoi(count)
+				if err != nil || parsed < 1 {
+					return fmt.Errorf("usage: %shistory <conversation> [n]", CommandPrefix)
+				}
+				n = parsed
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.showHistory(nickname, n)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "whois",
+		usage:   "<name>",
+		summary: "show who the users called name are, if they're online and where they talk",
+		run: func(args string) error {
+			if args == "" || strings.Contains(args, " ") {
+				return fmt.Errorf("usage: %swhois <name>", CommandPrefix)
+			}
+
+			for _, sc := range connectedServers() {
+				err := sc.whois(args)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "profile",
+		usage:   "[bio|avatar <text or URL>]",
+		summary: "show your profile, or set your bio or avatar URL (without text to clear it)",
+		run: func(args string) error {
+			field, value := firstArgument(args)
+
+			profile := common.Profile{}
+			switch strings.ToLower(field) {
+			case "":
+			case "bio":
+				profile.Bio = &value
+			case "avatar":
+				profile.AvatarURL = &value
+			default:
+				return fmt.Errorf("usage: %sprofile [bio|avatar <text or URL>]", CommandPrefix)
+			}
+
+			for _, sc := range connectedServers() {
+				err := sc.setProfile(profile)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "away",
+		usage:   "[text]",
+		summary: "tell the others you're away, and optionally what you're up to",
+		run: func(args string) error {
+			err := presence.set(common.Status{Away: true, Text: args}, false)
+			if err != nil {
+				return err
+			}
+
+			notice("You are away, " + CommandPrefix + "back when you're back")
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "back",
+		summary: "tell the others you're back",
+		run: func(args string) error {
+			err := presence.set(common.Status{}, false)
+			if err != nil {
+				return err
+			}
+
+			notice("Welcome back")
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "members",
+		usage:   "<conversation>",
+		summary: "list who is in a conversation, and who of them is away",
+		run: func(args string) error {
+			return withConversationArgument(args, (*serverConn).members)
+		},
+	})
+
+	commands.register(&command{
+		name:    "mute",
+		usage:   "<conversation>",
+		summary: "stop being notified of a conversation's messages, except for mentions",
+		run: func(args string) error {
+			return withConversationArgument(args, func(sc *serverConn, nickname string) error {
+				err := quiet.setMuted(sc, nickname, true)
+				if err != nil {
+					return err
+				}
+
+				notice("Muted " + sc.label(nickname))
+				return nil
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "unmute",
+		usage:   "<conversation>",
+		summary: "be notified of a conversation's messages again",
+		run: func(args string) error {
+			return withConversationArgument(args, func(sc *serverConn, nickname string) error {
+				err := quiet.setMuted(sc, nickname, false)
+				if err != nil {
+					return err
+				}
+
+				notice("Unmuted " + sc.label(nickname))
+				return nil
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "dnd",
+		usage:   "on|off",
+		summary: "do not disturb: no notifications, except for direct messages and mentions",
+		run: func(args string) error {
+			setting := strings.ToLower(args)
+			if setting != "on" && setting != "off" {
+				return fmt.Errorf("usage: %sdnd on|off", CommandPrefix)
+			}
+
+			err := quiet.setDoNotDisturb(setting == "on")
+			if err != nil {
+				return err
+			}
+
+			notice("Do not disturb is " + setting)
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "encrypt",
+		usage:   "on|off",
+		summary: "encrypt the direct messages you send end-to-end, so that servers can't read them",
+		run: func(args string) error {
+			setting := strings.ToLower(args)
+			if setting != "on" && setting != "off" {
+				return fmt.Errorf("usage: %sencrypt on|off", CommandPrefix)
+			}
+
+			err := setEncryptDirect(setting == "on")
+			if err != nil {
+				return err
+			}
+
+			notice("Encryption of direct messages is " + setting)
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "block",
+		usage:   "<name>",
+		summary: "hide the messages of the users called name, and stop the servers delivering them",
+		run: func(args string) error {
+			return setBlocked(args, true)
+		},
+	})
+
+	commands.register(&command{
+		name:    "unblock",
+		usage:   "<name>",
+		summary: "see the messages of the users called name again",
+		run: func(args string) error {
+			return setBlocked(args, false)
+		},
+	})
+
+	commands.register(&command{
+		name:    "blocks",
+		summary: "list who you blocked on every server",
+		run: func(args string) error {
+			for _, sc := range connectedServers() {
+				err := sc.listBlocks()
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "report",
+		usage:   "<conversation> <name> [reason]",
+		summary: "flag the last message of name in a conversation to the server's moderators",
+		run: func(args string) error {
+			ref, rest := firstArgument(args)
+			name, reason := firstArgument(rest)
+			if name == "" {
+				return fmt.Errorf("usage: %sreport <conversation> <name> [reason]", CommandPrefix)
+			}
+
+			name = strings.TrimPrefix(name, "@")
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				message, ok := sc.lastMessageFrom(nickname, name)
+				if !ok {
+					return fmt.Errorf("no message from %s in %s since connecting", name, sc.label(nickname))
+				}
+
+				err := sc.sendOperation(common.ReportOperationType, common.Report{MessageID: message.ID, Reason: reason})
+				if err != nil {
+					return err
+				}
+
+				notice(fmt.Sprintf("Reported %s's message %q to the moderators", name, message.Text))
+				return nil
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "search",
+		usage:   "[in:<conversation>] [from:<name>] [after:<when>] [before:<when>] [is:<kind>] [text]",
+		summary: "search the messages the servers keep, newest first",
+		run: func(args string) error {
+			search, ref, err := parseSearch(args)
+			if err != nil {
+				return err
+			}
+
+			forgetSearches()
+
+			if ref != "" {
+				return withConversation(ref, func(sc *serverConn, nickname string) error {
+					search.Conversation = nickname
+					return sc.search(search)
+				})
+			}
+
+			for _, sc := range connectedServers() {
+				err := sc.search(search)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "more",
+		summary: "show older results of the last search",
+		run: func(args string) error {
+			asked := false
+			for _, sc := range connectedServers() {
+				more, err := sc.searchMore()
+				if err != nil {
+					return err
+				}
+
+				asked = asked || more
+			}
+
+			if !asked {
+				return fmt.Errorf("no more search results: start one with %ssearch", CommandPrefix)
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "export",
+		usage:   "<conversation> json|csv <file>",
+		summary: "save the whole history the server keeps of a conversation to a file",
+		run: func(args string) error {
+			ref, rest := firstArgument(args)
+			format, path := firstArgument(rest)
+			format = strings.ToLower(format)
+			if ref == "" || path == "" || !slices.Contains(common.ExportFormats, format) {
+				return fmt.Errorf("usage: %sexport <conversation> json|csv <file>", CommandPrefix)
+			}
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				return sc.export(nickname, format, path)
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "star",
+		usage:   "<conversation> [name]",
+		summary: "star the last message in a conversation, or the last one of name, to find it with /starred",
+		run: func(args string) error {
+			ref, name := firstArgument(args)
+			if ref == "" || strings.Contains(name, " ") {
+				return fmt.Errorf("usage: %sstar <conversation> [name]", CommandPrefix)
+			}
+
+			name = strings.TrimPrefix(name, "@")
+
+			return withConversation(ref, func(sc *serverConn, nickname string) error {
+				message, ok := sc.lastMessageFrom(nickname, name)
+				if !ok {
+					return fmt.Errorf("no message to star in %s since connecting", sc.label(nickname))
+				}
+
+				added, err := starred.star(sc, nickname, message)
+				if err != nil {
+					return err
+				}
+
+				if !added {
+					notice(fmt.Sprintf("%s's message %q is starred already", message.Sender.Name, message.Text))
+					return nil
+				}
+
+				notice(fmt.Sprintf("Starred %s's message %q", message.Sender.Name, message.Text))
+				return nil
+			})
+		},
+	})
+
+	commands.register(&command{
+		name:    "starred",
+		summary: "list your starred messages",
+		run: func(args string) error {
+			showStarred()
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "unstar",
+		usage:   "<n>",
+		summary: "unstar the nth message of /starred",
+		run: func(args string) error {
+			n, err := strconv.Atoi(args)
+			if err != nil {
+				return fmt.Errorf("usage: %sunstar <n>", CommandPrefix)
+			}
+
+			message, err := starred.unstar(n)
+			if err != nil {
+				return err
+			}
+
+			notice(fmt.Sprintf("Unstarred %s's message %q", message.Sender, message.Text))
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "nick",
+		usage:   "<name>",
+		summary: "change your name, until you reconnect",
+		run: func(args string) error {
+			if args == "" {
+				return fmt.Errorf("usage: %snick <name>", CommandPrefix)
+			}
+
+			for _, sc := range connectedServers() {
+				err := sc.setName(args)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "register",
+		usage:   "[release]",
+		summary: "register your name, for no one else to connect with it, or release it",
+		run: func(args string) error {
+			setting := strings.ToLower(args)
+			if setting != "" && setting != "release" {
+				return fmt.Errorf("usage: %sregister [release]", CommandPrefix)
+			}
+
+			for _, sc := range connectedServers() {
+				err := sc.setRegistered(setting == "")
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "privacy",
+		usage:   "hidden|visible",
+		summary: "hide your conversations and connect time from /whois, or show them again",
+		run: func(args string) error {
+			setting := strings.ToLower(args)
+			if setting != "hidden" && setting != "visible" {
+				return fmt.Errorf("usage: %sprivacy hidden|visible", CommandPrefix)
+			}
+
+			for _, sc := range connectedServers() {
+				err := sc.setHidden(setting == "hidden")
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "digest",
+		usage:   "on|off|email <address>|email off",
+		summary: "get a daily digest of what you missed, or emails of the mentions and direct messages you get while away",
+		run: func(args string) error {
+			if kind, address, ok := strings.Cut(args, " "); ok && strings.EqualFold(kind, "email") {
+				address = strings.TrimSpace(address)
+				if strings.EqualFold(address, "off") {
+					address = ""
+				}
+
+				for _, sc := range connectedServers() {
+					err := sc.setEmailDigest(address)
+					if err != nil {
+						return err
+					}
+				}
+
+				return nil
+			}
+
+			setting := strings.ToLower(args)
+			if setting != "on" && setting != "off" {
+				return fmt.Errorf("usage: %sdigest on|off|email <address>|email off", CommandPrefix)
+			}
+
+			for _, sc := range connectedServers() {
+				err := sc.setDigest(setting == "on")
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "sessions",
+		usage:   "[all]",
+		summary: "list where you're connected from, or everyone's sessions for admins",
+		run: func(args string) error {
+			setting := strings.ToLower(args)
+			if setting != "" && setting != "all" {
+				return fmt.Errorf("usage: %ssessions [all]", CommandPrefix)
+			}
+
+			for _, sc := range connectedServers() {
+				err := sc.listSessions(setting == "all")
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "revoke",
+		usage:   "<session>",
+		summary: "disconnect one of the sessions /sessions listed, by the start of its ID",
+		run: func(args string) error {
+			return revokeSession(args)
+		},
+	})
+
+	commands.register(&command{
+		name:    "totp",
+		usage:   "enroll|confirm <code>|off <code> [server]",
+		summary: "set up two-factor authentication for the account you logged in to with a password",
+		run: func(args string) error {
+			usage := fmt.Errorf("usage: %stotp enroll|confirm <code>|off <code> [server]", CommandPrefix)
+
+			action, rest := firstArgument(args)
+			fields := strings.Fields(rest)
+
+			code := ""
+			switch strings.ToLower(action) {
+			case "enroll":
+				action = common.TOTPEnrollAction
+			case "confirm":
+				action = common.TOTPConfirmAction
+			case "off":
+				action = common.TOTPDisableAction
+			default:
+				return usage
+			}
+
+			if action != common.TOTPEnrollAction {
+				if len(fields) == 0 {
+					return usage
+				}
+				code, fields = fields[0], fields[1:]
+			}
+
+			alias := ""
+			switch len(fields) {
+			case 0:
+			case 1:
+				alias = fields[0]
+			default:
+				return usage
+			}
+
+			sc, err := passwordServer(alias)
+			if err != nil {
+				return err
+			}
+
+			return sc.setUpTOTP(action, code)
+		},
+	})
+
+	commands.register(&command{
+		name:    "mydata",
+		usage:   "<file> [server]",
+		summary: "save everything the server keeps about you, with your messages, to a JSON file",
+		run: func(args string) error {
+			path, alias := firstArgument(args)
+			if path == "" || strings.Contains(alias, " ") {
+				return fmt.Errorf("usage: %smydata <file> [server]", CommandPrefix)
+			}
+
+			sc, err := chosenServer(alias)
+			if err != nil {
+				return err
+			}
+
+			return sc.exportAccount(path)
+		},
+	})
+
+	commands.register(&command{
+		name:    "deleteaccount",
+		usage:   "<your name> [server]",
+		summary: "delete your account from the server for good, which disconnects you",
+		run: func(args string) error {
+			name, alias := firstArgument(args)
+			if name == "" || strings.Contains(alias, " ") {
+				return fmt.Errorf("usage: %sdeleteaccount <your name> [server]", CommandPrefix)
+			}
+
+			sc, err := chosenServer(alias)
+			if err != nil {
+				return err
+			}
+
+			return sc.deleteAccount(name)
+		},
+	})
+
+	commands.register(&command{
+		name:    "help",
+		summary: "show this help",
+		run: func(args string) error {
+			notice(commands.help() + "\nOther commands, like " + CommandPrefix + "roll 2d6, are sent to the active conversation for the server to run." +
+				"\nInput starting with " + IntentPrefix + " is translated by the intent handlers.")
+			return nil
+		},
+	})
+
+	commands.register(&command{
+		name:    "quit",
+		summary: "disconnect and quit",
+		run: func(args string) error {
+			return errQuit
+		},
+	})
+}
+
+// setBlocked blocks or unblocks the users called name, as typed after /block or /unblock
+func setBlocked(name string, blocked bool) error {
+	if name == "" || strings.Contains(name, " ") {
+		return errors.New("expected a single name")
+	}
+
+	name = strings.TrimPrefix(name, "@")
+
+	err := blocking.set(name, blocked)
+	if err != nil {
+		return err
+	}
+
+	if blocked {
+		notice("Blocked " + name)
+	} else {
+		notice("Unblocked " + name)
+	}
+
+	return nil
+}
+
+// parseSlowMode parses the interval of /slowmode, a number of seconds, a duration like 2m, or off
+func parseSlowMode(interval string) (int, error) {
+	if strings.EqualFold(interval, "off") {
+		return 0, nil
+	}
+
+	if seconds, err := strconv.Atoi(interval); err == nil && seconds >= 0 {
+		return seconds, nil
+	}
+
+	duration, err := time.ParseDuration(interval)
+	if err != nil || duration < 0 {
+		return 0, errors.New("invalid slow mode interval")
+	}
+
+	return int(duration.Round(time.Second).Seconds()), nil
+}
+
+// parseInvite parses the access, uses and expiry of /invite, in any order, leaving the ones
+// that aren't given to the server
+func parseInvite(args string) (access string, uses int, expiry time.Duration, err error) {
+	for _, arg := range strings.Fields(args) {
+		if slices.Contains(common.AccessLevels, strings.ToLower(arg)) {
+			access = strings.ToLower(arg)
+		} else if n, convErr := strconv.Atoi(arg); convErr == nil && n > 0 {
+			uses = n
+		} else if d, parseErr := time.ParseDuration(arg); parseErr == nil && d > 0 {
+			expiry = d
+		} else {
+			return "", 0, 0, fmt.Errorf("expected read, write or moderate, a number of uses, or an expiry like 2h, not %s", arg)
+		}
+	}
+
+	return access, uses, expiry, nil
+}
+
+// withConversationArgument runs f on the conversation named by the only argument of a command
+func withConversationArgument(args string, f func(sc *serverConn, nickname string) error) error {
+	ref, rest := firstArgument(args)
+	if ref == "" || rest != "" {
+		return errors.New("expected a single conversation")
+	}
+
+	return withConversation(ref, f)
+}
+
+// runInput runs a line of input: a command, an intent, or a message for the active conversation
+func runInput(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	presence.typed()
+
+	if strings.HasPrefix(strings.TrimSpace(line), IntentPrefix) {
+		return runIntent(line)
+	}
+
+	sc, nickname := active.get()
+
+	// the commands the client doesn't know may be the server's, like /roll, which it runs
+	// when they're sent to a conversation
+	if name, _, ok := parseCommand(line); ok && (sc == nil || commands.has(name)) {
+		return commands.run(line)
+	}
+
+	if sc == nil {
+		return fmt.Errorf("commands start with %s, and messages need a conversation: try %sswitch <conversation> or %shelp", CommandPrefix, CommandPrefix, CommandPrefix)
+	}
+
+	return sc.sendMessage(nickname, line)
+}
+
+// activeConversation is where the messages typed without a command go
+type activeConversation struct {
+	mu       sync.Mutex
+	sc       *serverConn
+	nickname string
+}
+
+var active = &activeConversation{}
+
+// switchTo makes the conversation active, joining it first if needed
+func (a *activeConversation) switchTo(sc *serverConn, nickname string) error {
+	sc.mu.Lock()
+	subscribed := sc.subscriptions[nickname]
+	sc.mu.Unlock()
+
+	if !subscribed {
+		err := sc.subscribe(nickname)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	a.sc, a.nickname = sc, nickname
+	a.mu.Unlock()
+
+	status := "Now talking in " + sc.label(nickname)
+	if n := sc.markRead(nickname); n > 0 {
+		status += fmt.Sprintf(" (%d unread)", n)
+	}
+	notice(status)
+	screen.refresh()
+
+	return nil
+}
+
+// get returns the active conversation, or a nil server if there is none
+func (a *activeConversation) get() (*serverConn, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.sc, a.nickname
+}
+
+// label is how the active conversation is shown in the prompt and status bar, if there is one
+func (a *activeConversation) label() string {
+	sc, nickname := a.get()
+	if sc == nil {
+		return ""
+	}
+
+	return sc.label(nickname)
+}
+
+// renamed follows the active conversation when it's renamed
+func (a *activeConversation) renamed(sc *serverConn, from, to string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sc == sc && a.nickname == from {
+		a.nickname = to
+	}
+}
+
+// left clears the active conversation if we left it, or it was deleted
+func (a *activeConversation) left(sc *serverConn, nickname string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sc == sc && a.nickname == nickname {
+		a.sc, a.nickname = nil, ""
+	}
+}
+
+// forget clears the active conversation if it is on sc, once we're disconnected from sc
+func (a *activeConversation) forget(sc *serverConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sc == sc {
+		a.sc, a.nickname = nil, ""
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+		args string
+		ok   bool
+	}{
+		{line: "/join general", name: "join", args: "general", ok: true},
+		{line: "/msg general hello world", name: "msg", args: "general hello world", ok: true},
+		{line: "  /msg   general  hello  ", name: "msg", args: "general  hello", ok: true},
+		{line: "/JOIN general", name: "join", args: "general", ok: true},
+		{line: "/quit", name: "quit", args: "", ok: true},
+		{line: "/nosuchcommand x", name: "nosuchcommand", args: "x", ok: true},
+		{line: "hello world", ok: false},
+		{line: "join /general", ok: false},
+		{line: "", ok: false},
+		{line: "   ", ok: false},
+		{line: "/", ok: false},
+		{line: "/ join", ok: false},
+	}
+
+	for _, test := range tests {
+		name, args, ok := parseCommand(test.line)
+		if ok != test.ok || (ok && (name != test.name || args != test.args)) {
+			t.Errorf("parseCommand(%q) = %q, %q, %t, want %q, %q, %t", test.line, name, args, ok, test.name, test.args, test.ok)
+		}
+	}
+}
+
+func TestFirstArgument(t *testing.T) {
+	tests := []struct {
+		args  string
+		first string
+		rest  string
+	}{
+		{args: "general hello world", first: "general", rest: "hello world"},
+		{args: "  general   hello  ", first: "general", rest: "hello"},
+		{args: "general", first: "general", rest: ""},
+		{args: "", first: "", rest: ""},
+		{args: "   ", first: "", rest: ""},
+	}
+
+	for _, test := range tests {
+		first, rest := firstArgument(test.args)
+		if first != test.first || rest != test.rest {
+			t.Errorf("firstArgument(%q) = %q, %q, want %q, %q", test.args, first, rest, test.first, test.rest)
+		}
+	}
+}
+
+func TestCommandRouterRun(t *testing.T) {
+	var got []string
+
+	r := newCommandRouter()
+	r.register(&command{name: "echo", run: func(args string) error {
+		got = append(got, args)
+		return nil
+	}})
+	r.register(&command{name: "quit", run: func(args string) error {
+		return errQuit
+	}})
+
+	tests := []struct {
+		line string
+		// err is the error run should return, or the start of its message if it isn't errQuit
+		err  error
+		echo string
+	}{
+		{line: "/echo hello world", echo: "hello world"},
+		{line: "/ECHO  spaced out ", echo: "spaced out"},
+		{line: "/quit", err: errQuit},
+		{line: "/nosuchcommand", err: errors.New("unknown command /nosuchcommand")},
+		{line: "echo hello", err: errors.New("commands start with /")},
+		{line: "", err: errors.New("commands start with /")},
+	}
+
+	for _, test := range tests {
+		got = nil
+		err := r.run(test.line)
+
+		switch {
+		case test.err == errQuit:
+			if err != errQuit {
+				t.Errorf("run(%q) = %v, want errQuit", test.line, err)
+			}
+		case test.err != nil:
+			if err == nil || !strings.HasPrefix(err.Error(), test.err.Error()) {
+				t.Errorf("run(%q) = %v, want an error starting with %q", test.line, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("run(%q) = %v, want no error", test.line, err)
+		}
+
+		if test.echo != "" && (len(got) != 1 || got[0] != test.echo) {
+			t.Errorf("run(%q) ran echo with %q, want %q", test.line, got, test.echo)
+		}
+		if test.echo == "" && len(got) != 0 {
+			t.Errorf("run(%q) ran echo with %q, want it not run", test.line, got)
+		}
+	}
+}
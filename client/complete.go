@@ -0,0 +1,142 @@
+package client
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheRefreshInterval is how often the conversation lists used for completion are fetched again
+const cacheRefreshInterval = time.Minute
+
+// conversationCommands take a conversation as their first argument
+var conversationCommands = map[string]bool{
+	"join": true, "leave": true, "create": true, "msg": true, "switch": true, "history": true,
+	"topic": true, "rename": true, "archive": true, "unarchive": true, "delete": true, "members": true,
+	"mute": true, "unmute": true, "report": true, "slowmode": true,
+	"star": true, "export": true, "acl": true, "invite": true,
+}
+
+// userCommands take the name of a user as their first argument
+var userCommands = map[string]bool{"whois": true, "block": true, "unblock": true, "dm": true}
+
+// complete completes the word before pos in line when Tab is pressed: command names after a
+// slash, @usernames, and conversations or users in the arguments of commands that take one. When
+// several candidates are left, the word is completed as far as they agree, and if that doesn't
+// get it any further the candidates are returned to be listed
+func complete(line string, pos int) (newLine string, newPos int, candidates []string, ok bool) {
+	before := line[:pos]
+	start := strings.LastIndex(before, " ") + 1
+	word := before[start:]
+
+	switch {
+	case start == 0 && strings.HasPrefix(word, CommandPrefix):
+		candidates = withPrefix(commandNames(), word, CommandPrefix)
+	case strings.HasPrefix(word, "@"):
+		candidates = withPrefix(knownUsers(), word, "@")
+	default:
+		name, args, isCommand := parseCommand(before)
+		// only the first argument, so the text of /msg isn't completed with conversations
+		if isCommand && conversationCommands[name] && start > 0 && !strings.Contains(args, " ") {
+			candidates = withPrefix(knownConversations(), word, "")
+		}
+		if isCommand && userCommands[name] && start > 0 && !strings.Contains(args, " ") {
+			candidates = withPrefix(knownUsers(), word, "")
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", 0, nil, false
+	}
+
+	completion := commonPrefix(candidates)
+	if len(candidates) == 1 {
+		completion += " "
+	}
+	if completion != word {
+		candidates = nil
+	}
+
+	return line[:start] + completion + line[pos:], start + len(completion), candidates, true
+}
+
+// withPrefix returns prefix+name for every name that starts with the word being completed
+func withPrefix(names []string, word, prefix string) []string {
+	candidates := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(prefix+name, word) {
+			candidates = append(candidates, prefix+name)
+		}
+	}
+	sort.Strings(candidates)
+
+	return candidates
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	return prefix
+}
+
+func commandNames() []string {
+	names := []string{}
+	for name := range commands.commands {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// knownConversations are the conversations of every server, as they're referred to in commands
+func knownConversations() []string {
+	names := []string{}
+	for _, sc := range connectedServers() {
+		sc.mu.Lock()
+		nicknames := []string{}
+		for _, conversation := range sc.conversations {
+			nicknames = append(nicknames, conversation.Nickname)
+		}
+		sc.mu.Unlock()
+
+		for _, nickname := range nicknames {
+			names = append(names, sc.label(nickname))
+		}
+	}
+
+	return names
+}
+
+// knownUsers are the names of the users we've seen messages from, on any server
+func knownUsers() []string {
+	seen := map[string]bool{}
+	for _, sc := range connectedServers() {
+		sc.mu.Lock()
+		for name := range sc.users {
+			seen[name] = true
+		}
+		sc.mu.Unlock()
+	}
+
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// refreshCaches fetches the conversation lists again every once in a while, so that completion
+// knows about the conversations created since
+func refreshCaches() {
+	for range time.Tick(cacheRefreshInterval) {
+		for _, sc := range connectedServers() {
+			sc.refreshConversations()
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is a server the client can connect to, named by its alias
+type Profile struct {
+	Alias   string `yaml:"alias"`
+	Address string `yaml:"address"`
+	// Name is the display name to use on this server, if it should differ from the default one
+	Name string `yaml:"name"`
+	// OIDC is the provider to log in with on this server, if it differs from the default one
+	OIDC OIDC `yaml:"oidc"`
+	// Username is the account to log in to with a password on this server, if it differs from
+	// the default one
+	Username string `yaml:"username"`
+	// TOTP asks for a one-time code when logging in to the account, for two-factor authentication
+	TOTP bool `yaml:"totp"`
+}
+
+// Colors are the ANSI SGR parameters (like "1" for bold or "1;34" for bold blue) used to
+// show the different parts of the chat. Whatever is left out comes from the theme
+type Colors struct {
+	Enabled bool   `yaml:"enabled"`
+	Theme   string `yaml:"theme"`
+	Sender  string `yaml:"sender"`
+	// Senders, if set, are picked from for every sender's name instead of Sender, so
+	// that each sender keeps a color of their own
+	Senders []string `yaml:"senders"`
+	Direct  string   `yaml:"direct"`
+	// Mention highlights our @name in the text of messages
+	Mention string `yaml:"mention"`
+	// Code is for `code` and code blocks in messages
+	Code string `yaml:"code"`
+	// Notice is for everything that doesn't come from another user, like timestamps
+	Notice string `yaml:"notice"`
+}
+
+// themes are the colors the theme setting picks from
+var themes = map[string]Colors{
+	"default": {
+		Sender:  "1",
+		Direct:  "1",
+		Mention: "1;7",
+		Code:    "36",
+		Notice:  "2",
+	},
+	"vivid": {
+		Sender:  "1",
+		Senders: []string{"1;31", "1;32", "1;33", "1;34", "1;35", "1;36"},
+		Direct:  "1;35",
+		Mention: "1;33;7",
+		Code:    "32",
+		Notice:  "2;37",
+	},
+}
+
+// themed fills in the colors that were left out from the theme
+func (c Colors) themed() (Colors, error) {
+	theme, ok := themes[c.Theme]
+	if !ok {
+		return c, fmt.Errorf("unknown color theme %s", c.Theme)
+	}
+
+	for _, color := range []struct{ value, fallback *string }{
+		{&c.Sender, &theme.Sender},
+		{&c.Direct, &theme.Direct},
+		{&c.Mention, &theme.Mention},
+		{&c.Code, &theme.Code},
+		{&c.Notice, &theme.Notice},
+	} {
+		if *color.value == "" {
+			*color.value = *color.fallback
+		}
+	}
+
+	if len(c.Senders) == 0 {
+		c.Senders = theme.Senders
+	}
+
+	return c, nil
+}
+
+// TLS decides whether servers are connected to over TLS. CA is a file of PEM encoded certificates
+// to verify them with instead of the system's roots, e.g. for self-signed certificates. Cert and
+// Key are the files of the PEM encoded client certificate and key, for servers that ask for one
+type TLS struct {
+	Enabled bool   `yaml:"enabled"`
+	CA      string `yaml:"ca"`
+	Cert    string `yaml:"cert"`
+	Key     string `yaml:"key"`
+}
+
+// TCP tunes the connections to servers. ReadTimeout is how long to go without hearing from a
+// server before the connection is taken as lost and reconnected, and WriteTimeout how long an
+// operation may take to be sent, zero waiting forever. KeepAlive is the interval of TCP
+// keep-alive probes, zero turning them off, and NoDelay sends operations right away instead of
+// batching small ones (Nagle's algorithm)
+type TCP struct {
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	KeepAlive    time.Duration `yaml:"keepalive"`
+	NoDelay      bool          `yaml:"no_delay"`
+}
+
+// Notifications decide when the client gets the user's attention by ringing the terminal bell,
+// and whether it shows desktop notifications for direct messages and mentions
+type Notifications struct {
+	Bell bool `yaml:"bell"`
+	// Level is "all" to ring the bell for every message, "mentions" for mentions and direct
+	// messages only, or "none"
+	Level string `yaml:"level"`
+	// Desktop shows a notification for direct messages, and for mentions outside of the
+	// conversation we're talking in
+	Desktop bool `yaml:"desktop"`
+	// Muted are the conversations that don't notify of anything but mentions, referred to
+	// like in commands
+	Muted []string `yaml:"muted"`
+	// DND is do not disturb: nothing notifies, except for the kinds of messages in
+	// DNDExceptions, "direct" and "mentions"
+	DND           bool     `yaml:"dnd"`
+	DNDExceptions []string `yaml:"dnd_exceptions"`
+}
+
+// Transcripts decide whether the messages we receive are logged to files under Dir, with ~
+// standing for the home directory. A file is rotated once it grows past MaxSize bytes, keeping
+// Keep old files
+type Transcripts struct {
+	Dir     string `yaml:"dir"`
+	MaxSize int64  `yaml:"max_size"`
+	Keep    int    `yaml:"keep"`
+}
+
+// Config is the client's configuration file, e.g.
+//
+//	server: chat.example.com:8080
+//	name: alice
+//	id: 6f1c0a52-8d1e-4c8e-9f3a-2a1b0c9d8e7f
+//	autojoin: [general, home/family]
+//	colors:
+//	  sender: "1;34"
+//	notifications:
+//	  bell: true
+//	  level: mentions
+//	away_after: 15m
+//	tcp:
+//	  write_timeout: 10s
+//	  keepalive: 15s
+//	encrypt_direct: true
+//	servers:
+//	  - alias: home
+//	    address: localhost:8080
+//	    name: al
+//
+// Command line flags override the values in it
+type Config struct {
+	// Server is the address or profile alias connected to when none is given
+	Server  string    `yaml:"server"`
+	Name    string    `yaml:"name"`
+	ID      uuid.UUID `yaml:"id"`
+	Network string    `yaml:"network"`
+	Proxy   string    `yaml:"proxy"`
+	TLS     TLS       `yaml:"tls"`
+	TCP     TCP       `yaml:"tcp"`
+	// OIDC is the provider to log in with on the servers that delegate authentication to one
+	OIDC OIDC `yaml:"oidc"`
+	// Username is the account to log in to with a password, on the servers that check them
+	Username string `yaml:"username"`
+	// TOTP asks for a one-time code when logging in to the account
+	TOTP bool `yaml:"totp"`
+	// TUI starts the full screen terminal interface instead of the plain prompt
+	TUI bool `yaml:"tui"`
+	// JSON reads JSON lines of input and writes JSON lines of events instead of the prompt,
+	// for programs to chat. It's only set with the -json flag
+	JSON bool `yaml:"-"`
+	// AutoJoin are the conversations subscribed to on connecting, as <alias>/<nickname> when
+	// connecting to several servers
+	AutoJoin []string `yaml:"autojoin"`
+	// Timestamps is the time.Format layout messages are shown with, in the local time zone,
+	// "relative" for times like "2m ago", or "none"
+	Timestamps    string        `yaml:"timestamps"`
+	Colors        Colors        `yaml:"colors"`
+	Notifications Notifications `yaml:"notifications"`
+	Transcripts   Transcripts   `yaml:"transcripts"`
+	// AwayAfter is how long without typing anything before we're marked away, or 0 not to
+	AwayAfter time.Duration `yaml:"away_after"`
+	// Blocked are the names of the users whose messages are hidden
+	Blocked []string `yaml:"blocked"`
+	// EncryptDirect encrypts the direct messages we send end-to-end
+	EncryptDirect bool      `yaml:"encrypt_direct"`
+	Servers       []Profile `yaml:"servers"`
+
+	// path is the file the configuration was loaded from, which settings changed from the
+	// client are saved to
+	path string
+}
+
+// defaultConfig is the configuration used for whatever the configuration file leaves out
+func defaultConfig() *Config {
+	return &Config{
+		Network:    "tcp",
+		Timestamps: "15:04",
+		Colors: Colors{
+			// see https://no-color.org
+			Enabled: os.Getenv("NO_COLOR") == "",
+			Theme:   "default",
+		},
+		Notifications: Notifications{
+			Level:         "mentions",
+			DNDExceptions: []string{"direct", "mentions"},
+		},
+		Transcripts: Transcripts{
+			MaxSize: 1 << 20,
+			Keep:    5,
+		},
+		AwayAfter: 15 * time.Minute,
+		TCP: TCP{
+			WriteTimeout: 10 * time.Second,
+			KeepAlive:    15 * time.Second,
+			NoDelay:      true,
+		},
+	}
+}
+
+// ConfigPath is where the configuration file is looked for, ~/.config/tcpchat/config.yaml on Linux
+func ConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "tcpchat", "config.yaml"), nil
+}
+
+// LoadConfig reads the configuration file at path. A missing file is the default configuration
+func LoadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+	config.path = path
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err == nil {
+		err = yaml.Unmarshal(b, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config.Colors, err = config.Colors.themed()
+	if err != nil {
+		return nil, err
+	}
+
+	config.Transcripts.Dir, err = expandHome(config.Transcripts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// save sets the setting at keys, like ["notifications", "dnd"], to value in the configuration
+// file, creating the file if needed. The rest of the file, comments included, is kept as it is
+func (c *Config) save(keys []string, value interface{}) error {
+	if c.path == "" {
+		return errors.New("there is no configuration file to save settings to")
+	}
+
+	document := &yaml.Node{}
+
+	b, err := os.ReadFile(c.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	err = yaml.Unmarshal(b, document)
+	if err != nil {
+		return err
+	}
+
+	if document.Kind == 0 {
+		document = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+
+	valueNode := &yaml.Node{}
+	err = valueNode.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	node := document.Content[0]
+	for i, key := range keys {
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s in %s isn't a mapping", strings.Join(keys[:i], "."), c.path)
+		}
+
+		var child *yaml.Node
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			if node.Content[j].Value == key {
+				child = node.Content[j+1]
+				break
+			}
+		}
+
+		last := i == len(keys)-1
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+		}
+
+		if last {
+			// keep the comments of the value being replaced
+			valueNode.HeadComment, valueNode.LineComment, valueNode.FootComment = child.HeadComment, child.LineComment, child.FootComment
+			*child = *valueNode
+		}
+
+		node = child
+	}
+
+	err = os.MkdirAll(filepath.Dir(c.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+
+	err = encoder.Encode(document)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(c.path, out.Bytes(), 0600)
+}
+
+// expandHome replaces the ~ at the start of path with the home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, path[1:]), nil
+}
+
+// Profile returns the profile with the given alias
+func (c *Config) Profile(alias string) (Profile, bool) {
+	for _, profile := range c.Servers {
+		if profile.Alias == alias {
+			return profile, true
+		}
+	}
+
+	return Profile{}, false
+}
+
+// Profiles turns arguments that are either profile aliases or "host:port" addresses into profiles.
+// Without arguments, the default server is used
+func (c *Config) Profiles(args []string) []Profile {
+	profiles := []Profile{}
+
+	if len(args) == 0 && c.Server != "" {
+		args = []string{c.Server}
+	}
+
+	for _, arg := range args {
+		profile, ok := c.Profile(arg)
+		if !ok {
+			profile = Profile{Alias: arg, Address: arg}
+		}
+		if profile.OIDC.Issuer == "" {
+			profile.OIDC = c.OIDC
+		}
+		if profile.Username == "" {
+			profile.Username = c.Username
+			profile.TOTP = c.TOTP
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	return profiles
+}
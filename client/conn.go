@@ -0,0 +1,218 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// Conn is a connection to a server for programs that handle what it sends themselves, like
+// bots, rather than showing it at a prompt. Its writes are safe from several goroutines, its
+// reads are not
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	me     *common.ClientAboutMe
+	// limit is the rate limit the server advertised
+	limit common.RateLimit
+
+	mu sync.Mutex
+}
+
+// Dial connects to the server of profile and logs in as the user of config, like Connect does.
+// Like Connect, it sets up the network, TCP settings and identity of config for the whole
+// process. The server's refusals of the login are returned as the *common.Error it sent
+func Dial(config *Config, profile Profile) (*Conn, error) {
+	err := common.CheckNetwork(config.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	network = config.Network
+	settings = config
+	useTCP(config.TCP)
+
+	loaded, err := loadIdentity(config.path)
+	if err != nil {
+		return nil, err
+	}
+	self = loaded
+
+	name := profile.Name
+	if name == "" {
+		name = config.Name
+	}
+	if name == "" {
+		return nil, errors.New("no name to log in with: pass -name, or set one in the config file")
+	}
+
+	account, err := credentials(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	if profile.TOTP && profile.Username != "" {
+		account.TOTPCode, err = askCode(profile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := dial(network, profile.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{conn: conn, reader: bufio.NewReader(conn), me: initialiseSender(name), limit: defaultRateLimit}
+
+	err = c.logIn(account)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Conn) logIn(account common.Login) error {
+	proof, err := answerChallenge(c.reader)
+	if err != nil {
+		return err
+	}
+
+	err = sendAboutClient(c.conn, *c.me, account, proof)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.Await(common.AboutMeOperationType)
+	if err != nil {
+		return err
+	}
+
+	if response.RateLimit != nil {
+		c.limit = *response.RateLimit
+	}
+
+	// the server may know us by another identity, like that of our certificate
+	return json.Unmarshal(*response.Message, c.me)
+}
+
+// Me is who the server knows us as
+func (c *Conn) Me() common.ClientAboutMe {
+	return *c.me
+}
+
+// RateLimit is the rate limit the server advertised, or the default one if it didn't
+func (c *Conn) RateLimit() common.RateLimit {
+	return c.limit
+}
+
+// Send sends an operation of operationType with v as its message
+func (c *Conn) Send(operationType string, v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return writeOperationTo(c.conn, operationType, v)
+}
+
+// SendMessage sends text to conversation, signed, and returns the key the server will
+// acknowledge it with. Encrypted conversations aren't supported
+func (c *Conn) SendMessage(conversation *common.Conversation, text string) (string, error) {
+	if conversation.Encrypted {
+		return "", errors.New("can't send messages to encrypted conversations")
+	}
+
+	message := common.Message{
+		Text:         text,
+		Conversation: conversation,
+		Sender:       (*common.Sender)(c.me),
+		Key:          uuid.NewString(),
+	}
+	common.Sign(&message, self.PrivateKey)
+
+	return message.Key, c.Send(common.MessageOperationType, message)
+}
+
+// List returns the conversations of the server
+func (c *Conn) List() ([]*common.Conversation, error) {
+	err := c.Send(common.ListOperationType, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.Await(common.ListOperationType)
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := []*common.Conversation{}
+	err = json.Unmarshal(*response.Message, &conversations)
+	if err != nil {
+		return nil, err
+	}
+
+	return conversations, nil
+}
+
+// ListPage returns a page of the conversations the list asks for, which needs a Limit or a
+// Cursor. The NextCursor of the page is the Cursor of the next one
+func (c *Conn) ListPage(list common.List) (*common.ConversationPage, error) {
+	if list.Limit == 0 && list.Cursor == "" {
+		return nil, errors.New("a page of the list needs a limit or a cursor")
+	}
+
+	err := c.Send(common.ListOperationType, list)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.Await(common.ListOperationType)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &common.ConversationPage{}
+	err = json.Unmarshal(*response.Message, page)
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// Next reads the next response from the server, whatever it is, errors included
+func (c *Conn) Next() (*common.Response, error) {
+	frame, err := common.ReadUntil(c.reader, common.EOFBytes)
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("connection closed by server")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response := common.Response{}
+	err = json.Unmarshal(frame, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
+
+// Await reads responses until the one to an operation of operationType, skipping the others,
+// and returns an error response as the *common.Error it carries
+func (c *Conn) Await(operationType string) (*common.Response, error) {
+	return awaitOutcome(c.reader, operationType)
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// encryptDirect is set to encrypt the direct messages we send end-to-end, so that the servers
+// can't read them
+var encryptDirect atomic.Bool
+
+// setEncryptDirect turns the encryption of direct messages on or off, and saves the setting
+func setEncryptDirect(enabled bool) error {
+	encryptDirect.Store(enabled)
+
+	return settings.save([]string{"encrypt_direct"}, enabled)
+}
+
+// directMessage is a direct message waiting for the server to tell us who its recipient is,
+// and whether to encrypt it, as it was when it was typed
+type directMessage struct {
+	text    string
+	encrypt bool
+}
+
+// sendDirect sends text to the user called name, once the server told us who that is
+func (sc *serverConn) sendDirect(name, text string) error {
+	key := strings.ToLower(name)
+	message := directMessage{text: text, encrypt: encryptDirect.Load()}
+
+	sc.mu.Lock()
+	recipient, known := sc.directKeys[key]
+	if !known {
+		sc.pendingDirect[key] = append(sc.pendingDirect[key], message)
+	}
+	waiting := len(sc.pendingDirect[key])
+	sc.mu.Unlock()
+
+	if known {
+		return sc.sendDirectTo(recipient, message)
+	}
+
+	// the first message waiting asks for the keys, the others wait with it
+	if waiting > 1 {
+		return nil
+	}
+
+	return sc.sendOperation(common.KeysOperationType, common.Keys{Name: name})
+}
+
+// sendDirectTo sends a direct message to recipient, encrypted for its box key if it's to be
+func (sc *serverConn) sendDirectTo(recipient common.Sender, direct directMessage) error {
+	sc.mu.Lock()
+	sender := common.Sender(sc.clientInfo)
+	sc.mu.Unlock()
+
+	message := common.Message{
+		Recipient: &common.Sender{ID: recipient.ID, Name: recipient.Name},
+		Sender:    &sender,
+		Text:      direct.text,
+	}
+
+	if direct.encrypt {
+		if len(recipient.BoxKey) != 32 {
+			return fmt.Errorf("%s's client can't receive encrypted messages: turn encryption off with %sencrypt off to send it anyway", recipient.Name, CommandPrefix)
+		}
+
+		var nonce [24]byte
+		_, err := rand.Read(nonce[:])
+		if err != nil {
+			return err
+		}
+
+		message.Box = box.Seal(nil, []byte(direct.text), &nonce, (*[32]byte)(recipient.BoxKey), (*[32]byte)(self.BoxPrivateKey))
+		message.Nonce = nonce[:]
+		message.Text = ""
+	}
+
+	shown := message
+	shown.Text = direct.text
+	shown.Timestamp = time.Now()
+	screen.print(sc.formatMessage(shown, len(connectedServers()) > 1))
+
+	return sc.sendKeyed(message)
+}
+
+// handleKeysResponse sends the direct messages waiting for the keys of a user, or drops them
+// when there's no such user, or more than one
+func (sc *serverConn) handleKeysResponse(jsonKeys *json.RawMessage) {
+	keys := common.Keys{}
+
+	err := json.Unmarshal(*jsonKeys, &keys)
+	if common.CheckErrorAndLog(err) || keys.Name == "" {
+		return
+	}
+
+	key := strings.ToLower(keys.Name)
+
+	sc.mu.Lock()
+	pending := sc.pendingDirect[key]
+	delete(sc.pendingDirect, key)
+	if len(keys.Users) == 1 {
+		sc.directKeys[key] = keys.Users[0]
+	}
+	sc.mu.Unlock()
+
+	if len(keys.Users) == 0 {
+		notice(fmt.Sprintf("There is no user called %s on %s", keys.Name, sc.profile.Alias))
+		return
+	}
+
+	if len(keys.Users) > 1 {
+		notice(fmt.Sprintf("There are %d users called %s on %s, so the message wasn't sent", len(keys.Users), keys.Name, sc.profile.Alias))
+		return
+	}
+
+	recipient := keys.Users[0]
+	sc.checkBoxKey(recipient)
+
+	for _, direct := range pending {
+		common.CheckErrorAndLog(sc.sendDirectTo(recipient, direct))
+	}
+}
+
+// openBox decrypts the text of an encrypted direct message to us
+func (sc *serverConn) openBox(message common.Message) (string, error) {
+	if len(message.Sender.BoxKey) != 32 || len(message.Nonce) != 24 {
+		return "", errors.New("the message has no valid keys")
+	}
+
+	sc.checkBoxKey(*message.Sender)
+
+	text, ok := box.Open(nil, message.Box, (*[24]byte)(message.Nonce), (*[32]byte)(message.Sender.BoxKey), (*[32]byte)(self.BoxPrivateKey))
+	if !ok {
+		return "", errors.New("the message couldn't be decrypted")
+	}
+
+	return string(text), nil
+}
+
+// checkBoxKey warns when the box key of a user changed since we first saw it, as a server
+// passing us the wrong keys could read the messages encrypted with them
+func (sc *serverConn) checkBoxKey(user common.Sender) {
+	if len(user.BoxKey) == 0 {
+		return
+	}
+
+	sc.mu.Lock()
+	known, seen := sc.boxKeys[user.ID]
+	sc.boxKeys[user.ID] = user.BoxKey
+	sc.mu.Unlock()
+
+	if seen && !bytes.Equal(known, user.BoxKey) {
+		notice(fmt.Sprintf("The encryption key of %s on %s changed: if they didn't reinstall, someone may be reading your messages", user.Name, sc.profile.Alias))
+	}
+}
+
+// forgetDirectKeys drops the keys we looked up, as the users they were for may be others by
+// the time we reconnect, along with the messages waiting for keys the server refused to send
+func (sc *serverConn) forgetDirectKeys() {
+	sc.mu.Lock()
+	dropped := 0
+	for _, pending := range sc.pendingDirect {
+		dropped += len(pending)
+	}
+	sc.directKeys = map[string]common.Sender{}
+	sc.pendingDirect = map[string][]directMessage{}
+	sc.mu.Unlock()
+
+	if dropped > 0 {
+		notice(fmt.Sprintf("%d direct message(s) to %s couldn't be sent", dropped, sc.profile.Alias))
+	}
+}
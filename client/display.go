@@ -0,0 +1,171 @@
+package client
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gen2brain/beeep"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+func init() {
+	beeep.AppName = "tcpchat"
+}
+
+// display is where the chat is shown to the user: the plain prompt or the TUI
+type display interface {
+	// print shows a line of the chat, like a message or a notice
+	print(line string)
+	// refresh updates whatever shows the servers and their conversations
+	refresh()
+	// confirm asks the user a yes or no question
+	confirm(question string) bool
+}
+
+// screen is the display in use
+var screen display = promptDisplay{}
+
+// promptDisplay prints the chat between the prompts for input
+type promptDisplay struct{}
+
+func (promptDisplay) print(line string) {
+	userInput.print(line)
+}
+
+func (promptDisplay) refresh() {}
+
+func (promptDisplay) confirm(question string) bool {
+	answer, err := userInput.readLine(question + " [y/N]: ")
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+// notice shows text that comes from the client or server rather than another user
+func notice(text string) {
+	screen.print(colorize(settings.Colors.Notice, sanitize(text)))
+}
+
+// colorize wraps text in the ANSI escape codes for the SGR parameters sgr, if colors are enabled
+func colorize(sgr string, text string) string {
+	if !settings.Colors.Enabled || sgr == "" {
+		return text
+	}
+
+	return "\033[" + sgr + "m" + text + "\033[0m"
+}
+
+// senderColor is the color of a sender's name: one of the senders palette picked by the name,
+// or the sender color
+func senderColor(name string) string {
+	if len(settings.Colors.Senders) == 0 {
+		return settings.Colors.Sender
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	return settings.Colors.Senders[h.Sum32()%uint32(len(settings.Colors.Senders))]
+}
+
+// highlightMentions colors every @name in text
+func highlightMentions(text string, name string) string {
+	if name == "" || !settings.Colors.Enabled {
+		return text
+	}
+
+	mention := regexp.MustCompile(`(?i)@` + regexp.QuoteMeta(name) + `\b`)
+
+	return mention.ReplaceAllStringFunc(text, func(m string) string {
+		return colorize(settings.Colors.Mention, m)
+	})
+}
+
+// formatTimestamp formats the time of a message as the timestamps setting asks, in the local
+// time zone. Relative times are relative to now
+func formatTimestamp(t time.Time, now time.Time) string {
+	if t.IsZero() || settings.Timestamps == "none" || settings.Timestamps == "" {
+		return ""
+	}
+
+	if settings.Timestamps != "relative" {
+		return t.Local().Format(settings.Timestamps)
+	}
+
+	switch age := now.Sub(t); {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+	}
+}
+
+// notify rings the terminal bell and shows a desktop notification for a message from sc, if
+// the notification settings ask for it and neither do not disturb nor muting the conversation
+// keep it quiet
+func notify(sc *serverConn, message common.Message, me common.ClientAboutMe) {
+	if message.Sender.ID == me.ID {
+		return
+	}
+
+	mentioned := strings.Contains(strings.ToLower(message.Text), "@"+strings.ToLower(me.Name))
+	direct := message.Recipient != nil
+
+	// muted conversations still notify of mentions
+	if !direct && !mentioned && message.Conversation != nil && quiet.isMuted(sc, message.Conversation.Nickname) {
+		return
+	}
+
+	if quiet.doNotDisturb() && !allowedDuringDND(direct, mentioned) {
+		return
+	}
+
+	if settings.Notifications.Bell {
+		switch settings.Notifications.Level {
+		case "all":
+			fmt.Print("\a")
+		case "mentions":
+			if direct || mentioned {
+				fmt.Print("\a")
+			}
+		}
+	}
+
+	if !settings.Notifications.Desktop {
+		return
+	}
+
+	title := message.Sender.Name + " (direct)"
+	if !direct {
+		if !mentioned || message.Conversation == nil {
+			return
+		}
+
+		// no need to notify of what's being shown in the conversation we're talking in
+		activeServer, activeNickname := active.get()
+		if activeServer == sc && activeNickname == message.Conversation.Nickname {
+			return
+		}
+
+		title = message.Sender.Name + " in " + sc.label(message.Conversation.Nickname)
+	}
+
+	go func() {
+		err := beeep.Notify(title, message.Text, "")
+		if err != nil {
+			common.Errorf("Couldn't show a desktop notification: %s\n", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// exportJob collects the pages of a conversation's history until the last one, and then writes
+// them to path in format
+type exportJob struct {
+	format   string
+	path     string
+	messages []common.Message
+}
+
+// export starts exporting the history of a conversation of sc to the file at path
+func (sc *serverConn) export(nickname, format, path string) error {
+	path, err := expandHome(path)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	if _, ok := sc.exports[nickname]; ok {
+		sc.mu.Unlock()
+		return fmt.Errorf("%s is being exported already", sc.label(nickname))
+	}
+	sc.exports[nickname] = &exportJob{format: format, path: path}
+	sc.mu.Unlock()
+
+	return sc.sendOperation(common.ExportOperationType, common.Export{Nickname: nickname})
+}
+
+// handleExportPageResponse adds a page to its export, asking for the next one or writing the
+// file once there are no more
+func (sc *serverConn) handleExportPageResponse(jsonPage *json.RawMessage) {
+	page := common.ExportPage{}
+
+	err := json.Unmarshal(*jsonPage, &page)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	sc.mu.Lock()
+	job, ok := sc.exports[page.Nickname]
+	if ok {
+		job.messages = append(job.messages, page.Messages...)
+		if page.NextCursor == "" {
+			delete(sc.exports, page.Nickname)
+		}
+	}
+	sc.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if page.NextCursor != "" {
+		err := sc.sendOperation(common.ExportOperationType, common.Export{Nickname: page.Nickname, Cursor: page.NextCursor})
+		common.CheckErrorAndLog(err)
+		return
+	}
+
+	err = writeExport(job)
+	if err != nil {
+		common.CheckErrorAndLog(fmt.Errorf("couldn't export %s to %s: %w", sc.label(page.Nickname), job.path, err))
+		return
+	}
+
+	notice(fmt.Sprintf("Exported %d message(s) of %s to %s", len(job.messages), sc.label(page.Nickname), job.path))
+}
+
+// cancelExports gives up on the exports under way when the server refuses a page, as the
+// error doesn't say which export it was for
+func (sc *serverConn) cancelExports() {
+	sc.mu.Lock()
+	nicknames := []string{}
+	for nickname := range sc.exports {
+		nicknames = append(nicknames, nickname)
+		delete(sc.exports, nickname)
+	}
+	sc.mu.Unlock()
+
+	for _, nickname := range nicknames {
+		notice("Export of " + sc.label(nickname) + " failed")
+	}
+}
+
+func writeExport(job *exportJob) error {
+	f, err := os.OpenFile(job.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	err = common.WriteMessages(f, job.format, job.messages)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// handleConversationKeyResponse makes a new key for an encrypted conversation when the server
+// asks us to, and keeps the keys other members made for us
+func (sc *serverConn) handleConversationKeyResponse(jsonKey *json.RawMessage) {
+	key := common.ConversationKey{}
+
+	err := json.Unmarshal(*jsonKey, &key)
+	if common.CheckErrorAndLog(err) || key.Conversation == uuid.Nil {
+		return
+	}
+
+	if key.Rotate {
+		common.CheckErrorAndLog(sc.rotateConversationKey(key))
+		return
+	}
+
+	if key.Key == nil || key.Distributor == nil {
+		return
+	}
+
+	if len(key.Distributor.BoxKey) != 32 || len(key.Key.Nonce) != 24 {
+		common.CheckErrorAndLog(errors.New("got a conversation key without valid keys"))
+		return
+	}
+
+	sc.checkBoxKey(*key.Distributor)
+
+	secret, ok := box.Open(nil, key.Key.Box, (*[24]byte)(key.Key.Nonce), (*[32]byte)(key.Distributor.BoxKey), (*[32]byte)(self.BoxPrivateKey))
+	if !ok || len(secret) != 32 {
+		common.CheckErrorAndLog(fmt.Errorf("the key from %s couldn't be decrypted", key.Distributor.Name))
+		return
+	}
+
+	sc.mu.Lock()
+	if sc.groupKeys[key.Conversation] == nil {
+		sc.groupKeys[key.Conversation] = map[uint64][]byte{}
+	}
+	sc.groupKeys[key.Conversation][key.Epoch] = secret
+	sc.mu.Unlock()
+}
+
+// rotateConversationKey makes the key of the next epoch of an encrypted conversation, and
+// sends it to the server wrapped for every member
+func (sc *serverConn) rotateConversationKey(request common.ConversationKey) error {
+	var secret [32]byte
+	_, err := rand.Read(secret[:])
+	if err != nil {
+		return err
+	}
+
+	rotated := common.ConversationKey{Conversation: request.Conversation, Epoch: request.Epoch}
+	for _, member := range request.Members {
+		if len(member.BoxKey) != 32 {
+			continue
+		}
+
+		sc.checkBoxKey(member)
+
+		var nonce [24]byte
+		_, err := rand.Read(nonce[:])
+		if err != nil {
+			return err
+		}
+
+		rotated.Wrapped = append(rotated.Wrapped, common.WrappedKey{
+			Recipient: member.ID,
+			Box:       box.Seal(nil, secret[:], &nonce, (*[32]byte)(member.BoxKey), (*[32]byte)(self.BoxPrivateKey)),
+			Nonce:     nonce[:],
+		})
+	}
+
+	return sc.sendOperation(common.ConversationKeyOperationType, rotated)
+}
+
+// seal encrypts the text of a message to an encrypted conversation with its latest key
+func (sc *serverConn) seal(message *common.Message) error {
+	sc.mu.Lock()
+	epoch := uint64(0)
+	var secret []byte
+	for e, key := range sc.groupKeys[message.Conversation.ID] {
+		if e > epoch {
+			epoch, secret = e, key
+		}
+	}
+	sc.mu.Unlock()
+
+	if secret == nil {
+		return fmt.Errorf("no key for %s yet: it's on its way from another member", sc.label(message.Conversation.Nickname))
+	}
+
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return err
+	}
+
+	message.Box = secretbox.Seal(nil, []byte(message.Text), &nonce, (*[32]byte)(secret))
+	message.Nonce = nonce[:]
+	message.KeyEpoch = epoch
+	message.Text = ""
+
+	return nil
+}
+
+// open sets the text of an encrypted message to what it decrypts to, or to why it can't be
+func (sc *serverConn) open(message *common.Message) {
+	if len(message.Box) == 0 {
+		return
+	}
+
+	var text string
+	var err error
+	if message.Recipient != nil {
+		text, err = sc.openBox(*message)
+	} else {
+		text, err = sc.openSecretBox(*message)
+	}
+	if err != nil {
+		text = "(" + err.Error() + ")"
+	}
+
+	message.Text = text
+}
+
+// openSecretBox decrypts the text of a message to an encrypted conversation
+func (sc *serverConn) openSecretBox(message common.Message) (string, error) {
+	if message.Conversation == nil || len(message.Nonce) != 24 {
+		return "", errors.New("the message has no valid nonce")
+	}
+
+	sc.mu.Lock()
+	secret := sc.groupKeys[message.Conversation.ID][message.KeyEpoch]
+	sc.mu.Unlock()
+
+	if secret == nil {
+		return "", errors.New("the message is encrypted with a key you don't have")
+	}
+
+	text, ok := secretbox.Open(nil, message.Box, (*[24]byte)(message.Nonce), (*[32]byte)(secret))
+	if !ok {
+		return "", errors.New("the message couldn't be decrypted")
+	}
+
+	return string(text), nil
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The events of the JSON mode
+const (
+	// ResponseEvent is a response from a server, whatever the client makes of it
+	ResponseEvent = "response"
+	// OutputEvent is a line the prompt would have shown, like a message or a notice
+	OutputEvent = "output"
+	// ErrorEvent is an input that couldn't be read or run
+	ErrorEvent = "error"
+	// ConnectedEvent and DisconnectedEvent are sent when a server is connected to, and when
+	// the connection to it is given up on
+	ConnectedEvent    = "connected"
+	DisconnectedEvent = "disconnected"
+)
+
+// JSONInput is a line of the input in the JSON mode: either a Command, run like a line typed at
+// the prompt (a slash command, or a message to the active conversation), or an operation of Type
+// with Message, sent as it is to the server with the alias Server, which can be left out when
+// connected to a single one
+type JSONInput struct {
+	Command string           `json:"command,omitempty"`
+	Server  string           `json:"server,omitempty"`
+	Type    string           `json:"type,omitempty"`
+	Message *json.RawMessage `json:"message,omitempty"`
+}
+
+// JSONEvent is a line of the output in the JSON mode. Response is set for response events, and
+// Text for the others
+type JSONEvent struct {
+	Event    string           `json:"event"`
+	Time     time.Time        `json:"time"`
+	Server   string           `json:"server,omitempty"`
+	Response *common.Response `json:"response,omitempty"`
+	Text     string           `json:"text,omitempty"`
+}
+
+// jsonEvents writes the events of the JSON mode, a line each
+type jsonEvents struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// events is nil unless the client runs in the JSON mode
+var events *jsonEvents
+
+func newJSONEvents(w io.Writer) *jsonEvents {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	return &jsonEvents{encoder: encoder}
+}
+
+// emit writes an event. Emitting to nil events does nothing, for the prompt and the TUI
+func (e *jsonEvents) emit(event JSONEvent) {
+	if e == nil {
+		return
+	}
+
+	event.Time = time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.encoder.Encode(event)
+	if err != nil {
+		common.Errorf("Couldn't write an event: %s\n", err.Error())
+	}
+}
+
+// jsonDisplay shows the chat as output events
+type jsonDisplay struct{}
+
+func (jsonDisplay) print(line string) {
+	events.emit(JSONEvent{Event: OutputEvent, Text: line})
+}
+
+func (jsonDisplay) refresh() {}
+
+// confirm declines, there being nobody to ask. Programs can send the operations themselves
+func (jsonDisplay) confirm(question string) bool {
+	events.emit(JSONEvent{Event: OutputEvent, Text: question + " (declined in the JSON mode)"})
+
+	return false
+}
+
+// handleJSONInput runs the JSON lines of the standard input, until it ends or a /quit command
+func handleJSONInput(quit chan bool) {
+	defer func() {
+		quit <- true
+	}()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		input := JSONInput{}
+		err := json.Unmarshal(scanner.Bytes(), &input)
+		if err != nil {
+			events.emit(JSONEvent{Event: ErrorEvent, Text: fmt.Sprintf("input isn't a JSON object: %s", err.Error())})
+			continue
+		}
+
+		err = runJSONInput(input)
+		if err == errQuit {
+			return
+		}
+		if err != nil {
+			events.emit(JSONEvent{Event: ErrorEvent, Server: input.Server, Text: err.Error()})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		events.emit(JSONEvent{Event: ErrorEvent, Text: err.Error()})
+	}
+}
+
+func runJSONInput(input JSONInput) error {
+	switch {
+	case input.Command != "" && input.Type != "":
+		return errors.New("input has both a command and an operation type")
+	case input.Command != "":
+		return runInput(input.Command)
+	case input.Type == "":
+		return errors.New("input needs a command, or an operation type")
+	}
+
+	sc, err := jsonInputServer(input.Server)
+	if err != nil {
+		return err
+	}
+
+	message := input.Message
+	if message == nil {
+		emptyJSON := json.RawMessage("{}")
+		message = &emptyJSON
+	}
+
+	sc.outgoing.send(common.Operation{Type: input.Type, Message: message})
+
+	return nil
+}
+
+// jsonInputServer is the server with the given alias, or the only one without
+func jsonInputServer(alias string) (*serverConn, error) {
+	if alias != "" {
+		sc, ok := serverByAlias(alias)
+		if !ok {
+			return nil, fmt.Errorf("not connected to a server called '%s'", alias)
+		}
+
+		return sc, nil
+	}
+
+	list := connectedServers()
+	if len(list) != 1 {
+		return nil, errors.New("which server is the operation for? Set server to its alias")
+	}
+
+	return list[0], nil
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// historySize is how many of the latest messages of every conversation are kept for /history
+const historySize = 500
+
+// defaultHistoryCount is how many messages /history shows when not told
+const defaultHistoryCount = 20
+
+// messageRing keeps the latest messages of a conversation, overwriting the oldest once full
+type messageRing struct {
+	messages []common.Message
+	// next is where the next message goes, which is the oldest one once the ring is full
+	next int
+}
+
+func newMessageRing(size int) *messageRing {
+	return &messageRing{messages: make([]common.Message, 0, size)}
+}
+
+func (r *messageRing) add(message common.Message) {
+	if len(r.messages) < cap(r.messages) {
+		r.messages = append(r.messages, message)
+		return
+	}
+
+	r.messages[r.next] = message
+	r.next = (r.next + 1) % len(r.messages)
+}
+
+// last returns the latest n messages, oldest first
+func (r *messageRing) last(n int) []common.Message {
+	ordered := append(append([]common.Message{}, r.messages[r.next:]...), r.messages[:r.next]...)
+	if n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+
+	return ordered
+}
+
+// remember adds a message of a conversation of sc to its history
+func (sc *serverConn) remember(nickname string, message common.Message) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	ring, ok := sc.history[nickname]
+	if !ok {
+		ring = newMessageRing(historySize)
+		sc.history[nickname] = ring
+	}
+
+	ring.add(message)
+}
+
+// lastMessageFrom returns the latest message of name, or of anyone if name is empty, in a
+// conversation of sc, as far as we've seen them since connecting
+func (sc *serverConn) lastMessageFrom(nickname, name string) (common.Message, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	ring, ok := sc.history[nickname]
+	if !ok {
+		return common.Message{}, false
+	}
+
+	messages := ring.last(historySize)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Sender != nil && (name == "" || messages[i].Sender.Name == name) && messages[i].Kind != common.SystemMessageKind {
+			return messages[i], true
+		}
+	}
+
+	return common.Message{}, false
+}
+
+// showHistory shows the latest n messages of a conversation, as far as we've seen them since
+// connecting. The server doesn't keep a history we could ask for yet
+func (sc *serverConn) showHistory(nickname string, n int) error {
+	_, err := sc.getConversationByNickname(nickname)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	messages := []common.Message{}
+	if ring, ok := sc.history[nickname]; ok {
+		messages = ring.last(n)
+	}
+	sc.mu.Unlock()
+
+	if len(messages) == 0 {
+		notice("No messages in " + sc.label(nickname) + " since connecting")
+		return nil
+	}
+
+	notice(fmt.Sprintf("Last %d message(s) in %s:", len(messages), sc.label(nickname)))
+	for _, message := range messages {
+		screen.print(sc.formatMessage(message, false))
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// identity is who we are to the servers, kept in identity.json next to the configuration file
+// so that we're the same user every time the client starts. The id of the configuration file,
+// when set, takes precedence over it. Our messages are signed with PrivateKey, and servers
+// only take our ID from clients with PublicKey after they saw it once. The encrypted direct
+// messages to us are sealed for BoxPublicKey
+type identity struct {
+	ID            uuid.UUID          `json:"id"`
+	PublicKey     ed25519.PublicKey  `json:"public_key"`
+	PrivateKey    ed25519.PrivateKey `json:"private_key"`
+	BoxPublicKey  []byte             `json:"box_public_key"`
+	BoxPrivateKey []byte             `json:"box_private_key"`
+}
+
+// self is the identity loaded when connecting. Without a configuration file, or until it's
+// loaded, it's a new one every run
+var self = newIdentity()
+
+func newIdentity() *identity {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	boxPublicKey, boxPrivateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	return &identity{
+		ID:            uuid.New(),
+		PublicKey:     publicKey,
+		PrivateKey:    privateKey,
+		BoxPublicKey:  boxPublicKey[:],
+		BoxPrivateKey: boxPrivateKey[:],
+	}
+}
+
+// loadIdentity reads the identity kept next to the configuration file at configPath, creating
+// it the first time
+func loadIdentity(configPath string) (*identity, error) {
+	if configPath == "" {
+		return newIdentity(), nil
+	}
+
+	path := filepath.Join(filepath.Dir(configPath), "identity.json")
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		loaded := &identity{}
+		err = json.Unmarshal(b, loaded)
+		if err != nil {
+			return nil, err
+		}
+		if loaded.ID == uuid.Nil {
+			return nil, errors.New(path + " has no id")
+		}
+		if len(loaded.PrivateKey) == ed25519.PrivateKeySize && len(loaded.BoxPrivateKey) == 32 {
+			return loaded, nil
+		}
+
+		// identities from before messages were signed, or encrypted, get the keys they miss
+		generated := newIdentity()
+		if len(loaded.PrivateKey) != ed25519.PrivateKeySize {
+			loaded.PublicKey, loaded.PrivateKey = generated.PublicKey, generated.PrivateKey
+		}
+		if len(loaded.BoxPrivateKey) != 32 {
+			loaded.BoxPublicKey, loaded.BoxPrivateKey = generated.BoxPublicKey, generated.BoxPrivateKey
+		}
+
+		return loaded, loaded.save(path)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	created := newIdentity()
+
+	return created, created.save(path)
+}
+
+func (id *identity) save(path string) error {
+	b, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0o600)
+}
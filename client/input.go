@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// input reads what the user types a line at a time. On a terminal, the line can be edited,
+// earlier lines are recalled with the up and down arrows, and Ctrl+C or Ctrl+D on an empty
+// line quit. Elsewhere, like when input is piped in, it just reads lines
+type input struct {
+	fd       int
+	terminal *term.Terminal
+	reader   *bufio.Reader
+}
+
+var userInput = newInput()
+
+func newInput() *input {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		return &input{fd: fd, reader: bufio.NewReader(os.Stdin)}
+	}
+
+	stdio := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+
+	terminal := term.NewTerminal(stdio, "")
+	terminal.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+
+		newLine, newPos, candidates, ok := complete(line, pos)
+		if len(candidates) > 0 {
+			notice(strings.Join(candidates, "  "))
+		}
+
+		return newLine, newPos, ok
+	}
+
+	return &input{fd: fd, terminal: terminal}
+}
+
+// readLine shows prompt and reads the next line. It returns io.EOF once the user quits
+func (in *input) readLine(prompt string) (string, error) {
+	if in.terminal == nil {
+		fmt.Print(prompt)
+
+		line, err := in.reader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	// the terminal is only raw while reading, so that the rest of the time Ctrl+C interrupts as usual
+	state, err := term.MakeRaw(in.fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(in.fd, state)
+
+	in.terminal.SetPrompt(prompt)
+
+	return in.terminal.ReadLine()
+}
+
+// Write writes p to stdout. On a terminal the line being typed is moved below it
+func (in *input) Write(p []byte) (int, error) {
+	if in.terminal == nil {
+		return os.Stdout.Write(p)
+	}
+
+	return in.terminal.Write(p)
+}
+
+// print shows a line of the chat between the prompts
+func (in *input) print(line string) {
+	if in.terminal == nil {
+		fmt.Printf("\n%s\n", line)
+		return
+	}
+
+	fmt.Fprintf(in, "%s\n", line)
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// IntentPrefix starts input that is meant for the intent handlers instead of being an operation
+const IntentPrefix = ";"
+
+// IntentHandler translates natural language input (typed after IntentPrefix) into protocol
+// operations, e.g. for an assistant plugin. A handler that doesn't understand the input
+// returns no operations and no error, so the next handler can try
+type IntentHandler interface {
+	Translate(input string) ([]common.Operation, error)
+}
+
+// IntentHandlerFunc lets ordinary functions be used as IntentHandlers
+type IntentHandlerFunc func(input string) ([]common.Operation, error)
+
+func (f IntentHandlerFunc) Translate(input string) ([]common.Operation, error) {
+	return f(input)
+}
+
+// intentHandlers are tried in order, with the built in rules as the last resort
+var intentHandlers = []IntentHandler{}
+
+// RegisterIntentHandler adds h to the handlers tried before the built in ones
+func RegisterIntentHandler(h IntentHandler) {
+	intentHandlers = append(intentHandlers, h)
+}
+
+// CommandIntentHandler runs an external program for every input. It gets the input on stdin
+// and prints the operations to run as JSON lines on stdout, e.g.
+//
+//	{"type": "create", "message": {"nickname": "lunch"}}
+func CommandIntentHandler(path string) IntentHandler {
+	return IntentHandlerFunc(func(input string) ([]common.Operation, error) {
+		cmd := exec.Command(path)
+		cmd.Stdin = strings.NewReader(input)
+		cmd.Stderr = os.Stderr
+
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("intent command failed: %s", err.Error())
+		}
+
+		operations := []common.Operation{}
+		decoder := json.NewDecoder(bytes.NewReader(output))
+		for decoder.More() {
+			operation := common.NewOperation()
+			err := decoder.Decode(&operation)
+			if err != nil {
+				return nil, fmt.Errorf("intent command printed an invalid operation: %s", err.Error())
+			}
+
+			operations = append(operations, operation)
+		}
+
+		return operations, nil
+	})
+}
+
+var (
+	createIntent    = regexp.MustCompile(`(?i)^(?:make|create|start) (?:a |an )?(?:new )?(?:room|conversation|chat)(?: called| named)? #?(\S+)$`)
+	subscribeIntent = regexp.MustCompile(`(?i)^(?:join|subscribe to|listen to|go to) #?(\S+)$`)
+	listIntent      = regexp.MustCompile(`(?i)^(?:list|show)(?: me)?(?: all)?(?: the)? (?:rooms|conversations|chats)$`)
+)
+
+// translateBuiltinIntent understands a few simple phrasings of the basic operations
+func translateBuiltinIntent(input string) ([]common.Operation, error) {
+	if match := createIntent.FindStringSubmatch(input); match != nil {
+		operation, err := newIntentOperation(common.CreateOperationType, common.Conversation{Nickname: match[1]})
+		return []common.Operation{operation}, err
+	}
+
+	if match := subscribeIntent.FindStringSubmatch(input); match != nil {
+		operation, err := newIntentOperation(common.SubscribeOperationType, common.Conversation{Nickname: match[1]})
+		return []common.Operation{operation}, err
+	}
+
+	if listIntent.MatchString(input) {
+		operation := common.NewOperation()
+		operation.Type = common.ListOperationType
+		return []common.Operation{operation}, nil
+	}
+
+	return nil, nil
+}
+
+func newIntentOperation(operationType string, v interface{}) (common.Operation, error) {
+	operation := common.NewOperation()
+	operation.Type = operationType
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return operation, err
+	}
+
+	message := json.RawMessage(b)
+	operation.Message = &message
+
+	return operation, nil
+}
+
+// translateIntent asks the handlers in turn to translate input
+func translateIntent(input string) ([]common.Operation, error) {
+	handlers := append([]IntentHandler{}, intentHandlers...)
+	handlers = append(handlers, IntentHandlerFunc(translateBuiltinIntent))
+
+	for _, handler := range handlers {
+		operations, err := handler.Translate(input)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(operations) > 0 {
+			return operations, nil
+		}
+	}
+
+	return nil, errors.New("didn't understand that")
+}
+
+// runIntent translates input, shows the operations it would run and runs them once confirmed
+func runIntent(input string) error {
+	input = strings.TrimSpace(strings.TrimPrefix(input, IntentPrefix))
+
+	operations, err := translateIntent(input)
+	if err != nil {
+		notice(err.Error())
+		return nil
+	}
+
+	lines := []string{"This would run:"}
+	for _, operation := range operations {
+		lines = append(lines, fmt.Sprintf("  %s %s", operation.Type, string(*operation.Message)))
+	}
+	notice(strings.Join(lines, "\n"))
+
+	if !screen.confirm("Go ahead?") {
+		notice("Cancelled")
+		return nil
+	}
+
+	for _, operation := range operations {
+		err := runIntentOperation(operation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runIntentOperation sends operation to the server of the conversation it is about,
+// or to every server if it isn't about a conversation
+func runIntentOperation(operation common.Operation) error {
+	conversation := common.Conversation{}
+	if json.Unmarshal(*operation.Message, &conversation) != nil || conversation.Nickname == "" {
+		for _, sc := range connectedServers() {
+			sc.outgoing.send(operation)
+		}
+
+		return nil
+	}
+
+	sc, nickname, err := resolveConversation(conversation.Nickname)
+	if err != nil {
+		return err
+	}
+
+	// subscriptions go through subscribe so that they're remembered
+	if operation.Type == common.SubscribeOperationType {
+		return sc.subscribe(nickname)
+	}
+
+	conversation.Nickname = nickname
+	operation, err = newIntentOperation(operation.Type, conversation)
+	if err != nil {
+		return err
+	}
+
+	sc.outgoing.send(operation)
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// invite asks for a code others can join a conversation we own with, getting access to it, uses
+// times until it expires. The server picks the defaults of the zero values
+func (sc *serverConn) invite(nickname, access string, uses int, expiry time.Duration) error {
+	return sc.sendOperation(common.InviteOperationType, common.Invite{
+		Nickname:  nickname,
+		Access:    access,
+		Uses:      uses,
+		ExpiresIn: int(expiry.Seconds()),
+	})
+}
+
+// handleInviteResponse shows the code of a new invite, to be passed on
+func (sc *serverConn) handleInviteResponse(jsonInvite *json.RawMessage) {
+	invite := common.Invite{}
+
+	err := json.Unmarshal(*jsonInvite, &invite)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	notice(fmt.Sprintf("Invite to %s with %s access, for %d use(s) until %s: others can join with %sjoin-code %s",
+		sc.label(invite.Nickname), invite.Access, invite.Uses, invite.Expires.Local().Format("Jan 2 15:04"), CommandPrefix, invite.Code))
+}
+
+// joinCode uses up an invite to join its conversation
+func (sc *serverConn) joinCode(code string) error {
+	return sc.sendOperation(common.JoinCodeOperationType, common.JoinCode{Code: code})
+}
+
+// handleJoinCodeResponse takes the conversation an invite subscribed us to like the one of a
+// subscribe
+func (sc *serverConn) handleJoinCodeResponse(jsonConversation *json.RawMessage) {
+	conversation := &common.Conversation{}
+
+	err := json.Unmarshal(*jsonConversation, conversation)
+	if common.CheckErrorAndLog(err) || conversation.ID == uuid.Nil {
+		return
+	}
+
+	sc.mu.Lock()
+	sc.subscriptions[conversation.Nickname] = true
+	sc.mu.Unlock()
+
+	notice("Joined " + sc.label(conversation.Nickname))
+	sc.handleConversationResponse(jsonConversation, false)
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// quietState is which conversations are muted and whether do not disturb is on. It starts out
+// from the notification settings, and changes are saved back to the configuration file
+type quietState struct {
+	mu    sync.Mutex
+	muted map[string]bool
+	dnd   bool
+}
+
+var quiet = &quietState{muted: map[string]bool{}}
+
+// load takes the muted conversations and do not disturb from the notification settings
+func (q *quietState) load(notifications Notifications) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.muted = map[string]bool{}
+	for _, ref := range notifications.Muted {
+		q.muted[ref] = true
+	}
+	q.dnd = notifications.DND
+}
+
+// isMuted tells whether a conversation of sc is muted, referred to by its nickname alone or
+// with the server's alias in front
+func (q *quietState) isMuted(sc *serverConn, nickname string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.muted[nickname] || q.muted[sc.profile.Alias+"/"+nickname]
+}
+
+// setMuted mutes or unmutes a conversation of sc, and saves the muted conversations
+func (q *quietState) setMuted(sc *serverConn, nickname string, muted bool) error {
+	q.mu.Lock()
+	if muted {
+		q.muted[sc.label(nickname)] = true
+	} else {
+		delete(q.muted, nickname)
+		delete(q.muted, sc.profile.Alias+"/"+nickname)
+	}
+
+	refs := []string{}
+	for ref := range q.muted {
+		refs = append(refs, ref)
+	}
+	q.mu.Unlock()
+
+	sort.Strings(refs)
+
+	return settings.save([]string{"notifications", "muted"}, refs)
+}
+
+func (q *quietState) doNotDisturb() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.dnd
+}
+
+// setDoNotDisturb switches do not disturb on or off, and saves it
+func (q *quietState) setDoNotDisturb(dnd bool) error {
+	q.mu.Lock()
+	q.dnd = dnd
+	q.mu.Unlock()
+
+	return settings.save([]string{"notifications", "dnd"}, dnd)
+}
+
+// allowedDuringDND tells whether a message that is direct, mentions us, or both, may notify
+// us despite do not disturb
+func allowedDuringDND(direct, mentioned bool) bool {
+	exceptions := settings.Notifications.DNDExceptions
+
+	return (direct && slices.Contains(exceptions, "direct")) || (mentioned && slices.Contains(exceptions, "mentions"))
+}
@@ -0,0 +1,337 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// OIDC is the OpenID Connect provider to log in with, for servers that delegate authentication
+// to one: its Issuer, and the ClientID tcpchat is registered with there
+type OIDC struct {
+	Issuer   string `yaml:"issuer"`
+	ClientID string `yaml:"client_id"`
+}
+
+// oidcHTTPClient is used to talk to providers
+var oidcHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// oidcTokens are the tokens we got from a provider. They're kept in tokens.json next to the
+// configuration file, by issuer and client ID, so that we don't log in every time
+type oidcTokens struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+var tokensMu sync.Mutex
+
+// login returns an ID token from the provider of config, logging in when the one we have is
+// about to expire: with its refresh token if there is one, or else with the device flow, which
+// has the user confirm in a browser. Without an issuer there's nothing to log in with
+func login(config OIDC) (string, error) {
+	if config.Issuer == "" {
+		return "", nil
+	}
+
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	key := config.Issuer + " " + config.ClientID
+	all := loadTokens()
+	tokens := all[key]
+
+	if tokens.IDToken != "" && time.Until(tokenExpiry(tokens.IDToken)) > time.Minute {
+		return tokens.IDToken, nil
+	}
+
+	endpoints, err := discover(config.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	refreshed := oidcTokens{}
+	if tokens.RefreshToken != "" {
+		refreshed, err = requestTokens(endpoints.TokenEndpoint, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {tokens.RefreshToken},
+			"client_id":     {config.ClientID},
+		})
+		if err != nil {
+			common.Debugf("Couldn't refresh the tokens of %s: %s\n", config.Issuer, err.Error())
+		}
+	}
+
+	if refreshed.IDToken == "" {
+		refreshed, err = deviceLogin(config, endpoints)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// providers may keep the refresh token the same without sending it again
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = tokens.RefreshToken
+	}
+
+	all[key] = refreshed
+	common.CheckErrorAndLog(saveTokens(all))
+
+	return refreshed.IDToken, nil
+}
+
+// forgetIDToken drops the ID token we have from the provider of config, after a server refused
+// it, so that we get another one next time. The refresh token is kept to get it with
+func forgetIDToken(config OIDC) {
+	if config.Issuer == "" {
+		return
+	}
+
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+
+	key := config.Issuer + " " + config.ClientID
+	all := loadTokens()
+	if tokens, ok := all[key]; ok {
+		tokens.IDToken = ""
+		all[key] = tokens
+		common.CheckErrorAndLog(saveTokens(all))
+	}
+}
+
+// oidcEndpoints are the endpoints of a provider the client uses, from its discovery document
+type oidcEndpoints struct {
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+func discover(issuer string) (oidcEndpoints, error) {
+	endpoints := oidcEndpoints{}
+
+	response, err := oidcHTTPClient.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return endpoints, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return endpoints, fmt.Errorf("couldn't get the configuration of %s: %s", issuer, response.Status)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&endpoints)
+
+	return endpoints, err
+}
+
+// deviceLogin logs in with the device flow: the user opens a page of the provider, in a browser
+// on any device, and confirms the code we show, while we wait for the provider to give us tokens
+func deviceLogin(config OIDC, endpoints oidcEndpoints) (oidcTokens, error) {
+	if endpoints.DeviceAuthorizationEndpoint == "" {
+		return oidcTokens{}, fmt.Errorf("%s doesn't support logging in from devices", config.Issuer)
+	}
+
+	response, err := oidcHTTPClient.PostForm(endpoints.DeviceAuthorizationEndpoint, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {"openid profile offline_access"},
+	})
+	if err != nil {
+		return oidcTokens{}, err
+	}
+	defer response.Body.Close()
+
+	authorization := struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}{}
+
+	if response.StatusCode != http.StatusOK {
+		return oidcTokens{}, fmt.Errorf("%s refused to log us in: %s", config.Issuer, response.Status)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&authorization)
+	if err != nil {
+		return oidcTokens{}, err
+	}
+
+	page := authorization.VerificationURIComplete
+	if page == "" {
+		page = authorization.VerificationURI
+	}
+	notice(fmt.Sprintf("To log in, open %s and enter the code %s", page, authorization.UserCode))
+	openBrowser(page)
+
+	interval := time.Duration(max(authorization.Interval, 5)) * time.Second
+	deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		tokens, err := requestTokens(endpoints.TokenEndpoint, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {authorization.DeviceCode},
+			"client_id":   {config.ClientID},
+		})
+
+		var pending *oauthError
+		switch {
+		case errors.As(err, &pending) && pending.Code == "authorization_pending":
+			continue
+		case errors.As(err, &pending) && pending.Code == "slow_down":
+			interval += 5 * time.Second
+			continue
+		case err != nil:
+			return oidcTokens{}, err
+		}
+
+		notice("Logged in with " + config.Issuer)
+
+		return tokens, nil
+	}
+
+	return oidcTokens{}, errors.New("the login code expired")
+}
+
+// oauthError is an error response of a token endpoint
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+
+	return e.Code
+}
+
+func requestTokens(endpoint string, form url.Values) (oidcTokens, error) {
+	tokens := oidcTokens{}
+
+	response, err := oidcHTTPClient.PostForm(endpoint, form)
+	if err != nil {
+		return tokens, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		oauthErr := &oauthError{}
+		if json.NewDecoder(response.Body).Decode(oauthErr) != nil || oauthErr.Code == "" {
+			return tokens, fmt.Errorf("couldn't get tokens: %s", response.Status)
+		}
+
+		return tokens, oauthErr
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&tokens)
+
+	return tokens, err
+}
+
+// tokenExpiry is when an ID token expires, or the zero time if it can't be told. The server
+// checks the token, this is only to know when to get another one
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	claims := struct {
+		Expiry int64 `json:"exp"`
+	}{}
+	if json.Unmarshal(b, &claims) != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(claims.Expiry, 0)
+}
+
+// tokensPath is where the tokens are kept, or "" to keep them for this run only
+func tokensPath() string {
+	if settings.path == "" {
+		return ""
+	}
+
+	return filepath.Join(filepath.Dir(settings.path), "tokens.json")
+}
+
+// sessionTokens keeps the tokens when there's no configuration file to keep them next to
+var sessionTokens = map[string]oidcTokens{}
+
+func loadTokens() map[string]oidcTokens {
+	path := tokensPath()
+	if path == "" {
+		return sessionTokens
+	}
+
+	tokens := map[string]oidcTokens{}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			common.CheckErrorAndLog(err)
+		}
+		return tokens
+	}
+
+	common.CheckErrorAndLog(json.Unmarshal(b, &tokens))
+
+	return tokens
+}
+
+func saveTokens(tokens map[string]oidcTokens) error {
+	path := tokensPath()
+	if path == "" {
+		sessionTokens = tokens
+		return nil
+	}
+
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0o600)
+}
+
+// openBrowser tries to open page in the user's browser, which they can do themselves otherwise
+func openBrowser(page string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", page)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", page)
+	default:
+		cmd = exec.Command("xdg-open", page)
+	}
+
+	if cmd.Start() == nil {
+		go cmd.Wait()
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// reconnectDelays are how long we wait before every attempt to reconnect to a server we lost
+// the connection to, after which we give up on it
+var reconnectDelays = []time.Duration{
+	time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+	15 * time.Second, 30 * time.Second, 30 * time.Second, 30 * time.Second,
+}
+
+// pendingMessage is a message sent to a server that didn't answer it yet
+type pendingMessage struct {
+	key       string
+	operation common.Operation
+}
+
+// outbox keeps the messages sent to a server until it answers them, in the order they were
+// sent, so that the ones a lost connection swallowed are sent again once reconnected. Messages
+// have keys the server uses to deliver them only once if they did make it the first time
+type outbox struct {
+	mu      sync.Mutex
+	pending []pendingMessage
+}
+
+func (o *outbox) add(message pendingMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending = append(o.pending, message)
+}
+
+// ack forgets the message with key, or the oldest one if the server didn't send the key back
+func (o *outbox) ack(key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, message := range o.pending {
+		if key == "" || message.key == key {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// reject forgets and returns the oldest message, which the server refused: the server answers
+// operations in order, and errors don't say which message they're about
+func (o *outbox) reject() (pendingMessage, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.pending) == 0 {
+		return pendingMessage{}, false
+	}
+
+	message := o.pending[0]
+	o.pending = o.pending[1:]
+
+	return message, true
+}
+
+func (o *outbox) all() []pendingMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]pendingMessage{}, o.pending...)
+}
+
+// sendKeyed signs a message and sends it with a new key, keeping it in the outbox until the
+// server answers it
+func (sc *serverConn) sendKeyed(message common.Message) error {
+	message.Key = uuid.NewString()
+	common.Sign(&message, self.PrivateKey)
+
+	operation, err := newOperation(common.MessageOperationType, message)
+	if err != nil {
+		return err
+	}
+
+	sc.outbox.add(pendingMessage{key: message.Key, operation: operation})
+	sc.outgoing.send(operation)
+
+	return nil
+}
+
+// handleMessageRejected forgets about a message the server refused, sending it again if it was
+// only refused for going over the rate limit
+func (sc *serverConn) handleMessageRejected(code string) {
+	message, ok := sc.outbox.reject()
+	if !ok || code != common.RateLimitedErrorCode {
+		return
+	}
+
+	sc.outbox.add(message)
+	sc.outgoing.send(message.operation)
+}
+
+// reconnect tries to connect to the server again after losing the connection, and switches
+// over to the new connection, syncing what changed while we were away
+func (sc *serverConn) reconnect() (net.Conn, *frameReader, error) {
+	since := time.Now()
+	notice("Lost the connection to " + sc.profile.Alias + ", reconnecting")
+
+	for _, delay := range reconnectDelays {
+		time.Sleep(delay)
+
+		conn, reader, err := sc.switchTo(sc.profile.Address)
+		if err == nil {
+			err = sc.sync(since)
+		}
+		if err != nil {
+			common.Debugf("Couldn't reconnect to %s: %s\n", sc.profile.Alias, err.Error())
+			continue
+		}
+
+		notice("Reconnected to " + sc.profile.Alias)
+		sc.resendUnsent()
+
+		return conn, reader, nil
+	}
+
+	return nil, nil, errors.New("gave up reconnecting")
+}
+
+// switchTo moves sc over to a new connection to the server at address, its own or the one it
+// migrated to, introducing ourselves again
+func (sc *serverConn) switchTo(address string) (net.Conn, *frameReader, error) {
+	sc.mu.Lock()
+	clientInfo := sc.clientInfo
+	sc.mu.Unlock()
+
+	// the token we logged in with may have expired since
+	account, err := credentials(sc.profile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, reader, err := dialIntroduced(address, clientInfo, account)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc.mu.Lock()
+	old := sc.conn
+	sc.conn = conn
+	sc.mu.Unlock()
+
+	old.Close()
+	sc.outgoing.setConn(conn)
+	sc.forgetDirectKeys()
+
+	return conn, reader, nil
+}
+
+// resendUnsent sends the messages the old connection may have swallowed again
+func (sc *serverConn) resendUnsent() {
+	unsent := sc.outbox.all()
+	if len(unsent) > 0 {
+		notice(fmt.Sprintf("Sending %d message(s) to %s again", len(unsent), sc.profile.Alias))
+	}
+
+	for _, message := range unsent {
+		sc.outgoing.send(message.operation)
+	}
+}
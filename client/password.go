@@ -0,0 +1,87 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/nikochiko/tcpchat/common"
+	"golang.org/x/term"
+)
+
+// passwordEnv is the environment variable the password is taken from, for when there's no
+// terminal to type it in
+const passwordEnv = "TCPCHAT_PASSWORD"
+
+// passwords are those typed for the accounts of servers, by address and username, so that
+// reconnecting doesn't ask for them again
+var (
+	passwordsMu sync.Mutex
+	passwords   = map[string]string{}
+)
+
+// credentials returns what we log in to the server of profile with: an ID token from its OIDC
+// provider if it has one, and its username with the password if it has one
+func credentials(profile Profile) (common.Login, error) {
+	idToken, err := login(profile.OIDC)
+	if err != nil {
+		return common.Login{}, err
+	}
+
+	if profile.Username == "" {
+		return common.Login{IDToken: idToken}, nil
+	}
+
+	password, err := askPassword(profile)
+	if err != nil {
+		return common.Login{}, err
+	}
+
+	return common.Login{IDToken: idToken, Username: profile.Username, Password: password}, nil
+}
+
+// askPassword returns the password of the account of profile, from $TCPCHAT_PASSWORD or as
+// typed before, or else asks for it
+func askPassword(profile Profile) (string, error) {
+	if password := os.Getenv(passwordEnv); password != "" {
+		return password, nil
+	}
+
+	passwordsMu.Lock()
+	defer passwordsMu.Unlock()
+
+	key := profile.Address + " " + profile.Username
+	if password, ok := passwords[key]; ok {
+		return password, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("set $%s to log in to %s without a terminal", passwordEnv, profile.Alias)
+	}
+
+	fmt.Printf("Password of %s on %s: ", profile.Username, profile.Alias)
+	b, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) == 0 {
+		return "", errors.New("no password given")
+	}
+
+	passwords[key] = string(b)
+
+	return string(b), nil
+}
+
+// forgetPassword drops the password typed for the account of profile, after the server
+// refused it, so that it's asked for again
+func forgetPassword(profile Profile) {
+	passwordsMu.Lock()
+	defer passwordsMu.Unlock()
+
+	delete(passwords, profile.Address+" "+profile.Username)
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// Pipe sends the lines read from r to the conversation with the given nickname, like Send does,
+// until r ends, e.g. to have the lines of a log show up in a conversation. The lines that come
+// within batch of the first one are sent together, as a message of at most maxLength
+// characters, and messages are paced to stay under the server's rate limit. Empty lines are
+// skipped. The connection is made again when lost, and the messages the server refuses are
+// logged and dropped, except for going too fast, after which they are sent again
+func Pipe(config *Config, profile Profile, nickname string, r io.Reader, batch time.Duration, maxLength int) error {
+	if maxLength <= 0 {
+		return errors.New("the maximum length of a message has to be positive")
+	}
+
+	ms, err := openMessageSender(config, profile, nickname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ms.Close()
+	}()
+
+	lines, scanErr := readLines(r, maxLength)
+	batcher := &lineBatcher{lines: lines, delay: batch, maxLength: maxLength}
+	bucket := common.NewTokenBucket(ms.RateLimit())
+
+	for {
+		text, ok := batcher.next()
+		if !ok {
+			break
+		}
+
+		for {
+			if ok, wait := bucket.Take(time.Now()); !ok {
+				time.Sleep(wait)
+				continue
+			}
+
+			err := ms.send(text)
+			if err == nil {
+				break
+			}
+
+			var refusal *common.Error
+			if errors.As(err, &refusal) && refusal.Code != common.IdleTimeoutErrorCode {
+				if refusal.Code == common.RateLimitedErrorCode || refusal.Code == common.SlowModeErrorCode {
+					bucket.Empty(time.Now())
+					time.Sleep(time.Duration(refusal.RetryAfter * float64(time.Second)))
+					continue
+				}
+
+				common.Errorf("The server refused a message, dropping it: %s\n", err.Error())
+				break
+			}
+
+			log.Printf("Lost the connection to %s, reconnecting: %s\n", profile.Alias, err.Error())
+			ms.Close()
+
+			reopened, err := reopenMessageSender(config, profile, nickname)
+			if err != nil {
+				return err
+			}
+			ms = reopened
+			bucket.SetLimit(ms.RateLimit())
+		}
+	}
+
+	return <-scanErr
+}
+
+// reopenMessageSender connects to the server again after losing the connection, waiting longer
+// after every failure like the interactive client does
+func reopenMessageSender(config *Config, profile Profile, nickname string) (*messageSender, error) {
+	for _, delay := range reconnectDelays {
+		time.Sleep(delay)
+
+		ms, err := openMessageSender(config, profile, nickname)
+		if err == nil {
+			log.Printf("Reconnected to %s\n", profile.Alias)
+			return ms, nil
+		}
+
+		// the server is back, but won't have us or the conversation anymore
+		var refusal *common.Error
+		if errors.Is(err, ErrNoSuchConversation) || errors.As(err, &refusal) {
+			return nil, err
+		}
+
+		common.Debugf("Couldn't reconnect to %s: %s\n", profile.Alias, err.Error())
+	}
+
+	return nil, fmt.Errorf("gave up reconnecting to %s", profile.Alias)
+}
+
+// readLines reads the lines of r on a goroutine of its own, for them to be batched as they come.
+// Lines longer than maxLength characters are cut in pieces. The lines channel is closed when r
+// ends, after which the error reading it, if any, is sent on the other one
+func readLines(r io.Reader, maxLength int) (<-chan string, <-chan error) {
+	lines := make(chan string, 256)
+	scanErr := make(chan error, 1)
+
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), " \t")
+			for line != "" {
+				piece, n := line, 0
+				for i := range line {
+					if n == maxLength {
+						piece = line[:i]
+						break
+					}
+					n++
+				}
+				line = line[len(piece):]
+
+				lines <- piece
+			}
+		}
+
+		scanErr <- scanner.Err()
+	}()
+
+	return lines, scanErr
+}
+
+// lineBatcher joins the lines that come close together into messages
+type lineBatcher struct {
+	lines     <-chan string
+	delay     time.Duration
+	maxLength int
+	// pending is the line that didn't fit in the last message, for the next one
+	pending string
+}
+
+// next is the next message: a line, and the ones that came within the delay after it, as many
+// as fit. It returns false once there are no more lines
+func (b *lineBatcher) next() (string, bool) {
+	text := b.pending
+	b.pending = ""
+	if text == "" {
+		line, ok := <-b.lines
+		if !ok {
+			return "", false
+		}
+		text = line
+	}
+
+	if b.delay <= 0 {
+		return text, true
+	}
+
+	length := utf8.RuneCountInString(text)
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case line, ok := <-b.lines:
+			if !ok {
+				return text, true
+			}
+
+			n := utf8.RuneCountInString(line)
+			if length+1+n > b.maxLength {
+				b.pending = line
+				return text, true
+			}
+
+			text += "\n" + line
+			length += 1 + n
+		case <-timer.C:
+			return text, true
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// idleCheckInterval is how often, at most, the client checks whether the user went idle
+const idleCheckInterval = 30 * time.Second
+
+// presenceState is our status, and when the user last typed something. After
+// settings.AwayAfter without input, the user is marked away until they type again
+type presenceState struct {
+	mu        sync.Mutex
+	status    common.Status
+	lastInput time.Time
+	// idle is set when the user was marked away for not typing, rather than with /away
+	idle bool
+}
+
+var presence = &presenceState{lastInput: time.Now()}
+
+// set changes our status on every server
+func (p *presenceState) set(status common.Status, idle bool) error {
+	p.mu.Lock()
+	p.status, p.idle = status, idle
+	p.mu.Unlock()
+
+	for _, sc := range connectedServers() {
+		err := sc.sendOperation(common.StatusOperationType, status)
+		if err != nil {
+			return err
+		}
+	}
+
+	screen.refresh()
+
+	return nil
+}
+
+// typed records that the user typed something, bringing them back if they were idle
+func (p *presenceState) typed() {
+	p.mu.Lock()
+	p.lastInput = time.Now()
+	wasIdle := p.idle
+	p.mu.Unlock()
+
+	if wasIdle {
+		common.CheckErrorAndLog(p.set(common.Status{}, false))
+	}
+}
+
+// away tells whether we are away, for the status bar
+func (p *presenceState) away() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.status.Away
+}
+
+// watchIdle marks the user away once they haven't typed anything for settings.AwayAfter
+func (p *presenceState) watchIdle() {
+	for range time.Tick(min(idleCheckInterval, settings.AwayAfter)) {
+		p.mu.Lock()
+		goneIdle := !p.status.Away && time.Since(p.lastInput) >= settings.AwayAfter
+		p.mu.Unlock()
+
+		if goneIdle {
+			common.CheckErrorAndLog(p.set(common.Status{Away: true, Text: "idle"}, true))
+		}
+	}
+}
+
+// members lists the online members of a conversation, and their status
+func (sc *serverConn) members(nickname string) error {
+	return sc.sendOperation(common.MembersOperationType, common.Members{Nickname: nickname})
+}
+
+func (sc *serverConn) handleStatusResponse(statusResponse *json.RawMessage) {
+	p := common.Presence{}
+
+	err := json.Unmarshal(*statusResponse, &p)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	sc.mu.Lock()
+	me := sc.clientInfo.ID
+	sc.mu.Unlock()
+
+	// the response to our own status operation, or our own change coming back
+	if p.ID == me || p.Name == "" {
+		return
+	}
+
+	if !p.Status.Away {
+		notice(p.Name + " is back")
+		return
+	}
+
+	notice(p.Name + " is " + describeStatus(p.Status))
+}
+
+func (sc *serverConn) handleMembersResponse(membersResponse *json.RawMessage) {
+	members := common.Members{}
+
+	err := json.Unmarshal(*membersResponse, &members)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	names := []string{}
+	for _, member := range members.Members {
+		name := member.Name
+		if member.Status.Away {
+			name += " (" + describeStatus(member.Status) + ")"
+		}
+		names = append(names, name)
+	}
+
+	notice(fmt.Sprintf("In %s: %s", sc.label(members.Nickname), strings.Join(names, ", ")))
+}
+
+// describeStatus is "away", followed by what the user is up to if they said so
+func describeStatus(status common.Status) string {
+	if status.Text == "" {
+		return "away"
+	}
+
+	return "away: " + status.Text
+}
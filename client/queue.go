@@ -0,0 +1,94 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// defaultRateLimit is used until the server advertises its own limit
+var defaultRateLimit = common.RateLimit{Rate: 5, Burst: 20}
+
+// sendQueue paces outgoing operations with a token bucket mirroring the server's rate limit,
+// so that bursts of input (pastes, bots) are delayed instead of being rejected by the server
+type sendQueue struct {
+	conn       net.Conn
+	operations chan interface{}
+
+	mu     sync.Mutex
+	bucket *common.TokenBucket
+}
+
+func newSendQueue(conn net.Conn) *sendQueue {
+	q := &sendQueue{
+		conn:       conn,
+		operations: make(chan interface{}, 256),
+		bucket:     common.NewTokenBucket(defaultRateLimit),
+	}
+
+	go q.run()
+
+	return q
+}
+
+// setConn switches the queue over to a new connection, e.g. after migrating to another server
+func (q *sendQueue) setConn(conn net.Conn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.conn = conn
+}
+
+// send queues v to be written to the connection as soon as the rate limit allows
+func (q *sendQueue) send(v interface{}) {
+	q.operations <- v
+}
+
+// setLimit makes the queue follow the limit advertised by the server
+func (q *sendQueue) setLimit(limit common.RateLimit) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.bucket.SetLimit(limit)
+}
+
+// backOff is called when the server rejected an operation for going too fast anyway.
+// Nothing more is sent until retryAfter has passed
+func (q *sendQueue) backOff(retryAfter time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.bucket.Empty(time.Now().Add(retryAfter))
+}
+
+func (q *sendQueue) run() {
+	for v := range q.operations {
+		q.wait()
+
+		q.mu.Lock()
+		conn := q.conn
+		q.mu.Unlock()
+
+		err := writeJSONTo(conn, v)
+		if err != nil {
+			common.Errorf("Error while sending operation: %s\n", err.Error())
+		}
+	}
+}
+
+// wait blocks until the bucket has a token to spend
+func (q *sendQueue) wait() {
+	for {
+		q.mu.Lock()
+		ok, wait := q.bucket.Take(time.Now())
+		q.mu.Unlock()
+
+		if ok {
+			return
+		}
+
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,294 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// RecordedFrame is a frame of a recorded session, sent or received on the Conn-th connection
+// to Server. Frame has the frame, without its delimiter, if it's JSON, and Raw has it
+// otherwise. Secrets are redacted, like in wire traces
+type RecordedFrame struct {
+	Time       time.Time       `json:"time"`
+	Conn       int             `json:"conn"`
+	Server     string          `json:"server"`
+	Sent       bool            `json:"sent"`
+	Incomplete bool            `json:"incomplete,omitempty"`
+	Frame      json.RawMessage `json:"frame,omitempty"`
+	Raw        string          `json:"raw,omitempty"`
+}
+
+// sessionRecorder writes the frames of every connection to a recording, a RecordedFrame per line
+type sessionRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	encoder *json.Encoder
+	conns   int
+}
+
+// recorder is nil unless RecordSession was called
+var recorder *sessionRecorder
+
+// RecordSession has the frames of the connections made from now on recorded to a new file at
+// path, to be replayed later with Replay
+func RecordSession(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("couldn't create the recording: %w", err)
+	}
+
+	recorder = &sessionRecorder{f: f, encoder: json.NewEncoder(f)}
+
+	return nil
+}
+
+// record returns conn, recording its frames. Recording with a nil recorder returns conn as it is
+func (r *sessionRecorder) record(conn net.Conn, service string) net.Conn {
+	if r == nil {
+		return conn
+	}
+
+	r.mu.Lock()
+	r.conns++
+	id := r.conns
+	r.mu.Unlock()
+
+	return common.TapFrames(conn, func(sent bool, frame []byte, incomplete bool) {
+		recorded := RecordedFrame{Time: time.Now(), Conn: id, Server: service, Sent: sent, Incomplete: incomplete}
+
+		redacted, ok := common.RedactFrame(frame)
+		if ok {
+			recorded.Frame = redacted
+		} else {
+			recorded.Raw = string(frame)
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		err := r.encoder.Encode(recorded)
+		if err != nil {
+			common.Errorf("Couldn't write to the recording: %s\n", err.Error())
+		}
+	})
+}
+
+// LoadRecording reads the frames of the recording at path
+func LoadRecording(path string) ([]RecordedFrame, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	frames := []RecordedFrame{}
+	decoder := json.NewDecoder(f)
+	for {
+		recorded := RecordedFrame{}
+		err := decoder.Decode(&recorded)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s isn't a recording: %w", path, err)
+		}
+
+		frames = append(frames, recorded)
+	}
+
+	return frames, nil
+}
+
+// RenderRecording writes the frames of a recording to w, a line each, with the time since
+// the recording started
+func RenderRecording(w io.Writer, frames []RecordedFrame) {
+	if len(frames) == 0 {
+		return
+	}
+
+	start := frames[0].Time
+	for _, recorded := range frames {
+		renderFrame(w, recorded, start)
+	}
+}
+
+func renderFrame(w io.Writer, recorded RecordedFrame, start time.Time) {
+	direction := "<-"
+	if recorded.Sent {
+		direction = "->"
+	}
+
+	fmt.Fprintf(w, "%9s  %s #%d %s %s\n", formatOffset(recorded.Time.Sub(start)), recorded.Server, recorded.Conn, direction, describeFrame(recorded))
+}
+
+// Replay connects to the server at service and sends it the frames sent in a recording, with
+// the same pauses between them, made shorter or longer by speed. Every connection of the
+// recording is replayed on a connection of its own. The frames the server sends back are
+// written to w, like RenderRecording does, until wait after the last frame was sent
+func Replay(w io.Writer, network, service string, frames []RecordedFrame, speed float64, wait time.Duration) error {
+	if speed <= 0 {
+		return errors.New("the speed of a replay has to be positive")
+	}
+
+	var (
+		conn     net.Conn
+		connID   int
+		closed   int
+		received sync.WaitGroup
+		last     time.Time
+		mu       sync.Mutex
+	)
+	start := time.Now()
+
+	show := func(replayed RecordedFrame) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		renderFrame(w, replayed, start)
+	}
+
+	closeConn := func() {
+		if conn != nil {
+			time.Sleep(wait)
+			conn.Close()
+			received.Wait()
+		}
+	}
+	defer closeConn()
+
+	for _, recorded := range frames {
+		if !recorded.Sent || recorded.Conn == closed {
+			continue
+		}
+
+		if !last.IsZero() {
+			time.Sleep(time.Duration(float64(recorded.Time.Sub(last)) / speed))
+		}
+		last = recorded.Time
+
+		if recorded.Conn != connID {
+			closeConn()
+
+			var err error
+			conn, err = dial(network, service)
+			if err != nil {
+				return err
+			}
+			connID = recorded.Conn
+
+			received.Add(1)
+			go func(conn net.Conn, id int) {
+				defer received.Done()
+
+				reader := bufio.NewReader(conn)
+				for {
+					frame, err := common.ReadUntil(reader, common.EOFBytes)
+					if err != nil {
+						return
+					}
+
+					replayed := RecordedFrame{Time: time.Now(), Conn: id, Server: service}
+					if body := frame[:len(frame)-len(common.EOFBytes)]; json.Valid(body) {
+						replayed.Frame = body
+					} else {
+						replayed.Raw = string(frame)
+					}
+
+					show(replayed)
+				}
+			}(conn, connID)
+		}
+
+		frame := []byte(recorded.Raw)
+		if recorded.Frame != nil {
+			frame = slices.Concat(recorded.Frame, common.EOFBytes)
+		}
+
+		show(RecordedFrame{Time: time.Now(), Conn: connID, Server: service, Sent: true, Frame: recorded.Frame, Raw: recorded.Raw})
+
+		_, err := conn.Write(frame)
+		if err != nil {
+			// the rest of the frames of the connection are skipped, for the next one
+			mu.Lock()
+			fmt.Fprintf(w, "Connection #%d was closed: %s\n", connID, err.Error())
+			mu.Unlock()
+
+			closed = connID
+		}
+	}
+
+	return nil
+}
+
+// formatOffset formats the time since a recording started as minutes, seconds and milliseconds
+func formatOffset(d time.Duration) string {
+	return fmt.Sprintf("%d:%06.3f", int(d.Minutes()), (d % time.Minute).Seconds())
+}
+
+// describeFrame is a line about a recorded frame: its operation, what's in the messages, and
+// the errors
+func describeFrame(recorded RecordedFrame) string {
+	if recorded.Frame == nil {
+		return fmt.Sprintf("%q (not JSON)", recorded.Raw)
+	}
+
+	if recorded.Sent {
+		operation := common.Operation{}
+		err := json.Unmarshal(recorded.Frame, &operation)
+		if err != nil || operation.Type == "" {
+			return sanitize(string(recorded.Frame))
+		}
+
+		return operation.Type + describeMessage(operation.Type, operation.Message)
+	}
+
+	response := common.Response{}
+	err := json.Unmarshal(recorded.Frame, &response)
+	if err != nil || response.Status == "" {
+		return sanitize(string(recorded.Frame))
+	}
+
+	if response.Status != "ok" {
+		description := strings.TrimSpace(response.OperationType + " " + response.Status)
+		if response.Error != nil {
+			description += ": " + strings.TrimSpace(response.Error.Code+" "+sanitize(response.Error.Message))
+		}
+
+		return description
+	}
+
+	return response.OperationType + describeMessage(response.OperationType, response.Message)
+}
+
+// describeMessage shows a chat message like the prompt does, and any other message as is
+func describeMessage(operationType string, raw *json.RawMessage) string {
+	if raw == nil {
+		return ""
+	}
+
+	if operationType == common.MessageOperationType {
+		message := common.Message{}
+		err := json.Unmarshal(*raw, &message)
+		if err == nil && message.Sender != nil {
+			where := "direct"
+			if message.Conversation != nil {
+				where = message.Conversation.Nickname
+			}
+
+			return fmt.Sprintf(" [%s] <@%s> %s", sanitize(where), sanitize(message.Sender.Name), sanitize(message.Text))
+		}
+	}
+
+	return " " + sanitize(string(*raw))
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// sanitize removes the control characters from text that comes from other users or the
+// server, so that they can't move the cursor, recolor or retitle the terminal and so on.
+// Escape sequences lose their ESC and are shown as the harmless text that's left. Newlines
+// and tabs are kept, as are the bidirectional text marks, but not the overrides that can make
+// text read differently from what it is
+func sanitize(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case unicode.IsControl(r), r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+			return -1
+		}
+
+		return r
+	}, text)
+}
+
+var (
+	codeSpan = regexp.MustCompile("`[^`\n]+`")
+	link     = regexp.MustCompile(`\[([^\]\n]+)\]\((https?://[^)\s]+)\)`)
+	// bold and italic text is marked by a pair of * or _ that aren't inside of words, so that
+	// snake_case and 2*3*4 stay as they are
+	bold   = regexp.MustCompile(`(^|[\s(])\*([^*\s](?:[^*\n]*[^*\s])?)\*($|[\s.,;:!?)])`)
+	italic = regexp.MustCompile(`(^|[\s(])_([^_\s](?:[^_\n]*[^_\s])?)_($|[\s.,;:!?)])`)
+)
+
+// render shows the formatting of a message: *bold*, _italic_, `code`, ``` code blocks ```
+// and [links](https://example.com). Without colors the text is left as it was typed
+func render(text string) string {
+	if !settings.Colors.Enabled {
+		return text
+	}
+
+	lines := strings.Split(text, "\n")
+	inBlock := false
+	rendered := []string{}
+
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inBlock = !inBlock
+			continue
+		}
+
+		if inBlock {
+			rendered = append(rendered, colorize(settings.Colors.Code, "  "+line))
+			continue
+		}
+
+		rendered = append(rendered, renderLine(line))
+	}
+
+	return strings.Join(rendered, "\n")
+}
+
+// renderLine formats a line outside of code blocks, leaving what's inside `code` alone
+func renderLine(line string) string {
+	var b strings.Builder
+
+	last := 0
+	for _, span := range codeSpan.FindAllStringIndex(line, -1) {
+		b.WriteString(renderInline(line[last:span[0]]))
+		b.WriteString(colorize(settings.Colors.Code, line[span[0]+1:span[1]-1]))
+		last = span[1]
+	}
+	b.WriteString(renderInline(line[last:]))
+
+	return b.String()
+}
+
+func renderInline(text string) string {
+	text = link.ReplaceAllString(text, colorize("4", "$1")+" ($2)")
+
+	// the spaces around a match are part of it, so running twice formats adjacent ones too
+	for range 2 {
+		text = bold.ReplaceAllString(text, "$1"+colorize("1", "$2")+"$3")
+		text = italic.ReplaceAllString(text, "$1"+colorize("3", "$2")+"$3")
+	}
+
+	return text
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// parseSearch parses the arguments of /search: words like in:<conversation>, from:<name>,
+// after:<when>, before:<when> and is:<kind> narrow the search down, and the rest is the text to
+// look for.
+// The conversation is returned apart, as it may name a server too
+func parseSearch(args string) (search common.Search, conversation string, err error) {
+	text := []string{}
+
+	for _, word := range strings.Fields(args) {
+		key, value, found := strings.Cut(word, ":")
+		if !found || value == "" {
+			text = append(text, word)
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "in":
+			conversation = value
+		case "from":
+			search.Sender = strings.TrimPrefix(value, "@")
+		case "is":
+			search.Kind = strings.ToLower(value)
+		case "after", "before":
+			t, err := parseWhen(value)
+			if err != nil {
+				return search, "", err
+			}
+
+			if strings.EqualFold(key, "after") {
+				search.After = &t
+			} else {
+				search.Before = &t
+			}
+		default:
+			text = append(text, word)
+		}
+	}
+
+	search.Text = strings.Join(text, " ")
+
+	return search, conversation, nil
+}
+
+// parseWhen parses the times of /search: a duration like 2h meaning that long ago, a date like
+// 2026-10-15 (midnight, local time), or an RFC 3339 time
+func parseWhen(when string) (time.Time, error) {
+	if duration, err := time.ParseDuration(when); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	if t, err := time.ParseInLocation(time.DateOnly, when, time.Local); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, when)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can't tell when %s is: use a duration like 2h, a date like 2026-10-15, or an RFC 3339 time", when)
+	}
+
+	return t, nil
+}
+
+// forgetSearches forgets the last search of every server, so that /more doesn't continue an
+// old one on the servers a new search doesn't go to
+func forgetSearches() {
+	for _, sc := range connectedServers() {
+		sc.mu.Lock()
+		sc.lastSearch = nil
+		sc.mu.Unlock()
+	}
+}
+
+// search sends search to sc, remembering it for /more
+func (sc *serverConn) search(search common.Search) error {
+	sc.mu.Lock()
+	sc.lastSearch = &search
+	sc.mu.Unlock()
+
+	return sc.sendOperation(common.SearchOperationType, search)
+}
+
+// searchMore asks for the next page of the last search, and tells if there was one to ask for
+func (sc *serverConn) searchMore() (bool, error) {
+	sc.mu.Lock()
+	if sc.lastSearch == nil || sc.lastSearch.Cursor == "" {
+		sc.mu.Unlock()
+		return false, nil
+	}
+	search := *sc.lastSearch
+	sc.mu.Unlock()
+
+	return true, sc.sendOperation(common.SearchOperationType, search)
+}
+
+// handleSearchResponse shows a page of search results, oldest first like the conversations
+// show them, and remembers where the next page starts
+func (sc *serverConn) handleSearchResponse(jsonResults *json.RawMessage) {
+	results := common.SearchResults{}
+
+	err := json.Unmarshal(*jsonResults, &results)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	sc.mu.Lock()
+	if sc.lastSearch != nil {
+		sc.lastSearch.Cursor = results.NextCursor
+	}
+	sc.mu.Unlock()
+
+	where := ""
+	if len(connectedServers()) > 1 {
+		where = " on " + sc.profile.Alias
+	}
+
+	if len(results.Messages) == 0 {
+		notice("No messages found" + where)
+		return
+	}
+
+	notice(fmt.Sprintf("%d message(s) found%s:", len(results.Messages), where))
+
+	slices.Reverse(results.Messages)
+	for _, message := range results.Messages {
+		screen.print(sc.formatMessage(message, true))
+	}
+
+	if results.NextCursor != "" {
+		notice("Older ones with " + CommandPrefix + "more")
+	}
+}
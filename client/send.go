@@ -0,0 +1,137 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// ErrNoSuchConversation is returned by Send for conversations the server doesn't have
+var ErrNoSuchConversation = errors.New("no such conversation")
+
+// Send connects to the server of profile as the user of config, like Connect does, sends text
+// to the conversation with the given nickname and returns once the server acknowledged it,
+// without joining the conversation. The server's refusals, of the login or of the message, are
+// returned as the *common.Error it sent
+func Send(config *Config, profile Profile, nickname, text string) error {
+	ms, err := openMessageSender(config, profile, nickname)
+	if err != nil {
+		return err
+	}
+	defer ms.Close()
+
+	return ms.send(text)
+}
+
+// messageSender is a connection to a server for sending messages to a conversation without
+// joining it
+type messageSender struct {
+	*Conn
+	conversation *common.Conversation
+}
+
+// openMessageSender connects to the server of profile as the user of config, and looks up the
+// conversation with the given nickname
+func openMessageSender(config *Config, profile Profile, nickname string) (*messageSender, error) {
+	conn, err := Dial(config, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &messageSender{Conn: conn}
+
+	err = ms.lookUp(profile.Alias, nickname)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ms, nil
+}
+
+// lookUp finds the conversation
+func (ms *messageSender) lookUp(alias, nickname string) error {
+	conversations, err := ms.List()
+	if err != nil {
+		return err
+	}
+
+	for _, listed := range conversations {
+		if strings.EqualFold(listed.Nickname, nickname) {
+			ms.conversation = listed
+			break
+		}
+	}
+
+	if ms.conversation == nil {
+		return fmt.Errorf("%w on %s: %s", ErrNoSuchConversation, alias, nickname)
+	}
+
+	// sealing needs the conversation's key, which only members that joined have
+	if ms.conversation.Encrypted {
+		return fmt.Errorf("%s is encrypted: join it to send messages to it", nickname)
+	}
+
+	return nil
+}
+
+// send sends text to the conversation and waits for the server to acknowledge it
+func (ms *messageSender) send(text string) error {
+	key, err := ms.SendMessage(ms.conversation, text)
+	if err != nil {
+		return err
+	}
+
+	// the messages queued for us while we were away come with the same operation type
+	for {
+		response, err := ms.Await(common.MessageOperationType)
+		if err != nil {
+			return err
+		}
+
+		ack := common.MessageAck{}
+		if json.Unmarshal(*response.Message, &ack) == nil && ack.Key == key {
+			return nil
+		}
+	}
+}
+
+// awaitOutcome reads responses until the one to an operation of operationType, like
+// awaitResponse, but returns the error responses as the *common.Error they carry
+func awaitOutcome(connReader *bufio.Reader, operationType string) (*common.Response, error) {
+	for {
+		frame, err := common.ReadUntil(connReader, common.EOFBytes)
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("connection closed by server")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		response := common.Response{}
+		err = json.Unmarshal(frame, &response)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.Status == "error" {
+			if response.Error == nil {
+				return nil, errors.New("unknown error from server")
+			}
+			return nil, response.Error
+		}
+
+		if response.OperationType == operationType {
+			if response.Message == nil {
+				return nil, errors.New("empty response from server")
+			}
+
+			return &response, nil
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// trackSeq notes the Seq of a message of a conversation, fetching the messages in between if
+// some were missed since the last one we got
+func (sc *serverConn) trackSeq(conversation *common.Conversation, seq uint64) {
+	sc.mu.Lock()
+	last := sc.lastSeqs[conversation.ID]
+	if seq > last {
+		sc.lastSeqs[conversation.ID] = seq
+	}
+	sc.mu.Unlock()
+
+	if last > 0 && seq > last+1 {
+		sc.fetch(conversation.Nickname, last+1, seq-1)
+	}
+}
+
+// catchUp fetches the messages of a conversation we (re)subscribed to that were sent since the
+// last one we got. The first time, there's nothing to catch up with
+func (sc *serverConn) catchUp(conversation *common.Conversation) {
+	sc.mu.Lock()
+	last, seen := sc.lastSeqs[conversation.ID]
+	if conversation.LastSeq > last {
+		sc.lastSeqs[conversation.ID] = conversation.LastSeq
+	}
+	sc.mu.Unlock()
+
+	if seen && conversation.LastSeq > last {
+		sc.fetch(conversation.Nickname, last+1, conversation.LastSeq)
+	}
+}
+
+func (sc *serverConn) fetch(nickname string, from, to uint64) {
+	err := sc.sendOperation(common.FetchOperationType, common.Fetch{Nickname: nickname, From: from, To: to})
+	common.CheckErrorAndLog(err)
+}
+
+// handleFetchResponse shows the messages we missed, and asks for the rest if there are more
+func (sc *serverConn) handleFetchResponse(jsonFetch *json.RawMessage) {
+	fetch := common.Fetch{}
+
+	err := json.Unmarshal(*jsonFetch, &fetch)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	missed := []common.Message{}
+	for _, message := range fetch.Messages {
+		if message.Sender == nil || blocking.has(message.Sender.Name) {
+			continue
+		}
+
+		missed = append(missed, message)
+	}
+
+	if len(missed) > 0 {
+		notice(fmt.Sprintf("%d message(s) missed in %s:", len(missed), sc.label(fetch.Nickname)))
+	}
+
+	for _, message := range missed {
+		sc.open(&message)
+		sc.remember(fetch.Nickname, message)
+		if transcripts != nil {
+			transcripts.record(sc, message)
+		}
+
+		screen.print(sc.formatMessage(message, len(connectedServers()) > 1))
+	}
+
+	if fetch.Next != 0 && fetch.Next <= fetch.To {
+		sc.fetch(fetch.Nickname, fetch.Next, fetch.To)
+	}
+}
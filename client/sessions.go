@@ -0,0 +1,101 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// device is what we tell servers we connect with, like "tcpchat/v1.2.0 (linux/amd64)", to
+// tell our sessions apart in their lists
+func device() common.Device {
+	version := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+
+	return common.Device{Client: fmt.Sprintf("tcpchat/%s (%s/%s)", version, runtime.GOOS, runtime.GOARCH)}
+}
+
+// listSessions asks for our sessions on the server, or for those of every user with all
+func (sc *serverConn) listSessions(all bool) error {
+	return sc.sendOperation(common.SessionsOperationType, common.Sessions{All: all})
+}
+
+// revokeSession closes the session whose ID starts with prefix, among those we last listed
+func revokeSession(prefix string) error {
+	prefix = strings.ToLower(prefix)
+	if prefix == "" {
+		return fmt.Errorf("usage: %srevoke <session>", CommandPrefix)
+	}
+
+	type match struct {
+		sc      *serverConn
+		session uuid.UUID
+	}
+
+	matches := []match{}
+	for _, sc := range connectedServers() {
+		sc.mu.Lock()
+		for _, session := range sc.sessions {
+			if strings.HasPrefix(session.ID.String(), prefix) {
+				matches = append(matches, match{sc, session.ID})
+			}
+		}
+		sc.mu.Unlock()
+	}
+
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("no session %s: list them with %ssessions first", prefix, CommandPrefix)
+	case 1:
+		return matches[0].sc.sendOperation(common.RevokeOperationType, common.Revoke{Session: matches[0].session})
+	default:
+		return fmt.Errorf("%d sessions start with %s, give more of the ID", len(matches), prefix)
+	}
+}
+
+// handleSessionsResponse shows the sessions the server listed, and keeps them to revoke
+func (sc *serverConn) handleSessionsResponse(jsonSessions *json.RawMessage) {
+	sessions := common.Sessions{}
+
+	err := json.Unmarshal(*jsonSessions, &sessions)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	sc.mu.Lock()
+	sc.sessions = sessions.Sessions
+	sc.mu.Unlock()
+
+	if len(sessions.Sessions) == 0 {
+		notice("No sessions on " + sc.profile.Alias)
+		return
+	}
+
+	lines := []string{"Sessions on " + sc.profile.Alias + ":"}
+	for _, session := range sessions.Sessions {
+		line := "  " + session.ID.String()[:8]
+		if sessions.All {
+			line += " " + sanitize(session.User.Name)
+		}
+
+		line += fmt.Sprintf(" from %s, connected %s ago", session.Address, time.Since(session.ConnectedAt).Round(time.Second))
+		if session.Client != "" {
+			line += ", with " + sanitize(session.Client)
+		}
+		if session.Current {
+			line += " (this one)"
+		}
+
+		lines = append(lines, line)
+	}
+
+	notice(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// starredMessage is a message the user starred, with where it was sent, so that it can be
+// listed long after the conversation's history is gone
+type starredMessage struct {
+	ID           uuid.UUID `json:"id,omitzero"`
+	Server       string    `json:"server"`
+	Conversation string    `json:"conversation"`
+	Sender       string    `json:"sender"`
+	Text         string    `json:"text"`
+	Timestamp    time.Time `json:"timestamp"`
+	StarredAt    time.Time `json:"starred_at"`
+}
+
+// starState are the starred messages, kept in starred.json next to the configuration file.
+// The servers know nothing about them
+type starState struct {
+	mu       sync.Mutex
+	path     string
+	messages []starredMessage
+}
+
+var starred = &starState{}
+
+// load reads the starred messages kept next to the configuration file at configPath. Without
+// a configuration file, messages are only starred until the client exits
+func (st *starState) load(configPath string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.messages = nil
+	st.path = ""
+	if configPath == "" {
+		return nil
+	}
+	st.path = filepath.Join(filepath.Dir(configPath), "starred.json")
+
+	b, err := os.ReadFile(st.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, &st.messages)
+}
+
+// star adds the message of a conversation of sc, unless it's starred already
+func (st *starState) star(sc *serverConn, nickname string, message common.Message) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	entry := starredMessage{
+		ID:           message.ID,
+		Server:       sc.profile.Alias,
+		Conversation: nickname,
+		Sender:       message.Sender.Name,
+		Text:         message.Text,
+		Timestamp:    message.Timestamp,
+		StarredAt:    time.Now(),
+	}
+
+	for _, other := range st.messages {
+		if other.Server == entry.Server && other.Sender == entry.Sender &&
+			other.Text == entry.Text && other.Timestamp.Equal(entry.Timestamp) {
+			return false, nil
+		}
+	}
+
+	st.messages = append(st.messages, entry)
+
+	return true, st.save()
+}
+
+// unstar removes the nth starred message, counting from 1 like /starred does
+func (st *starState) unstar(n int) (starredMessage, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if n < 1 || n > len(st.messages) {
+		return starredMessage{}, fmt.Errorf("there is no starred message %d", n)
+	}
+
+	removed := st.messages[n-1]
+	st.messages = append(st.messages[:n-1], st.messages[n:]...)
+
+	return removed, st.save()
+}
+
+func (st *starState) list() []starredMessage {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return append([]starredMessage{}, st.messages...)
+}
+
+// save writes the starred messages to their file. st.mu must be held
+func (st *starState) save() error {
+	if st.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(st.messages, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(st.path), 0o700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(st.path, b, 0o600)
+}
+
+// showStarred lists the starred messages, numbered for /unstar
+func showStarred() {
+	messages := starred.list()
+	if len(messages) == 0 {
+		notice("No starred messages")
+		return
+	}
+
+	notice(fmt.Sprintf("%d starred message(s):", len(messages)))
+	now := time.Now()
+	for i, message := range messages {
+		where := message.Conversation
+		if len(connectedServers()) > 1 || message.Server != "" && !isConnectedTo(message.Server) {
+			where = message.Server + "/" + message.Conversation
+		}
+
+		timestamp := formatTimestamp(message.Timestamp, now)
+		if timestamp != "" {
+			timestamp += " "
+		}
+
+		screen.print(fmt.Sprintf("%d. %s[%s] <@%s> %s", i+1, timestamp, sanitize(where),
+			sanitize(message.Sender), renderInline(sanitize(message.Text))))
+	}
+}
+
+// isConnectedTo tells if one of the servers we're connected to has the given alias
+func isConnectedTo(alias string) bool {
+	for _, sc := range connectedServers() {
+		if sc.profile.Alias == alias {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// sync tells the server what we knew before losing the connection at since, for it to
+// subscribe us to our conversations again and send us what changed
+func (sc *serverConn) sync(since time.Time) error {
+	state := common.Sync{Subscriptions: map[uuid.UUID]uint64{}, Since: since}
+
+	sc.mu.Lock()
+	for _, conversation := range sc.conversations {
+		state.Known = append(state.Known, conversation.ID)
+		if sc.subscriptions[conversation.Nickname] {
+			state.Subscriptions[conversation.ID] = sc.lastSeqs[conversation.ID]
+		}
+	}
+	sc.mu.Unlock()
+
+	return sc.sendOperation(common.SyncOperationType, state)
+}
+
+// handleSyncResponse catches up with what changed while we were away: the conversations
+// created and deleted, and the messages and joins and leaves we missed in ours
+func (sc *serverConn) handleSyncResponse(jsonDelta *json.RawMessage) {
+	delta := common.SyncDelta{}
+
+	err := json.Unmarshal(*jsonDelta, &delta)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	sc.mu.Lock()
+	gone := []*common.Conversation{}
+	for _, conversation := range sc.conversations {
+		if slices.Contains(delta.Gone, conversation.ID) {
+			gone = append(gone, conversation)
+		}
+	}
+	sc.conversations = append(sc.conversations, delta.New...)
+	sc.mu.Unlock()
+
+	for _, conversation := range gone {
+		sc.forgetConversation(conversation)
+		notice(sc.label(conversation.Nickname) + " was deleted")
+	}
+
+	for _, conversation := range delta.Subscribed {
+		sc.updateConversation(conversation)
+	}
+
+	if len(delta.New) > 0 {
+		nicknames := []string{}
+		for _, conversation := range delta.New {
+			nicknames = append(nicknames, sc.label(conversation.Nickname))
+		}
+		notice("New conversations: " + strings.Join(nicknames, ", "))
+	}
+
+	sc.dropUnsynced(delta.Subscribed)
+
+	sc.showMissed(delta.Missed, delta.Membership)
+
+	for _, conversation := range delta.Subscribed {
+		sc.catchUp(conversation)
+	}
+
+	sc.joinPending()
+
+	screen.refresh()
+}
+
+// dropUnsynced forgets about the subscriptions the server didn't take back, like for going
+// over its limits
+func (sc *serverConn) dropUnsynced(subscribed []*common.Conversation) {
+	sc.mu.Lock()
+	dropped := []string{}
+	for _, conversation := range sc.conversations {
+		if !sc.subscriptions[conversation.Nickname] {
+			continue
+		}
+
+		if !slices.ContainsFunc(subscribed, func(c *common.Conversation) bool { return c.ID == conversation.ID }) {
+			delete(sc.subscriptions, conversation.Nickname)
+			dropped = append(dropped, conversation.Nickname)
+		}
+	}
+	sc.mu.Unlock()
+
+	for _, nickname := range dropped {
+		active.left(sc, nickname)
+		notice("Couldn't join " + sc.label(nickname) + " again")
+	}
+}
+
+// showMissed shows the messages we missed and who joined and left while we were away, in the
+// order they happened
+func (sc *serverConn) showMissed(missed, membership []common.Message) {
+	shown := []common.Message{}
+	for _, message := range missed {
+		// the messages queued for us while we were away came before, and are shown already
+		sc.mu.Lock()
+		seen := message.Seq <= sc.lastSeqs[message.Conversation.ID]
+		if !seen {
+			sc.lastSeqs[message.Conversation.ID] = message.Seq
+		}
+		sc.mu.Unlock()
+
+		if seen || message.Sender == nil || blocking.has(message.Sender.Name) {
+			continue
+		}
+
+		sc.open(&message)
+		sc.remember(message.Conversation.Nickname, message)
+		if transcripts != nil {
+			transcripts.record(sc, message)
+		}
+
+		shown = append(shown, message)
+	}
+
+	if len(shown) > 0 {
+		notice(fmt.Sprintf("%d message(s) missed on %s:", len(shown), sc.profile.Alias))
+	}
+
+	shown = append(shown, membership...)
+	slices.SortStableFunc(shown, func(a, b common.Message) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+
+	for _, message := range shown {
+		screen.print(sc.formatMessage(message, true))
+	}
+}
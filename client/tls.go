@@ -0,0 +1,76 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// tlsConfig is set by UseTLS to connect to servers over TLS
+var tlsConfig *tls.Config
+
+// UseTLS makes the client connect to servers over TLS. Their certificates are verified against
+// the system's roots, or the PEM encoded certificates in caFile if it isn't empty. With certFile
+// and keyFile, the client presents that certificate to the servers that ask for one
+func UseTLS(caFile, certFile, keyFile string) error {
+	config := &tls.Config{}
+
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("a client certificate needs both the certificate and its key")
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + caFile)
+		}
+
+		config.RootCAs = roots
+	}
+
+	tlsConfig = config
+
+	return nil
+}
+
+// secure starts TLS on conn to the server at service, if it is configured
+func secure(conn net.Conn, service string) (net.Conn, error) {
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	host, _, err := net.SplitHostPort(service)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	config := tlsConfig.Clone()
+	config.ServerName = host
+
+	tlsConn := tls.Client(conn, config)
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
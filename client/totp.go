@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nikochiko/tcpchat/common"
+	"golang.org/x/term"
+)
+
+// totpCodeEnv is the environment variable the one-time code is taken from, for when there's
+// no terminal to type it in
+const totpCodeEnv = "TCPCHAT_TOTP_CODE"
+
+// askCode returns the one-time code to log in to the account of profile with, from
+// $TCPCHAT_TOTP_CODE, or else asks for it
+func askCode(profile Profile) (string, error) {
+	if code := os.Getenv(totpCodeEnv); code != "" {
+		return code, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("set $%s to log in to %s without a terminal", totpCodeEnv, profile.Alias)
+	}
+
+	fmt.Printf("One-time code of %s on %s: ", profile.Username, profile.Alias)
+	b, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// passwordServer is the server with the given alias, or the only one we logged in to with a
+// password when alias is empty, for the commands about our account
+func passwordServer(alias string) (*serverConn, error) {
+	if alias != "" {
+		sc, ok := serverByAlias(alias)
+		if !ok {
+			return nil, fmt.Errorf("not connected to %s", alias)
+		}
+
+		return sc, nil
+	}
+
+	found := []*serverConn{}
+	for _, sc := range connectedServers() {
+		if sc.profile.Username != "" {
+			found = append(found, sc)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, errors.New("you didn't log in to any server with a password")
+	case 1:
+		return found[0], nil
+	default:
+		return nil, errors.New("which server? Give its alias last")
+	}
+}
+
+// setUpTOTP sends the server a step of setting up two-factor authentication
+func (sc *serverConn) setUpTOTP(action, code string) error {
+	return sc.sendOperation(common.TOTPOperationType, common.TOTP{Action: action, Code: code})
+}
+
+// handleTOTPResponse shows the secret to add to an authenticator app, or tells whether
+// two-factor authentication is on now
+func (sc *serverConn) handleTOTPResponse(jsonTOTP *json.RawMessage) {
+	totp := common.TOTP{}
+
+	err := json.Unmarshal(*jsonTOTP, &totp)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	switch totp.Action {
+	case common.TOTPEnrollAction:
+		notice(fmt.Sprintf("Add this secret to your authenticator app: %s\nor open %s\nthen turn two-factor authentication on with %stotp confirm <code>",
+			totp.Secret, totp.URI, CommandPrefix))
+	case common.TOTPConfirmAction:
+		notice(fmt.Sprintf("Two-factor authentication is on for %s: connect with -totp (or totp: true in the configuration) from now on", sc.profile.Alias))
+	case common.TOTPDisableAction:
+		notice(fmt.Sprintf("Two-factor authentication is off for %s", sc.profile.Alias))
+	}
+}
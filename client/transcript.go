@@ -0,0 +1,138 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// transcriptLog appends the messages we receive to a log file per conversation, in a directory
+// per server. Direct messages go to a file per sender, named @<sender>.log. A file is rotated
+// once it grows past the size limit: name.log becomes name.log.1, name.log.1 becomes
+// name.log.2 and so on, keeping the configured number of old files
+type transcriptLog struct {
+	mu       sync.Mutex
+	settings Transcripts
+	files    map[string]*os.File
+}
+
+// transcripts is nil unless the configuration asks for transcripts
+var transcripts *transcriptLog
+
+func newTranscriptLog(settings Transcripts) *transcriptLog {
+	return &transcriptLog{settings: settings, files: map[string]*os.File{}}
+}
+
+// record appends message, received from sc, to its transcript
+func (t *transcriptLog) record(sc *serverConn, message common.Message) {
+	name := "@" + message.Sender.Name
+	where := "direct"
+	if message.Recipient == nil && message.Conversation != nil {
+		name = message.Conversation.Nickname
+		where = message.Conversation.Nickname
+	}
+
+	timestamp := message.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	line := fmt.Sprintf("%s [%s] <@%s> %s\n", timestamp.Format(time.RFC3339), sanitize(where), sanitize(message.Sender.Name), sanitize(message.Text))
+	path := filepath.Join(t.settings.Dir, fileName(sc.profile.Alias), fileName(name)+".log")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.write(path, line)
+	if err != nil {
+		common.Errorf("Couldn't write the transcript %s: %s\n", path, err.Error())
+	}
+}
+
+func (t *transcriptLog) write(path string, line string) error {
+	f, ok := t.files[path]
+	if !ok {
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err != nil {
+			return err
+		}
+
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		t.files[path] = f
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if t.settings.MaxSize > 0 && info.Size() > 0 && info.Size()+int64(len(line)) > t.settings.MaxSize {
+		f, err = t.rotate(path, f)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = f.WriteString(line)
+
+	return err
+}
+
+// rotate closes the full log file f at path, shifts the old files along and starts a new file
+func (t *transcriptLog) rotate(path string, f *os.File) (*os.File, error) {
+	f.Close()
+	delete(t.files, path)
+
+	os.Remove(fmt.Sprintf("%s.%d", path, t.settings.Keep))
+	for i := t.settings.Keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+
+	if t.settings.Keep > 0 {
+		err := os.Rename(path, path+".1")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		os.Remove(path)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	t.files[path] = f
+
+	return f, nil
+}
+
+// close closes every open log file
+func (t *transcriptLog) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for path, f := range t.files {
+		f.Close()
+		delete(t.files, path)
+	}
+}
+
+// fileName makes name, like a server's host:port, safe to use as a file name
+func fileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+
+		return r
+	}, name)
+}
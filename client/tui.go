@@ -0,0 +1,297 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+const (
+	sidebarWidth = 24
+	// scrollback is how many lines the message pane keeps
+	scrollback = 1000
+)
+
+var (
+	sidebarStyle = lipgloss.NewStyle().
+			Width(sidebarWidth).
+			PaddingLeft(1).
+			Border(lipgloss.NormalBorder(), false, false, false, true)
+	statusStyle = lipgloss.NewStyle().Reverse(true)
+	aliasStyle  = lipgloss.NewStyle().Bold(true)
+)
+
+// tuiDisplay shows the chat in a full screen terminal interface: the messages on the left,
+// the conversations of every server on the right, a status bar and an input box at the bottom
+type tuiDisplay struct {
+	program *tea.Program
+}
+
+// The messages the TUI's model gets from the rest of the client
+type (
+	tuiLine     string
+	tuiRefresh  struct{}
+	tuiQuestion struct {
+		question string
+		answer   chan bool
+	}
+)
+
+func newTUIDisplay() *tuiDisplay {
+	input := textinput.New()
+	input.Placeholder = "/help for the list of commands, /switch <conversation> to chat in one"
+	input.Prompt = "> "
+	input.Focus()
+
+	model := &tuiModel{
+		messages: viewport.New(0, 0),
+		input:    input,
+	}
+
+	return &tuiDisplay{program: tea.NewProgram(model, tea.WithAltScreen())}
+}
+
+func (t *tuiDisplay) print(line string) {
+	t.program.Send(tuiLine(line))
+}
+
+func (t *tuiDisplay) refresh() {
+	t.program.Send(tuiRefresh{})
+}
+
+func (t *tuiDisplay) confirm(question string) bool {
+	answer := make(chan bool, 1)
+	t.program.Send(tuiQuestion{question: question, answer: answer})
+
+	return <-answer
+}
+
+// Write shows the logs in the message pane, as they'd mess up the screen on stderr
+func (t *tuiDisplay) Write(p []byte) (int, error) {
+	notice(strings.TrimRight(string(p), "\n"))
+
+	return len(p), nil
+}
+
+// run shows the TUI until the user quits, then goes back to printing on the terminal
+func (t *tuiDisplay) run(quit chan bool) {
+	defer func() {
+		quit <- true
+	}()
+
+	common.SetLogOutput(t)
+
+	_, err := t.program.Run()
+
+	screen = promptDisplay{}
+	common.SetLogOutput(os.Stderr)
+
+	common.CheckErrorAndLog(err)
+}
+
+type tuiModel struct {
+	messages viewport.Model
+	input    textinput.Model
+	lines    []string
+	width    int
+	height   int
+
+	// answer is where the next line typed goes while a question is asked
+	answer chan bool
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.messages.Width = m.width - sidebarWidth - 2
+		// the status bar and the input box take a line each
+		m.messages.Height = m.height - 2
+		m.input.Width = m.width - len(m.input.Prompt) - 1
+		m.setContent()
+	case tuiLine:
+		m.lines = append(m.lines, string(msg))
+		if len(m.lines) > scrollback {
+			m.lines = m.lines[len(m.lines)-scrollback:]
+		}
+		m.setContent()
+	case tuiRefresh:
+		// the sidebar and status bar are drawn from the servers' state in View
+	case tuiQuestion:
+		m.answer = msg.answer
+		m.lines = append(m.lines, msg.question+" [y/N]")
+		m.setContent()
+	case tea.KeyMsg:
+		switch msg.Type {
+		case tea.KeyCtrlC, tea.KeyEsc:
+			m.answerQuestion("")
+			return m, tea.Quit
+		case tea.KeyEnter:
+			return m, m.submit()
+		case tea.KeyTab:
+			m.complete()
+			return m, nil
+		case tea.KeyPgUp, tea.KeyPgDown, tea.KeyUp, tea.KeyDown:
+			var cmd tea.Cmd
+			m.messages, cmd = m.messages.Update(msg)
+			return m, cmd
+		}
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+
+	return m, cmd
+}
+
+// setContent fills the message pane with the lines, wrapped to its width, and follows new
+// lines unless the user scrolled up
+func (m *tuiModel) setContent() {
+	following := m.messages.AtBottom()
+
+	wrap := lipgloss.NewStyle().Width(max(m.messages.Width, 1))
+	m.messages.SetContent(wrap.Render(strings.Join(m.lines, "\n")))
+
+	if following {
+		m.messages.GotoBottom()
+	}
+}
+
+// submit runs the line in the input box, or answers the question being asked with it
+func (m *tuiModel) submit() tea.Cmd {
+	line := m.input.Value()
+	m.input.Reset()
+
+	if m.answer != nil {
+		m.answerQuestion(line)
+		return nil
+	}
+
+	// operations may wait for the rate limit, so run them off the UI's goroutine
+	return func() tea.Msg {
+		err := runInput(line)
+		if err == errQuit {
+			return tea.Quit()
+		}
+		if err != nil {
+			return tuiLine("Error: " + err.Error())
+		}
+
+		return nil
+	}
+}
+
+// complete completes the word before the cursor, see complete
+func (m *tuiModel) complete() {
+	value := m.input.Value()
+	// the cursor position is in runes, complete works with bytes
+	pos := len(string([]rune(value)[:m.input.Position()]))
+
+	line, newPos, candidates, ok := complete(value, pos)
+	if !ok {
+		return
+	}
+
+	if len(candidates) > 0 {
+		m.lines = append(m.lines, colorize(settings.Colors.Notice, strings.Join(candidates, "  ")))
+		m.setContent()
+	}
+
+	m.input.SetValue(line)
+	m.input.SetCursor(len([]rune(line[:newPos])))
+}
+
+func (m *tuiModel) answerQuestion(line string) {
+	if m.answer == nil {
+		return
+	}
+
+	answer := strings.ToLower(strings.TrimSpace(line))
+	m.answer <- answer == "y" || answer == "yes"
+	m.answer = nil
+}
+
+func (m *tuiModel) View() string {
+	if m.width == 0 {
+		return ""
+	}
+
+	sidebar := sidebarStyle.Height(m.messages.Height).Render(m.sidebar())
+	top := lipgloss.JoinHorizontal(lipgloss.Top, m.messages.View(), " ", sidebar)
+
+	return lipgloss.JoinVertical(lipgloss.Left, top, m.statusBar(), m.input.View())
+}
+
+// sidebar lists the conversations of every server, with the ones we're subscribed to marked
+// and the number of unread messages next to them
+func (m *tuiModel) sidebar() string {
+	lines := []string{}
+
+	for _, sc := range connectedServers() {
+		lines = append(lines, aliasStyle.Render(truncate(sc.profile.Alias, sidebarWidth-1)))
+
+		sc.mu.Lock()
+		for _, conversation := range sc.conversations {
+			mark := "  "
+			if sc.subscriptions[conversation.Nickname] {
+				mark = "● "
+			}
+
+			count := ""
+			if n := sc.unread[conversation.Nickname]; n > 0 {
+				count = fmt.Sprintf(" (%d)", n)
+			}
+
+			lines = append(lines, mark+truncate(sanitize(conversation.Nickname), sidebarWidth-3-len(count))+count)
+		}
+		sc.mu.Unlock()
+
+		lines = append(lines, "")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (m *tuiModel) statusBar() string {
+	list := connectedServers()
+
+	names := []string{}
+	for _, sc := range list {
+		sc.mu.Lock()
+		names = append(names, fmt.Sprintf("%s@%s", sc.clientInfo.Name, sc.profile.Alias))
+		sc.mu.Unlock()
+	}
+
+	status := fmt.Sprintf(" %s · %d server(s)", strings.Join(names, ", "), len(list))
+	if presence.away() {
+		status += " · away"
+	}
+	if sc, nickname := active.get(); sc != nil {
+		status += " · in " + sc.label(nickname)
+		if conversation, err := sc.getConversationByNickname(nickname); err == nil && conversation.Topic != "" {
+			status += ": " + sanitize(conversation.Topic)
+		}
+	}
+	status += " · PgUp/PgDn to scroll · Esc to quit"
+
+	return statusStyle.Width(m.width).Render(truncate(status, m.width))
+}
+
+func truncate(s string, width int) string {
+	runes := []rune(s)
+	if width < 1 || len(runes) <= width {
+		return s
+	}
+
+	return string(runes[:width-1]) + "…"
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// whois looks up the users called name
+func (sc *serverConn) whois(name string) error {
+	return sc.sendOperation(common.WhoisOperationType, common.Whois{Name: name})
+}
+
+// setHidden hides (or shows) our conversations and connect time from the whois of others
+func (sc *serverConn) setHidden(hidden bool) error {
+	return sc.sendOperation(common.PrivacyOperationType, common.PrivacySettings{Hidden: hidden})
+}
+
+// setName changes our name
+func (sc *serverConn) setName(name string) error {
+	return sc.sendOperation(common.NameOperationType, common.NameChange{Name: name})
+}
+
+// handleNameResponse tells about the new name of a user of our conversations, or our own, which
+// comes both as the response and in our conversations
+func (sc *serverConn) handleNameResponse(nameResponse *json.RawMessage) {
+	change := common.NameChange{}
+
+	err := json.Unmarshal(*nameResponse, &change)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	sc.mu.Lock()
+	mine := change.ID == sc.clientInfo.ID
+	known := mine && sc.clientInfo.Name == change.Name
+	if mine {
+		sc.clientInfo.Name = change.Name
+	}
+	sc.mu.Unlock()
+
+	switch {
+	case known:
+	case mine:
+		notice(fmt.Sprintf("You are now known as %s on %s", change.Name, sc.profile.Alias))
+	default:
+		notice(fmt.Sprintf("%s is now known as %s on %s", change.OldName, change.Name, sc.profile.Alias))
+	}
+}
+
+// setRegistered registers our name, for no one else to connect with it, or releases it
+func (sc *serverConn) setRegistered(registered bool) error {
+	return sc.sendOperation(common.RegisterOperationType, common.Registration{Registered: registered})
+}
+
+func (sc *serverConn) handleRegisterResponse(registerResponse *json.RawMessage) {
+	registration := common.Registration{}
+
+	err := json.Unmarshal(*registerResponse, &registration)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	switch {
+	case registration.Registered:
+		notice(fmt.Sprintf("Registered your name %s on %s", registration.Name, sc.profile.Alias))
+	case registration.Name != "":
+		notice(fmt.Sprintf("Released your name %s on %s", registration.Name, sc.profile.Alias))
+	default:
+		notice(fmt.Sprintf("You had no name registered on %s", sc.profile.Alias))
+	}
+}
+
+func (sc *serverConn) handleWhoisResponse(whoisResponse *json.RawMessage) {
+	whois := common.Whois{}
+
+	err := json.Unmarshal(*whoisResponse, &whois)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	lines := []string{}
+	for _, info := range whois.Users {
+		lines = append(lines, sc.describeUser(info))
+	}
+
+	notice(strings.Join(lines, "\n"))
+}
+
+// describeUser is a line like "bob (2f1c...) is online, connected 5m ago, in general, lunch"
+func (sc *serverConn) describeUser(info common.UserInfo) string {
+	line := fmt.Sprintf("%s (%s)", info.Name, info.ID)
+	if len(connectedServers()) > 1 {
+		line += " on " + sc.profile.Alias
+	}
+
+	switch {
+	case !info.Online:
+		line += " is offline"
+	case info.Status.Away:
+		line += " is " + describeStatus(info.Status)
+	default:
+		line += " is online"
+	}
+
+	if info.Online {
+		if info.ConnectedAt != nil {
+			line += fmt.Sprintf(", connected %s ago", time.Since(*info.ConnectedAt).Round(time.Second))
+		}
+	}
+
+	switch {
+	case info.Hidden && info.ConnectedAt == nil && len(info.Conversations) == 0:
+		line += ", and keeps their conversations private"
+	case len(info.Conversations) > 0:
+		line += ", in " + strings.Join(info.Conversations, ", ")
+	}
+
+	return line + describeProfile(info.Profile)
+}
+
+// setProfile updates the fields of our profile that aren't nil. The response has the whole profile
+func (sc *serverConn) setProfile(profile common.Profile) error {
+	return sc.sendOperation(common.ProfileOperationType, profile)
+}
+
+func (sc *serverConn) handleProfileResponse(profileResponse *json.RawMessage) {
+	profile := common.Profile{}
+
+	err := json.Unmarshal(*profileResponse, &profile)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	description := describeProfile(profile)
+	if description == "" {
+		description = " is empty"
+	}
+
+	prefix := "Your profile"
+	if len(connectedServers()) > 1 {
+		prefix += " on " + sc.profile.Alias
+	}
+
+	notice(prefix + description)
+}
+
+// describeProfile is the lines with the fields of a profile that are set
+func describeProfile(profile common.Profile) string {
+	description := ""
+	if profile.Bio != nil && *profile.Bio != "" {
+		description += "\n  bio: " + *profile.Bio
+	}
+	if profile.AvatarURL != nil && *profile.AvatarURL != "" {
+		description += "\n  avatar: " + *profile.AvatarURL
+	}
+
+	return description
+}
@@ -3,48 +3,724 @@ package common
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const (
-	AboutMeOperationType   = "aboutme"
-	CreateOperationType    = "create"
-	SubscribeOperationType = "subscribe"
-	MessageOperationType   = "message"
-	ListOperationType      = "list"
+	AboutMeOperationType         = "aboutme"
+	ChallengeOperationType       = "challenge"
+	CreateOperationType          = "create"
+	SubscribeOperationType       = "subscribe"
+	UnsubscribeOperationType     = "unsubscribe"
+	MessageOperationType         = "message"
+	ListOperationType            = "list"
+	DigestOperationType          = "digest"
+	EmailDigestOperationType     = "email_digest"
+	DrainOperationType           = "drain"
+	MigrateOperationType         = "migrate"
+	TopicOperationType           = "topic"
+	RenameOperationType          = "rename"
+	ArchiveOperationType         = "archive"
+	DeleteOperationType          = "delete"
+	AnnounceOperationType        = "announce"
+	AuthOperationType            = "auth"
+	AdminOperationType           = "admin"
+	WhoisOperationType           = "whois"
+	PrivacyOperationType         = "privacy"
+	ProfileOperationType         = "profile"
+	StatusOperationType          = "status"
+	MembersOperationType         = "members"
+	BlockOperationType           = "block"
+	BlocksOperationType          = "blocks"
+	ReportOperationType          = "report"
+	SlowModeOperationType        = "slow_mode"
+	SearchOperationType          = "search"
+	ExportOperationType          = "export"
+	FetchOperationType           = "fetch"
+	SyncOperationType            = "sync"
+	KeysOperationType            = "keys"
+	ConversationKeyOperationType = "conversation_key"
+	TOTPOperationType            = "totp"
+	SessionsOperationType        = "sessions"
+	RevokeOperationType          = "revoke"
+	AccountExportOperationType   = "account_export"
+	DeleteAccountOperationType   = "delete_account"
+	ACLOperationType             = "acl"
+	InviteOperationType          = "invite"
+	JoinCodeOperationType        = "join_code"
+	RegisterOperationType        = "register"
+	NameOperationType            = "name"
+)
+
+const (
+	// RateLimitedErrorCode is the code of the error sent when a client goes over its RateLimit
+	RateLimitedErrorCode = "rate_limited"
+	// EmptyMessageErrorCode and MessageTooLongErrorCode are the codes of the errors sent for
+	// messages without any text, or with more than the server's maximum length
+	EmptyMessageErrorCode   = "empty_message"
+	MessageTooLongErrorCode = "message_too_long"
+	// ForbiddenErrorCode is the code of the error sent for operations the client isn't allowed to do
+	ForbiddenErrorCode = "forbidden"
+	// NotFoundErrorCode is the code of the error sent for messages to conversations that don't
+	// exist (anymore), and ArchivedErrorCode for messages to archived ones
+	NotFoundErrorCode = "not_found"
+	ArchivedErrorCode = "archived"
+	// InvalidProfileErrorCode is the code of the error sent for profiles that can't be saved
+	InvalidProfileErrorCode = "invalid_profile"
+	// BannedErrorCode is the code of the error sent to banned users when they connect
+	BannedErrorCode = "banned"
+	// FilteredErrorCode is the code of the error sent for messages the content filter blocked
+	FilteredErrorCode = "filtered"
+	// SlowModeErrorCode is the code of the error sent for messages that came too soon after the
+	// sender's previous one to a conversation in slow mode. Its RetryAfter says how long to wait.
+	// InvalidSlowModeErrorCode is sent for slow modes out of the range the server allows
+	SlowModeErrorCode        = "slow_mode"
+	InvalidSlowModeErrorCode = "invalid_slow_mode"
+	// LimitExceededErrorCode is the code of the error sent for operations that would go over one
+	// of the server's limits, like the most conversations a user may own
+	LimitExceededErrorCode = "limit_exceeded"
+	// KeyMismatchErrorCode is the code of the error sent to clients connecting with an ID that
+	// has another public key, and InvalidSignatureErrorCode for messages whose signature doesn't
+	// match their sender's key
+	KeyMismatchErrorCode      = "key_mismatch"
+	InvalidSignatureErrorCode = "invalid_signature"
+	// LoginRequiredErrorCode is the code of the error sent to clients connecting without logging
+	// in to a server that requires it, or with a login it doesn't take
+	LoginRequiredErrorCode = "login_required"
+	// TOTPRequiredErrorCode is the code of the error sent to clients logging in to an account
+	// with two-factor authentication without a one-time code, or with a wrong one
+	TOTPRequiredErrorCode = "totp_required"
+	// SessionRevokedErrorCode is the code of the error sent to a session before it's closed,
+	// when the user (or an admin) revoked it or deleted the account, for its client not to reconnect
+	SessionRevokedErrorCode = "session_revoked"
+	// EncryptionErrorCode is the code of the error sent for what doesn't fit an encrypted
+	// conversation, like plain messages to it or subscribing without a box key, or an
+	// unencrypted one, like encrypted messages to it
+	EncryptionErrorCode = "encryption"
+	// TimeoutErrorCode is the code of the error sent for operations the server gave up on, as
+	// they took longer than it allows
+	TimeoutErrorCode = "timeout"
+	// IdleTimeoutErrorCode is the code of the error sent to a session before it's closed for
+	// going without any operation for longer than the server allows
+	IdleTimeoutErrorCode = "idle_timeout"
+	// InvalidEmailErrorCode is the code of the error sent for email digest settings with an
+	// address that isn't valid, or to servers that don't send emails
+	InvalidEmailErrorCode = "invalid_email"
+	// InvalidCommandErrorCode is the code of the error sent for slash commands sent to a
+	// conversation with arguments they don't take, or that failed
+	InvalidCommandErrorCode = "invalid_command"
+	// InvalidPayloadErrorCode is the code of the error sent for operations whose message doesn't
+	// fit their type: fields it doesn't have, values of the wrong type, or required fields missing
+	InvalidPayloadErrorCode = "invalid_payload"
+	// InvalidNicknameErrorCode is the code of the error sent for nicknames of conversations, and
+	// names of users, that are empty, too long or have characters the server doesn't allow, and
+	// NicknameTakenErrorCode for those another conversation, or connected user, has, in any case
+	InvalidNicknameErrorCode = "invalid_nickname"
+	NicknameTakenErrorCode   = "nickname_taken"
 )
 
 var EOFBytes = []byte("\r\n")
 
-// Message type describes a message being transferred between a client and a server
+// Networks are the values accepted for the network to listen on or dial: "tcp" is dual-stack,
+// "tcp4" and "tcp6" restrict it to IPv4 or IPv6. IPv6 hosts are written in brackets, like [::1]:8080
+var Networks = []string{"tcp", "tcp4", "tcp6"}
+
+// The Kinds of messages: UserMessageKind for the text users send, ActionMessageKind for what
+// they do, like "/me waves", which clients show as "* alice waves", and SystemMessageKind for
+// what the server says to a conversation about what happens in it, like users joining and
+// leaving. Messages from servers before kinds have none for the users' text
+const (
+	UserMessageKind   = "user"
+	ActionMessageKind = "action"
+	SystemMessageKind = "system"
+)
+
+// KindOf is the Kind of message, UserMessageKind if it has none
+func KindOf(message Message) string {
+	if message.Kind == "" {
+		return UserMessageKind
+	}
+
+	return message.Kind
+}
+
+// Message type describes a message being transferred between a client and a server.
+// Direct messages have a Recipient instead of a Conversation. The ID, Timestamp and Sender
+// are set by the server; messages it doesn't keep, like direct ones from itself, have no ID
 type Message struct {
+	ID           uuid.UUID     `json:"id,omitzero"`
 	Conversation *Conversation `json:"conversation"`
+	Recipient    *Sender       `json:"recipient,omitempty"`
 	Sender       *Sender       `json:"sender"`
 	Text         string        `json:"text"`
+	Timestamp    time.Time     `json:"timestamp"`
+	Kind         string        `json:"kind,omitempty"`
+	// Seq numbers the messages of a conversation, one after another from 1, so that clients
+	// can tell when they missed some
+	Seq uint64 `json:"seq,omitempty"`
+	// Key is set by clients to a key of their own for every message they send, so that the
+	// server delivers a message sent again (e.g. after reconnecting) only once
+	Key string `json:"key,omitempty"`
+	// Signature is the ed25519 signature of the message's SignedBytes by its sender, for the
+	// server and other clients to tell it really is from the sender. The server drops it when
+	// it has to change the text
+	Signature []byte `json:"signature,omitempty"`
+	// Box is the text of an end-to-end encrypted direct message, sealed with NaCl box with
+	// Nonce for the BoxKey of its Recipient by the one of its Sender. Text is empty then, and
+	// the server relays the box without being able to read it. In encrypted conversations it's
+	// sealed with NaCl secretbox with the conversation's key of KeyEpoch
+	Box      []byte `json:"box,omitempty"`
+	Nonce    []byte `json:"nonce,omitempty"`
+	KeyEpoch uint64 `json:"key_epoch,omitempty"`
 }
 
-// Sender type describes a sender of a message
+// MessageAck is the response to a message operation, with the Key of the message if it had one
+type MessageAck struct {
+	Key string `json:"key,omitempty"`
+}
+
+// Sender type describes a sender of a message. PublicKey is its ed25519 public key, if it has
+// one: the first key a server sees for an ID is the only one it takes for that ID afterwards.
+// BoxKey is its X25519 public key, for direct messages to it to be encrypted with
 type Sender struct {
-	ID   uuid.UUID `json:"id"`
-	Name string    `json:"name"`
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	PublicKey []byte    `json:"public_key,omitempty"`
+	BoxKey    []byte    `json:"box_key,omitempty"`
 }
 
-// Conversation type is where senders can send and viewers can view the messages
+// Conversation type is where senders can send and viewers can view the messages.
+// Owner is the client that created it, and only the owner and Moderators may change its Topic.
+// Only the owner can rename, archive or delete it. Archived conversations get no new messages.
+// In slow mode, everyone but the owner and Moderators may send a message every SlowMode seconds.
+// The messages of Encrypted conversations are sealed with a key only their members have.
+// Conversations with an ACL are only open to the users in it, as far as it lets them
 type Conversation struct {
-	ID       uuid.UUID `json:"id"`
+	ID         uuid.UUID   `json:"id"`
+	Nickname   string      `json:"nickname"`
+	Topic      string      `json:"topic,omitempty"`
+	Owner      uuid.UUID   `json:"owner"`
+	Moderators []uuid.UUID `json:"moderators,omitempty"`
+	Archived   bool        `json:"archived,omitempty"`
+	SlowMode   int         `json:"slow_mode,omitempty"`
+	Encrypted  bool        `json:"encrypted,omitempty"`
+	ACL        []ACLEntry  `json:"acl,omitempty"`
+	// LastSeq is the Seq of the latest message of the conversation, sent in the response to subscribe
+	LastSeq uint64 `json:"last_seq,omitempty"`
+	// Members, LastMessage and Unread are sent in the response to list: how many users are
+	// subscribed to the conversation, when its latest message was sent, and how many of its
+	// messages came since the client was last subscribed to it
+	Members     int       `json:"members,omitempty"`
+	LastMessage time.Time `json:"last_message,omitzero"`
+	Unread      uint64    `json:"unread,omitempty"`
+}
+
+// CanModerate tells if the client with the given ID may change the conversation's settings
+func (c *Conversation) CanModerate(id uuid.UUID) bool {
+	return c.Access(id) == ModerateAccess
+}
+
+// Access is what the client with the given ID may do in the conversation: moderate it if it's
+// the owner or a moderator, whatever the ACL gives it otherwise, or write when there's no ACL
+func (c *Conversation) Access(id uuid.UUID) string {
+	if c.Owner == id || slices.Contains(c.Moderators, id) {
+		return ModerateAccess
+	}
+
+	if len(c.ACL) == 0 {
+		return WriteAccess
+	}
+
+	for _, entry := range c.ACL {
+		if entry.ID == id {
+			return entry.Access
+		}
+	}
+
+	return ""
+}
+
+// Allows tells if the client with the given ID has access to the conversation, or more
+func (c *Conversation) Allows(id uuid.UUID, access string) bool {
+	return slices.Index(AccessLevels, c.Access(id)) >= slices.Index(AccessLevels, access)
+}
+
+// The access an ACL may give to a conversation, each allowing what the ones before do too:
+// reading its messages, sending some, and changing its settings like moderators
+const (
+	ReadAccess     = "read"
+	WriteAccess    = "write"
+	ModerateAccess = "moderate"
+)
+
+// AccessLevels are the accesses of ACLs, from the least to the most
+var AccessLevels = []string{ReadAccess, WriteAccess, ModerateAccess}
+
+// ACLEntry gives the user with ID, called Name, Access to a conversation
+type ACLEntry struct {
+	ID     uuid.UUID `json:"id"`
+	Name   string    `json:"name"`
+	Access string    `json:"access"`
+}
+
+// ACL is sent by the owner of the conversation with Nickname to give User, a name or an ID,
+// Access to it, or to take its access away when Access is empty. Without a User, it only asks
+// for the conversation. The response is the conversation, which subscribers get in an acl
+// response too when its ACL changes
+type ACL struct {
+	Nickname string `json:"nickname"`
+	User     string `json:"user,omitempty"`
+	Access   string `json:"access,omitempty"`
+}
+
+// Invite is sent by the owner of the conversation with Nickname, which must have an ACL, to
+// make a code others can join it with, getting Access (write by default) to it. The code can
+// be used Uses times (once by default) for ExpiresIn seconds (a day by default). The response
+// is the Invite with its Code and when it Expires
+type Invite struct {
+	Nickname  string    `json:"nickname"`
+	Access    string    `json:"access,omitempty"`
+	Uses      int       `json:"uses,omitempty"`
+	ExpiresIn int       `json:"expires_in,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	Expires   time.Time `json:"expires,omitzero"`
+}
+
+// JoinCode is sent to join a conversation with the Code of an invite to it, using it up. The
+// response is the conversation, like the one to subscribe
+type JoinCode struct {
+	Code string `json:"code"`
+}
+
+// Topic is sent by a client to get the topic of the conversation with Nickname, or to set it
+// when Topic isn't nil. The server sends the conversation back, and when the topic changes
+// it sends a topic response with the conversation to all of its subscribers
+type Topic struct {
+	Nickname string  `json:"nickname"`
+	Topic    *string `json:"topic,omitempty"`
+}
+
+// Rename is sent by the owner of the conversation with Nickname to rename it to NewNickname.
+// Subscribers get it back in a rename response once it's renamed
+type Rename struct {
+	Nickname    string `json:"nickname"`
+	NewNickname string `json:"new_nickname"`
+}
+
+// Archive is sent by the owner of the conversation with Nickname to archive it, or to
+// unarchive it when Archived is false. Subscribers get the conversation in an archive
+// response. Conversations are deleted with a delete operation, whose message is the
+// conversation, and which subscribers get back the same way
+type Archive struct {
+	Nickname string `json:"nickname"`
+	Archived bool   `json:"archived"`
+}
+
+// SlowMode is sent by the owner or a moderator of the conversation with Nickname to let its
+// members send a message every Seconds seconds only, or to turn slow mode off when Seconds is 0.
+// Subscribers get the conversation in a slow_mode response
+type SlowMode struct {
+	Nickname string `json:"nickname"`
+	Seconds  int    `json:"seconds"`
+}
+
+// Search is sent to find the messages the server keeps, newest first. Every field narrows the
+// search down: the Conversation with that nickname, the Sender with that name, Text found in
+// the message regardless of case, messages sent After or Before some time, and of that Kind,
+// like actions. The response is SearchResults with at most Limit messages; when there are more,
+// its NextCursor is sent back as Cursor, with the same search, for the next page
+type Search struct {
+	Conversation string     `json:"conversation,omitempty"`
+	Sender       string     `json:"sender,omitempty"`
+	Text         string     `json:"text,omitempty"`
+	After        *time.Time `json:"after,omitempty"`
+	Before       *time.Time `json:"before,omitempty"`
+	Limit        int        `json:"limit,omitempty"`
+	Cursor       string     `json:"cursor,omitempty"`
+	Kind         string     `json:"kind,omitempty"`
+}
+
+// SearchResults are the messages found by a search, and where to continue it if there are more
+type SearchResults struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// List is sent to get the conversations of the server whose nickname starts with Prefix (in
+// any case), sorted by Sort: one of the ListSort values, or in the order they were created if
+// empty. With a Limit or a Cursor, the response is a ConversationPage of up to Limit
+// conversations, whose NextCursor is sent back as Cursor for the next page; without them, it's
+// the list of all the conversations at once, as servers that don't page the list send
+type List struct {
+	Prefix string `json:"prefix,omitempty"`
+	Sort   string `json:"sort,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// The orders a List may ask for: by nickname, by the latest message, most recent first, or by
+// how many are subscribed, most first
+const (
+	ListSortName     = "name"
+	ListSortActivity = "activity"
+	ListSortMembers  = "members"
+)
+
+// ConversationPage is the response to a List with a Limit or a Cursor
+type ConversationPage struct {
+	Conversations []*Conversation `json:"conversations"`
+	NextCursor    string          `json:"next_cursor,omitempty"`
+}
+
+// Export is sent to get the whole history of the conversation with Nickname, oldest first, in
+// pages of up to Limit messages. The response is an ExportPage; when there are more messages,
+// its NextCursor is sent back as Cursor for the next page
+type Export struct {
+	Nickname string `json:"nickname"`
+	Limit    int    `json:"limit,omitempty"`
+	Cursor   string `json:"cursor,omitempty"`
+}
+
+// ExportPage is a page of the history of the conversation with Nickname
+type ExportPage struct {
+	Nickname   string    `json:"nickname"`
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// Fetch is sent to get the messages of the conversation with Nickname whose Seq are From to To,
+// both included, like the ones a client missed while reconnecting. The response is the Fetch
+// with the Messages found, oldest first. When there were too many for one response, Next is
+// the From to fetch the rest with
+type Fetch struct {
 	Nickname string    `json:"nickname"`
+	From     uint64    `json:"from"`
+	To       uint64    `json:"to"`
+	Messages []Message `json:"messages,omitempty"`
+	Next     uint64    `json:"next,omitempty"`
+}
+
+// Sync is sent by a client after reconnecting, instead of listing the conversations and
+// subscribing to them again one by one. Known has the IDs of the conversations it knew of,
+// Subscriptions the Seq of the latest message it got of every conversation it was subscribed
+// to, by ID, and Since when it lost the connection. The server subscribes it again and answers
+// with a SyncDelta
+type Sync struct {
+	Known         []uuid.UUID          `json:"known,omitempty"`
+	Subscriptions map[uuid.UUID]uint64 `json:"subscriptions,omitempty"`
+	Since         time.Time            `json:"since,omitzero"`
+}
+
+// SyncDelta is what changed while a client was away: the conversations created (New) and
+// deleted (Gone) since, the ones it's subscribed to again as they are now (Subscribed), the
+// messages it missed in them (Missed, oldest first in every conversation), and the system messages saying who joined
+// and left them since (Membership). At most 500 missed messages of a conversation are sent,
+// the oldest, and the rest are left to fetch
+type SyncDelta struct {
+	New        []*Conversation `json:"new,omitempty"`
+	Gone       []uuid.UUID     `json:"gone,omitempty"`
+	Subscribed []*Conversation `json:"subscribed,omitempty"`
+	Missed     []Message       `json:"missed,omitempty"`
+	Membership []Message       `json:"membership,omitempty"`
+}
+
+// Keys is sent to get the keys of the users called Name, to send them direct messages. The
+// response is the Keys with the Users found, who may be more than one as names aren't unique
+type Keys struct {
+	Name  string   `json:"name"`
+	Users []Sender `json:"users,omitempty"`
+}
+
+// ConversationKey distributes the keys of the encrypted Conversation. Every time its members
+// change, the server sends one with Rotate set to its owner, or another member when the owner
+// is away, with the Members to make a new key of Epoch for. That member sends it
+// back with the new key Wrapped for every member, sealed with NaCl box for their BoxKey, and
+// the server sends each member its own Key along with the Distributor who wrapped it
+type ConversationKey struct {
+	Conversation uuid.UUID    `json:"conversation"`
+	Epoch        uint64       `json:"epoch"`
+	Rotate       bool         `json:"rotate,omitempty"`
+	Members      []Sender     `json:"members,omitempty"`
+	Wrapped      []WrappedKey `json:"wrapped,omitempty"`
+	Distributor  *Sender      `json:"distributor,omitempty"`
+	Key          *WrappedKey  `json:"key,omitempty"`
+}
+
+// WrappedKey is the key of a conversation sealed for its Recipient
+type WrappedKey struct {
+	Recipient uuid.UUID `json:"recipient"`
+	Box       []byte    `json:"box"`
+	Nonce     []byte    `json:"nonce"`
 }
 
-// Error type is used to send errors
+// Error type is used to send errors. Code identifies the kind of error for programs, and
+// RetryAfter (in seconds) tells the client when it may retry errors like rate limiting. Field
+// is the field of the operation's message that's wrong, for invalid payloads, like "nickname"
+// or "conversation.id"
 type Error struct {
-	Message string `json:"message"`
+	Code       string  `json:"code,omitempty"`
+	Message    string  `json:"message"`
+	RetryAfter float64 `json:"retry_after,omitempty"`
+	Field      string  `json:"field,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Drain is sent by an admin to make the server hand its clients over to another server
+// (at Address) before shutting down. The server exits once it has at most Threshold
+// connections left, or after Timeout seconds
+type Drain struct {
+	Address   string  `json:"address"`
+	Threshold int     `json:"threshold"`
+	Timeout   float64 `json:"timeout"`
+}
+
+// Announcement is sent by an admin to send Text to every connected client, as a direct
+// message from the server, or to the conversation with the nickname Conversation, as a
+// system message
+type Announcement struct {
+	Text         string `json:"text"`
+	Conversation string `json:"conversation,omitempty"`
+}
+
+// Whois is sent by a client to look up the users called Name. Names aren't unique, so the
+// response has a UserInfo for every user with that name in Users
+type Whois struct {
+	Name  string     `json:"name"`
+	Users []UserInfo `json:"users,omitempty"`
+}
+
+// UserInfo describes a user in the response to Whois. For users that chose to be Hidden, only
+// the ID, Name and Online are filled in
+type UserInfo struct {
+	ID            uuid.UUID  `json:"id"`
+	Name          string     `json:"name"`
+	Online        bool       `json:"online"`
+	ConnectedAt   *time.Time `json:"connected_at,omitempty"`
+	Conversations []string   `json:"conversations,omitempty"`
+	Hidden        bool       `json:"hidden,omitempty"`
+	Profile       Profile    `json:"profile"`
+	Status        Status     `json:"status"`
+}
+
+// Status is sent by a client to tell the others whether it's Away, and optionally what it's up
+// to. The subscribers of the user's conversations get the change as a Presence
+type Status struct {
+	Away bool   `json:"away"`
+	Text string `json:"text,omitempty"`
+}
+
+// Presence is sent by the server, as a response of type status, when a user changes its Status
+type Presence struct {
+	ID     uuid.UUID `json:"id"`
+	Name   string    `json:"name"`
+	Status Status    `json:"status"`
+}
+
+// Members is sent by a client to list who is in the conversation with Nickname: the response
+// has a UserInfo, without the conversations, for every online subscriber in Members
+type Members struct {
+	Nickname string     `json:"nickname"`
+	Members  []UserInfo `json:"members,omitempty"`
+}
+
+// Profile is what users tell others about themselves, shown in Whois. It's set with the
+// profile operation, which leaves the fields that are nil as they were, and responds with
+// the whole profile
+type Profile struct {
+	AvatarURL *string `json:"avatar_url,omitempty"`
+	Bio       *string `json:"bio,omitempty"`
+}
+
+// PrivacySettings is sent by a client to hide (or show) its conversations and connect time
+// from the other users' Whois
+type PrivacySettings struct {
+	Hidden bool `json:"hidden"`
+}
+
+// Block is sent by a client to block (or unblock) User, a name or an ID: the server stops
+// delivering messages from the blocked users to it. Blocking a name blocks every user with
+// that name. The response, like the one to the blocks operation, is a BlockList
+type Block struct {
+	User    string `json:"user"`
+	Blocked bool   `json:"blocked"`
+}
+
+// BlockList are the users a client blocked
+type BlockList struct {
+	Users []Sender `json:"users"`
+}
+
+// Report is sent by a client to flag the message with MessageID to the server's moderators,
+// saying why in Reason
+type Report struct {
+	MessageID uuid.UUID `json:"message_id"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// Auth is sent by a client to become an admin of the server, with the token of its configuration
+type Auth struct {
+	Token string `json:"token"`
+}
+
+// AdminCommand is sent by an admin to run Command, a line of the server's admin console.
+// The response carries the command's Output
+type AdminCommand struct {
+	Command string `json:"command"`
+	Output  string `json:"output,omitempty"`
+}
+
+// Device is sent along with the ClientAboutMe fields in the handshake, to tell the sessions
+// of a user apart: Client is the software it connects with and its version
+type Device struct {
+	Client string `json:"client,omitempty"`
+}
+
+// SessionInfo describes a connection of a user: its ID, where it's from and since when, and
+// its Client. Current is set for the session asking
+type SessionInfo struct {
+	ID          uuid.UUID `json:"id"`
+	User        Sender    `json:"user"`
+	Address     string    `json:"address"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Client      string    `json:"client,omitempty"`
+	Current     bool      `json:"current,omitempty"`
+}
+
+// Sessions asks for the sessions of the client's user, or of All users for admins, which
+// the response lists as Sessions, oldest first
+type Sessions struct {
+	All      bool          `json:"all,omitempty"`
+	Sessions []SessionInfo `json:"sessions,omitempty"`
+}
+
+// Revoke is sent to close the Session with the given ID, one of the user's own unless it's
+// sent by an admin
+type Revoke struct {
+	Session uuid.UUID `json:"session"`
+}
+
+// AccountExport is sent to get all the data the server keeps about the client's user. The
+// response is AccountData with up to Limit of the user's messages, oldest first; when there are
+// more, its NextCursor is sent back as Cursor for the next page, which only has messages
+type AccountExport struct {
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// AccountData is what the server keeps about a user: who it is and its settings, the
+// conversations it's subscribed to, owns and moderates, who it blocks, the messages waiting
+// for it to connect (Queued) and the messages it sent to conversations
+type AccountData struct {
+	User          Sender    `json:"user"`
+	LastConnect   time.Time `json:"last_connect,omitzero"`
+	Profile       Profile   `json:"profile"`
+	Hidden        bool      `json:"hidden,omitempty"`
+	Digest        bool      `json:"digest,omitempty"`
+	Email         string    `json:"email,omitempty"`
+	TwoFactor     bool      `json:"two_factor,omitempty"`
+	Conversations []string  `json:"conversations,omitempty"`
+	Owned         []string  `json:"owned,omitempty"`
+	Moderated     []string  `json:"moderated,omitempty"`
+	Blocked       []Sender  `json:"blocked,omitempty"`
+	Queued        []Message `json:"queued,omitempty"`
+	Messages      []Message `json:"messages"`
+	NextCursor    string    `json:"next_cursor,omitempty"`
+}
+
+// DeleteAccount is sent to delete the client's user from the server, with its name as Confirm.
+// Its messages are anonymized or removed, as the server is configured to, and its sessions
+// are revoked
+type DeleteAccount struct {
+	Confirm string `json:"confirm"`
+}
+
+// Migrate is sent by a draining server to tell clients where to reconnect
+type Migrate struct {
+	Address string `json:"address"`
+}
+
+// NameChange is sent by a client to change its name to Name. The response, and the name
+// operation the subscribers of the client's conversations get, have its ID and OldName too
+type NameChange struct {
+	ID      uuid.UUID `json:"id,omitzero"`
+	Name    string    `json:"name"`
+	OldName string    `json:"old_name,omitempty"`
+}
+
+// Registration is sent to register the client's name, for no other user to connect with it, or
+// to release it. Users may register a single name, and only if they prove who they are, with a
+// public key, a login or a certificate. The response has the Name registered, or released
+type Registration struct {
+	Registered bool   `json:"registered"`
+	Name       string `json:"name,omitempty"`
+}
+
+// DigestSettings is sent by a client to opt in to (or out of) the daily digest
+type DigestSettings struct {
+	Enabled bool `json:"enabled"`
+}
+
+// EmailDigestSettings is sent by a client to be emailed at Address the mentions and direct
+// messages it gets while offline, or without an Address to stop being emailed
+type EmailDigestSettings struct {
+	Address string `json:"address"`
 }
 
 // ClientAboutMe is a representation of the JSON message that client sends to let server know who they are
 type ClientAboutMe Sender
 
+// Challenge is sent by the server as a connection opens: clients with a public key sign its
+// Nonce, with Prove, for the Proof of their handshake
+type Challenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// Proof is sent along with the ClientAboutMe fields in the handshake by clients with a public
+// key, to show they have its private key, which the key they claim alone doesn't: the Nonce of
+// the server's challenge and their Signature of it
+type Proof struct {
+	Nonce     []byte `json:"nonce,omitempty"`
+	Signature []byte `json:"proof,omitempty"`
+}
+
+// Login is sent along with the ClientAboutMe fields in the handshake by clients logging in: to
+// a server that delegates authentication to an OIDC provider, with the IDToken they got from
+// it, or to one that checks passwords, with their Username and Password
+type Login struct {
+	IDToken  string `json:"id_token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// TOTPCode is the one-time code of accounts with two-factor authentication
+	TOTPCode string `json:"totp_code,omitempty"`
+}
+
+// The actions of TOTP operations
+const (
+	TOTPEnrollAction  = "enroll"
+	TOTPConfirmAction = "confirm"
+	TOTPDisableAction = "disable"
+)
+
+// TOTP is sent by clients logged in to a password account to set up two-factor authentication
+// with time-based one-time codes: "enroll" has the server make a Secret, also sent as an
+// otpauth:// URI for authenticator apps, which "confirm" turns on with a Code from the app.
+// "disable" turns it off, also with a Code. The server answers with whether it's Enabled
+type TOTP struct {
+	Action  string `json:"action"`
+	Code    string `json:"code,omitempty"`
+	Secret  string `json:"secret,omitempty"`
+	URI     string `json:"uri,omitempty"`
+	Enabled bool   `json:"enabled"`
+}
+
 // Operation struct is used to encapsulate general messages alongside metadata
 type Operation struct {
 	Type    string           `json:"type"`
@@ -56,6 +732,10 @@ type Response struct {
 	OperationType string           `json:"operation_type"`
 	Error         *Error           `json:"error"`
 	Message       *json.RawMessage `json:"message"`
+	RateLimit     *RateLimit       `json:"rate_limit,omitempty"`
+	// Queued is set in the response to the aboutme handshake to how many messages were kept
+	// for the client while it wasn't connected, which follow the response
+	Queued int `json:"queued,omitempty"`
 }
 
 func NewOperation() Operation {
@@ -76,19 +756,22 @@ func NewResponse() Response {
 	return response
 }
 
-// CheckError checks that err is not nil, and exits after a log if it isn't
-func CheckError(err error) {
-	if err != nil {
-		// this logs to standard error and calls os.Exit(1)
-		log.Fatalf("Fatal error: %s\n", err.Error())
+// CheckNetwork returns an error if network isn't one of Networks
+func CheckNetwork(network string) error {
+	for _, n := range Networks {
+		if network == n {
+			return nil
+		}
 	}
+
+	return fmt.Errorf("unknown network %q, should be one of %s", network, strings.Join(Networks, ", "))
 }
 
 // CheckErrorAndLog checks that err is not nil and logs the error if it isn't
 // Doesn't exit if err is not nil, but instead returns a boolean for whether err is not nil
 func CheckErrorAndLog(err error) (isNotNil bool) {
 	if err != nil {
-		log.Printf("Error: %s\n", err.Error())
+		Errorf("Error: %s\n", err.Error())
 		isNotNil = true
 	}
 
@@ -104,12 +787,11 @@ func ReadUntil(r reader, delim []byte) (returnBytes []byte, err error) {
 
 	for {
 		b, err := r.ReadBytes(lastChar)
+		returnBytes = append(returnBytes, b...)
 		if err != nil {
-			break
+			return returnBytes, err
 		}
 
-		returnBytes = append(returnBytes, b...)
-
 		if len(returnBytes) > len(delim) {
 			bSuffix := returnBytes[len(returnBytes)-len(delim):]
 			if bytes.Equal(delim, bSuffix) {
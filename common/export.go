@@ -0,0 +1,67 @@
+package common
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ExportFormats are the formats a conversation's history can be exported in
+var ExportFormats = []string{"json", "csv"}
+
+// csvHeader names the columns of CSV exports
+var csvHeader = []string{"id", "timestamp", "conversation", "sender_id", "sender", "kind", "text"}
+
+// WriteMessages writes messages to w in format, one of ExportFormats: a JSON array of the
+// messages as they're sent over the protocol, or CSV with a header line
+func WriteMessages(w io.Writer, format string, messages []Message) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		if messages == nil {
+			messages = []Message{}
+		}
+
+		return encoder.Encode(messages)
+	case "csv":
+		writer := csv.NewWriter(w)
+
+		err := writer.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+
+		for _, message := range messages {
+			conversation, senderID, sender := "", "", ""
+			if message.Conversation != nil {
+				conversation = message.Conversation.Nickname
+			}
+			if message.Sender != nil {
+				senderID, sender = message.Sender.ID.String(), message.Sender.Name
+			}
+
+			err := writer.Write([]string{
+				message.ID.String(),
+				message.Timestamp.Format(time.RFC3339Nano),
+				conversation,
+				senderID,
+				sender,
+				message.Kind,
+				message.Text,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		writer.Flush()
+
+		return writer.Error()
+	default:
+		return fmt.Errorf("unknown export format '%s', expected json or csv", format)
+	}
+}
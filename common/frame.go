@@ -0,0 +1,114 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// maxPooledFrameSize is the largest buffer kept in the pool, for a huge frame not to hold on to
+// its memory for ever
+const maxPooledFrameSize = 64 << 10
+
+// frameBuffer is a buffer frames are read into or encoded in, with an encoder writing to it
+type frameBuffer struct {
+	bytes.Buffer
+	encoder *json.Encoder
+}
+
+// framePool holds the frame buffers, reused from one frame to the next instead of allocating
+// new ones for every message
+var framePool = sync.Pool{
+	New: func() interface{} {
+		buf := &frameBuffer{}
+		buf.encoder = json.NewEncoder(&buf.Buffer)
+
+		return buf
+	},
+}
+
+func getFrameBuffer() *frameBuffer {
+	buf := framePool.Get().(*frameBuffer)
+	buf.Reset()
+
+	return buf
+}
+
+func putFrameBuffer(buf *frameBuffer) {
+	if buf.Cap() > maxPooledFrameSize {
+		return
+	}
+
+	framePool.Put(buf)
+}
+
+// Frame is a frame read by ReadFrame, in a buffer from the pool
+type Frame struct {
+	buf *frameBuffer
+}
+
+// Bytes are the bytes of the frame, delimiter included. They're only valid until Release
+func (f Frame) Bytes() []byte {
+	return f.buf.Bytes()
+}
+
+// Release gives the buffer of the frame back to the pool, once done with its bytes
+func (f Frame) Release() {
+	putFrameBuffer(f.buf)
+}
+
+// ReadFrame reads the next frame from r, like ReadUntil with EOFBytes does, but into a pooled
+// buffer, which the caller gives back with Release
+func ReadFrame(r *bufio.Reader) (Frame, error) {
+	buf := getFrameBuffer()
+	lastChar := EOFBytes[len(EOFBytes)-1]
+
+	for {
+		b, err := r.ReadSlice(lastChar)
+		buf.Write(b)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			putFrameBuffer(buf)
+			return Frame{}, err
+		}
+
+		if buf.Len() > len(EOFBytes) && bytes.HasSuffix(buf.Bytes(), EOFBytes) {
+			return Frame{buf: buf}, nil
+		}
+	}
+}
+
+// EncodeFrame encodes v as a frame, in a buffer of its own rather than a pooled one, for frames
+// that are kept around, e.g. to be written to many connections
+func EncodeFrame(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, EOFBytes...), nil
+}
+
+// WriteFrame encodes v as a frame and writes it to w in a single write, encoding it in a pooled
+// buffer rather than a new one every time
+func WriteFrame(w io.Writer, v interface{}) error {
+	buf := getFrameBuffer()
+	defer putFrameBuffer(buf)
+
+	err := buf.encoder.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	// the encoder ends the JSON with a newline, which the delimiter takes the place of
+	buf.Truncate(buf.Len() - 1)
+	buf.Write(EOFBytes)
+
+	_, err = w.Write(buf.Bytes())
+
+	return err
+}
@@ -0,0 +1,240 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestFrameRoundTrip writes frames with WriteFrame and EncodeFrame and reads them back with
+// ReadFrame, including ones longer than the reader's buffer and ones with "\r\n" in a string
+func TestFrameRoundTrip(t *testing.T) {
+	operations := []Operation{benchmarkOperation()}
+
+	long := json.RawMessage(`{"text":"` + strings.Repeat("x", 10000) + `"}`)
+	operations = append(operations, Operation{Type: MessageOperationType, Message: &long})
+
+	escaped := json.RawMessage(`{"text":"line one\r\nline two"}`)
+	operations = append(operations, Operation{Type: MessageOperationType, Message: &escaped})
+
+	stream := &bytes.Buffer{}
+	for _, operation := range operations {
+		err := WriteFrame(stream, operation)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frame, err := EncodeFrame(operation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write(frame)
+	}
+
+	reader := bufio.NewReaderSize(stream, 64)
+	for i := 0; i < 2*len(operations); i++ {
+		frame, err := ReadFrame(reader)
+		if err != nil {
+			t.Fatalf("frame %d: %s", i, err)
+		}
+
+		decoded := Operation{}
+		err = json.Unmarshal(frame.Bytes(), &decoded)
+		frame.Release()
+		if err != nil {
+			t.Fatalf("frame %d: %s", i, err)
+		}
+
+		want := operations[i/2]
+		if decoded.Type != want.Type || !bytes.Equal(*decoded.Message, *want.Message) {
+			t.Errorf("frame %d = %s %s, want %s %s", i, decoded.Type, *decoded.Message, want.Type, *want.Message)
+		}
+	}
+
+	_, err := ReadFrame(reader)
+	if err != io.EOF {
+		t.Errorf("got %v after the last frame, want io.EOF", err)
+	}
+}
+
+// readUntil and readFrame read a frame off r with ReadUntil and ReadFrame
+func readUntil(r *bufio.Reader) error {
+	_, err := ReadUntil(r, EOFBytes)
+	return err
+}
+
+func readFrame(r *bufio.Reader) error {
+	frame, err := ReadFrame(r)
+	if err != nil {
+		return err
+	}
+
+	frame.Release()
+
+	return nil
+}
+
+// benchmarkRead measures reading frames of 256 bytes to 64 KiB, without decoding them
+func benchmarkRead(b *testing.B, read func(r *bufio.Reader) error) {
+	for _, size := range []int{256, 4096, 65536} {
+		b.Run(fmt.Sprintf("bytes=%d", size), func(b *testing.B) {
+			frame := append(bytes.Repeat([]byte("x"), size-len(EOFBytes)), EOFBytes...)
+			reader := bufio.NewReader(&repeatReader{frame: frame})
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				err := read(reader)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadUntil and BenchmarkReadFrame compare reading frames without and with the pool
+func BenchmarkReadUntil(b *testing.B) {
+	benchmarkRead(b, readUntil)
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	benchmarkRead(b, readFrame)
+}
+
+func benchmarkOperation() Operation {
+	message := json.RawMessage(`{"conversation":{"id":"8c0cbb2e-6a4b-4f5e-9bd2-5f8e1a2c3d4e","nickname":"general"},` +
+		`"sender":{"id":"1f2e3d4c-5b6a-4978-8695-a4b3c2d1e0f9","name":"alice"},"text":"hello there, how is everyone doing today?"}`)
+
+	return Operation{Type: MessageOperationType, Message: &message}
+}
+
+// BenchmarkFrameEncode and BenchmarkFrameDecode allocate new buffers for every frame, next to
+// the pooled ones framing as the server and client do it
+func BenchmarkFrameEncode(b *testing.B) {
+	operation := benchmarkOperation()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		frame, err := json.Marshal(operation)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		frame = append(frame, EOFBytes...)
+		b.SetBytes(int64(len(frame)))
+	}
+}
+
+func BenchmarkFrameDecode(b *testing.B) {
+	operation := benchmarkOperation()
+
+	frame, err := json.Marshal(operation)
+	if err != nil {
+		b.Fatal(err)
+	}
+	frame = append(frame, EOFBytes...)
+
+	reader := bufio.NewReader(&repeatReader{frame: frame})
+
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		request, err := ReadUntil(reader, EOFBytes)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		decoded := Operation{}
+		err = json.Unmarshal(request, &decoded)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFrameEncodePooled(b *testing.B) {
+	operation := benchmarkOperation()
+	counter := &countingWriter{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		counter.n = 0
+
+		err := WriteFrame(counter, operation)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.SetBytes(counter.n)
+	}
+}
+
+func BenchmarkFrameDecodePooled(b *testing.B) {
+	operation := benchmarkOperation()
+
+	frame, err := json.Marshal(operation)
+	if err != nil {
+		b.Fatal(err)
+	}
+	frame = append(frame, EOFBytes...)
+
+	reader := bufio.NewReader(&repeatReader{frame: frame})
+
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		request, err := ReadFrame(reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		decoded := Operation{}
+		err = json.Unmarshal(request.Bytes(), &decoded)
+		request.Release()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// countingWriter discards what's written to it, counting the bytes
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// repeatReader reads frame over and over, without ever coming to an end
+type repeatReader struct {
+	frame  []byte
+	offset int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		copied := copy(p[n:], r.frame[r.offset:])
+		n += copied
+		r.offset = (r.offset + copied) % len(r.frame)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Log levels, from the most to the least verbose
+const (
+	DebugLogLevel = "debug"
+	InfoLogLevel  = "info"
+	ErrorLogLevel = "error"
+)
+
+var logLevel = InfoLogLevel
+
+// logOutput is where the logs go, unless they are silenced
+var logOutput io.Writer = os.Stderr
+
+// errorLog keeps logging errors when the standard logger is silenced
+var errorLog = log.New(os.Stderr, "", log.LstdFlags)
+
+// SetLogLevel makes the logs as verbose as level: debug logs everything, including the
+// frames sent and received, info leaves those out, and error only logs errors
+func SetLogLevel(level string) error {
+	switch level {
+	case DebugLogLevel, InfoLogLevel:
+		log.SetOutput(logOutput)
+	case ErrorLogLevel:
+		log.SetOutput(io.Discard)
+	default:
+		return fmt.Errorf("unknown log level '%s', use debug, info or error", level)
+	}
+
+	logLevel = level
+
+	return nil
+}
+
+// SetLogOutput sends the logs, errors included, to w instead of stderr
+func SetLogOutput(w io.Writer) {
+	logOutput = w
+	errorLog.SetOutput(w)
+
+	if logLevel != ErrorLogLevel {
+		log.SetOutput(w)
+	}
+}
+
+// Debugf logs like log.Printf, but only at the debug level
+func Debugf(format string, v ...interface{}) {
+	if logLevel == DebugLogLevel {
+		log.Printf(format, v...)
+	}
+}
+
+// Errorf logs an error like log.Printf, at every level
+func Errorf(format string, v ...interface{}) {
+	errorLog.Printf(format, v...)
+}
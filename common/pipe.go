@@ -0,0 +1,68 @@
+package common
+
+import (
+	"net"
+	"sync"
+)
+
+// PipeListener is an in-memory net.Listener. Every Dial makes a net.Pipe, returning one end and
+// handing the other to Accept, so that a server and its clients can be wired together in a
+// single process, e.g. in tests or when embedding the server, without opening any socket
+type PipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Accept waits for the next Dial, returning the server's end of its pipe
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener. The pipes it made stay open
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial makes a pipe to the listener, waiting for it to be accepted. network and address are
+// ignored, for PipeListener to be used where a dialer is expected
+func (l *PipeListener) Dial(network, address string) (net.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+
+	select {
+	case l.conns <- serverConn:
+		return clientConn, nil
+	case <-l.closed:
+		serverConn.Close()
+		clientConn.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+// pipeAddr is the address of a PipeListener, like that of the ends of a net.Pipe
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "pipe"
+}
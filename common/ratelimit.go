@@ -0,0 +1,70 @@
+package common
+
+import (
+	"math"
+	"time"
+)
+
+// RateLimit describes the token bucket that a server applies to the operations of each client.
+// Clients get `Burst` operations at once, refilled at `Rate` operations per second
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// TokenBucket is a token bucket rate limiter shared by the server (to enforce a RateLimit) and
+// the client (to pace itself under it). It is not safe for concurrent use
+type TokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full token bucket for the given limit
+func NewTokenBucket(limit RateLimit) *TokenBucket {
+	return &TokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+// SetLimit changes the limit of the bucket, keeping the tokens it already has (up to the new burst)
+func (tb *TokenBucket) SetLimit(limit RateLimit) {
+	tb.limit = limit
+	tb.tokens = math.Min(tb.tokens, float64(limit.Burst))
+}
+
+// Take takes one token out of the bucket if there is one. If there isn't, it returns
+// how long it will be until the next token is available
+func (tb *TokenBucket) Take(now time.Time) (ok bool, wait time.Duration) {
+	if tb.limit.Rate <= 0 {
+		// no limit
+		return true, 0
+	}
+
+	tb.refill(now)
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+
+	wait = time.Duration((1 - tb.tokens) / tb.limit.Rate * float64(time.Second))
+
+	return false, wait
+}
+
+// Empty removes all tokens from the bucket, e.g. after the server said that we're going too fast
+func (tb *TokenBucket) Empty(now time.Time) {
+	tb.refill(now)
+	tb.tokens = 0
+}
+
+func (tb *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.last).Seconds()
+	if elapsed > 0 {
+		tb.tokens = math.Min(tb.tokens+elapsed*tb.limit.Rate, float64(tb.limit.Burst))
+		tb.last = now
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ed25519"
+)
+
+// signingContext starts the bytes of every signed message, so that signatures made for
+// messages can't be passed off as signatures of anything else, and handshakeContext those of
+// the proofs of the handshake
+const (
+	signingContext   = "tcpchat message v1\n"
+	handshakeContext = "tcpchat handshake v1\n"
+)
+
+// SignedBytes are the bytes of a message its sender signs: who sends it, to which conversation
+// (or recipient, for direct messages), and its text, or its nonce and box when it's encrypted
+func SignedBytes(message Message) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString(signingContext)
+
+	if message.Sender != nil {
+		b.WriteString(message.Sender.ID.String())
+	}
+	b.WriteByte('\n')
+
+	switch {
+	case message.Conversation != nil:
+		b.WriteString(message.Conversation.ID.String())
+	case message.Recipient != nil:
+		b.WriteString(message.Recipient.ID.String())
+	}
+	b.WriteByte('\n')
+
+	if len(message.Box) > 0 {
+		b.Write(message.Nonce)
+		b.Write(message.Box)
+	} else {
+		b.WriteString(message.Text)
+	}
+
+	return b.Bytes()
+}
+
+// Sign sets the Signature of message, whose Sender and Conversation or Recipient must be set,
+// with key
+func Sign(message *Message, key ed25519.PrivateKey) {
+	message.Signature = ed25519.Sign(key, SignedBytes(*message))
+}
+
+// Verify tells if message is signed with the key of its Sender. Unsigned messages, and
+// messages from senders without a key, aren't
+func Verify(message Message) bool {
+	if message.Sender == nil || len(message.Sender.PublicKey) != ed25519.PublicKeySize || len(message.Signature) == 0 {
+		return false
+	}
+
+	return ed25519.Verify(message.Sender.PublicKey, SignedBytes(message), message.Signature)
+}
+
+// Prove signs the nonce of the server's challenge with key, for the Proof of the handshake
+func Prove(nonce []byte, key ed25519.PrivateKey) Proof {
+	return Proof{Nonce: nonce, Signature: ed25519.Sign(key, append([]byte(handshakeContext), nonce...))}
+}
+
+// VerifyProof tells if proof was signed with the private key of publicKey
+func VerifyProof(publicKey []byte, proof Proof) bool {
+	if len(publicKey) != ed25519.PublicKeySize || len(proof.Nonce) == 0 || len(proof.Signature) == 0 {
+		return false
+	}
+
+	return ed25519.Verify(publicKey, append([]byte(handshakeContext), proof.Nonce...), proof.Signature)
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTracedFrameSize is how much of a frame TapFrames buffers waiting for its delimiter, past
+// which it taps what it has as is
+const maxTracedFrameSize = 1 << 20
+
+// redacted takes the place of secrets in traced frames
+const redacted = "[redacted]"
+
+// secretFields are the fields of the protocol's messages whose values are left out of traces:
+// passwords, tokens and the like
+var secretFields = map[string]bool{
+	"password":  true,
+	"token":     true,
+	"id_token":  true,
+	"totp_code": true,
+	"secret":    true,
+}
+
+// WireTracer logs the frames going in and out of connections, for debugging the protocol.
+// Frames of JSON are pretty-printed with their secrets redacted, anything else is hex dumped
+type WireTracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWireTracer(w io.Writer) *WireTracer {
+	return &WireTracer{w: w}
+}
+
+// OpenWireTrace returns a WireTracer appending to the file at path, created if needed. Traces
+// have the text of messages, so only the user can read the file
+func OpenWireTrace(path string) (*WireTracer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open the wire trace: %w", err)
+	}
+
+	return NewWireTracer(f), nil
+}
+
+// Trace returns conn, logging the frames read from and written to it. Tracing a nil WireTracer
+// returns conn as it is
+func (t *WireTracer) Trace(conn net.Conn) net.Conn {
+	if t == nil {
+		return conn
+	}
+
+	return TapFrames(conn, func(sent bool, frame []byte, incomplete bool) {
+		direction := "<-"
+		if sent {
+			direction = "->"
+		}
+
+		t.log(conn, direction, frame, incomplete)
+	})
+}
+
+func (t *WireTracer) log(conn net.Conn, direction string, frame []byte, incomplete bool) {
+	entry := &bytes.Buffer{}
+	fmt.Fprintf(entry, "%s %s %s %s", time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), conn.LocalAddr(), direction, conn.RemoteAddr())
+	if incomplete {
+		entry.WriteString(" (incomplete)")
+	}
+	entry.WriteString("\n")
+
+	pretty, ok := prettyFrame(frame)
+	if ok {
+		entry.Write(pretty)
+	} else {
+		entry.WriteString(hex.Dump(frame))
+	}
+	entry.WriteString("\n")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.w.Write(entry.Bytes())
+}
+
+// prettyFrame is frame, without its delimiter, indented and with its secrets redacted, if it
+// is JSON
+func prettyFrame(frame []byte) ([]byte, bool) {
+	return redactFrame(frame, "  ")
+}
+
+// RedactFrame is frame, without its delimiter, with the values of its secrets replaced, if it
+// is JSON. The JSON is re-encoded, with the keys of objects sorted
+func RedactFrame(frame []byte) ([]byte, bool) {
+	b, ok := redactFrame(frame, "")
+	if !ok {
+		return nil, false
+	}
+
+	return bytes.TrimSuffix(b, []byte("\n")), true
+}
+
+func redactFrame(frame []byte, indent string) ([]byte, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(bytes.TrimSuffix(frame, EOFBytes)))
+	decoder.UseNumber()
+
+	var v interface{}
+	err := decoder.Decode(&v)
+	if err != nil || decoder.More() {
+		return nil, false
+	}
+
+	b := &bytes.Buffer{}
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+
+	err = encoder.Encode(redact(v))
+	if err != nil {
+		return nil, false
+	}
+
+	return b.Bytes(), true
+}
+
+// redact replaces the values of the secret fields in v, wherever they're nested, and the
+// otpauth:// URIs two-factor secrets are sent in
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if secretFields[key] && value != "" {
+				v[key] = redacted
+				continue
+			}
+
+			v[key] = redact(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redact(value)
+		}
+	case string:
+		if strings.HasPrefix(v, "otpauth://") {
+			return redacted
+		}
+	}
+
+	return v
+}
+
+// FrameTap is called with every frame going over a connection, whether it was sent or
+// received, with whatever was left of one that never ended as incomplete
+type FrameTap func(sent bool, frame []byte, incomplete bool)
+
+// TapFrames returns conn, calling tap with the frames read from and written to it, whole
+// however they were read or written
+func TapFrames(conn net.Conn, tap FrameTap) net.Conn {
+	return &tappedConn{
+		Conn:     conn,
+		inbound:  frameSplitter{tap: tap},
+		outbound: frameSplitter{tap: tap, sent: true},
+	}
+}
+
+// tappedConn is a connection whose frames go to a FrameTap
+type tappedConn struct {
+	net.Conn
+	inbound  frameSplitter
+	outbound frameSplitter
+}
+
+func (c *tappedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.inbound.write(b[:n])
+
+	return n, err
+}
+
+func (c *tappedConn) Write(b []byte) (int, error) {
+	// before writing, for the frame to be tapped before its response
+	c.outbound.write(b)
+
+	return c.Conn.Write(b)
+}
+
+// Close taps whatever is left of a frame in either direction, then closes the connection
+func (c *tappedConn) Close() error {
+	c.inbound.flush()
+	c.outbound.flush()
+
+	return c.Conn.Close()
+}
+
+// frameSplitter collects the bytes going one way on a connection into frames
+type frameSplitter struct {
+	mu   sync.Mutex
+	buf  []byte
+	tap  FrameTap
+	sent bool
+}
+
+func (s *frameSplitter) write(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf = append(s.buf, b...)
+
+	for {
+		i := bytes.Index(s.buf, EOFBytes)
+		if i < 0 {
+			break
+		}
+
+		end := i + len(EOFBytes)
+		// the client ends its frames with a second delimiter, which isn't a frame of its own
+		if i > 0 {
+			s.tap(s.sent, s.buf[:end], false)
+		}
+		s.buf = s.buf[end:]
+	}
+
+	if len(s.buf) > maxTracedFrameSize {
+		s.tap(s.sent, s.buf, true)
+		s.buf = nil
+	}
+
+	// don't hold on to the memory of a big frame
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+}
+
+func (s *frameSplitter) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.buf) > 0 {
+		s.tap(s.sent, s.buf, true)
+		s.buf = nil
+	}
+}
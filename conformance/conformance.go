@@ -0,0 +1,665 @@
+// Package conformance checks that a server behaves like tcpchat's own does on the wire, one
+// behavior at a time, for other implementations of the protocol to be tested against
+package conformance
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+const (
+	// responseTimeout is how long a check waits for a response it expects
+	responseTimeout = 5 * time.Second
+	// silenceTimeout is how long a check waits to be sure that nothing comes
+	silenceTimeout = 500 * time.Millisecond
+)
+
+// Check is a behavior expected of a server
+type Check struct {
+	Name        string
+	Description string
+	run         func(dial Dial) error
+}
+
+// Dial connects to the server under test
+type Dial func() (net.Conn, error)
+
+// Checks are all the behaviors checked by Run, in order
+var Checks = []Check{
+	{"handshake", "aboutme is answered with the client's identity", checkHandshake},
+	{"malformed-handshake", "a handshake that isn't JSON is answered with an error, and the connection closed", checkMalformedHandshake},
+	{"create", "a conversation can be created", checkCreate},
+	{"list", "the list of conversations has the ones created", checkList},
+	{"subscribe", "subscribing answers with the conversation", checkSubscribe},
+	{"subscribe-unknown", "subscribing to a conversation that doesn't exist is refused", checkSubscribeUnknown},
+	{"message", "a message is delivered to its sender, when subscribed", checkMessage},
+	{"fan-out", "a message is delivered to the other subscribers", checkFanOut},
+	{"unsubscribe", "messages stop being delivered once unsubscribed", checkUnsubscribe},
+	{"empty-message", "an empty message is refused with empty_message, and the session goes on", checkEmptyMessage},
+	{"unknown-conversation", "a message to a conversation that doesn't exist is refused with not_found", checkUnknownConversation},
+	{"malformed-frame", "a frame that isn't JSON is answered with an error, and the connection closed", checkMalformedFrame},
+	{"missing-message", "an operation without a message is answered with an error, and the connection closed", checkMissingMessage},
+}
+
+// Run runs the checks with names matching filter, or all of them if filter is nil, against the
+// server dial connects to. Every result is written to w, and the number of failed checks returned
+func Run(w io.Writer, dial Dial, filter *regexp.Regexp) int {
+	passed, failed := 0, 0
+
+	for _, check := range Checks {
+		if filter != nil && !filter.MatchString(check.Name) {
+			continue
+		}
+
+		err := check.run(dial)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL  %s: %s\n      %s\n", check.Name, check.Description, err.Error())
+			continue
+		}
+
+		passed++
+		fmt.Fprintf(w, "ok    %s: %s\n", check.Name, check.Description)
+	}
+
+	fmt.Fprintf(w, "\n%d passed, %d failed\n", passed, failed)
+
+	return failed
+}
+
+// client is a connection to the server under test
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	id     uuid.UUID
+	name   string
+}
+
+func connect(dial Dial) (*client, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect: %w", err)
+	}
+
+	id := uuid.New()
+	return &client{conn: conn, reader: bufio.NewReader(conn), id: id, name: "conformance-" + id.String()[:8]}, nil
+}
+
+// connectAs connects and introduces the client, checking that the server accepts it
+func connectAs(dial Dial) (*client, error) {
+	c, err := connect(dial)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.send(common.AboutMeOperationType, common.ClientAboutMe{ID: c.id, Name: c.name})
+	if err == nil {
+		_, err = c.expect(common.AboutMeOperationType)
+	}
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	return c, nil
+}
+
+func (c *client) close() {
+	c.conn.Close()
+}
+
+func (c *client) send(operationType string, v interface{}) error {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	raw := json.RawMessage(message)
+
+	return c.sendFrame(common.Operation{Type: operationType, Message: &raw})
+}
+
+func (c *client) sendFrame(v interface{}) error {
+	c.conn.SetWriteDeadline(time.Now().Add(responseTimeout))
+	return common.WriteFrame(c.conn, v)
+}
+
+// next reads the next response, waiting up to timeout for it
+func (c *client) next(timeout time.Duration) (common.Response, error) {
+	response := common.Response{}
+
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	frame, err := common.ReadFrame(c.reader)
+	if err != nil {
+		return response, err
+	}
+	defer frame.Release()
+
+	err = json.Unmarshal(frame.Bytes(), &response)
+	if err != nil {
+		return response, fmt.Errorf("response isn't JSON: %w: %q", err, frame.Bytes())
+	}
+
+	return response, nil
+}
+
+// expect reads responses until one to an operation of the given type, which must be ok
+func (c *client) expect(operationType string) (common.Response, error) {
+	for {
+		response, err := c.next(responseTimeout)
+		if err != nil {
+			return response, fmt.Errorf("expected a response to %s: %w", operationType, err)
+		}
+
+		if response.Status == "error" && (response.OperationType == operationType || response.OperationType == "") {
+			return response, fmt.Errorf("expected %s to be ok, got error %s", operationType, describe(response.Error))
+		}
+
+		if response.OperationType == operationType {
+			if response.Status != "ok" {
+				return response, fmt.Errorf("expected status ok for %s, got %q", operationType, response.Status)
+			}
+
+			return response, nil
+		}
+	}
+}
+
+// expectError reads responses until an error, which must have the given code unless it's empty
+func (c *client) expectError(code string) (*common.Error, error) {
+	for {
+		response, err := c.next(responseTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("expected an error: %w", err)
+		}
+
+		if response.Status != "error" {
+			continue
+		}
+
+		if response.Error == nil {
+			return nil, errors.New("expected an error, got one without any details")
+		}
+		if code != "" && response.Error.Code != code {
+			return nil, fmt.Errorf("expected an error with code %s, got %s", code, describe(response.Error))
+		}
+
+		return response.Error, nil
+	}
+}
+
+// expectMessage reads responses until the message with the given text
+func (c *client) expectMessage(text string) (common.Message, error) {
+	for {
+		response, err := c.next(responseTimeout)
+		if err != nil {
+			return common.Message{}, fmt.Errorf("expected message %q: %w", text, err)
+		}
+
+		message, ok := asMessage(response)
+		if ok && message.Text == text {
+			return message, nil
+		}
+	}
+}
+
+// expectNoMessage reads responses for a while, none of which may be the message with the
+// given text
+func (c *client) expectNoMessage(text string) error {
+	deadline := time.Now().Add(silenceTimeout)
+
+	for {
+		response, err := c.next(time.Until(deadline))
+		if errors.Is(err, net.ErrClosed) || isTimeout(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if message, ok := asMessage(response); ok && message.Text == text {
+			return fmt.Errorf("got message %q, which shouldn't have been delivered", text)
+		}
+	}
+}
+
+// expectClosed reads responses until the server closes the connection
+func (c *client) expectClosed() error {
+	for {
+		_, err := c.next(responseTimeout)
+		if err == nil {
+			continue
+		}
+		if isTimeout(err) {
+			return errors.New("expected the connection to be closed, it's still open")
+		}
+
+		return nil
+	}
+}
+
+// createAndSubscribe creates a conversation with a new nickname and subscribes to it
+func (c *client) createAndSubscribe() (*common.Conversation, error) {
+	nickname := "conformance-" + uuid.New().String()[:8]
+
+	err := c.send(common.CreateOperationType, common.Conversation{Nickname: nickname})
+	if err == nil {
+		_, err = c.expect(common.CreateOperationType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	return c.subscribe(nickname)
+}
+
+func (c *client) subscribe(nickname string) (*common.Conversation, error) {
+	err := c.send(common.SubscribeOperationType, common.Conversation{Nickname: nickname})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.expect(common.SubscribeOperationType)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation := &common.Conversation{}
+	err = json.Unmarshal(*response.Message, conversation)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe response isn't a conversation: %w", err)
+	}
+	if conversation.Nickname != nickname || conversation.ID == uuid.Nil {
+		return nil, fmt.Errorf("expected conversation %s with an ID, got %q with ID %s", nickname, conversation.Nickname, conversation.ID)
+	}
+
+	return conversation, nil
+}
+
+func (c *client) sendMessage(conversation *common.Conversation, text string) error {
+	return c.send(common.MessageOperationType, common.Message{
+		Conversation: &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname},
+		Sender:       &common.Sender{ID: c.id, Name: c.name},
+		Text:         text,
+		Timestamp:    time.Now(),
+	})
+}
+
+// asMessage is the message delivered by response, if it delivers one
+func asMessage(response common.Response) (common.Message, bool) {
+	message := common.Message{}
+	if response.OperationType != common.MessageOperationType || response.Status != "ok" || response.Message == nil {
+		return message, false
+	}
+
+	err := json.Unmarshal(*response.Message, &message)
+	if err != nil || message.Conversation == nil {
+		return message, false
+	}
+
+	return message, true
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func describe(err *common.Error) string {
+	if err == nil {
+		return "(no details)"
+	}
+	if err.Code == "" {
+		return fmt.Sprintf("%q", err.Message)
+	}
+
+	return fmt.Sprintf("%s (%q)", err.Code, err.Message)
+}
+
+func checkHandshake(dial Dial) error {
+	c, err := connect(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.send(common.AboutMeOperationType, common.ClientAboutMe{ID: c.id, Name: c.name})
+	if err != nil {
+		return err
+	}
+
+	response, err := c.expect(common.AboutMeOperationType)
+	if err != nil {
+		return err
+	}
+
+	about := common.ClientAboutMe{}
+	err = json.Unmarshal(*response.Message, &about)
+	if err != nil {
+		return fmt.Errorf("aboutme response isn't a client: %w", err)
+	}
+	if about.ID != c.id {
+		return fmt.Errorf("expected our ID %s back, got %s", c.id, about.ID)
+	}
+
+	return nil
+}
+
+func checkMalformedHandshake(dial Dial) error {
+	c, err := connect(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	_, err = c.conn.Write([]byte("this isn't JSON" + string(common.EOFBytes)))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expectError("")
+	if err != nil {
+		return err
+	}
+
+	return c.expectClosed()
+}
+
+func checkCreate(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.send(common.CreateOperationType, common.Conversation{Nickname: "conformance-" + uuid.New().String()[:8]})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expect(common.CreateOperationType)
+
+	return err
+}
+
+func checkList(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	conversation, err := c.createAndSubscribe()
+	if err != nil {
+		return err
+	}
+
+	err = c.send(common.ListOperationType, struct{}{})
+	if err != nil {
+		return err
+	}
+
+	response, err := c.expect(common.ListOperationType)
+	if err != nil {
+		return err
+	}
+
+	list := []common.Conversation{}
+	err = json.Unmarshal(*response.Message, &list)
+	if err != nil {
+		return fmt.Errorf("list response isn't a list of conversations: %w", err)
+	}
+
+	if !slices.ContainsFunc(list, func(listed common.Conversation) bool { return listed.ID == conversation.ID }) {
+		return fmt.Errorf("conversation %s isn't listed", conversation.Nickname)
+	}
+
+	return nil
+}
+
+func checkSubscribe(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	_, err = c.createAndSubscribe()
+
+	return err
+}
+
+func checkSubscribeUnknown(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.send(common.SubscribeOperationType, common.Conversation{Nickname: "conformance-missing-" + uuid.New().String()[:8]})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expectError("")
+
+	return err
+}
+
+func checkMessage(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	conversation, err := c.createAndSubscribe()
+	if err != nil {
+		return err
+	}
+
+	err = c.sendMessage(conversation, "hello from the conformance checks")
+	if err != nil {
+		return err
+	}
+
+	message, err := c.expectMessage("hello from the conformance checks")
+	if err != nil {
+		return err
+	}
+
+	if message.Conversation.ID != conversation.ID {
+		return fmt.Errorf("expected the message in conversation %s, got %s", conversation.ID, message.Conversation.ID)
+	}
+	if message.Sender == nil || message.Sender.ID != c.id {
+		return errors.New("expected the message to be from us")
+	}
+
+	return nil
+}
+
+func checkFanOut(dial Dial) error {
+	sender, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer sender.close()
+
+	receiver, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer receiver.close()
+
+	conversation, err := sender.createAndSubscribe()
+	if err != nil {
+		return err
+	}
+
+	_, err = receiver.subscribe(conversation.Nickname)
+	if err != nil {
+		return err
+	}
+
+	err = sender.sendMessage(conversation, "hello to the other subscribers")
+	if err != nil {
+		return err
+	}
+
+	message, err := receiver.expectMessage("hello to the other subscribers")
+	if err != nil {
+		return err
+	}
+
+	if message.Sender == nil || message.Sender.ID != sender.id {
+		return errors.New("expected the message to be from its sender")
+	}
+
+	return nil
+}
+
+func checkUnsubscribe(dial Dial) error {
+	sender, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer sender.close()
+
+	receiver, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer receiver.close()
+
+	conversation, err := sender.createAndSubscribe()
+	if err != nil {
+		return err
+	}
+
+	_, err = receiver.subscribe(conversation.Nickname)
+	if err != nil {
+		return err
+	}
+
+	err = receiver.send(common.UnsubscribeOperationType, common.Conversation{Nickname: conversation.Nickname})
+	if err != nil {
+		return err
+	}
+
+	_, err = receiver.expect(common.UnsubscribeOperationType)
+	if err != nil {
+		return err
+	}
+
+	err = sender.sendMessage(conversation, "hello to nobody else")
+	if err != nil {
+		return err
+	}
+
+	_, err = sender.expectMessage("hello to nobody else")
+	if err != nil {
+		return err
+	}
+
+	return receiver.expectNoMessage("hello to nobody else")
+}
+
+func checkEmptyMessage(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	conversation, err := c.createAndSubscribe()
+	if err != nil {
+		return err
+	}
+
+	err = c.sendMessage(conversation, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expectError(common.EmptyMessageErrorCode)
+	if err != nil {
+		return err
+	}
+
+	// the session goes on
+	err = c.send(common.ListOperationType, struct{}{})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expect(common.ListOperationType)
+
+	return err
+}
+
+func checkUnknownConversation(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.sendMessage(&common.Conversation{ID: uuid.New(), Nickname: "conformance-missing"}, "hello?")
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expectError(common.NotFoundErrorCode)
+
+	return err
+}
+
+func checkMalformedFrame(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	_, err = c.conn.Write([]byte(`{"type": "list", "message": ` + string(common.EOFBytes)))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expectError("")
+	if err != nil {
+		return err
+	}
+
+	return c.expectClosed()
+}
+
+func checkMissingMessage(dial Dial) error {
+	c, err := connectAs(dial)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	err = c.sendFrame(map[string]string{"type": common.ListOperationType})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expectError("")
+	if err != nil {
+		return err
+	}
+
+	return c.expectClosed()
+}
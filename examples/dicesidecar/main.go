@@ -0,0 +1,92 @@
+// dicesidecar is a sample plugin sidecar: it answers "/dice 2d6" in conversations with the
+// dice it rolled. The server runs it, speaking JSON-RPC on its standard input and output, with
+// this in its configuration:
+//
+//	plugins:
+//	  - command: [go, run, ./examples/dicesidecar]
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nikochiko/tcpchat/common"
+	"github.com/nikochiko/tcpchat/server"
+)
+
+// Plugin has the methods the server calls
+type Plugin struct{}
+
+func (Plugin) Commands(_ struct{}, commands *[]string) error {
+	*commands = []string{"dice"}
+	return nil
+}
+
+func (Plugin) OnConnect(client common.Sender, result *server.SidecarConnect) error {
+	return nil
+}
+
+func (Plugin) OnMessage(message common.Message, result *server.FilterResult) error {
+	return nil
+}
+
+func (Plugin) OnCommand(command server.Command, reply *server.SidecarReply) error {
+	dice := command.Args
+	if dice == "" {
+		dice = "1d6"
+	}
+
+	count, sides, ok := strings.Cut(dice, "d")
+	n, err := strconv.Atoi(count)
+	if count == "" {
+		n, err = 1, nil
+	}
+	m, err2 := strconv.Atoi(sides)
+	if !ok || err != nil || err2 != nil || n < 1 || n > 100 || m < 2 || m > 1000 {
+		reply.Text = "usage: /dice [count]d<sides>, like /dice 2d6"
+		return nil
+	}
+
+	rolls := []string{}
+	total := 0
+	for range n {
+		roll := rand.IntN(m) + 1
+		total += roll
+		rolls = append(rolls, strconv.Itoa(roll))
+	}
+
+	name := "someone"
+	if command.Message.Sender != nil {
+		name = command.Message.Sender.Name
+	}
+	reply.Text = fmt.Sprintf("%s rolled %s: %s (%d)", name, dice, strings.Join(rolls, " + "), total)
+
+	return nil
+}
+
+// stdio is the standard input and output as one connection
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error {
+	return nil
+}
+
+func main() {
+	err := rpc.Register(Plugin{})
+	if err != nil {
+		log.Fatalf("Fatal error: %s\n", err.Error())
+	}
+
+	// the server closes the standard input when it's done with the sidecar, which returns
+	jsonrpc.ServeConn(stdio{os.Stdin, os.Stdout})
+}
@@ -0,0 +1,93 @@
+// karmabot is a sample bot: it echoes "!echo" messages back, and keeps the karma people give
+// each other with "name++" and "name--" in every conversation it joins, telling it on "!karma".
+//
+//	go run ./examples/karmabot -name karmabot localhost:8080 general random
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/nikochiko/tcpchat/bot"
+	"github.com/nikochiko/tcpchat/client"
+)
+
+// karmaPattern matches "name++" and "name--", with an @ before the name or not
+var karmaPattern = regexp.MustCompile(`@?([\pL\pN_.-]+?)(\+\+|--)(?:\s|$)`)
+
+func main() {
+	configFile := flag.String("config", "", "read the configuration, and keep the bot's identity, next to `file` (a new identity every run without)")
+	name := flag.String("name", "karmabot", "display `name` of the bot")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: karmabot [flags] <host>:<port>|<profile alias> <conversation>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := client.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Fatal error: %s\n", err.Error())
+	}
+	config.Name = *name
+
+	b := bot.New(config, config.Profiles(flag.Args()[:1])[0])
+	b.Join(flag.Args()[1:]...)
+
+	b.Command("!echo", func(m *bot.Message) error {
+		if m.Args == "" {
+			return nil
+		}
+
+		return m.Reply(m.Args)
+	})
+
+	b.Command("!karma", func(m *bot.Message) error {
+		who := strings.TrimPrefix(m.Args, "@")
+		if who == "" {
+			who = m.Sender.Name
+		}
+
+		return m.Reply(fmt.Sprintf("%s has %d karma", who, karma(m)[strings.ToLower(who)]))
+	})
+
+	b.Pattern(karmaPattern, func(m *bot.Message) error {
+		who, change := m.Match[1], m.Match[2]
+		if strings.EqualFold(who, m.Sender.Name) {
+			return m.Reply("Nice try, " + m.Sender.Name)
+		}
+
+		counts := karma(m)
+		if change == "++" {
+			counts[strings.ToLower(who)]++
+		} else {
+			counts[strings.ToLower(who)]--
+		}
+
+		return m.Reply(fmt.Sprintf("%s now has %d karma", who, counts[strings.ToLower(who)]))
+	})
+
+	err = b.Run()
+	if err != nil {
+		log.Fatalf("Fatal error: %s\n", err.Error())
+	}
+}
+
+// karma is the karma of everyone in the conversation of m, by their lowercased name
+func karma(m *bot.Message) map[string]int {
+	counts, ok := m.State["karma"].(map[string]int)
+	if !ok {
+		counts = map[string]int{}
+		m.State["karma"] = counts
+	}
+
+	return counts
+}
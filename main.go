@@ -1,27 +1,654 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/nikochiko/tcpchat/bench"
 	"github.com/nikochiko/tcpchat/client"
+	"github.com/nikochiko/tcpchat/common"
+	"github.com/nikochiko/tcpchat/conformance"
 	"github.com/nikochiko/tcpchat/server"
+	"golang.org/x/term"
 )
 
+const usage = `tcpchat is a multi-user, multi-conversation chat over TCP.
+
+Usage:
+
+	tcpchat <command> [flags] [arguments]
+
+The commands are:
+
+	serve     run a server
+	connect   connect to servers and chat
+	admin     run an administrative command on a server
+	send      send a message to a conversation and exit
+	pipe      send the lines of the standard input to a conversation
+	bench     run the benchmarks and compare them with an earlier run
+	replay    show a recorded session, or replay it against a server
+	conformance
+	          check that a server speaks the protocol like tcpchat's does
+
+Run "tcpchat <command> -h" for the flags of a command.
+`
+
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatalf("Usage: %s [client|server] <host>:<port>\n", os.Args[0])
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	args := flag.Args()[1:]
+
+	// server and client are the names the commands had before they got their own flags
+	switch command := strings.ToLower(flag.Arg(0)); command {
+	case "serve", "server":
+		runServe(args)
+	case "connect", "client":
+		runConnect(args)
+	case "admin":
+		runAdmin(args)
+	case "send":
+		runSend(args)
+	case "pipe":
+		runPipe(args)
+	case "bench":
+		runBench(args)
+	case "replay":
+		runReplay(args)
+	case "conformance":
+		runConformance(args)
+	case "help":
+		flag.Usage()
+	default:
+		fmt.Fprintf(os.Stderr, "tcpchat: unknown command %s\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// newFlagSet returns the flag set of a command, with a -h output made of the command's usage
+// line, its description and its flags
+func newFlagSet(name, usageLine, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: tcpchat %s\n\n%s\n\nFlags:\n", usageLine, description)
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+// exitOnError exits after logging err, if it isn't nil. Only the commands exit on errors, when
+// they can't start: the client and server give up on the connection they happen on instead
+func exitOnError(err error) {
+	if err != nil {
+		// this logs to standard error and calls os.Exit(1)
+		log.Fatalf("Fatal error: %s\n", err.Error())
+	}
+}
+
+// addNetworkFlags adds the flags shared by every command that listens or dials
+func addNetworkFlags(flags *flag.FlagSet) (network, logLevel *string) {
+	network = flags.String("network", "tcp", "network to use: tcp (dual-stack), tcp4 or tcp6")
+	logLevel = flags.String("log-level", common.InfoLogLevel, "log `level`: debug, info or error")
+
+	return network, logLevel
+}
+
+func runServe(args []string) {
+	flags := newFlagSet("serve", "serve [flags]",
+		"Runs a server. It is set up with flags, a configuration file, or both, with the flags\n"+
+			"overriding the file. The file is reloaded on SIGHUP.")
+	configFile := flags.String("config", "", "read the configuration from `file`")
+	addr := flags.String("addr", "", "listen for TCP connections on `host:port` (IPv6 hosts go in brackets, e.g. [::1]:8080)")
+	grpcAddr := flags.String("grpc", "", "also serve the gRPC API on `host:port`")
+	httpAddr := flags.String("http", "", "also serve the HTTP (SSE/long-polling) transport on `host:port`")
+	ircAddr := flags.String("irc", "", "also serve IRC clients on `host:port`")
+	tlsCert := flags.String("tls-cert", "", "serve TLS with the PEM encoded certificate in `file`")
+	tlsKey := flags.String("tls-key", "", "serve TLS with the PEM encoded key in `file`")
+	tlsClientCA := flags.String("tls-client-ca", "", "require client certificates signed by the PEM encoded CA certificates in `file`")
+	console := flags.Bool("console", true, "read admin commands from stdin when it's a terminal")
+	filterCommand := flags.String("filter-command", "", "filter the messages to conversations by running `program`")
+	traceWire := flags.String("trace-wire", "", "log every frame of the TCP connections to `file`, with secrets redacted")
+	injectChaos := addChaosFlag(flags)
+	network, logLevel := addNetworkFlags(flags)
+	flags.Parse(args)
+
+	exitOnError(common.SetLogLevel(*logLevel))
+
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config := server.DefaultConfig()
+	if *configFile != "" {
+		loaded, err := server.LoadConfig(*configFile)
+		exitOnError(err)
+		config = loaded
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			config.Listen = *addr
+		case "network":
+			config.Network = *network
+		case "grpc":
+			config.GRPC = *grpcAddr
+		case "http":
+			config.HTTP = *httpAddr
+		case "irc":
+			config.IRC = *ircAddr
+		case "tls-cert":
+			config.TLS.Cert = *tlsCert
+		case "tls-key":
+			config.TLS.Key = *tlsKey
+		case "tls-client-ca":
+			config.TLS.ClientCA = *tlsClientCA
+		}
+	})
+
+	if config.Listen == "" {
+		log.Fatalf("No address to listen on: pass -addr, or set listen in the configuration file\n")
+	}
+
+	exitOnError(server.Configure(config))
+	exitOnError(server.LoadPlugins())
+
+	if *filterCommand != "" {
+		server.RegisterContentFilter(server.CommandContentFilter(*filterCommand))
+	}
+
+	if *traceWire != "" {
+		tracer, err := common.OpenWireTrace(*traceWire)
+		exitOnError(err)
+		server.TraceWire(tracer)
+	}
+
+	injectChaos()
+
+	// interrupting the server shuts it down, closing the connections after what they're doing
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *configFile != "" {
+		go server.ReloadOnHangup(ctx, *configFile)
+	}
+
+	if *console && term.IsTerminal(int(os.Stdin.Fd())) {
+		go server.RunConsole(os.Stdin, os.Stdout)
+	}
+
+	// without one of its listeners, the server would leave the clients of that transport out
+	if config.GRPC != "" {
+		go func() {
+			exitOnError(server.ListenGRPC(ctx, config.Network, config.GRPC))
+		}()
+	}
+
+	if config.HTTP != "" {
+		go func() {
+			exitOnError(server.ListenHTTP(ctx, config.Network, config.HTTP))
+		}()
+	}
+
+	if config.IRC != "" {
+		go func() {
+			exitOnError(server.ListenIRC(ctx, config.Network, config.IRC))
+		}()
+	}
+
+	exitOnError(server.Listen(ctx, config.Network, config.Listen))
+	log.Printf("Shut down\n")
+}
+
+func runConnect(args []string) {
+	flags := newFlagSet("connect", "connect [flags] [<host>:<port>|<profile alias>...]",
+		"Connects to the given servers, or to the default one of the configuration file, and starts\n"+
+			"the chat prompt. Flags override the configuration file.")
+	configFile := flags.String("config", "", "read the configuration from `file` instead of ~/.config/tcpchat/config.yaml")
+	name := flags.String("name", "", "display `name` to use")
+	proxyURL := flags.String("proxy", "", "connect through the proxy at `url`, e.g. socks5://localhost:9050 (defaults to $ALL_PROXY)")
+	useTLS := flags.Bool("tls", false, "connect over TLS")
+	tlsCA := flags.String("tls-ca", "", "verify servers with the PEM encoded certificates in `file` (implies -tls)")
+	tlsCert := flags.String("tls-cert", "", "present the PEM encoded client certificate in `file` to servers that ask for one (implies -tls)")
+	tlsKey := flags.String("tls-key", "", "the PEM encoded key of the client certificate, in `file`")
+	oidcIssuer := flags.String("oidc-issuer", "", "log in with the OpenID Connect provider at `url`, for servers that require it")
+	oidcClientID := flags.String("oidc-client-id", "", "the client `id` tcpchat is registered with at the OpenID Connect provider")
+	username := flags.String("username", "", "log in to the account `name` with a password (from $TCPCHAT_PASSWORD or typed in), for servers that check them")
+	totp := flags.Bool("totp", false, "also give a one-time code (from $TCPCHAT_TOTP_CODE or typed in), for accounts with two-factor authentication")
+	intentCommand := flags.String("intent-command", "", "translate input starting with ';' by running `program`")
+	useTUI := flags.Bool("tui", false, "use the full screen terminal interface")
+	useJSON := flags.Bool("json", false, "read operations and commands as JSON lines on stdin, and write events as JSON lines on stdout, for programs")
+	noColor := flags.Bool("no-color", false, "don't use colors (also set by $NO_COLOR)")
+	transcriptDir := flags.String("transcripts", "", "log the messages received to a file per conversation under `dir`")
+	traceWire := flags.String("trace-wire", "", "log every frame sent to and received from servers to `file`, with secrets redacted")
+	record := flags.String("record", "", "record the session to `file`, for the replay command")
+	network, logLevel := addNetworkFlags(flags)
+	flags.Parse(args)
+
+	exitOnError(common.SetLogLevel(*logLevel))
+
+	configPath := *configFile
+	if configPath == "" {
+		path, err := client.ConfigPath()
+		exitOnError(err)
+		configPath = path
+	}
+
+	config, err := client.LoadConfig(configPath)
+	exitOnError(err)
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "network":
+			config.Network = *network
+		case "proxy":
+			config.Proxy = *proxyURL
+		case "name":
+			config.Name = *name
+		case "tls":
+			config.TLS.Enabled = *useTLS
+		case "tls-ca":
+			config.TLS.Enabled = true
+			config.TLS.CA = *tlsCA
+		case "tls-cert":
+			config.TLS.Enabled = true
+			config.TLS.Cert = *tlsCert
+		case "tls-key":
+			config.TLS.Key = *tlsKey
+		case "oidc-issuer":
+			config.OIDC.Issuer = *oidcIssuer
+		case "oidc-client-id":
+			config.OIDC.ClientID = *oidcClientID
+		case "username":
+			config.Username = *username
+		case "totp":
+			config.TOTP = *totp
+		case "tui":
+			config.TUI = *useTUI
+		case "json":
+			config.JSON = *useJSON
+		case "no-color":
+			config.Colors.Enabled = !*noColor
+		case "transcripts":
+			config.Transcripts.Dir = *transcriptDir
+		}
+	})
+
+	if *intentCommand != "" {
+		client.RegisterIntentHandler(client.CommandIntentHandler(*intentCommand))
+	}
+
+	if *traceWire != "" {
+		tracer, err := common.OpenWireTrace(*traceWire)
+		exitOnError(err)
+		client.TraceWire(tracer)
+	}
+
+	if *record != "" {
+		exitOnError(client.RecordSession(*record))
+	}
+
+	if config.Proxy != "" {
+		exitOnError(client.UseProxy(config.Proxy))
+	}
+
+	if config.TLS.Enabled {
+		exitOnError(client.UseTLS(config.TLS.CA, config.TLS.Cert, config.TLS.Key))
+	}
+
+	exitOnError(client.Connect(config, config.Profiles(flags.Args())))
+}
+
+// runAdmin runs commands like `drain <alternate host>:<port>` on the server at -addr
+func runAdmin(args []string) {
+	flags := newFlagSet("admin", "admin -addr <host>:<port> [flags] <command> [arguments]",
+		"Runs an administrative command on the server at -addr, with the admin token of the\n"+
+			"server's configuration, or from the server's host if it trusts local clients.\n"+
+			"The commands are:\n\n"+
+			"\tdrain [-threshold n] [-timeout duration] <alternate host>:<port>\n"+
+			"\t      migrate the server's clients to another server and shut it down\n"+
+			"\tannounce [-conversation nickname] <text>\n"+
+			"\t      send an announcement to every connected client, or to a conversation\n\n"+
+			"Any other command is run by the server's admin console, e.g. connections, kick <name>,\n"+
+			"or help for the list.")
+	addr := flags.String("addr", "", "the server's `host:port`")
+	useTLS := flags.Bool("tls", false, "connect over TLS")
+	tlsCA := flags.String("tls-ca", "", "verify the server with the PEM encoded certificates in `file` (implies -tls)")
+	tlsCert := flags.String("tls-cert", "", "present the PEM encoded client certificate in `file` (implies -tls)")
+	tlsKey := flags.String("tls-key", "", "the PEM encoded key of the client certificate, in `file`")
+	token := flags.String("token", os.Getenv("TCPCHAT_ADMIN_TOKEN"), "authenticate with the admin `token` (defaults to $TCPCHAT_ADMIN_TOKEN)")
+	network, logLevel := addNetworkFlags(flags)
+	flags.Parse(args)
+
+	exitOnError(common.SetLogLevel(*logLevel))
+
+	if *addr == "" || flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		exitOnError(client.UseTLS(*tlsCA, *tlsCert, *tlsKey))
+	}
+
+	if *token != "" {
+		client.UseAdminToken(*token)
 	}
 
-	service := os.Args[2]
+	switch command := flags.Arg(0); strings.ToLower(command) {
+	case common.DrainOperationType:
+		drainFlags := newFlagSet("drain", "admin -addr <host>:<port> drain [flags] <alternate host>:<port>",
+			"Marks the server as draining: its clients are told to migrate to the alternate server,\n"+
+				"new connections are redirected there, and the server exits once enough clients left.")
+		threshold := drainFlags.Int("threshold", 0, "exit once at most `n` connections are left")
+		timeout := drainFlags.Duration("timeout", 0, "exit after `duration` regardless (default 5m)")
+		drainFlags.Parse(flags.Args()[1:])
+
+		if drainFlags.NArg() != 1 {
+			drainFlags.Usage()
+			os.Exit(2)
+		}
+
+		drain := common.Drain{
+			Address:   drainFlags.Arg(0),
+			Threshold: *threshold,
+			Timeout:   timeout.Seconds(),
+		}
 
-	switch component := os.Args[1]; strings.ToLower(component) {
-	case "client":
-		client.Connect(service)
-	case "server":
-		server.Listen(service)
+		exitOnError(client.Drain(*network, *addr, drain))
+	case common.AnnounceOperationType:
+		announceFlags := newFlagSet("announce", "admin -addr <host>:<port> announce [flags] <text>",
+			"Sends text to every connected client as a direct message from the server, or to the\n"+
+				"subscribers of a conversation.")
+		conversation := announceFlags.String("conversation", "", "only announce to the conversation with `nickname`")
+		announceFlags.Parse(flags.Args()[1:])
+
+		if announceFlags.NArg() < 1 {
+			announceFlags.Usage()
+			os.Exit(2)
+		}
+
+		announcement := common.Announcement{
+			Text:         strings.Join(announceFlags.Args(), " "),
+			Conversation: *conversation,
+		}
+
+		exitOnError(client.Announce(*network, *addr, announcement))
 	default:
-		log.Fatalf("Unrecognised component %s\n", component)
+		output, err := client.RunAdminCommand(*network, *addr, strings.Join(flags.Args(), " "))
+		exitOnError(err)
+		fmt.Print(output)
+	}
+}
+
+// The exit statuses of the send command, other than 0 for a message the server acknowledged,
+// 1 for failures to connect and such, and 2 for usage errors
+const (
+	exitNoSuchConversation = 3
+	exitMessageRefused     = 4
+	exitLoginRefused       = 5
+)
+
+// runSend sends a single message, e.g. from cron jobs or CI, exiting with a status telling
+// what went wrong if it wasn't acknowledged
+func runSend(args []string) {
+	flags := newFlagSet("send", "send [flags] <host>:<port>|<profile alias> <conversation> <text>",
+		"Connects to the server, logging in like connect does, sends the text to the conversation,\n"+
+			"which it doesn't need to have joined, and exits once the server acknowledged it.\n"+
+			"The exit status is 0 once acknowledged, 1 if the server couldn't be reached, 2 for usage\n"+
+			"errors, 3 if there's no such conversation, 4 if the server refused the message, and 5 if\n"+
+			"it refused the login.")
+	loadConfig := addSenderFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() < 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config := loadConfig()
+	profile := config.Profiles(flags.Args()[:1])[0]
+	text := strings.Join(flags.Args()[2:], " ")
+
+	exitOnSendError(client.Send(config, profile, flags.Arg(1), text))
+}
+
+// runPipe sends the lines of the standard input to a conversation until it ends, e.g. to follow
+// a log in a conversation
+func runPipe(args []string) {
+	flags := newFlagSet("pipe", "pipe [flags] <host>:<port>|<profile alias> <conversation>",
+		"Connects to the server like send does, and sends the lines of the standard input to the\n"+
+			"conversation until it ends, e.g. tail -f build.log | tcpchat pipe localhost:8080 builds.\n"+
+			"The lines that come within the batch delay of each other are sent as a single message,\n"+
+			"and messages are paced to stay under the rate limit of the server. The exit status is\n"+
+			"like that of send.")
+	batch := flags.Duration("batch", time.Second, "send the lines that come within `delay` of the first one together (0 to send every line alone)")
+	maxLength := flags.Int("max-length", 4000, "send messages of at most `n` characters, like the server's max_message_length")
+	loadConfig := addSenderFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config := loadConfig()
+	profile := config.Profiles(flags.Args()[:1])[0]
+
+	exitOnSendError(client.Pipe(config, profile, flags.Arg(1), os.Stdin, *batch, *maxLength))
+}
+
+// addSenderFlags adds the flags of the commands that send messages without connecting, and
+// returns a function loading the configuration once they are parsed, with the flags applied
+func addSenderFlags(flags *flag.FlagSet) func() *client.Config {
+	configFile := flags.String("config", "", "read the configuration from `file` instead of ~/.config/tcpchat/config.yaml")
+	name := flags.String("name", "", "display `name` to send as")
+	useTLS := flags.Bool("tls", false, "connect over TLS")
+	tlsCA := flags.String("tls-ca", "", "verify the server with the PEM encoded certificates in `file` (implies -tls)")
+	username := flags.String("username", "", "log in to the account `name` with a password (from $TCPCHAT_PASSWORD)")
+	network, logLevel := addNetworkFlags(flags)
+
+	return func() *client.Config {
+		exitOnError(common.SetLogLevel(*logLevel))
+
+		configPath := *configFile
+		if configPath == "" {
+			path, err := client.ConfigPath()
+			exitOnError(err)
+			configPath = path
+		}
+
+		config, err := client.LoadConfig(configPath)
+		exitOnError(err)
+
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "network":
+				config.Network = *network
+			case "name":
+				config.Name = *name
+			case "tls":
+				config.TLS.Enabled = *useTLS
+			case "tls-ca":
+				config.TLS.Enabled = true
+				config.TLS.CA = *tlsCA
+			case "username":
+				config.Username = *username
+			}
+		})
+
+		if config.Proxy != "" {
+			exitOnError(client.UseProxy(config.Proxy))
+		}
+
+		if config.TLS.Enabled {
+			exitOnError(client.UseTLS(config.TLS.CA, config.TLS.Cert, config.TLS.Key))
+		}
+
+		return config
+	}
+}
+
+// exitOnSendError exits with the status telling what went wrong sending a message, if anything
+func exitOnSendError(err error) {
+	if err == nil {
+		return
+	}
+
+	log.Printf("Fatal error: %s\n", err.Error())
+
+	var refusal *common.Error
+	switch {
+	case errors.Is(err, client.ErrNoSuchConversation):
+		os.Exit(exitNoSuchConversation)
+	case errors.As(err, &refusal) && loginRefusals[refusal.Code]:
+		os.Exit(exitLoginRefused)
+	case errors.As(err, &refusal):
+		os.Exit(exitMessageRefused)
+	}
+
+	os.Exit(1)
+}
+
+// loginRefusals are the codes of the errors a server refuses a login with, rather than a message
+var loginRefusals = map[string]bool{
+	common.LoginRequiredErrorCode:  true,
+	common.TOTPRequiredErrorCode:   true,
+	common.BannedErrorCode:         true,
+	common.KeyMismatchErrorCode:    true,
+	common.SessionRevokedErrorCode: true,
+}
+
+// runBench runs the benchmarks from the source tree and prints their report, exiting with an
+// error if any got slower than in the report it's compared with
+func runBench(args []string) {
+	flags := newFlagSet("bench", "bench [flags]",
+		"Runs the benchmarks for framing, routing, the message store and end-to-end message\n"+
+			"handling with `go test -bench`, from the tcpchat source tree at -dir. With -compare,\n"+
+			"prints how every benchmark changed since the report in the given file, and fails if\n"+
+			"any got slower by more than -threshold percent.")
+	run := flags.String("run", ".", "only run benchmarks matching `regexp`")
+	count := flags.Int("count", 1, "run every benchmark `n` times, averaging the results")
+	dir := flags.String("dir", ".", "the `directory` of the tcpchat source tree")
+	save := flags.String("save", "", "save the report to `file`, to compare later runs with")
+	compare := flags.String("compare", "", "compare with the report saved in `file`")
+	threshold := flags.Float64("threshold", 10, "how many `percent` slower a benchmark may get before it's a regression")
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	report, err := bench.Run(os.Stdout, *dir, *run, *count)
+	exitOnError(err)
+
+	if *save != "" {
+		exitOnError(os.WriteFile(*save, report, 0644))
+	}
+
+	if *compare == "" {
+		return
+	}
+
+	before, err := os.Open(*compare)
+	exitOnError(err)
+	defer before.Close()
+
+	old, err := bench.Parse(before)
+	exitOnError(err)
+
+	current, err := bench.Parse(bytes.NewReader(report))
+	exitOnError(err)
+
+	fmt.Println()
+	regressions := bench.Compare(os.Stdout, old, current, *threshold)
+	if regressions > 0 {
+		exitOnError(fmt.Errorf("%d benchmark(s) got slower by more than %g%%", regressions, *threshold))
+	}
+}
+
+// runReplay shows a session recorded with connect -record, or replays it against a server
+func runReplay(args []string) {
+	flags := newFlagSet("replay", "replay [flags] <recording>",
+		"Shows the frames of a session recorded with connect -record. With -addr, sends the frames\n"+
+			"the client sent to the server at -addr instead, with the same pauses between them, and\n"+
+			"shows them along with what the server answers. Secrets were left out of the recording,\n"+
+			"so sessions that logged in with a password or token don't replay as they were.")
+	addr := flags.String("addr", "", "replay the session against the server at `host:port`")
+	speed := flags.Float64("speed", 1, "replay `times` as fast as the session was recorded")
+	wait := flags.Duration("wait", 2*time.Second, "how long to wait for the server to answer before closing each connection")
+	network, logLevel := addNetworkFlags(flags)
+	flags.Parse(args)
+
+	exitOnError(common.SetLogLevel(*logLevel))
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	frames, err := client.LoadRecording(flags.Arg(0))
+	exitOnError(err)
+
+	if *addr == "" {
+		client.RenderRecording(os.Stdout, frames)
+		return
+	}
+
+	exitOnError(client.Replay(os.Stdout, *network, *addr, frames, *speed, *wait))
+}
+
+// runConformance runs the conformance checks against a server, e.g. one of another
+// implementation of the protocol, exiting with an error if any of them failed
+func runConformance(args []string) {
+	flags := newFlagSet("conformance", "conformance [flags] <host>:<port>",
+		"Checks that the server at <host>:<port> behaves like tcpchat's own does, going through\n"+
+			"the handshake, conversations, messages, and the errors for malformed frames, and\n"+
+			"reporting which behaviors pass and which fail.")
+	run := flags.String("run", "", "only run checks matching `regexp`")
+	network, logLevel := addNetworkFlags(flags)
+	flags.Parse(args)
+
+	exitOnError(common.SetLogLevel(*logLevel))
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var filter *regexp.Regexp
+	if *run != "" {
+		filter = regexp.MustCompile(*run)
+	}
+
+	addr := flags.Arg(0)
+	failed := conformance.Run(os.Stdout, func() (net.Conn, error) {
+		return net.Dial(*network, addr)
+	}, filter)
+
+	if failed > 0 {
+		exitOnError(fmt.Errorf("%d check(s) failed", failed))
 	}
 }
@@ -0,0 +1,11 @@
+//go:build !chaos
+
+package main
+
+import "flag"
+
+// addChaosFlag adds nothing without the chaos tag, for servers people chat on never to be
+// started with faults injected on purpose
+func addChaosFlag(flags *flag.FlagSet) func() {
+	return func() {}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The policies for the messages of deleted accounts: anonymizing keeps them in the history as
+// sent by a deleted user, scrubbing removes them
+const (
+	AnonymizeDeletedMessages = "anonymize"
+	ScrubDeletedMessages     = "scrub"
+)
+
+// deletedUserName is what the users of deleted accounts are called from then on
+const deletedUserName = "deleted user"
+
+// handleAccountExport sends the data kept about the client's user, with a page of its messages.
+// Starting an export is recorded in the audit log, like conversation exports
+func handleAccountExport(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	export := common.AccountExport{}
+
+	err := json.Unmarshal(*op.Message, &export)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing AccountExport: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	cursor := uuid.Nil
+	if export.Cursor != "" {
+		cursor, err = uuid.Parse(export.Cursor)
+		if err != nil {
+			return nil, &common.Error{Code: common.NotFoundErrorCode, Message: "invalid export cursor"}
+		}
+	}
+
+	limit := export.Limit
+	if limit <= 0 {
+		limit = defaultExportLimit
+	}
+	limit = min(limit, maxExportLimit)
+
+	data, err := accountData(ctx, s.client.ID, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if cursor == uuid.Nil {
+		auditLog.record(s.actor(), common.AccountExportOperationType, s.client.ID.String(), "")
+	}
+
+	return marshalResponse(data)
+}
+
+// accountData collects what's kept about the user with the given ID, with up to limit (or all,
+// if it's negative) of its messages after the message with the ID cursor. Pages after the
+// first only have messages
+func accountData(ctx context.Context, id uuid.UUID, cursor uuid.UUID, limit int) (common.AccountData, error) {
+	found, more, err := messages.pageWhere(ctx, func(message common.Message) bool {
+		return message.Sender != nil && message.Sender.ID == id
+	}, cursor, limit)
+	if errors.Is(err, errCursorGone) {
+		return common.AccountData{}, &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: "the export cursor is gone from the history, start the export over",
+		}
+	}
+	if err != nil {
+		return common.AccountData{}, err
+	}
+
+	data := common.AccountData{Messages: found}
+	if more && len(found) > 0 {
+		data.NextCursor = found[len(found)-1].ID.String()
+	}
+
+	if cursor != uuid.Nil {
+		return data, nil
+	}
+
+	u, ok := users.get(id)
+	if !ok {
+		return common.AccountData{}, &common.Error{Code: common.NotFoundErrorCode, Message: fmt.Sprintf("no user %s has been here", id)}
+	}
+
+	data.User = u.sender
+	data.LastConnect = u.lastConnect
+	data.Profile = u.profile
+	data.Hidden = u.hidden
+	data.Digest = u.digest
+	data.Email = u.email
+	data.TwoFactor = totpSecrets.enabled(id)
+	data.Blocked = u.blockList()
+	data.Queued = offlineMessages.queued(id)
+
+	for _, conversation := range conversations.all() {
+		if u.conversations[conversation.ID] {
+			data.Conversations = append(data.Conversations, conversation.Nickname)
+		}
+
+		if conversation.Owner == id {
+			data.Owned = append(data.Owned, conversation.Nickname)
+		} else if slices.Contains(conversation.Moderators, id) {
+			data.Moderated = append(data.Moderated, conversation.Nickname)
+		}
+	}
+
+	return data, nil
+}
+
+// handleDeleteAccount deletes the client's user, once it confirmed with its name
+func handleDeleteAccount(ctx context.Context, op *common.Operation, s *session) error {
+	request := common.DeleteAccount{}
+
+	err := json.Unmarshal(*op.Message, &request)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing DeleteAccount: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	if request.Confirm != s.client.Name {
+		return &common.Error{Code: common.ForbiddenErrorCode, Message: "confirm with your name to delete your account"}
+	}
+
+	policy := currentConfig.deletedMessages()
+	auditLog.record(s.actor(), common.DeleteAccountOperationType, s.client.ID.String(), policy)
+
+	changed := deleteAccount(s.client.ID, policy)
+	log.Printf("%v at %v deleted its account (%d message(s), %s)\n", s.client, s.addr, changed, policy)
+
+	return nil
+}
+
+// deleteAccount revokes the sessions of the user with the given ID and forgets it, leaving its
+// messages to policy. The conversations it owned are left to the admins. It tells how many of
+// the messages in the history were the user's
+func deleteAccount(id uuid.UUID, policy string) int {
+	for _, s := range connectedSessions() {
+		if s.client.ID == id {
+			s.writeError(&common.Error{Code: common.SessionRevokedErrorCode, Message: "your account was deleted"})
+		}
+	}
+
+	// its own sessions closing told the conversations it left, so its subscriptions go after
+	u, _ := users.get(id)
+
+	deleted := common.Sender{ID: uuid.New(), Name: deletedUserName}
+	redact := func(message common.Message) (common.Message, bool) {
+		if message.Sender == nil || message.Sender.ID != id {
+			return message, true
+		}
+
+		if policy == ScrubDeletedMessages {
+			return message, false
+		}
+
+		// the signature and key would tell who sent it
+		message.Sender = &deleted
+		message.Signature = nil
+		message.Key = ""
+
+		return message, true
+	}
+
+	changed := 0
+	messages.rewrite(func(message common.Message) (common.Message, bool) {
+		if message.Sender != nil && message.Sender.ID == id {
+			changed++
+		}
+
+		return redact(message)
+	})
+	offlineMessages.rewrite(redact)
+	offlineMessages.take(id)
+	reports.rewrite(func(r *report) bool {
+		if r.reporter.ID == id {
+			r.reporter = deleted
+		}
+
+		message, keep := redact(r.message)
+		r.message = message
+
+		return keep
+	})
+
+	membership.forgetUser(id)
+	messageKeys.forget(id)
+	totpSecrets.disable(id)
+	users.remove(id)
+
+	for _, conversation := range conversations.all() {
+		if conversation.Owner == id || slices.Contains(conversation.Moderators, id) {
+			_, err := conversations.update(conversation.Nickname, func(conversation *common.Conversation) {
+				if conversation.Owner == id {
+					conversation.Owner = uuid.Nil
+				}
+				conversation.Moderators = slices.DeleteFunc(slices.Clone(conversation.Moderators), func(moderator uuid.UUID) bool {
+					return moderator == id
+				})
+			})
+			common.CheckErrorAndLog(err)
+		}
+
+		// the members left must get a key the deleted user doesn't have
+		if conversation.Encrypted && u.conversations[conversation.ID] {
+			conversationKeys.membersChanged(conversation)
+		}
+	}
+
+	return changed
+}
+
+// findUser returns the one user with the given ID or name
+func findUser(ref string) (common.Sender, error) {
+	senders, err := findUsers(ref)
+	if err != nil {
+		return common.Sender{}, err
+	}
+
+	if len(senders) > 1 {
+		return common.Sender{}, fmt.Errorf("%d users are called %s, give the ID of one", len(senders), ref)
+	}
+
+	return senders[0], nil
+}
+
+// exportUserCommand writes what's kept about a user to the console, as JSON
+func exportUserCommand(out io.Writer, args string, actor auditActor) error {
+	sender, err := findUser(args)
+	if err != nil {
+		return err
+	}
+
+	data, err := accountData(context.Background(), sender.ID, uuid.Nil, -1)
+	if err != nil {
+		return err
+	}
+
+	auditLog.record(actor, common.AccountExportOperationType, sender.ID.String(), "")
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(data)
+}
+
+// deleteUserCommand deletes the account of a user, leaving its messages to the configuration
+func deleteUserCommand(out io.Writer, args string, actor auditActor) error {
+	sender, err := findUser(args)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := users.get(sender.ID); !ok {
+		return fmt.Errorf("no user %s has been here", sender.ID)
+	}
+
+	policy := currentConfig.deletedMessages()
+	auditLog.record(actor, common.DeleteAccountOperationType, sender.ID.String(), policy)
+
+	changed := deleteAccount(sender.ID, policy)
+	fmt.Fprintf(out, "Deleted the account of %s (%d message(s), %s)\n", sender.Name, changed, policy)
+
+	return nil
+}
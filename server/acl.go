@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// handleACL gives a user access to a conversation, or takes it away, for its owner
+func handleACL(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	request := common.ACL{}
+
+	err := json.Unmarshal(*op.Message, &request)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing ACL: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	if request.User == "" {
+		conversation, ok := conversations.getByNickname(request.Nickname)
+		if !ok {
+			return nil, &common.Error{
+				Code:    common.NotFoundErrorCode,
+				Message: fmt.Sprintf("conversation '%s' does not exist", request.Nickname),
+			}
+		}
+
+		return marshalResponse(conversation)
+	}
+
+	if request.Access != "" && !slices.Contains(common.AccessLevels, request.Access) {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("unknown access '%s', expected read, write or moderate", request.Access),
+		}
+	}
+
+	conversation, err := ownedConversation(request.Nickname, s, "change the access to")
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := findUser(request.User)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.ID == conversation.Owner {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("the owner of '%s' always has every access", conversation.Nickname),
+		}
+	}
+
+	conversation, err = setAccess(conversation.Nickname, user, request.Access, s.actor())
+	if err != nil {
+		return nil, err
+	}
+
+	// subscribers get the conversation with the new ACL from publish already
+	if s.isSubscribed(conversation.ID) {
+		emptyJSON := json.RawMessage("{}")
+		return &emptyJSON, nil
+	}
+
+	return marshalResponse(conversation)
+}
+
+// setAccess gives user access to the conversation with the given nickname in its ACL, or takes
+// it away when access is empty, on behalf of actor. Subscribers get the conversation with its
+// new ACL, and those it locks out are unsubscribed
+func setAccess(nickname string, user common.Sender, access string, actor auditActor) (*common.Conversation, error) {
+	conversation, err := conversations.update(nickname, func(c *common.Conversation) {
+		c.ACL = slices.DeleteFunc(slices.Clone(c.ACL), func(entry common.ACLEntry) bool {
+			return entry.ID == user.ID
+		})
+		if access != "" {
+			c.ACL = append(c.ACL, common.ACLEntry{ID: user.ID, Name: user.Name, Access: access})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if access == "" {
+		access = "none"
+	}
+
+	auditLog.record(actor, common.ACLOperationType, conversation.Nickname, fmt.Sprintf("%s (%s): %s", user.Name, user.ID, access))
+	messageRouter.publish(conversation.ID, common.ACLOperationType, conversation)
+	lockOut(conversation)
+
+	return conversation, nil
+}
+
+// lockOut unsubscribes the users the ACL of conversation doesn't let read it (anymore)
+func lockOut(conversation *common.Conversation) {
+	lockedOut := false
+
+	for _, s := range connectedSessions() {
+		if s.isSubscribed(conversation.ID) && !canAccess(conversation, s, common.ReadAccess) {
+			s.unsubscribe(conversation.ID)
+		}
+	}
+
+	for _, id := range users.subscribers(conversation.ID) {
+		if !conversation.Allows(id, common.ReadAccess) {
+			users.unsubscribed(id, conversation.ID)
+			lockedOut = true
+		}
+	}
+
+	if conversation.Encrypted && lockedOut {
+		conversationKeys.membersChanged(conversation)
+	}
+}
+
+// canAccess tells if the client of s has access to a conversation, or more. Admins have every
+// access to every conversation
+func canAccess(conversation *common.Conversation, s *session, access string) bool {
+	return s.admin || conversation.Allows(s.client.ID, access)
+}
+
+// checkAccess refuses the clients that don't have access to a conversation
+func checkAccess(conversation *common.Conversation, s *session, access string) error {
+	if canAccess(conversation, s, access) {
+		return nil
+	}
+
+	return &common.Error{
+		Code:    common.ForbiddenErrorCode,
+		Message: fmt.Sprintf("you don't have %s access to '%s'", access, conversation.Nickname),
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// handleAuth makes the session an admin if it sent the admin token of the configuration.
+// A wrong token ends the session, so that guessing it takes a connection per guess
+func handleAuth(ctx context.Context, op *common.Operation, s *session) error {
+	auth := common.Auth{}
+
+	err := json.Unmarshal(*op.Message, &auth)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Auth: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	token := currentConfig.adminToken()
+	if token == "" {
+		return &common.Error{Code: common.ForbiddenErrorCode, Message: "remote administration is not enabled on this server"}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(auth.Token), []byte(token)) != 1 {
+		log.Printf("Wrong admin token from %v at %v\n", s.client, s.addr)
+		auditLog.record(s.actor(), common.AuthOperationType, "admin", "wrong token")
+		return errors.New("wrong admin token")
+	}
+
+	s.admin = true
+	log.Printf("%v at %v authenticated as an admin\n", s.client, s.addr)
+	auditLog.record(s.actor(), common.AuthOperationType, "admin", "")
+
+	return nil
+}
+
+// handleAdminCommand runs a line of the admin console for an admin, and responds with its output
+func handleAdminCommand(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	if !s.privileged() {
+		return nil, &common.Error{Code: common.ForbiddenErrorCode, Message: "admin commands are only allowed for admins"}
+	}
+
+	command := common.AdminCommand{}
+
+	err := json.Unmarshal(*op.Message, &command)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing AdminCommand: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	log.Printf("Admin command from %v at %v: %s\n", s.client, s.addr, command.Command)
+
+	out := &bytes.Buffer{}
+	runConsoleCommand(out, command.Command, s.actor())
+	command.Output = out.String()
+
+	return marshalResponse(command)
+}
+
+// privileged tells whether the session may run admin operations: it authenticated with the
+// admin token, or logged in with the admin role, or it's trusted for being local
+func (s *session) privileged() bool {
+	return s.admin || s.trustedLocal()
+}
+
+// trustedLocal tells whether the session is trusted for coming from the server's own host,
+// which only those over raw TCP are, and only when the configuration says so
+func (s *session) trustedLocal() bool {
+	return s.local && currentConfig.trustLocal()
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+func handleAnnounce(ctx context.Context, op *common.Operation, s *session) error {
+	if !s.privileged() {
+		return &common.Error{Code: common.ForbiddenErrorCode, Message: "announce is only allowed for admins"}
+	}
+
+	announcement := common.Announcement{}
+
+	err := json.Unmarshal(*op.Message, &announcement)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Announcement: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	return announceFor(s.actor(), announcement)
+}
+
+// announceFor sends an announcement on behalf of actor, recording it in the audit log
+func announceFor(actor auditActor, announcement common.Announcement) error {
+	err := announce(announcement)
+	if err != nil {
+		return err
+	}
+
+	target := announcement.Conversation
+	if target == "" {
+		target = "everyone"
+	}
+	auditLog.record(actor, common.AnnounceOperationType, target, announcement.Text)
+
+	return nil
+}
+
+// announce sends an announcement to every client, or to the subscribers of its conversation
+func announce(announcement common.Announcement) error {
+	text, err := cleanText(announcement.Text, currentConfig.maxMessageLength())
+	if err != nil {
+		return err
+	}
+
+	if announcement.Conversation == "" {
+		announceToAll(text)
+		return nil
+	}
+
+	conversation, ok := conversations.getByNickname(announcement.Conversation)
+	if !ok {
+		err := fmt.Sprintf("conversation '%s' does not exist", announcement.Conversation)
+		return errors.New(err)
+	}
+
+	messageRouter.broadcast(common.Message{
+		Conversation: &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname},
+		Sender:       &serverSender,
+		Text:         text,
+		Timestamp:    time.Now(),
+		Kind:         common.SystemMessageKind,
+	})
+
+	return nil
+}
+
+// announceToAll sends text to every connected client as a direct message from the server
+func announceToAll(text string) {
+	for _, s := range connectedSessions() {
+		shared, err := newSharedResponse(common.MessageOperationType, common.Message{
+			Recipient: &common.Sender{ID: s.client.ID, Name: s.client.Name},
+			Sender:    &serverSender,
+			Text:      text,
+			Timestamp: time.Now(),
+		})
+		if common.CheckErrorAndLog(err) {
+			continue
+		}
+
+		s.enqueue(queuedResponse{shared: shared, operationType: common.MessageOperationType})
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// auditEntry is a line of the audit log: Actor did Action to Target at Time
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor"`
+	ActorID string    `json:"actor_id,omitempty"`
+	Address string    `json:"address,omitempty"`
+	Target  string    `json:"target"`
+	Details string    `json:"details,omitempty"`
+}
+
+// auditActor is who did something worth auditing: a client, or the operator at the console
+type auditActor struct {
+	name    string
+	id      string
+	address string
+}
+
+var consoleActor = auditActor{name: "console"}
+
+// actor is the session's client, as it's recorded in the audit log
+func (s *session) actor() auditActor {
+	return auditActor{name: s.client.Name, id: s.client.ID.String(), address: s.addr.String()}
+}
+
+// auditLogger appends the administrative and moderation actions to the file of the
+// configuration's audit_log, as JSON objects one per line. Without one, nothing is recorded
+type auditLogger struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+var auditLog = &auditLogger{}
+
+// open switches to the file at path, opening it for appending. An empty path stops recording
+func (a *auditLogger) open(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if path == a.path {
+		return nil
+	}
+
+	var file *os.File
+	if path != "" {
+		opened, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+
+		file = opened
+	}
+
+	if a.file != nil {
+		common.CheckErrorAndLog(a.file.Close())
+	}
+
+	a.path, a.file = path, file
+
+	return nil
+}
+
+// record appends an entry for actor doing action to target. Failing to write it is logged,
+// but doesn't undo the action
+func (a *auditLogger) record(actor auditActor, action, target, details string) {
+	b, err := json.Marshal(auditEntry{
+		Time:    time.Now(),
+		Action:  action,
+		Actor:   actor.name,
+		ActorID: actor.id,
+		Address: actor.address,
+		Target:  target,
+		Details: details,
+	})
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return
+	}
+
+	_, err = a.file.Write(append(b, '\n'))
+	if err != nil {
+		log.Printf("Error while writing to the audit log %s: %s\n", a.path, err.Error())
+	}
+}
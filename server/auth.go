@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// AdminRole is the role of the accounts that are admins of the server, as if they had
+// authenticated with the admin token
+const AdminRole = "admin"
+
+// Account is a user an AuthProvider vouches for: the Name it's known by, and its Roles
+type Account struct {
+	Name  string
+	Roles []string
+}
+
+var (
+	// ErrInvalidCredentials is returned by AuthProviders for unknown names and wrong passwords
+	ErrInvalidCredentials = errors.New("wrong name or password")
+	// ErrNoRole is returned by AuthProviders for accounts that aren't allowed to chat
+	ErrNoRole = errors.New("your account isn't allowed on this server")
+)
+
+// AuthProvider checks the names and passwords clients log in with, e.g. against the directory
+// of an organization, so that its accounts can be used to chat. It should give up once ctx is
+// done, when the client disconnected or took too long to log in
+type AuthProvider interface {
+	Authenticate(ctx context.Context, name, password string) (Account, error)
+}
+
+// AuthProviderFunc lets ordinary functions be used as AuthProviders
+type AuthProviderFunc func(ctx context.Context, name, password string) (Account, error)
+
+func (f AuthProviderFunc) Authenticate(ctx context.Context, name, password string) (Account, error) {
+	return f(ctx, name, password)
+}
+
+var (
+	authProviderMu sync.RWMutex
+	// registeredAuthProvider takes the place of the LDAP directory of the configuration
+	registeredAuthProvider AuthProvider
+)
+
+// RegisterAuthProvider makes p check the names and passwords of the clients logging in,
+// instead of the LDAP directory of the configuration
+func RegisterAuthProvider(p AuthProvider) {
+	authProviderMu.Lock()
+	defer authProviderMu.Unlock()
+
+	registeredAuthProvider = p
+}
+
+// authProvider is the provider passwords are checked with, or nil when the server doesn't
+// take any
+func authProvider() AuthProvider {
+	authProviderMu.RLock()
+	defer authProviderMu.RUnlock()
+
+	if registeredAuthProvider != nil {
+		return registeredAuthProvider
+	}
+
+	if directory := currentConfig.ldapDirectory(); directory != nil {
+		return directory
+	}
+
+	return nil
+}
+
+// accountNamespace is the namespace of the IDs derived from the names of accounts
+var accountNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/nikochiko/tcpchat/account"))
+
+// isDerivedID tells if id may be one derived from the name of an account, the subject of an ID
+// token or that of a client certificate. Those are name-based (version 5) UUIDs, which clients
+// don't pick for themselves, so they're kept for the clients proving them even before they
+// first do
+func isDerivedID(id uuid.UUID) bool {
+	return id.Version() == 5
+}
+
+// logIn makes the identity of aboutClient the one its ID token or password prove, or refuses
+// it when they're wrong, or it has neither and the server requires logging in, unless it lets
+// guests in. It tells if the client was logged in
+func (s *session) logIn(ctx context.Context, aboutClient *common.ClientAboutMe, login common.Login) (bool, error) {
+	if login.IDToken != "" && currentConfig.oidc().Issuer != "" {
+		return s.logInWithToken(ctx, aboutClient, login.IDToken)
+	}
+
+	if login.Username != "" && authProvider() != nil {
+		return s.logInWithPassword(ctx, aboutClient, login)
+	}
+
+	if s.trustedLocal() {
+		return false, nil
+	}
+
+	ways := []string{}
+	if config := currentConfig.oidc(); config.Issuer != "" && config.Required {
+		ways = append(ways, fmt.Sprintf("with %s, as client %s", config.Issuer, config.ClientID))
+	}
+	if currentConfig.ldap().Required {
+		ways = append(ways, "with your name and password")
+	}
+
+	if len(ways) == 0 {
+		return false, nil
+	}
+
+	if currentConfig.guests().Mode != "" {
+		s.guest = true
+		return false, nil
+	}
+
+	return false, &common.Error{
+		Code:    common.LoginRequiredErrorCode,
+		Message: "this server needs you to log in " + strings.Join(ways, ", or "),
+	}
+}
+
+// logInWithPassword has the auth provider check the name and password of login, and its
+// one-time code if the account has two-factor authentication, and makes the client the
+// account they belong to, an admin if the account has the admin role
+func (s *session) logInWithPassword(ctx context.Context, aboutClient *common.ClientAboutMe, login common.Login) (bool, error) {
+	account, err := authProvider().Authenticate(ctx, login.Username, login.Password)
+	if err != nil {
+		log.Printf("Refused the login of %s from %v: %s\n", login.Username, s.addr, err.Error())
+
+		if !errors.Is(err, ErrInvalidCredentials) && !errors.Is(err, ErrNoRole) {
+			err = errors.New("your login couldn't be checked, try again later")
+		}
+
+		return false, &common.Error{Code: common.LoginRequiredErrorCode, Message: err.Error()}
+	}
+
+	id := uuid.NewSHA1(accountNamespace, []byte(strings.ToLower(login.Username)))
+
+	err = checkTOTP(id, login)
+	if err != nil {
+		log.Printf("Refused the login of %s from %v: %s\n", login.Username, s.addr, err.Error())
+		return false, err
+	}
+
+	aboutClient.ID = id
+	aboutClient.Name = account.Name
+	s.account = login.Username
+	s.roles = account.Roles
+
+	if slices.Contains(account.Roles, AdminRole) {
+		s.admin = true
+		log.Printf("%s from %v logged in as an admin\n", login.Username, s.addr)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// handshakeAs runs the handshake of a new session introducing itself as aboutClient, with login
+func handshakeAs(t *testing.T, aboutClient common.ClientAboutMe, login common.Login) error {
+	t.Helper()
+
+	b, err := json.Marshal(struct {
+		common.ClientAboutMe
+		common.Login
+	}{aboutClient, login})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := json.RawMessage(b)
+	s := newSession(context.Background(), discardWriter{}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)})
+	defer s.close()
+
+	return s.handshake(&common.Operation{Type: common.AboutMeOperationType, Message: &raw})
+}
+
+func TestAccountIDsNeedLogIn(t *testing.T) {
+	RegisterAuthProvider(AuthProviderFunc(func(ctx context.Context, name, password string) (Account, error) {
+		if password != "secret" {
+			return Account{}, ErrInvalidCredentials
+		}
+
+		return Account{Name: name}, nil
+	}))
+	defer RegisterAuthProvider(nil)
+
+	name := "owner-" + uuid.New().String()[:8]
+	id := uuid.NewSHA1(accountNamespace, []byte(name))
+	impostor := common.ClientAboutMe{ID: id, Name: "impostor"}
+
+	refused := func(when string) {
+		t.Helper()
+
+		err := handshakeAs(t, impostor, common.Login{})
+		codedErr := &common.Error{}
+		if !errors.As(err, &codedErr) || codedErr.Code != common.LoginRequiredErrorCode {
+			t.Errorf("%s, a client without a login connected with the ID of an account: %v", when, err)
+		}
+	}
+
+	refused("before the account logged in")
+
+	err := handshakeAs(t, common.ClientAboutMe{ID: uuid.New(), Name: name}, common.Login{Username: name, Password: "secret"})
+	if err != nil {
+		t.Fatalf("the account couldn't log in: %s", err)
+	}
+
+	refused("once the account logged in")
+
+	err = handshakeAs(t, common.ClientAboutMe{ID: uuid.New(), Name: "someone"}, common.Login{})
+	if err != nil {
+		t.Errorf("a client without a login couldn't connect with an ID of its own: %s", err)
+	}
+}
+
+// TestAdminOperationsForbidden has a client that isn't an admin announce and drain, which must
+// be refused without ending its session
+func TestAdminOperationsForbidden(t *testing.T) {
+	s := benchmarkSession(discardWriter{}, "bob")
+	defer s.close()
+
+	message := json.RawMessage(`{"text":"hello","address":"127.0.0.1:9000"}`)
+	operation := &common.Operation{Message: &message}
+
+	for name, handle := range map[string]func(ctx context.Context, op *common.Operation, s *session) error{
+		"announce": handleAnnounce,
+		"drain":    handleDrain,
+	} {
+		err := handle(context.Background(), operation, s)
+
+		var coded *common.Error
+		if !errors.As(err, &coded) || coded.Code != common.ForbiddenErrorCode {
+			t.Errorf("%s: got %v, want a %s error", name, err, common.ForbiddenErrorCode)
+		}
+	}
+}
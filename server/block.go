@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// handleBlock blocks or unblocks the users with the given ID or name for the session's user
+func handleBlock(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	block := common.Block{}
+
+	err := json.Unmarshal(*op.Message, &block)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Block: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	senders, err := findUsers(block.User)
+	if err != nil {
+		return nil, err
+	}
+
+	blocked := users.setBlocked(s.client.ID, senders, block.Blocked)
+
+	return marshalResponse(common.BlockList{Users: blocked})
+}
+
+// handleBlocks lists who the session's user blocked
+func handleBlocks(ctx context.Context, s *session) (*json.RawMessage, error) {
+	return marshalResponse(common.BlockList{Users: users.blocked(s.client.ID)})
+}
+
+// findUsers returns the users with the given ID, or all of those with the given name
+func findUsers(ref string) ([]common.Sender, error) {
+	if ref == "" {
+		return nil, &common.Error{Code: common.NotFoundErrorCode, Message: "expected the name or id of a user"}
+	}
+
+	senders := []common.Sender{}
+	if id, err := uuid.Parse(ref); err == nil {
+		sender, ok := users.sender(id)
+		if !ok {
+			sender = common.Sender{ID: id, Name: ref}
+		}
+		senders = append(senders, sender)
+	}
+	for _, u := range users.named(ref) {
+		senders = append(senders, u.sender)
+	}
+
+	if len(senders) == 0 {
+		return nil, &common.Error{Code: common.NotFoundErrorCode, Message: "no user called " + ref + " has been here"}
+	}
+
+	return senders, nil
+}
+
+// blocksSender tells whether the user of s blocked the sender of message
+func blocksSender(s *session, message common.Message) bool {
+	return message.Sender != nil && users.blocks(s.client.ID, message.Sender.ID)
+}
@@ -0,0 +1,523 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The platforms conversations may be bridged to
+const (
+	SlackBridgePlatform   = "slack"
+	DiscordBridgePlatform = "discord"
+)
+
+// The APIs of the platforms, unless a bridge has its own URL for them, e.g. for a proxy
+const (
+	slackAPIURL   = "https://slack.com/api"
+	discordAPIURL = "https://discord.com/api/v10"
+)
+
+// bridgeNamespace is the namespace the IDs of the users of bridged channels are derived from
+// their platform and their ID on it in, for them to keep their IDs across restarts
+var bridgeNamespace = uuid.MustParse("3a6d0f5c-81e2-4b9a-a8c4-6f1d2e7b9c30")
+
+// bridgePollInterval is how often bridged channels are asked for new messages, and
+// bridgeQueueSize how many messages may wait to be relayed to one. Messages that find the
+// queue full are dropped
+const (
+	bridgePollInterval = 5 * time.Second
+	bridgeQueueSize    = 100
+)
+
+// maxDiscordMessageLength is the most characters a Discord message may have. Longer messages are
+// cut off
+const maxDiscordMessageLength = 2000
+
+var bridgeHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Bridge relays the messages of the conversation with the nickname Conversation to a Slack or
+// Discord channel, and those of the channel back, as the bot whose Token it has. The channel is
+// the ID of a Slack channel, or of a Discord one. Slack bots need the chat:write,
+// chat:write.customize, channels:history and users:read scopes, Discord ones the Read Message
+// History and Send Messages permissions and the message content intent
+type Bridge struct {
+	Conversation string `yaml:"conversation"`
+	Platform     string `yaml:"platform"`
+	Channel      string `yaml:"channel"`
+	Token        string `yaml:"token"`
+	APIURL       string `yaml:"api_url"`
+}
+
+func (b Bridge) check() error {
+	if b.Platform != SlackBridgePlatform && b.Platform != DiscordBridgePlatform {
+		return fmt.Errorf("unknown bridge platform '%s', expected %s or %s", b.Platform, SlackBridgePlatform, DiscordBridgePlatform)
+	}
+
+	if b.Conversation == "" || b.Channel == "" || b.Token == "" {
+		return errors.New("bridges need a conversation, a channel and a token")
+	}
+
+	return nil
+}
+
+func (b Bridge) String() string {
+	return fmt.Sprintf("%s bridge of %s", b.Platform, b.Conversation)
+}
+
+// bridgedMessage is a message of a bridged channel, from the user with the given ID and name on
+// the platform
+type bridgedMessage struct {
+	userID string
+	name   string
+	text   string
+}
+
+// bridgeClient speaks the API of a platform
+type bridgeClient interface {
+	// post sends text to the channel, from the user called name
+	post(ctx context.Context, name, text string) error
+	// poll returns the messages sent to the channel since the last call, oldest first, but for
+	// those of bots, the bridge's own included
+	poll(ctx context.Context) ([]bridgedMessage, error)
+}
+
+// runningBridge is a bridge relaying messages
+type runningBridge struct {
+	config Bridge
+	client bridgeClient
+	outbox chan common.Message
+}
+
+type bridgeStore struct {
+	mu      sync.RWMutex
+	bridges []*runningBridge
+}
+
+var (
+	bridges         = &bridgeStore{}
+	startBridgeOnce sync.Once
+)
+
+// runBridges starts the bridges of the configuration, which relay messages until ctx is done
+func runBridges(ctx context.Context) {
+	startBridgeOnce.Do(func() {
+		for _, config := range currentConfig.bridges() {
+			b := &runningBridge{config: config, client: newBridgeClient(config), outbox: make(chan common.Message, bridgeQueueSize)}
+
+			bridges.mu.Lock()
+			bridges.bridges = append(bridges.bridges, b)
+			bridges.mu.Unlock()
+
+			go b.relayOut(ctx)
+			go b.relayIn(ctx)
+
+			log.Printf("Started the %s\n", config)
+		}
+	})
+}
+
+func newBridgeClient(config Bridge) bridgeClient {
+	if config.Platform == SlackBridgePlatform {
+		return &slackClient{Bridge: config, oldest: slackTimestamp(time.Now()), names: map[string]string{}}
+	}
+
+	return &discordClient{Bridge: config, after: discordSnowflake(time.Now())}
+}
+
+// relayToBridges queues message to the bridges of its conversation, but for the one it came
+// from, if any
+func relayToBridges(message common.Message, from *runningBridge) {
+	if message.Conversation == nil || message.Text == "" {
+		return
+	}
+
+	bridges.mu.RLock()
+	defer bridges.mu.RUnlock()
+
+	for _, b := range bridges.bridges {
+		if b == from || !strings.EqualFold(b.config.Conversation, message.Conversation.Nickname) {
+			continue
+		}
+
+		select {
+		case b.outbox <- message:
+		default:
+			common.Errorf("Too many messages waiting for the %s, dropping one\n", b.config)
+		}
+	}
+}
+
+// relayOut posts the messages of the conversation to the channel, one at a time
+func (b *runningBridge) relayOut(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-b.outbox:
+			// the channels have no actions, which are in italics there
+			text := message.Text
+			if message.Kind == common.ActionMessageKind {
+				text = "_" + text + "_"
+			}
+
+			err := b.client.post(ctx, message.Sender.Name, text)
+			var limited *bridgeRateLimitedError
+			if errors.As(err, &limited) {
+				time.Sleep(limited.wait)
+				err = b.client.post(ctx, message.Sender.Name, text)
+			}
+			if err != nil {
+				common.Errorf("Couldn't relay a message to the %s: %s\n", b.config, err.Error())
+			}
+		}
+	}
+}
+
+// relayIn sends the messages of the channel to the conversation, checking for new ones every
+// bridgePollInterval
+func (b *runningBridge) relayIn(ctx context.Context) {
+	ticker := time.NewTicker(bridgePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		bridged, err := b.client.poll(ctx)
+		var limited *bridgeRateLimitedError
+		if errors.As(err, &limited) {
+			ticker.Reset(max(limited.wait, bridgePollInterval))
+			continue
+		}
+		ticker.Reset(bridgePollInterval)
+		if err != nil {
+			common.Errorf("Couldn't get the messages of the %s: %s\n", b.config, err.Error())
+			continue
+		}
+
+		for _, message := range bridged {
+			b.post(message)
+		}
+	}
+}
+
+// post sends a message of the channel to the conversation, as a user of its own
+func (b *runningBridge) post(bridged bridgedMessage) {
+	conversation, ok := conversations.getByNickname(b.config.Conversation)
+	if !ok || conversation.Archived || conversation.Encrypted {
+		common.Debugf("Not relaying a message from the %s, whose conversation can't take it\n", b.config)
+		return
+	}
+
+	text, err := cleanText(bridged.text, currentConfig.maxMessageLength())
+	if err != nil {
+		return
+	}
+
+	publishMessage(common.Message{
+		Conversation: &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname},
+		Sender: &common.Sender{
+			ID:   uuid.NewSHA1(bridgeNamespace, []byte(b.config.Platform+":"+bridged.userID)),
+			Name: stripControls(bridged.name, false),
+		},
+		Text: text,
+	}, b)
+}
+
+// bridgeRateLimitedError is returned by the platforms' APIs asking to wait before the next request
+type bridgeRateLimitedError struct {
+	wait time.Duration
+}
+
+func (e *bridgeRateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.wait)
+}
+
+// bridgeRequest makes a request to the API of a platform with body, if any, as JSON, and
+// decodes the JSON response into out
+func bridgeRequest(ctx context.Context, method, url, authorization string, body, out interface{}) error {
+	reader := bytes.NewReader(nil)
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", authorization)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+
+	response, err := bridgeHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusTooManyRequests {
+		seconds, _ := strconv.ParseFloat(response.Header.Get("Retry-After"), 64)
+		return &bridgeRateLimitedError{wait: time.Duration(max(seconds, 1) * float64(time.Second))}
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("got %s", response.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+// slackClient speaks the Slack Web API
+type slackClient struct {
+	Bridge
+	// oldest is the timestamp of the last message seen, and names the names of the users seen,
+	// by their IDs
+	oldest string
+	names  map[string]string
+}
+
+// slackResponse is what every method of the Slack Web API responds with
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+func (r slackResponse) err() error {
+	if !r.OK {
+		return fmt.Errorf("slack said %s", r.Error)
+	}
+
+	return nil
+}
+
+// slackEscaper and slackUnescaper escape the characters Slack messages use for their markup
+var (
+	slackEscaper   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	slackUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+)
+
+func (c *slackClient) url(method string, query url.Values) string {
+	base := c.APIURL
+	if base == "" {
+		base = slackAPIURL
+	}
+
+	if len(query) == 0 {
+		return base + "/" + method
+	}
+
+	return base + "/" + method + "?" + query.Encode()
+}
+
+func (c *slackClient) post(ctx context.Context, name, text string) error {
+	response := slackResponse{}
+
+	err := bridgeRequest(ctx, http.MethodPost, c.url("chat.postMessage", nil), "Bearer "+c.Token, map[string]string{
+		"channel":  c.Channel,
+		"text":     slackEscaper.Replace(text),
+		"username": name,
+	}, &response)
+	if err != nil {
+		return err
+	}
+
+	return response.err()
+}
+
+func (c *slackClient) poll(ctx context.Context) ([]bridgedMessage, error) {
+	history := struct {
+		slackResponse
+		Messages []struct {
+			User    string `json:"user"`
+			Text    string `json:"text"`
+			TS      string `json:"ts"`
+			BotID   string `json:"bot_id"`
+			Subtype string `json:"subtype"`
+		} `json:"messages"`
+	}{}
+
+	query := url.Values{"channel": {c.Channel}, "oldest": {c.oldest}, "limit": {"100"}}
+	err := bridgeRequest(ctx, http.MethodGet, c.url("conversations.history", query), "Bearer "+c.Token, nil, &history)
+	if err != nil {
+		return nil, err
+	}
+	if err := history.err(); err != nil {
+		return nil, err
+	}
+
+	bridged := []bridgedMessage{}
+
+	// the newest come first
+	for _, message := range slices.Backward(history.Messages) {
+		c.oldest = message.TS
+
+		// bots' messages, like those relayed from here, and joins and the like, are left out
+		if message.BotID != "" || message.Subtype != "" || message.User == "" {
+			continue
+		}
+
+		bridged = append(bridged, bridgedMessage{
+			userID: message.User,
+			name:   c.name(ctx, message.User),
+			text:   slackUnescaper.Replace(message.Text),
+		})
+	}
+
+	return bridged, nil
+}
+
+// name is the name of the user with the given ID, or the ID if Slack won't tell it
+func (c *slackClient) name(ctx context.Context, id string) string {
+	if name, ok := c.names[id]; ok {
+		return name
+	}
+
+	info := struct {
+		slackResponse
+		User struct {
+			Name    string `json:"name"`
+			Profile struct {
+				DisplayName string `json:"display_name"`
+			} `json:"profile"`
+		} `json:"user"`
+	}{}
+
+	err := bridgeRequest(ctx, http.MethodGet, c.url("users.info", url.Values{"user": {id}}), "Bearer "+c.Token, nil, &info)
+	if err == nil {
+		err = info.err()
+	}
+	if err != nil {
+		common.Debugf("Couldn't get the name of Slack user %s: %s\n", id, err.Error())
+		return id
+	}
+
+	name := info.User.Profile.DisplayName
+	if name == "" {
+		name = info.User.Name
+	}
+	c.names[id] = name
+
+	return name
+}
+
+// slackTimestamp is the timestamp Slack gives a message sent at t
+func slackTimestamp(t time.Time) string {
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+}
+
+// discordClient speaks the Discord REST API
+type discordClient struct {
+	Bridge
+	// after is the ID of the last message seen
+	after string
+}
+
+// discordMessage is a message of a Discord channel, as the API has it
+type discordMessage struct {
+	ID        string `json:"id"`
+	Content   string `json:"content"`
+	WebhookID string `json:"webhook_id"`
+	Author    struct {
+		ID         string `json:"id"`
+		Username   string `json:"username"`
+		GlobalName string `json:"global_name"`
+		Bot        bool   `json:"bot"`
+	} `json:"author"`
+}
+
+// discordEpoch is when the IDs of Discord start, in Unix milliseconds
+const discordEpoch = 1420070400000
+
+func (c *discordClient) url(path string) string {
+	base := c.APIURL
+	if base == "" {
+		base = discordAPIURL
+	}
+
+	return base + "/channels/" + url.PathEscape(c.Channel) + path
+}
+
+func (c *discordClient) post(ctx context.Context, name, text string) error {
+	content := fmt.Sprintf("**%s**: %s", name, text)
+	if runes := []rune(content); len(runes) > maxDiscordMessageLength {
+		content = string(runes[:maxDiscordMessageLength-1]) + "…"
+	}
+
+	return bridgeRequest(ctx, http.MethodPost, c.url("/messages"), "Bot "+c.Token, map[string]interface{}{
+		"content": content,
+		// nobody is pinged by what's relayed
+		"allowed_mentions": map[string][]string{"parse": {}},
+	}, nil)
+}
+
+func (c *discordClient) poll(ctx context.Context) ([]bridgedMessage, error) {
+	messages := []discordMessage{}
+
+	err := bridgeRequest(ctx, http.MethodGet, c.url("/messages?limit=100&after="+url.QueryEscape(c.after)), "Bot "+c.Token, nil, &messages)
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs grow with time, and longer ones are later
+	slices.SortFunc(messages, func(a, b discordMessage) int {
+		return compareSnowflakes(a.ID, b.ID)
+	})
+
+	bridged := []bridgedMessage{}
+	for _, message := range messages {
+		c.after = message.ID
+
+		if message.Author.Bot || message.WebhookID != "" || message.Content == "" {
+			continue
+		}
+
+		name := message.Author.GlobalName
+		if name == "" {
+			name = message.Author.Username
+		}
+
+		bridged = append(bridged, bridgedMessage{userID: message.Author.ID, name: name, text: message.Content})
+	}
+
+	return bridged, nil
+}
+
+// discordSnowflake is the smallest Discord ID of the time t
+func discordSnowflake(t time.Time) string {
+	return strconv.FormatInt((t.UnixMilli()-discordEpoch)<<22, 10)
+}
+
+func compareSnowflakes(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+
+	return strings.Compare(a, b)
+}
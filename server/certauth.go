@@ -0,0 +1,36 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// certificateNamespace is the namespace of the IDs derived from the subjects of client
+// certificates, so that a subject is the same user whatever certificate it comes with
+var certificateNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/nikochiko/tcpchat/client-certificate"))
+
+// clientCertificate is the certificate a client presented in the TLS handshake of state, when
+// client certificates are required. They're verified by then, or the handshake failed
+func clientCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || currentConfig.get().TLS.ClientCA == "" || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return state.PeerCertificates[0]
+}
+
+// certify makes the identity of aboutClient the one of the subject of cert: its ID is derived
+// from the subject, and its name is the subject's common name
+func certify(aboutClient *common.ClientAboutMe, cert *x509.Certificate) error {
+	if cert.Subject.CommonName == "" {
+		return &common.Error{Code: common.ForbiddenErrorCode, Message: "client certificates need a common name"}
+	}
+
+	aboutClient.ID = uuid.NewSHA1(certificateNamespace, []byte(cert.Subject.String()))
+	aboutClient.Name = cert.Subject.CommonName
+
+	return nil
+}
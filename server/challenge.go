@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// challengeNonceSize is how long the random part of the nonces of challenges is
+const challengeNonceSize = 32
+
+// challengeKey signs the nonces of the challenges handed out over HTTP, which aren't sent on the
+// connection the client introduces itself on, for them to be checked without keeping them
+var challengeKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+
+	return key
+}()
+
+// sendChallenge opens the session with a challenge, for its client to prove it has the private
+// key of its public key in the handshake. Only the nonce of this challenge answers it
+func (s *session) sendChallenge() error {
+	s.challenge = make([]byte, challengeNonceSize)
+	rand.Read(s.challenge)
+
+	b, err := json.Marshal(common.Challenge{Nonce: s.challenge})
+	if err != nil {
+		return err
+	}
+
+	jsonChallenge := json.RawMessage(b)
+
+	return s.writeOK(&jsonChallenge, common.ChallengeOperationType)
+}
+
+// answersChallenge tells if nonce is that of the challenge the session was opened with, which
+// is only answered once
+func (s *session) answersChallenge(nonce []byte) bool {
+	challenge := s.challenge
+	s.challenge = nil
+
+	return len(challenge) != 0 && subtle.ConstantTimeCompare(challenge, nonce) == 1
+}
+
+// signedChallenge is the nonce of a challenge handed out over HTTP: random bytes, followed by
+// when the challenge expires, in Unix seconds, and the signature of both
+func signedChallenge() []byte {
+	nonce := make([]byte, challengeNonceSize, challengeNonceSize+8+sha256.Size)
+	rand.Read(nonce)
+
+	expires := time.Now().Add(currentConfig.handshakeTimeout())
+	nonce = binary.BigEndian.AppendUint64(nonce, uint64(expires.Unix()))
+
+	return append(nonce, challengeSignature(nonce)...)
+}
+
+// checkSignedChallenge tells if nonce is one signedChallenge made, which hasn't expired yet
+func checkSignedChallenge(nonce []byte) bool {
+	if len(nonce) != challengeNonceSize+8+sha256.Size {
+		return false
+	}
+
+	signed, signature := nonce[:challengeNonceSize+8], nonce[challengeNonceSize+8:]
+	if !hmac.Equal(signature, challengeSignature(signed)) {
+		return false
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(signed[challengeNonceSize:])), 0)
+
+	return time.Now().Before(expires)
+}
+
+func challengeSignature(b []byte) []byte {
+	mac := hmac.New(sha256.New, challengeKey)
+	mac.Write(b)
+
+	return mac.Sum(nil)
+}
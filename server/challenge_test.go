@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// handshakeWithProof runs the handshake of s for a client with the given public key and proof
+func handshakeWithProof(t *testing.T, s *session, publicKey ed25519.PublicKey, proof common.Proof) error {
+	t.Helper()
+
+	b, err := json.Marshal(struct {
+		common.ClientAboutMe
+		common.Proof
+	}{common.ClientAboutMe{ID: uuid.New(), Name: "keyholder", PublicKey: publicKey}, proof})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := json.RawMessage(b)
+
+	return s.handshake(&common.Operation{Type: common.AboutMeOperationType, Message: &raw})
+}
+
+func TestProofOnlyAnswersItsOwnChallenge(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newChallengedSession := func() *session {
+		s := newSession(context.Background(), discardWriter{}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)})
+		t.Cleanup(s.close)
+
+		err := s.sendChallenge()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	victim := newChallengedSession()
+	attacker := newChallengedSession()
+
+	proof := common.Prove(victim.challenge, privateKey)
+
+	err = handshakeWithProof(t, attacker, publicKey, proof)
+	codedErr := &common.Error{}
+	if !errors.As(err, &codedErr) || codedErr.Code != common.KeyMismatchErrorCode {
+		t.Fatalf("a proof for the challenge of another session was taken: %v", err)
+	}
+
+	err = handshakeWithProof(t, victim, publicKey, proof)
+	if err != nil {
+		t.Fatalf("the proof for the session's own challenge was refused: %s", err)
+	}
+}
+
+func TestSignedChallenge(t *testing.T) {
+	nonce := signedChallenge()
+	if !checkSignedChallenge(nonce) {
+		t.Fatalf("a signed challenge didn't check out")
+	}
+
+	forged := append([]byte{}, nonce...)
+	forged[0] ^= 1
+	if checkSignedChallenge(forged) {
+		t.Errorf("a changed challenge checked out")
+	}
+
+	if checkSignedChallenge(nonce[:challengeNonceSize]) {
+		t.Errorf("a challenge without a signature checked out")
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+	"gopkg.in/yaml.v3"
+)
+
+// chaosPieceDelay is the pause between the pieces of a partial write, for them to arrive apart
+const chaosPieceDelay = 10 * time.Millisecond
+
+// Chaos makes the server misbehave on purpose, to test how clients cope with bad networks and
+// servers: reconnecting, resuming and deduplicating. Every response is held back Latency
+// milliseconds, plus up to Jitter more at random. PartialWrites, Disconnects and Corruption
+// are the odds, from 0 to 1, of a response being written in several pieces, of the connection
+// being closed instead of writing it, and of a byte of it being garbled. Faults are random but
+// reproducible: with the same Seed, the n-th connection gets the same ones every time. Only for
+// testing, never for a server people chat on: it's only set by `tcpchat serve -chaos`, in builds
+// with the chaos tag, and isn't part of the configuration reloaded on SIGHUP
+type Chaos struct {
+	Seed          uint64  `yaml:"seed"`
+	Latency       int     `yaml:"latency"`
+	Jitter        int     `yaml:"jitter"`
+	PartialWrites float64 `yaml:"partial_writes"`
+	Disconnects   float64 `yaml:"disconnects"`
+	Corruption    float64 `yaml:"corruption"`
+}
+
+// injectedChaos is the chaos of every TCP connection, when set by InjectChaos
+var injectedChaos Chaos
+
+// InjectChaos has faults injected into the TCP connections served from now on, as c says
+func InjectChaos(c Chaos) {
+	injectedChaos = c
+}
+
+// LoadChaos reads the chaos settings from the YAML file at path
+func LoadChaos(path string) (Chaos, error) {
+	c := Chaos{}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+
+	err = yaml.Unmarshal(b, &c)
+	if err != nil {
+		return c, err
+	}
+
+	return c, c.check()
+}
+
+func (c Chaos) check() error {
+	if c.Latency < 0 || c.Jitter < 0 {
+		return errors.New("chaos latency and jitter can't be negative")
+	}
+
+	for _, odds := range []float64{c.PartialWrites, c.Disconnects, c.Corruption} {
+		if odds < 0 || odds > 1 {
+			return fmt.Errorf("chaos odds should be between 0 and 1, not %g", odds)
+		}
+	}
+
+	return nil
+}
+
+func (c Chaos) enabled() bool {
+	return c != Chaos{}
+}
+
+// chaosConnections counts the connections faults were injected into, for each of them to get
+// the random numbers of its own place in line
+var chaosConnections atomic.Uint64
+
+// wrap returns conn, injecting faults into what's written to it if chaos is enabled
+func (c Chaos) wrap(conn net.Conn) net.Conn {
+	if !c.enabled() {
+		return conn
+	}
+
+	return c.newConn(conn, chaosConnections.Add(1))
+}
+
+// newConn returns conn with the faults of the n-th connection
+func (c Chaos) newConn(conn net.Conn, n uint64) *chaosConn {
+	return &chaosConn{Conn: conn, chaos: c, rng: rand.New(rand.NewPCG(c.Seed, n)), n: n}
+}
+
+// chaosConn is a connection whose writes are delayed, split, dropped or garbled by its Chaos
+type chaosConn struct {
+	net.Conn
+	chaos Chaos
+	n     uint64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// every write takes the same random numbers whatever happens to it, for the faults of the
+	// next ones not to depend on the faults of this one
+	delay := c.chaos.Latency
+	if c.chaos.Jitter > 0 {
+		delay += c.rng.IntN(c.chaos.Jitter + 1)
+	}
+	disconnect := c.rng.Float64() < c.chaos.Disconnects
+	corrupt := c.rng.Float64() < c.chaos.Corruption
+	split := c.rng.Float64() < c.chaos.PartialWrites
+	garbled := c.rng.IntN(max(len(b), 1))
+	cuts := []int{c.rng.IntN(max(len(b), 1)), c.rng.IntN(max(len(b), 1))}
+
+	time.Sleep(time.Duration(delay) * time.Millisecond)
+
+	if disconnect {
+		common.Debugf("chaos: disconnecting connection %d\n", c.n)
+		c.Conn.Close()
+		return 0, fmt.Errorf("chaos: %w", net.ErrClosed)
+	}
+
+	// garbled, but with its delimiter, for the client to see a broken frame rather than
+	// lose track of where frames start
+	if corrupt && garbled < len(b)-len(common.EOFBytes) {
+		common.Debugf("chaos: garbling byte %d of a write to connection %d\n", garbled, c.n)
+		b = slices.Clone(b)
+		if b[garbled] == '#' {
+			b[garbled] = '!'
+		} else {
+			b[garbled] = '#'
+		}
+	}
+
+	if !split || len(b) < 2 {
+		return c.Conn.Write(b)
+	}
+
+	slices.Sort(cuts)
+	common.Debugf("chaos: writing to connection %d in pieces, cut at %v\n", c.n, cuts)
+
+	written := 0
+	for _, end := range append(cuts, len(b)) {
+		if end <= written {
+			continue
+		}
+		if written > 0 {
+			time.Sleep(chaosPieceDelay)
+		}
+
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+)
+
+// recordingConn records what's written to it and whether it was closed, in order
+type recordingConn struct {
+	net.Conn
+	events []string
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.events = append(c.events, fmt.Sprintf("write %q", b))
+	return len(b), nil
+}
+
+func (c *recordingConn) Close() error {
+	c.events = append(c.events, "close")
+	return nil
+}
+
+// chaosFrame is what the test writes over and over
+var chaosFrame = append(bytes.Repeat([]byte("x"), 62), "\r\n"...)
+
+// chaosEvents writes frames to the n-th connection of chaos and returns what came out of it
+func chaosEvents(chaos Chaos, n uint64) []string {
+	rec := &recordingConn{}
+	conn := chaos.newConn(rec, n)
+
+	for i := 0; i < 50; i++ {
+		_, err := conn.Write(chaosFrame)
+		if err != nil {
+			rec.events = append(rec.events, err.Error())
+		}
+	}
+
+	return rec.events
+}
+
+func TestChaosIsReproducible(t *testing.T) {
+	chaos := Chaos{Seed: 42, PartialWrites: 0.2, Disconnects: 0.1, Corruption: 0.2}
+
+	first := chaosEvents(chaos, 1)
+	if !slices.Equal(first, chaosEvents(chaos, 1)) {
+		t.Fatalf("the same seed and connection got different faults")
+	}
+
+	faults := 0
+	for _, event := range first {
+		if event != fmt.Sprintf("write %q", chaosFrame) {
+			faults++
+		}
+	}
+	if faults == 0 {
+		t.Fatalf("no faults were injected into 50 writes")
+	}
+
+	if slices.Equal(first, chaosEvents(chaos, 2)) {
+		t.Errorf("the second connection got the faults of the first")
+	}
+
+	other := chaos
+	other.Seed = 43
+	if slices.Equal(first, chaosEvents(other, 1)) {
+		t.Errorf("another seed got the same faults")
+	}
+}
@@ -0,0 +1,577 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// clusterRingReplicas is how many points every node has on the hash ring, for the
+// conversations to be spread evenly
+const clusterRingReplicas = 64
+
+// clusterPingInterval is how often the nodes tell the others they're still there,
+// clusterRetryInterval how long they wait before connecting to a node again, and
+// clusterWriteTimeout how long sending to one may take before it's taken as down.
+// clusterQueueSize is how many frames may wait to be sent to a node; those that find the queue
+// full are dropped
+const (
+	clusterPingInterval  = 2 * time.Second
+	clusterRetryInterval = 2 * time.Second
+	clusterWriteTimeout  = 5 * time.Second
+	clusterQueueSize     = 1000
+)
+
+// The kinds of the frames the nodes send each other
+const (
+	// helloFrame opens the connection from a node, with its ID and the secret of the cluster
+	helloFrame = "hello"
+	pingFrame  = "ping"
+	// createFrame has a conversation created on the node
+	createFrame = "create"
+	// forwardFrame has a message for the node owning its conversation to store and deliver,
+	// and deliverFrame a message the owner stored, for the node to keep and deliver too
+	forwardFrame = "forward"
+	deliverFrame = "deliver"
+)
+
+// Cluster makes the server a node of a cluster with its Peers. Every conversation is owned by
+// one of the nodes that are up, picked by consistent hashing of its ID over their IDs: the owner
+// stores and numbers the messages of the conversation, which the other nodes forward to it, and
+// sends them on to every node. Node is the ID of this node, Listen the address the other nodes
+// connect to it on, and Secret what they prove they're part of the cluster with, the same on
+// every node. Without a Node, the server isn't in a cluster
+type Cluster struct {
+	Node   string `yaml:"node"`
+	Listen string `yaml:"listen"`
+	Secret string `yaml:"secret"`
+	Peers  []Peer `yaml:"peers"`
+}
+
+// Peer is another node of the cluster, with its ID and the Address it listens on for the others
+type Peer struct {
+	Node    string `yaml:"node"`
+	Address string `yaml:"address"`
+}
+
+func (c Cluster) check() error {
+	if c.Node == "" {
+		if len(c.Peers) > 0 {
+			return errors.New("the cluster needs the ID of this node")
+		}
+
+		return nil
+	}
+
+	if c.Secret == "" {
+		return errors.New("the cluster needs a secret")
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("cluster listen address '%s' should be host:port", c.Listen)
+	}
+
+	nodes := map[string]bool{c.Node: true}
+	for _, peer := range c.Peers {
+		if peer.Node == "" {
+			return errors.New("the peers of the cluster need an ID")
+		}
+
+		if nodes[peer.Node] {
+			return fmt.Errorf("node '%s' is in the cluster twice", peer.Node)
+		}
+		nodes[peer.Node] = true
+
+		if _, _, err := net.SplitHostPort(peer.Address); err != nil {
+			return fmt.Errorf("the address '%s' of node %s should be host:port", peer.Address, peer.Node)
+		}
+	}
+
+	return nil
+}
+
+// hashRing places the nodes on a ring of hashes, for conversations to be owned by the node
+// whose point comes first after the hash of their ID. Nodes coming and going only move the
+// conversations of their own points
+type hashRing struct {
+	hashes []uint64
+	nodes  map[uint64]string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{nodes: map[uint64]string{}}
+
+	for _, node := range nodes {
+		for i := range clusterRingReplicas {
+			hash := ringHash(node + "#" + strconv.Itoa(i))
+			r.hashes = append(r.hashes, hash)
+			r.nodes[hash] = node
+		}
+	}
+
+	slices.Sort(r.hashes)
+
+	return r
+}
+
+// ringHash places key on the ring. The IDs of the nodes are alike, so it takes a hash that
+// spreads them well
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// owner is the node owning key
+func (r *hashRing) owner(key string) string {
+	hash := ringHash(key)
+
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.nodes[r.hashes[i]]
+}
+
+// clusterFrame is what the nodes send each other, one JSON object per line
+type clusterFrame struct {
+	Kind         string               `json:"kind"`
+	Node         string               `json:"node,omitempty"`
+	Secret       string               `json:"secret,omitempty"`
+	Message      *common.Message      `json:"message,omitempty"`
+	Conversation *common.Conversation `json:"conversation,omitempty"`
+}
+
+// clusterPeer is another node, up while this node is connected to it
+type clusterPeer struct {
+	config Peer
+	up     atomic.Bool
+	outbox chan []byte
+}
+
+// clusterNode is this node of the cluster
+type clusterNode struct {
+	config Cluster
+	active atomic.Bool
+	peers  map[string]*clusterPeer
+	ring   atomic.Pointer[hashRing]
+
+	// bridged are the bridges the messages forwarded to their owner came from, by ID, so that
+	// they aren't relayed back to them once the owner delivers them
+	bridgedMu sync.Mutex
+	bridged   map[uuid.UUID]*runningBridge
+}
+
+var cluster = &clusterNode{}
+
+// joinCluster joins the cluster of the configuration, if it has one: it listens for the other
+// nodes, and connects to them, until ctx is done
+func joinCluster(ctx context.Context) error {
+	config := currentConfig.cluster()
+	if config.Node == "" || cluster.active.Load() {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+
+	cluster.config = config
+	cluster.bridged = map[uuid.UUID]*runningBridge{}
+	cluster.peers = map[string]*clusterPeer{}
+	for _, peer := range config.Peers {
+		cluster.peers[peer.Node] = &clusterPeer{config: peer, outbox: make(chan []byte, clusterQueueSize)}
+	}
+	cluster.updateRing()
+	cluster.active.Store(true)
+
+	for _, peer := range cluster.peers {
+		go cluster.connect(ctx, peer)
+	}
+
+	log.Printf("Node %s of the cluster listening for the other nodes on %s\n", config.Node, listener.Addr())
+
+	go cluster.accept(ctx, listener)
+
+	return nil
+}
+
+func (cn *clusterNode) accept(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			common.Errorf("Error while accepting a connection from a node: %s\n", err.Error())
+			continue
+		}
+
+		go cn.serve(conn)
+	}
+}
+
+// updateRing places this node, and the others that are up, on the ring
+func (cn *clusterNode) updateRing() {
+	nodes := []string{cn.config.Node}
+	for _, peer := range cn.peers {
+		if peer.up.Load() {
+			nodes = append(nodes, peer.config.Node)
+		}
+	}
+
+	cn.ring.Store(newHashRing(nodes))
+}
+
+// remoteOwner is the node owning a conversation, false if the server isn't in a cluster or owns
+// it itself. Encrypted conversations, whose keys are every node's own, stay with theirs
+func (cn *clusterNode) remoteOwner(conversationID uuid.UUID) (*clusterPeer, bool) {
+	if !cn.active.Load() {
+		return nil, false
+	}
+
+	conversation, ok := conversations.get(conversationID)
+	if !ok || conversation.Encrypted {
+		return nil, false
+	}
+
+	owner := cn.ring.Load().owner(conversationID.String())
+	if owner == cn.config.Node {
+		return nil, false
+	}
+
+	peer, ok := cn.peers[owner]
+	return peer, ok
+}
+
+// connect keeps a connection to peer, sending it what's queued for it and pings in between.
+// The peer is up while the connection is
+func (cn *clusterNode) connect(ctx context.Context, peer *clusterPeer) {
+	for {
+		err := cn.talkTo(ctx, peer)
+		if peer.up.Swap(false) {
+			cn.updateRing()
+			log.Printf("Node %s of the cluster is down: %s\n", peer.config.Node, err.Error())
+		}
+
+		select {
+		case <-time.After(clusterRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (cn *clusterNode) talkTo(ctx context.Context, peer *clusterPeer) error {
+	dialer := &net.Dialer{Timeout: clusterWriteTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.config.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the peer doesn't send anything back, but for closing the connection when it goes away
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, conn)
+		if err == nil {
+			err = io.EOF
+		}
+		closed <- err
+	}()
+
+	write := func(b []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(clusterWriteTimeout))
+		_, err := conn.Write(append(b, common.EOFBytes...))
+		return err
+	}
+
+	hello, _ := json.Marshal(clusterFrame{Kind: helloFrame, Node: cn.config.Node, Secret: cn.config.Secret})
+	err = write(hello)
+	if err != nil {
+		return err
+	}
+
+	// the peer may have missed conversations created while it was down, and messages, which it
+	// goes on numbering from their LastSeq if it owns them now
+	for _, conversation := range conversations.all() {
+		if conversation.Encrypted {
+			continue
+		}
+
+		// a copy, as the stored conversation is shared
+		synced := *conversation
+		synced.LastSeq = messages.lastSeq(conversation.ID)
+
+		b, err := json.Marshal(clusterFrame{Kind: createFrame, Conversation: &synced})
+		if common.CheckErrorAndLog(err) {
+			continue
+		}
+
+		err = write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	peer.up.Store(true)
+	cn.updateRing()
+	log.Printf("Node %s of the cluster is up at %s\n", peer.config.Node, peer.config.Address)
+
+	ping, _ := json.Marshal(clusterFrame{Kind: pingFrame})
+	ticker := time.NewTicker(clusterPingInterval)
+	defer ticker.Stop()
+
+	for {
+		var b []byte
+		select {
+		case b = <-peer.outbox:
+		case <-ticker.C:
+			b = ping
+		case err := <-closed:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		err = write(b)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// send queues frame for peer, unless it's down
+func (cn *clusterNode) send(peer *clusterPeer, frame clusterFrame) {
+	if !peer.up.Load() {
+		return
+	}
+
+	b, err := json.Marshal(frame)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	select {
+	case peer.outbox <- b:
+	default:
+		common.Errorf("Too many frames waiting to be sent to node %s, dropping one\n", peer.config.Node)
+	}
+}
+
+// sendAll queues frame for every node that's up
+func (cn *clusterNode) sendAll(frame clusterFrame) {
+	if !cn.active.Load() {
+		return
+	}
+
+	for _, peer := range cn.peers {
+		cn.send(peer, frame)
+	}
+}
+
+// serve handles the frames of a node that connected, once it said hello with the secret
+func (cn *clusterNode) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	hello := clusterFrame{}
+	b, err := common.ReadUntil(reader, common.EOFBytes)
+	if err == nil {
+		err = json.Unmarshal(b, &hello)
+	}
+	if err != nil || hello.Kind != helloFrame {
+		common.Errorf("Node at %v didn't say hello\n", conn.RemoteAddr())
+		return
+	}
+
+	if _, ok := cn.peers[hello.Node]; !ok || subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(cn.config.Secret)) != 1 {
+		log.Printf("Refused node '%s' at %v, which isn't in the cluster or has the wrong secret\n", hello.Node, conn.RemoteAddr())
+		return
+	}
+
+	for {
+		b, err := common.ReadUntil(reader, common.EOFBytes)
+		if err != nil {
+			return
+		}
+
+		frame := clusterFrame{}
+		err = json.Unmarshal(b, &frame)
+		if err != nil {
+			common.Errorf("Unmarshaling error while parsing a frame from node %s: %s\n", hello.Node, err.Error())
+			continue
+		}
+
+		cn.handle(frame)
+	}
+}
+
+func (cn *clusterNode) handle(frame clusterFrame) {
+	switch frame.Kind {
+	case createFrame:
+		if frame.Conversation == nil {
+			return
+		}
+
+		conversation := *frame.Conversation
+		conversation.LastSeq = 0
+
+		err := conversations.addShared(&conversation)
+		if err != nil {
+			common.Debugf("Not creating the conversation '%s' of another node: %s\n", conversation.Nickname, err.Error())
+		}
+
+		messages.skipTo(conversation.ID, frame.Conversation.LastSeq)
+	case forwardFrame:
+		if !cn.knows(frame.Message) {
+			return
+		}
+
+		// the forwarding node already gave the message its ID and time, the owner numbers it
+		message := messages.keep(*frame.Message)
+		if message.Kind == common.SystemMessageKind {
+			messageRouter.broadcast(message)
+			cn.sendAll(clusterFrame{Kind: deliverFrame, Message: &message})
+			return
+		}
+
+		events.publish(Event{Kind: MessageEvent, Conversation: message.Conversation, Message: &message})
+	case deliverFrame:
+		if !cn.knows(frame.Message) {
+			return
+		}
+
+		message := messages.replicate(*frame.Message)
+		if message.Kind == common.SystemMessageKind {
+			messageRouter.broadcast(message)
+			return
+		}
+
+		events.publish(Event{Kind: MessageEvent, Conversation: message.Conversation, Message: &message,
+			bridge: cn.bridgedFrom(message.ID), replicated: true})
+	}
+}
+
+// knows is whether message is for a conversation of this node, which it can take in
+func (cn *clusterNode) knows(message *common.Message) bool {
+	if message == nil || message.Conversation == nil {
+		return false
+	}
+
+	conversation, ok := conversations.get(message.Conversation.ID)
+	if !ok || conversation.Encrypted {
+		common.Debugf("Not taking in a message of '%s' from another node, which can't take it here\n", message.Conversation.Nickname)
+		return false
+	}
+
+	return true
+}
+
+// forward sends message to the node owning its conversation, which stores it and delivers it
+// to every node, this one included, returning it with the ID and time it's given here. from is
+// the bridge it came from, if any
+func (cn *clusterNode) forward(owner *clusterPeer, message common.Message, from *runningBridge) common.Message {
+	message.ID = uuid.New()
+	message.Timestamp = time.Now()
+
+	if from != nil {
+		cn.bridgedMu.Lock()
+		cn.bridged[message.ID] = from
+		cn.bridgedMu.Unlock()
+	}
+
+	cn.send(owner, clusterFrame{Kind: forwardFrame, Message: &message})
+
+	return message
+}
+
+func (cn *clusterNode) bridgedFrom(id uuid.UUID) *runningBridge {
+	cn.bridgedMu.Lock()
+	defer cn.bridgedMu.Unlock()
+
+	from := cn.bridged[id]
+	delete(cn.bridged, id)
+
+	return from
+}
+
+// deliverToCluster sends the messages of the conversations this node owns to the other nodes,
+// but for those of encrypted conversations
+func deliverToCluster(event Event) {
+	if event.replicated {
+		return
+	}
+
+	conversation, ok := conversations.get(event.Conversation.ID)
+	if !ok || conversation.Encrypted {
+		return
+	}
+
+	cluster.sendAll(clusterFrame{Kind: deliverFrame, Message: event.Message})
+}
+
+// announceConversation tells the other nodes about a conversation created on this one, for them
+// to have it too, with the same ID
+func announceConversation(conversation *common.Conversation) {
+	if conversation.Encrypted {
+		return
+	}
+
+	cluster.sendAll(clusterFrame{Kind: createFrame, Conversation: conversation})
+}
+
+// clusterCommand lists the nodes of the cluster, with whether they're up and how many of the
+// conversations they own
+func clusterCommand(out io.Writer, args string, actor auditActor) error {
+	if !cluster.active.Load() {
+		fmt.Fprintln(out, "Not in a cluster")
+		return nil
+	}
+
+	owned := map[string]int{}
+	ring := cluster.ring.Load()
+	for _, conversation := range conversations.all() {
+		owned[ring.owner(conversation.ID.String())]++
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tADDRESS\tSTATE\tCONVERSATIONS")
+	fmt.Fprintf(w, "%s\t%s\tthis node\t%d\n", cluster.config.Node, cluster.config.Listen, owned[cluster.config.Node])
+	for _, peer := range cluster.config.Peers {
+		state := "down"
+		if cluster.peers[peer.Node].up.Load() {
+			state = "up"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", peer.Node, peer.Address, state, owned[peer.Node])
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// Command is a slash command sent to a conversation, like "/roll 2d6": Name, without its "/",
+// and the Args after it, as the Message they came in
+type Command struct {
+	Name    string         `json:"name"`
+	Args    string         `json:"args"`
+	Message common.Message `json:"message"`
+}
+
+// CommandResult is what a command sends to the conversation instead of itself: Text as a system
+// message if System (nothing if it's empty), as the sender's action if Action, or as the
+// sender's message otherwise
+type CommandResult struct {
+	Text   string
+	System bool
+	Action bool
+}
+
+// CommandFunc runs a command. A *common.Error it returns is sent back to the client; other
+// errors are logged, and the command refused
+type CommandFunc func(ctx context.Context, command Command) (CommandResult, error)
+
+// commandNamePattern is what the names of commands look like, so that messages like
+// "/usr/bin is full" aren't taken for commands
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+var (
+	slashCommandsMu sync.RWMutex
+	slashCommands   = map[string]CommandFunc{
+		"roll":  rollCommand,
+		"me":    meCommand,
+		"shrug": shrugCommand,
+	}
+)
+
+// RegisterCommand has f run the command called name, without its "/", replacing the command
+// called so if there's one already
+func RegisterCommand(name string, f CommandFunc) {
+	slashCommandsMu.Lock()
+	defer slashCommandsMu.Unlock()
+
+	slashCommands[strings.ToLower(name)] = f
+}
+
+func registeredCommand(name string) (CommandFunc, bool) {
+	slashCommandsMu.RLock()
+	defer slashCommandsMu.RUnlock()
+
+	f, ok := slashCommands[name]
+	return f, ok
+}
+
+// Alias is a command of the operator's, called Name: its Text, where {args} is replaced with
+// what follows the command and {name} with the name of who sent it, is sent as the sender's
+// message, or as a system message if System
+type Alias struct {
+	Name   string `yaml:"name"`
+	Text   string `yaml:"text"`
+	System bool   `yaml:"system"`
+}
+
+func (a Alias) check() error {
+	if !commandNamePattern.MatchString(a.Name) {
+		return fmt.Errorf("command '%s' should be made of lowercase letters, digits, '-' and '_'", a.Name)
+	}
+
+	if a.Text == "" {
+		return fmt.Errorf("command '%s' has no text", a.Name)
+	}
+
+	return nil
+}
+
+func (a Alias) run(ctx context.Context, command Command) (CommandResult, error) {
+	sender := ""
+	if command.Message.Sender != nil {
+		sender = command.Message.Sender.Name
+	}
+
+	text := strings.NewReplacer("{args}", command.Args, "{name}", sender).Replace(a.Text)
+
+	return CommandResult{Text: strings.TrimSpace(text), System: a.System}, nil
+}
+
+// runCommand runs the command message starts with, if it's one, returning false if it isn't.
+// The aliases of the configuration come before the commands of the server. Messages starting
+// with "//" aren't commands, but what follows the first "/"
+func runCommand(ctx context.Context, message common.Message) (CommandResult, bool, error) {
+	if strings.HasPrefix(message.Text, "//") {
+		return CommandResult{Text: message.Text[1:], Action: message.Kind == common.ActionMessageKind}, true, nil
+	}
+
+	name, args, ok := parseCommand(message.Text)
+	if !ok {
+		return CommandResult{}, false, nil
+	}
+
+	var f CommandFunc
+	for _, alias := range currentConfig.aliases() {
+		if alias.Name == name {
+			f = alias.run
+			break
+		}
+	}
+
+	if f == nil {
+		f, ok = registeredCommand(name)
+		if !ok {
+			return CommandResult{}, true, &common.Error{
+				Code:    common.NotFoundErrorCode,
+				Message: fmt.Sprintf("unknown command /%s, start with // to send a message starting with /", name),
+			}
+		}
+	}
+
+	result, err := f(ctx, Command{Name: name, Args: args, Message: message})
+
+	var commandErr *common.Error
+	if errors.As(err, &commandErr) {
+		return result, true, commandErr
+	}
+	if err != nil {
+		common.Errorf("Error while running /%s: %s\n", name, err.Error())
+		return result, true, &common.Error{Code: common.InvalidCommandErrorCode, Message: fmt.Sprintf("/%s failed", name)}
+	}
+
+	return result, true, nil
+}
+
+// parseCommand splits a message like "/roll 2d6" into the command's name, "roll", and its
+// arguments, "2d6"
+func parseCommand(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", "", false
+	}
+
+	name, args, _ := strings.Cut(text[1:], " ")
+	name = strings.ToLower(name)
+	if !commandNamePattern.MatchString(name) {
+		return "", "", false
+	}
+
+	return name, strings.TrimSpace(args), true
+}
+
+// sendSystemMessage keeps text as a system message of conversation, and sends it to its
+// subscribers, on every node of the cluster if there's one
+func sendSystemMessage(conversation *common.Conversation, text string) {
+	message := common.Message{
+		Conversation: &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname},
+		Sender:       &serverSender,
+		Text:         text,
+		Kind:         common.SystemMessageKind,
+	}
+
+	if owner, ok := cluster.remoteOwner(conversation.ID); ok {
+		cluster.forward(owner, message, nil)
+		return
+	}
+
+	message = messages.add(message)
+	messageRouter.broadcast(message)
+	if !conversation.Encrypted {
+		cluster.sendAll(clusterFrame{Kind: deliverFrame, Message: &message})
+	}
+}
+
+// rollCommand rolls dice, like "/roll 2d6", one six-sided die without arguments
+func rollCommand(ctx context.Context, command Command) (CommandResult, error) {
+	usage := &common.Error{Code: common.InvalidCommandErrorCode, Message: "usage: /roll [count]d<sides>, like /roll 2d6"}
+
+	dice := command.Args
+	if dice == "" {
+		dice = "1d6"
+	}
+
+	count, sides, ok := strings.Cut(strings.ToLower(dice), "d")
+	if !ok {
+		return CommandResult{}, usage
+	}
+
+	n := 1
+	if count != "" {
+		var err error
+		n, err = strconv.Atoi(count)
+		if err != nil || n < 1 || n > 100 {
+			return CommandResult{}, usage
+		}
+	}
+
+	m, err := strconv.Atoi(sides)
+	if err != nil || m < 2 || m > 1000 {
+		return CommandResult{}, usage
+	}
+
+	rolls := []string{}
+	total := 0
+	for range n {
+		roll := rand.IntN(m) + 1
+		total += roll
+		rolls = append(rolls, strconv.Itoa(roll))
+	}
+
+	return CommandResult{
+		Text:   fmt.Sprintf("%s rolled %s: %s (%d)", command.Message.Sender.Name, dice, strings.Join(rolls, " + "), total),
+		System: true,
+	}, nil
+}
+
+// meCommand sends an action, "/me waves" being the action "waves" of the sender, like the
+// actions of IRC
+func meCommand(ctx context.Context, command Command) (CommandResult, error) {
+	if command.Args == "" {
+		return CommandResult{}, &common.Error{Code: common.InvalidCommandErrorCode, Message: "usage: /me <action>"}
+	}
+
+	return CommandResult{Text: command.Args, Action: true}, nil
+}
+
+// shrugCommand ends the message with a shrug
+func shrugCommand(ctx context.Context, command Command) (CommandResult, error) {
+	return CommandResult{Text: strings.TrimSpace(command.Args + ` ¯\_(ツ)_/¯`)}, nil
+}
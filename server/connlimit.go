@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// connectionCounts counts the sessions of every user and host, for the limits on them
+type connectionCounts struct {
+	mu     sync.Mutex
+	byUser map[uuid.UUID]int
+	byHost map[string]int
+	// counted are the sessions counted, by the user and host they were counted for
+	counted map[*session]countedConnection
+}
+
+type countedConnection struct {
+	user uuid.UUID
+	host string
+}
+
+var connectionCount = &connectionCounts{
+	byUser:  map[uuid.UUID]int{},
+	byHost:  map[string]int{},
+	counted: map[*session]countedConnection{},
+}
+
+// host is the host s connects from, or "" when it isn't known
+func host(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return h
+}
+
+// acquire counts s as a connection of the user with the given ID, unless the user or the host
+// s connects from has the most connections of limits already. Admins aren't limited
+func (cc *connectionCounts) acquire(s *session, id uuid.UUID, limits Limits) error {
+	counted := countedConnection{user: id, host: host(s.addr)}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if !s.privileged() {
+		if max := limits.MaxConnectionsPerUser; max > 0 && cc.byUser[id] >= max {
+			return &common.Error{
+				Code:    common.LimitExceededErrorCode,
+				Message: fmt.Sprintf("you can't have more than %d connections at a time", max),
+			}
+		}
+
+		if max := limits.MaxConnectionsPerHost; max > 0 && counted.host != "" && cc.byHost[counted.host] >= max {
+			return &common.Error{
+				Code:    common.LimitExceededErrorCode,
+				Message: fmt.Sprintf("%s can't have more than %d connections at a time", counted.host, max),
+			}
+		}
+	}
+
+	cc.byUser[counted.user]++
+	cc.byHost[counted.host]++
+	cc.counted[s] = counted
+
+	return nil
+}
+
+// release stops counting s, once it's closed
+func (cc *connectionCounts) release(s *session) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	counted, ok := cc.counted[s]
+	if !ok {
+		return
+	}
+	delete(cc.counted, s)
+
+	cc.byUser[counted.user]--
+	if cc.byUser[counted.user] <= 0 {
+		delete(cc.byUser, counted.user)
+	}
+
+	cc.byHost[counted.host]--
+	if cc.byHost[counted.host] <= 0 {
+		delete(cc.byHost, counted.host)
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// startedAt is when the server started, for the uptime in stats
+var startedAt = time.Now()
+
+// consoleCommand is one of the commands of the admin console
+type consoleCommand struct {
+	usage   string
+	summary string
+	// run writes the output of the command to out. actor is who ran it, for the audit log
+	run func(out io.Writer, args string, actor auditActor) error
+}
+
+var consoleCommands map[string]consoleCommand
+
+func init() {
+	consoleCommands = map[string]consoleCommand{
+		"conversations": {"", "list the conversations", listConversationsCommand},
+		"connections":   {"", "list the connected clients, and those still introducing themselves", listConnectionsCommand},
+		"close":         {"<session id>", "disconnect a connection, even one still in its handshake", closeCommand},
+		"kick":          {"<name or id>", "disconnect a client", kickCommand},
+		"revoke":        {"<session id>", "disconnect a session, without its client reconnecting", revokeCommand},
+		"broadcast":     {"<text>", "send an announcement to every connected client", broadcastCommand},
+		"say":           {"<conversation> <text>", "send an announcement to a conversation", sayCommand},
+		"stats":         {"", "show how busy the server is", statsCommand},
+		"reports":       {"", "list the reported messages to review", listReportsCommand},
+		"resolve":       {"<report id> dismiss|delete|warn|ban", "act on a report", resolveCommand},
+		"ban":           {"<name or id>", "disconnect a user and keep it from coming back", banCommand},
+		"unban":         {"<name or id>", "let a banned user connect again", unbanCommand},
+		"release":       {"<name>", "release a registered name, for anyone to connect with it", releaseCommand},
+		"schedule":      {"[add <name> <cron> <task> [args] | remove <name> | run <name>]", "list, add, remove or run the scheduled jobs", scheduleCommand},
+		"cluster":       {"", "list the nodes of the cluster, with the conversations they own", clusterCommand},
+		"export":        {"<conversation> [json|csv]", "dump the history of a conversation", exportCommand},
+		"export-user":   {"<name or id>", "dump what's kept about a user, with its messages", exportUserCommand},
+		"delete-user":   {"<name or id>", "delete the account of a user, anonymizing or scrubbing its messages", deleteUserCommand},
+		"help":          {"", "list the commands", helpCommand},
+	}
+}
+
+// RunConsole reads admin commands from in, one per line, and writes their output to out,
+// until in is closed. It's meant for operators running the server in a terminal
+func RunConsole(in io.Reader, out io.Writer) {
+	fmt.Fprintln(out, "Admin console ready, type help for the list of commands")
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		runConsoleCommand(out, line, consoleActor)
+	}
+}
+
+// runConsoleCommand runs a line of the console for actor, writing its output and errors to out
+func runConsoleCommand(out io.Writer, line string, actor auditActor) {
+	name, args, _ := strings.Cut(line, " ")
+
+	command, ok := consoleCommands[strings.ToLower(name)]
+	if !ok {
+		fmt.Fprintf(out, "Unknown command %s, type help for the list of commands\n", name)
+		return
+	}
+
+	err := command.run(out, strings.TrimSpace(args), actor)
+	if err != nil {
+		fmt.Fprintf(out, "Error: %s\n", err.Error())
+	}
+}
+
+func helpCommand(out io.Writer, args string, actor auditActor) error {
+	names := []string{}
+	for name := range consoleCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		command := consoleCommands[name]
+		fmt.Fprintf(w, "  %s\t%s\n", strings.TrimSpace(name+" "+command.usage), command.summary)
+	}
+
+	return w.Flush()
+}
+
+func listConversationsCommand(out io.Writer, args string, actor auditActor) error {
+	list := conversations.all()
+	if len(list) == 0 {
+		fmt.Fprintln(out, "No conversations yet")
+		return nil
+	}
+
+	subscribers := map[uuid.UUID]int{}
+	messageRouter.forEach(func(s *session) {
+		s.mu.Lock()
+		for id := range s.subscriptions {
+			subscribers[id]++
+		}
+		s.mu.Unlock()
+	})
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NICKNAME\tSUBSCRIBERS\tOWNER\tTOPIC")
+	for _, conversation := range list {
+		nickname := conversation.Nickname
+		if conversation.Archived {
+			nickname += " (archived)"
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", nickname, subscribers[conversation.ID], conversation.Owner, conversation.Topic)
+	}
+
+	return w.Flush()
+}
+
+func kickCommand(out io.Writer, args string, actor auditActor) error {
+	if args == "" {
+		return errors.New("usage: kick <name or id>")
+	}
+
+	kicked := 0
+	for _, s := range connectedSessions() {
+		if s.client.Name == args || s.client.ID.String() == args {
+			auditLog.record(actor, "kick", s.client.Name, s.client.ID.String())
+			notifyWebhooks(WebhookEvent{Event: KickWebhookEvent, User: webhookUser(*s.sender()), Actor: actor.name})
+			s.writeError(errors.New("disconnected by the server's operator"))
+			kicked++
+		}
+	}
+
+	if kicked == 0 {
+		return fmt.Errorf("no client called %s is connected", args)
+	}
+
+	fmt.Fprintf(out, "Disconnected %d connection(s)\n", kicked)
+
+	return nil
+}
+
+func revokeCommand(out io.Writer, args string, actor auditActor) error {
+	id, err := uuid.Parse(args)
+	if err != nil {
+		return errors.New("usage: revoke <session id>")
+	}
+
+	for _, s := range connectedSessions() {
+		if s.id == id {
+			auditLog.record(actor, common.RevokeOperationType, s.client.Name, s.id.String())
+			revokeSession(s)
+			fmt.Fprintf(out, "Revoked the session of %s\n", s.client.Name)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no session %s", id)
+}
+
+func broadcastCommand(out io.Writer, args string, actor auditActor) error {
+	return announceFor(actor, common.Announcement{Text: args})
+}
+
+func sayCommand(out io.Writer, args string, actor auditActor) error {
+	nickname, text, _ := strings.Cut(args, " ")
+
+	return announceFor(actor, common.Announcement{Text: text, Conversation: nickname})
+}
+
+func statsCommand(out io.Writer, args string, actor auditActor) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "uptime\t%s\n", time.Since(startedAt).Round(time.Second))
+	fmt.Fprintf(w, "connections\t%d\n", messageRouter.count())
+	fmt.Fprintf(w, "pending deliveries\t%d\n", deliveries.pending())
+	fmt.Fprintf(w, "users seen\t%d\n", users.count())
+	fmt.Fprintf(w, "conversations\t%d\n", len(conversations.all()))
+	fmt.Fprintf(w, "messages\t%d\n", messages.count())
+	fmt.Fprintf(w, "draining\t%t\n", draining.isActive())
+	fmt.Fprintf(w, "events\t%s\n", eventCounts)
+	fmt.Fprintf(w, "operations\t%s\n", operationCounts)
+	fmt.Fprintf(w, "errors\t%s\n", errorCounts)
+
+	return w.Flush()
+}
+
+// tally counts things of every kind since the server started, for stats
+type tally struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var (
+	// eventCounts are the events published, by kind
+	eventCounts = &tally{counts: map[string]int{}}
+	// operationCounts are the operations handled, by type, and errorCounts the errors they were
+	// refused with, by code
+	operationCounts = &tally{counts: map[string]int{}}
+	errorCounts     = &tally{counts: map[string]int{}}
+)
+
+func (t *tally) add(kind string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.counts[kind]++
+}
+
+// String lists the counts, like "connect 3, message 12"
+func (t *tally) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := []string{}
+	for _, kind := range slices.Sorted(maps.Keys(t.counts)) {
+		counts = append(counts, fmt.Sprintf("%s %d", kind, t.counts[kind]))
+	}
+
+	return strings.Join(counts, ", ")
+}
+
+// connectedSessions returns the sessions that finished their handshake, oldest first.
+// Sessions are closed outside of the router's lock, so they're collected first
+func connectedSessions() []*session {
+	sessions := []*session{}
+	messageRouter.forEach(func(s *session) {
+		if s.client != nil {
+			sessions = append(sessions, s)
+		}
+	})
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].connectedAt.Before(sessions[j].connectedAt)
+	})
+
+	return sessions
+}
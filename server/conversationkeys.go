@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// maxKeyEpochs is how many of the latest keys of every encrypted conversation are kept, for
+// its members to read the messages sent before the latest rotations
+const maxKeyEpochs = 50
+
+// secretKeySize is the size of the keys of encrypted conversations, for NaCl secretbox
+const secretKeySize = 32
+
+// keyEpoch is a key of an encrypted conversation, wrapped by its distributor for each of the
+// members it was made for
+type keyEpoch struct {
+	epoch       uint64
+	distributor common.Sender
+	wrapped     map[uuid.UUID]common.WrappedKey
+}
+
+// keyring is what the server has of the keys of an encrypted conversation, which it can't
+// read, only pass on. stale is set when the members changed since the latest key was made,
+// and rotator is the member asked to make the next one
+type keyring struct {
+	epochs  []keyEpoch
+	stale   bool
+	rotator uuid.UUID
+}
+
+func (kr *keyring) latest() uint64 {
+	if len(kr.epochs) == 0 {
+		return 0
+	}
+
+	return kr.epochs[len(kr.epochs)-1].epoch
+}
+
+// conversationKeyStore keeps the keyrings of the encrypted conversations, by their ID
+type conversationKeyStore struct {
+	mu       sync.Mutex
+	keyrings map[uuid.UUID]*keyring
+}
+
+var conversationKeys = &conversationKeyStore{keyrings: map[uuid.UUID]*keyring{}}
+
+// keyring returns the keyring of a conversation, creating it the first time. The lock must be held
+func (ks *conversationKeyStore) keyring(conversationID uuid.UUID) *keyring {
+	kr, ok := ks.keyrings[conversationID]
+	if !ok {
+		kr = &keyring{}
+		ks.keyrings[conversationID] = kr
+	}
+
+	return kr
+}
+
+// latest is the epoch of the latest key of a conversation, 0 when it has none yet
+func (ks *conversationKeyStore) latest(conversationID uuid.UUID) uint64 {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	return ks.keyring(conversationID).latest()
+}
+
+// forget drops the keys of a deleted conversation
+func (ks *conversationKeyStore) forget(conversationID uuid.UUID) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	delete(ks.keyrings, conversationID)
+}
+
+// subscribed sends the client of s the keys it has of an encrypted conversation it subscribed
+// to, and has a new key made if it joined as a new member
+func (ks *conversationKeyStore) subscribed(conversation *common.Conversation, s *session, joined bool) {
+	if joined {
+		ks.membersChanged(conversation)
+	} else {
+		// a key may be due from before, with nobody online to make it until now
+		ks.requestRotation(conversation)
+	}
+
+	ks.mu.Lock()
+	keys := []common.ConversationKey{}
+	for _, epoch := range ks.keyring(conversation.ID).epochs {
+		wrapped, ok := epoch.wrapped[s.client.ID]
+		if !ok {
+			continue
+		}
+
+		distributor := epoch.distributor
+		keys = append(keys, common.ConversationKey{
+			Conversation: conversation.ID,
+			Epoch:        epoch.epoch,
+			Distributor:  &distributor,
+			Key:          &wrapped,
+		})
+	}
+	ks.mu.Unlock()
+
+	for _, key := range keys {
+		writeKey(s, key)
+	}
+}
+
+// membersChanged marks the key of a conversation stale, for a member to make a new one that
+// those who left don't have
+func (ks *conversationKeyStore) membersChanged(conversation *common.Conversation) {
+	ks.mu.Lock()
+	kr := ks.keyring(conversation.ID)
+	kr.stale = true
+	kr.rotator = uuid.Nil
+	ks.mu.Unlock()
+
+	ks.requestRotation(conversation)
+}
+
+// requestRotation asks the owner of a conversation with a stale key for a new one, or the
+// member that connected first when the owner isn't online. Nobody is asked while the member
+// asked before is still online
+func (ks *conversationKeyStore) requestRotation(conversation *common.Conversation) {
+	members := keyHolders(conversation.ID)
+
+	var chosen *session
+	for _, s := range connectedSessions() {
+		if !slices.ContainsFunc(members, func(member common.Sender) bool { return member.ID == s.client.ID }) {
+			continue
+		}
+
+		if chosen == nil || (s.client.ID == conversation.Owner && chosen.client.ID != conversation.Owner) {
+			chosen = s
+		}
+	}
+
+	if chosen == nil {
+		return
+	}
+
+	ks.mu.Lock()
+	kr := ks.keyring(conversation.ID)
+	if !kr.stale || (kr.rotator != uuid.Nil && messageRouter.isOnline(kr.rotator)) {
+		ks.mu.Unlock()
+		return
+	}
+	kr.rotator = chosen.client.ID
+	request := common.ConversationKey{
+		Conversation: conversation.ID,
+		Epoch:        kr.latest() + 1,
+		Rotate:       true,
+		Members:      members,
+	}
+	ks.mu.Unlock()
+
+	writeKey(chosen, request)
+}
+
+// rotate takes the key of the next epoch of a conversation from the client of s, and sends
+// every member online its own
+func (ks *conversationKeyStore) rotate(conversation *common.Conversation, key common.ConversationKey, s *session) error {
+	members := keyHolders(conversation.ID)
+	isMember := func(id uuid.UUID) bool {
+		return slices.ContainsFunc(members, func(member common.Sender) bool { return member.ID == id })
+	}
+
+	wrapped := map[uuid.UUID]common.WrappedKey{}
+	for _, w := range key.Wrapped {
+		if len(w.Nonce) != boxNonceSize || len(w.Box) != secretKeySize+boxOverhead {
+			return &common.Error{
+				Code:    common.EncryptionErrorCode,
+				Message: "the key isn't wrapped properly",
+			}
+		}
+
+		// a member that left while the key was made doesn't get it
+		if isMember(w.Recipient) {
+			wrapped[w.Recipient] = w
+		}
+	}
+
+	ks.mu.Lock()
+	kr := ks.keyring(conversation.ID)
+	if s.client.ID != kr.rotator && s.client.ID != conversation.Owner {
+		ks.mu.Unlock()
+		return &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("only the member asked to may change the key of '%s'", conversation.Nickname),
+		}
+	}
+	if key.Epoch != kr.latest()+1 {
+		latest := kr.latest()
+		ks.mu.Unlock()
+		return &common.Error{
+			Code:    common.EncryptionErrorCode,
+			Message: fmt.Sprintf("the key of '%s' is at epoch %d", conversation.Nickname, latest),
+		}
+	}
+
+	distributor := *s.sender()
+	kr.epochs = append(kr.epochs, keyEpoch{epoch: key.Epoch, distributor: distributor, wrapped: wrapped})
+	if len(kr.epochs) > maxKeyEpochs {
+		kr.epochs = kr.epochs[len(kr.epochs)-maxKeyEpochs:]
+	}
+	kr.rotator = uuid.Nil
+	// a member that joined while the key was made needs another one
+	kr.stale = slices.ContainsFunc(members, func(member common.Sender) bool {
+		_, ok := wrapped[member.ID]
+		return !ok
+	})
+	stale := kr.stale
+	ks.mu.Unlock()
+
+	for _, member := range connectedSessions() {
+		w, ok := wrapped[member.client.ID]
+		if !ok {
+			continue
+		}
+
+		writeKey(member, common.ConversationKey{
+			Conversation: conversation.ID,
+			Epoch:        key.Epoch,
+			Distributor:  &distributor,
+			Key:          &w,
+		})
+	}
+
+	if stale {
+		ks.requestRotation(conversation)
+	}
+
+	return nil
+}
+
+// keyHolders are the members of a conversation with a box key, for its keys to be wrapped for
+func keyHolders(conversationID uuid.UUID) []common.Sender {
+	members := []common.Sender{}
+	for _, id := range users.subscribers(conversationID) {
+		if member, ok := users.sender(id); ok && len(member.BoxKey) == boxKeySize {
+			members = append(members, member)
+		}
+	}
+
+	return members
+}
+
+func writeKey(s *session, key common.ConversationKey) {
+	response, err := marshalResponse(key)
+	if err == nil {
+		err = s.writeOK(response, common.ConversationKeyOperationType)
+	}
+	if err != nil {
+		common.Errorf("error while sending the key of a conversation to %v: %s\n", s.client, err.Error())
+	}
+}
+
+// handleConversationKey takes a new key for an encrypted conversation, from the member the
+// server asked for it
+func handleConversationKey(ctx context.Context, op *common.Operation, s *session) error {
+	key := common.ConversationKey{}
+
+	err := json.Unmarshal(*op.Message, &key)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing ConversationKey: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	conversation, ok := conversations.get(key.Conversation)
+	if !ok {
+		return &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: "conversation does not exist",
+		}
+	}
+
+	if !conversation.Encrypted {
+		return &common.Error{
+			Code:    common.EncryptionErrorCode,
+			Message: fmt.Sprintf("conversation '%s' isn't encrypted", conversation.Nickname),
+		}
+	}
+
+	return conversationKeys.rotate(conversation, key, s)
+}
+
+// checkSealed checks that a message to an encrypted conversation is sealed with one of its keys
+func checkSealed(message *common.Message, conversation *common.Conversation) error {
+	if len(message.Box) == 0 || len(message.Nonce) != boxNonceSize {
+		return &common.Error{
+			Code:    common.EncryptionErrorCode,
+			Message: fmt.Sprintf("messages to '%s' must be encrypted", conversation.Nickname),
+		}
+	}
+
+	// utf8.UTFMax bytes for every character the text may have
+	if len(message.Box) > 4*currentConfig.maxMessageLength()+boxOverhead {
+		return &common.Error{
+			Code:    common.MessageTooLongErrorCode,
+			Message: "the encrypted message is too long",
+		}
+	}
+
+	if message.KeyEpoch == 0 || message.KeyEpoch > conversationKeys.latest(conversation.ID) {
+		return &common.Error{
+			Code:    common.EncryptionErrorCode,
+			Message: fmt.Sprintf("'%s' has no key of epoch %d", conversation.Nickname, message.KeyEpoch),
+		}
+	}
+
+	message.Text = ""
+
+	return nil
+}
+
+// checkCanDecrypt checks that the client of s has a box key, for the keys of an encrypted
+// conversation to be wrapped for it
+func checkCanDecrypt(conversation *common.Conversation, s *session) error {
+	if conversation.Encrypted && len(s.client.BoxKey) != boxKeySize {
+		return &common.Error{
+			Code:    common.EncryptionErrorCode,
+			Message: fmt.Sprintf("conversation '%s' is encrypted, and your client can't decrypt it", conversation.Nickname),
+		}
+	}
+
+	return nil
+}
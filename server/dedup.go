@@ -0,0 +1,49 @@
+package server
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// keysPerUser is how many of the latest message keys of every user are remembered
+const keysPerUser = 256
+
+// keyStore remembers the keys of the latest messages of every user, so that the messages a
+// client sends again after reconnecting, not knowing if they went through, are delivered once
+type keyStore struct {
+	mu   sync.Mutex
+	keys map[uuid.UUID][]string
+}
+
+var messageKeys = &keyStore{keys: map[uuid.UUID][]string{}}
+
+// seen tells if the user sent a message with key lately
+func (ks *keyStore) seen(id uuid.UUID, key string) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	return slices.Contains(ks.keys[id], key)
+}
+
+// remember records that the user sent a message with key, forgetting its oldest key if needed
+func (ks *keyStore) remember(id uuid.UUID, key string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	keys := append(ks.keys[id], key)
+	if len(keys) > keysPerUser {
+		keys = keys[len(keys)-keysPerUser:]
+	}
+
+	ks.keys[id] = keys
+}
+
+// forget drops the keys of the user with the given ID
+func (ks *keyStore) forget(id uuid.UUID) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	delete(ks.keys, id)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+const (
+	// maxPendingDeliveries is how many deliveries a conversation may have waiting. Past it, whoever
+	// publishes to the conversation waits for the workers to catch up, which only takes as long as
+	// queueing the deliveries for their sessions: the workers never wait for a client
+	maxPendingDeliveries = 1024
+	// maxQueuedDeliveries is how many delivered responses a session may have waiting to be written
+	// to its client. A client that falls further behind is disconnected, to resume where it left
+	// off once it reconnects
+	maxQueuedDeliveries = 1024
+	// deliveryBatch is how many deliveries of a conversation a worker makes before moving on to
+	// the next conversation, for a busy one not to starve the others
+	deliveryBatch = 16
+)
+
+// delivery is a response to write to some sessions
+type delivery struct {
+	shared        *sharedResponse
+	operationType string
+	sessions      []*session
+}
+
+// deliveryLane holds the deliveries of a conversation, made in order by one worker at a time
+type deliveryLane struct {
+	pending []delivery
+	// running is set while the lane is waiting for a worker or being worked on
+	running bool
+}
+
+// deliveryPool makes the deliveries of the router with a bounded number of workers, apart
+// from the sessions publishing them. The conversations with pending deliveries take turns
+type deliveryPool struct {
+	mu    sync.Mutex
+	lanes map[uuid.UUID]*deliveryLane
+	// ready are the conversations waiting for a worker, oldest first
+	ready   []uuid.UUID
+	work    *sync.Cond
+	room    *sync.Cond
+	started sync.Once
+}
+
+var deliveries = newDeliveryPool()
+
+func newDeliveryPool() *deliveryPool {
+	p := &deliveryPool{lanes: map[uuid.UUID]*deliveryLane{}}
+	p.work = sync.NewCond(&p.mu)
+	p.room = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// submit queues d after the other deliveries to the conversation with the given ID, waiting
+// for room if it has too many pending already. The workers are started on the first one
+func (p *deliveryPool) submit(conversationID uuid.UUID, d delivery) {
+	p.started.Do(func() {
+		for range currentConfig.deliveryWorkers() {
+			go p.runWorker()
+		}
+	})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var lane *deliveryLane
+	for {
+		var ok bool
+		lane, ok = p.lanes[conversationID]
+		if !ok {
+			lane = &deliveryLane{}
+			p.lanes[conversationID] = lane
+		}
+
+		if len(lane.pending) < maxPendingDeliveries {
+			break
+		}
+
+		p.room.Wait()
+	}
+
+	lane.pending = append(lane.pending, d)
+
+	if !lane.running {
+		lane.running = true
+		p.ready = append(p.ready, conversationID)
+		p.work.Signal()
+	}
+}
+
+// pending is how many deliveries are waiting for a worker
+func (p *deliveryPool) pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := 0
+	for _, lane := range p.lanes {
+		count += len(lane.pending)
+	}
+
+	return count
+}
+
+func (p *deliveryPool) runWorker() {
+	for {
+		p.mu.Lock()
+		for len(p.ready) == 0 {
+			p.work.Wait()
+		}
+
+		conversationID := p.ready[0]
+		p.ready = p.ready[1:]
+
+		lane := p.lanes[conversationID]
+		n := min(len(lane.pending), deliveryBatch)
+		batch := lane.pending[:n:n]
+		lane.pending = lane.pending[n:]
+		p.room.Broadcast()
+		p.mu.Unlock()
+
+		for _, d := range batch {
+			d.deliver()
+		}
+
+		p.mu.Lock()
+		if len(lane.pending) > 0 {
+			// back of the line, behind the other conversations
+			p.ready = append(p.ready, conversationID)
+			p.work.Signal()
+		} else {
+			lane.running = false
+			delete(p.lanes, conversationID)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (d delivery) deliver() {
+	for _, s := range d.sessions {
+		s.enqueue(queuedResponse{shared: d.shared, operationType: d.operationType})
+	}
+}
+
+// queuedResponse is a delivered response waiting in the queue of a session
+type queuedResponse struct {
+	shared        *sharedResponse
+	operationType string
+}
+
+// enqueue queues r for the session's writer, without waiting for its client: if the queue is
+// full, the session is closed instead
+func (s *session) enqueue(r queuedResponse) {
+	select {
+	case s.queue <- r:
+	case <-s.ctx.Done():
+	default:
+		common.Errorf("%v fell %d responses behind, disconnecting\n", s.client, maxQueuedDeliveries)
+		// closing publishes the disconnection, which mustn't wait on the worker delivering it
+		go s.close()
+	}
+}
+
+// writeQueued writes the responses queued for the session to its client, until it's closed
+func (s *session) writeQueued() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case r := <-s.queue:
+			err := r.shared.writeTo(s.writer)
+			// a session closed while writing has nothing left to write to
+			if err != nil && s.ctx.Err() == nil {
+				common.Errorf("error while delivering %s to %v: %s\n", r.operationType, s.client, err.Error())
+			}
+		}
+	}
+}
+
+// defaultDeliveryWorkers is the number of delivery workers when the configuration leaves it
+// out, one per CPU
+func defaultDeliveryWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+const (
+	digestInterval = 24 * time.Hour
+	// digestTopConversations is how many of the most active conversations a digest lists
+	digestTopConversations = 3
+)
+
+// serverSender is the sender of messages that come from the server itself
+var serverSender = common.Sender{ID: uuid.Nil, Name: "server"}
+
+// runDigests sends a digest to every online user that asked for one, once every digestInterval,
+// until ctx is done
+func runDigests(ctx context.Context) {
+	ticker := time.NewTicker(digestInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for _, u := range users.withDigest() {
+			if !messageRouter.isOnline(u.sender.ID) {
+				continue
+			}
+
+			text, ok := composeDigest(u, now)
+			if !ok {
+				continue
+			}
+
+			messageRouter.sendDirect(common.Message{
+				Recipient: &u.sender,
+				Sender:    &serverSender,
+				Text:      text,
+				Timestamp: now,
+			})
+
+			users.digestSent(u.sender.ID, now)
+		}
+	}
+}
+
+// composeDigest summarizes what happened since the user's last digest (or their last connection),
+// returning false if there is nothing to tell
+func composeDigest(u user, now time.Time) (string, bool) {
+	since := u.lastDigest
+	if u.previousConnect.After(since) {
+		since = u.previousConnect
+	}
+	if since.IsZero() {
+		since = u.lastConnect
+	}
+
+	unread := map[string]int{}
+	activity := map[string]int{}
+	mentions := []common.Message{}
+
+	for _, message := range messages.since(since) {
+		if message.Conversation == nil {
+			continue
+		}
+
+		nickname := message.Conversation.Nickname
+		activity[nickname]++
+
+		if message.Sender != nil && message.Sender.ID == u.sender.ID {
+			continue
+		}
+
+		if u.conversations[message.Conversation.ID] {
+			unread[nickname]++
+		}
+
+		if mentionsUser(message, u.sender.Name) {
+			mentions = append(mentions, message)
+		}
+	}
+
+	if len(activity) == 0 {
+		return "", false
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Your digest since %s\n", since.Format(time.RFC1123))
+
+	if len(unread) > 0 {
+		b.WriteString("Unread:\n")
+		for _, nickname := range sortedByCount(unread) {
+			fmt.Fprintf(&b, "  #%s: %d\n", nickname, unread[nickname])
+		}
+	}
+
+	b.WriteString("Most active:\n")
+	top := sortedByCount(activity)
+	if len(top) > digestTopConversations {
+		top = top[:digestTopConversations]
+	}
+	for _, nickname := range top {
+		fmt.Fprintf(&b, "  #%s: %d messages\n", nickname, activity[nickname])
+	}
+
+	if len(mentions) > 0 {
+		b.WriteString("Mentions:\n")
+		for _, message := range mentions {
+			fmt.Fprintf(&b, "  #%s <@%s>: %s\n", message.Conversation.Nickname, message.Sender.Name, message.Text)
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "\n"), true
+}
+
+// mentionsUser tells whether message mentions the user called name, with an @ before it
+func mentionsUser(message common.Message, name string) bool {
+	return strings.Contains(strings.ToLower(message.Text), "@"+strings.ToLower(name))
+}
+
+// sortedByCount returns the keys of counts, highest count first
+func sortedByCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+func handleDigestSettings(ctx context.Context, op *common.Operation, s *session) error {
+	settings := common.DigestSettings{}
+
+	err := json.Unmarshal(*op.Message, &settings)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing DigestSettings: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	users.setDigest(s.client.ID, settings.Enabled)
+
+	return nil
+}
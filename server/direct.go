@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// boxKeySize and boxNonceSize are the sizes of the keys and nonces of NaCl box, and boxOverhead
+// how much longer a box is than the text sealed in it
+const (
+	boxKeySize   = 32
+	boxNonceSize = 24
+	boxOverhead  = 16
+)
+
+// handleDirect sends a direct message from the client of s to its recipient, with key, the
+// message's key, remembered once sent. Direct messages aren't kept in the history, and the
+// encrypted ones are passed on as they are, as the server can't read them
+func handleDirect(ctx context.Context, message common.Message, key string, s *session) (*json.RawMessage, error) {
+	recipient, ok := users.sender(message.Recipient.ID)
+	if !ok {
+		return nil, &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: fmt.Sprintf("user '%s' does not exist", message.Recipient.Name),
+		}
+	}
+
+	message.Recipient = &recipient
+	message.Sender = s.sender()
+	message.Kind = common.KindOf(message)
+
+	signedText := message.Text
+	err := checkSignature(&message, s)
+	if err != nil {
+		return nil, err
+	}
+
+	maxLength := currentConfig.maxMessageLength()
+	if len(message.Box) > 0 {
+		// utf8.UTFMax bytes for every character the text may have
+		if len(message.Nonce) != boxNonceSize || len(message.Box) > 4*maxLength+boxOverhead {
+			return nil, &common.Error{
+				Code:    common.MessageTooLongErrorCode,
+				Message: "the encrypted message is too long, or its nonce isn't valid",
+			}
+		}
+		message.Text = ""
+	} else {
+		message.Text, err = cleanText(message.Text, maxLength)
+		if err != nil {
+			return nil, err
+		}
+
+		verdict, err := filterMessage(ctx, message)
+		if err != nil {
+			common.Errorf("Error while filtering a message from %v: %s\n", s.client, err.Error())
+		} else if verdict.Block {
+			return nil, &common.Error{
+				Code:    common.FilteredErrorCode,
+				Message: "message was blocked by the server's content filter",
+			}
+		} else {
+			message.Text = verdict.Text
+		}
+	}
+
+	if message.Text != signedText {
+		message.Signature = nil
+	}
+
+	message.ID = uuid.New()
+	message.Timestamp = time.Now()
+
+	messageRouter.sendDirect(message)
+
+	if key != "" {
+		messageKeys.remember(s.client.ID, key)
+	}
+
+	return marshalResponse(common.MessageAck{Key: key})
+}
+
+// handleKeys sends the keys of the users with a name, for clients to send them direct messages
+func handleKeys(ctx context.Context, op *common.Operation) (*json.RawMessage, error) {
+	keys := common.Keys{}
+
+	err := json.Unmarshal(*op.Message, &keys)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Keys: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	keys.Users = []common.Sender{}
+	for _, u := range users.named(keys.Name) {
+		keys.Users = append(keys.Users, u.sender)
+	}
+
+	return marshalResponse(keys)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+const defaultDrainTimeout = 5 * time.Minute
+
+// drainState is switched on by an admin before a restart. While draining, clients are told to
+// migrate to another server, and the server stops once enough of them have left
+type drainState struct {
+	mu     sync.RWMutex
+	active bool
+	drain  common.Drain
+
+	// done is closed when the server should stop listening and exit
+	done chan bool
+}
+
+var draining = &drainState{done: make(chan bool)}
+
+func (ds *drainState) isActive() bool {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+
+	return ds.active
+}
+
+// start marks the server as draining, hints all connected clients to migrate and
+// waits in the background for them to leave
+func (ds *drainState) start(drain common.Drain) error {
+	if drain.Address == "" {
+		return errors.New("drain needs an alternate address for clients to migrate to")
+	}
+
+	ds.mu.Lock()
+	if ds.active {
+		ds.mu.Unlock()
+		return errors.New("server is already draining")
+	}
+
+	ds.active = true
+	ds.drain = drain
+	ds.mu.Unlock()
+
+	log.Printf("Draining connections to %s\n", drain.Address)
+
+	migrateResponse, err := ds.migrateResponse()
+	if err != nil {
+		return err
+	}
+
+	messageRouter.sendToAll(migrateResponse)
+
+	go ds.wait()
+
+	return nil
+}
+
+// wait closes done once the connections drop to the threshold or the timeout passes
+func (ds *drainState) wait() {
+	timeout := defaultDrainTimeout
+	if ds.drain.Timeout > 0 {
+		timeout = time.Duration(ds.drain.Timeout * float64(time.Second))
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-deadline:
+			log.Printf("Drain timeout reached with %d connections left\n", messageRouter.count())
+			close(ds.done)
+			return
+		case <-ticker.C:
+			if messageRouter.count() <= ds.drain.Threshold {
+				log.Printf("Connections drained\n")
+				close(ds.done)
+				return
+			}
+		}
+	}
+}
+
+func (ds *drainState) migrateResponse() (*common.Response, error) {
+	ds.mu.RLock()
+	migrate := common.Migrate{Address: ds.drain.Address}
+	ds.mu.RUnlock()
+
+	b, err := json.Marshal(migrate)
+	if err != nil {
+		return nil, err
+	}
+
+	migrateJSON := json.RawMessage(b)
+	response := newOKResponse(&migrateJSON, common.MigrateOperationType)
+
+	return &response, nil
+}
+
+// redirect tells a client connecting during a drain where to go instead, and closes the connection
+func (ds *drainState) redirect(writer responseWriter) {
+	defer writer.close()
+
+	response, err := ds.migrateResponse()
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	common.CheckErrorAndLog(writer.writeResponse(response))
+}
+
+func handleDrain(ctx context.Context, op *common.Operation, s *session) error {
+	if !s.privileged() {
+		return &common.Error{Code: common.ForbiddenErrorCode, Message: "drain is only allowed for admins"}
+	}
+
+	drain := common.Drain{}
+
+	err := json.Unmarshal(*op.Message, &drain)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Drain: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	err = draining.start(drain)
+	if err != nil {
+		return err
+	}
+
+	auditLog.record(s.actor(), common.DrainOperationType, drain.Address, "")
+
+	return nil
+}
+
+func isLoopback(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.IsLoopback()
+	default:
+		return false
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// defaultEmailInterval is how often email digests go out, unless the configuration says otherwise
+const defaultEmailInterval = time.Hour
+
+// SMTP is the mail server email digests are sent through, from From. Address is its
+// "host:port", and Username and Password, if set, are used to log in to it with PLAIN
+// authentication, which it must offer over TLS (STARTTLS) unless it's on localhost. Interval is
+// how many seconds go by between digests, an hour if zero. Without an Address, no emails are sent
+type SMTP struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	Interval int    `yaml:"interval"`
+}
+
+func (s SMTP) check() error {
+	if s.Address == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(s.Address); err != nil {
+		return fmt.Errorf("SMTP address '%s' should be host:port", s.Address)
+	}
+
+	if _, err := mail.ParseAddress(s.From); err != nil {
+		return fmt.Errorf("SMTP from address '%s' isn't valid", s.From)
+	}
+
+	if s.Interval < 0 {
+		return errors.New("SMTP interval can't be negative")
+	}
+
+	return nil
+}
+
+func (s SMTP) interval() time.Duration {
+	if s.Interval == 0 {
+		return defaultEmailInterval
+	}
+
+	return time.Duration(s.Interval) * time.Second
+}
+
+// send emails text to the address to, with subject
+func (s SMTP) send(to, subject, text string) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Address)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	from, _ := mail.ParseAddress(s.From)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from.String())
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	return smtp.SendMail(s.Address, auth, from.Address, []string{to}, []byte(b.String()))
+}
+
+// runEmailDigests emails the users that asked for it the mentions and direct messages they got
+// while offline, every interval of the SMTP settings, until ctx is done
+func runEmailDigests(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(currentConfig.smtp().interval()):
+		case <-ctx.Done():
+			return
+		}
+
+		settings := currentConfig.smtp()
+		if settings.Address == "" {
+			continue
+		}
+
+		now := time.Now()
+		for _, u := range users.withEmail() {
+			if messageRouter.isOnline(u.sender.ID) {
+				continue
+			}
+
+			subject, text, ok := composeEmailDigest(u)
+			if !ok {
+				continue
+			}
+
+			err := settings.send(u.email, subject, text)
+			if err != nil {
+				common.Errorf("Couldn't email the digest of %s (%s): %s\n", u.sender.Name, u.sender.ID, err.Error())
+				continue
+			}
+
+			users.emailSent(u.sender.ID, now)
+			log.Printf("Emailed the digest of %s (%s)\n", u.sender.Name, u.sender.ID)
+		}
+	}
+}
+
+// composeEmailDigest tells the user about the mentions and direct messages among the messages
+// queued for it since its last email, returning false if there are none
+func composeEmailDigest(u user) (string, string, bool) {
+	direct := []common.Message{}
+	mentions := []common.Message{}
+
+	for _, message := range offlineMessages.queued(u.sender.ID) {
+		if !message.Timestamp.After(u.lastEmail) || message.Sender == nil {
+			continue
+		}
+
+		switch {
+		case message.Recipient != nil:
+			direct = append(direct, message)
+		case message.Conversation != nil && mentionsUser(message, u.sender.Name):
+			mentions = append(mentions, message)
+		}
+	}
+
+	if len(direct) == 0 && len(mentions) == 0 {
+		return "", "", false
+	}
+
+	subject := fmt.Sprintf("While you were away: %d direct messages, %d mentions", len(direct), len(mentions))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s, here's what you missed. Connect again to answer.\n", u.sender.Name)
+
+	if len(direct) > 0 {
+		b.WriteString("\nDirect messages:\n")
+		for _, message := range direct {
+			text := message.Text
+			// the server can't read encrypted ones
+			if len(message.Box) > 0 {
+				text = "(encrypted)"
+			}
+			fmt.Fprintf(&b, "  %s <@%s>: %s\n", message.Timestamp.Format(time.Kitchen), message.Sender.Name, text)
+		}
+	}
+
+	if len(mentions) > 0 {
+		b.WriteString("\nMentions:\n")
+		for _, message := range mentions {
+			fmt.Fprintf(&b, "  %s #%s <@%s>: %s\n", message.Timestamp.Format(time.Kitchen),
+				message.Conversation.Nickname, message.Sender.Name, message.Text)
+		}
+	}
+
+	return subject, strings.TrimSuffix(b.String(), "\n"), true
+}
+
+// handleEmailDigestSettings sets where the client's email digests go, or stops them
+func handleEmailDigestSettings(ctx context.Context, op *common.Operation, s *session) error {
+	settings := common.EmailDigestSettings{}
+
+	err := json.Unmarshal(*op.Message, &settings)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing EmailDigestSettings: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	if settings.Address == "" {
+		users.setEmail(s.client.ID, "")
+		return nil
+	}
+
+	if currentConfig.smtp().Address == "" {
+		return &common.Error{Code: common.InvalidEmailErrorCode, Message: "this server doesn't send emails"}
+	}
+
+	address, err := mail.ParseAddress(settings.Address)
+	if err != nil {
+		return &common.Error{Code: common.InvalidEmailErrorCode, Message: fmt.Sprintf("'%s' isn't an email address", settings.Address)}
+	}
+
+	users.setEmail(s.client.ID, address.Address)
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The kinds of the events of the server
+const (
+	// ConnectEvent is published once a client is through its handshake, and DisconnectEvent
+	// once its connection is closed
+	ConnectEvent    = "connect"
+	DisconnectEvent = "disconnect"
+	// MessageEvent is published for every message stored in a conversation, sent by a client,
+	// a bridge or an incoming webhook, but for the server's own system messages
+	MessageEvent = "message"
+	// JoinEvent and LeaveEvent are published when a client subscribes to a conversation it
+	// wasn't subscribed to, or unsubscribes from one
+	JoinEvent  = "join"
+	LeaveEvent = "leave"
+	// StatusEvent is published when a client sets its status, and NameEvent when it changes its name
+	StatusEvent = "status"
+	NameEvent   = "name"
+)
+
+// Event is something that happened on the server. Client is who it happened to, but for
+// message events, which have their Message instead. Conversation is set for message, join and
+// leave events, Status for status events, and OldName, the name the client had, for name events
+type Event struct {
+	Kind         string
+	Client       common.Sender
+	Conversation *common.Conversation
+	Message      *common.Message
+	Status       *common.Status
+	OldName      string
+
+	// session is where the event happened, for all but message events
+	session *session
+	// bridge is the bridge a message came from, so that it isn't relayed back to it
+	bridge *runningBridge
+	// shared is set for the messages another instance of the server shared, which it sent to
+	// its webhooks and bridges, and which aren't shared again
+	shared bool
+	// replicated is set for the messages the node of the cluster owning their conversation
+	// delivered to this one, which it sent to its webhooks, and which aren't delivered again
+	replicated bool
+}
+
+// EventHandler is called with the events it subscribed to, one at a time and in order, on the
+// goroutine of whoever published them. It must return quickly, queueing anything slow
+type EventHandler func(event Event)
+
+// eventBus calls the handlers subscribed to the kinds of the events published, in the order
+// they subscribed
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]EventHandler
+}
+
+var events = &eventBus{handlers: map[string][]EventHandler{}}
+
+func (eb *eventBus) subscribe(kind string, handler EventHandler) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	eb.handlers[kind] = append(eb.handlers[kind], handler)
+}
+
+func (eb *eventBus) publish(event Event) {
+	eb.mu.RLock()
+	handlers := eb.handlers[event.Kind]
+	eb.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// SubscribeEvents has handler called with the events of kind, after the server's own handlers,
+// for programs embedding the server and Go plugins
+func SubscribeEvents(kind string, handler EventHandler) {
+	events.subscribe(kind, handler)
+}
+
+func init() {
+	// the subscribers of a conversation get its messages before anyone outside of it
+	events.subscribe(MessageEvent, deliverMessage)
+	events.subscribe(MessageEvent, notifyMessageWebhooks)
+	events.subscribe(MessageEvent, relayMessageToBridges)
+	events.subscribe(MessageEvent, shareMessage)
+	events.subscribe(MessageEvent, deliverToCluster)
+
+	events.subscribe(JoinEvent, announceMembership("%s joined %s"))
+	events.subscribe(JoinEvent, notifyMembershipWebhooks(JoinWebhookEvent))
+	events.subscribe(JoinEvent, runJoinScripts)
+	events.subscribe(LeaveEvent, announceMembership("%s left %s"))
+	events.subscribe(LeaveEvent, notifyMembershipWebhooks(LeaveWebhookEvent))
+
+	events.subscribe(DisconnectEvent, announceDisconnect)
+	events.subscribe(DisconnectEvent, rememberSeen)
+
+	events.subscribe(StatusEvent, publishStatus)
+
+	events.subscribe(NameEvent, publishName)
+
+	for _, kind := range []string{ConnectEvent, DisconnectEvent, MessageEvent, JoinEvent, LeaveEvent, StatusEvent, NameEvent} {
+		events.subscribe(kind, countEvent)
+	}
+}
+
+func countEvent(event Event) {
+	eventCounts.add(event.Kind)
+}
+
+// publishMessage stores message in its conversation and publishes it, returning it as stored.
+// from is the bridge it came from, if any. In a cluster, messages of the conversations another
+// node owns are forwarded to it instead, and published once it delivers them back
+func publishMessage(message common.Message, from *runningBridge) common.Message {
+	if owner, ok := cluster.remoteOwner(message.Conversation.ID); ok {
+		return cluster.forward(owner, message, from)
+	}
+
+	message = messages.add(message)
+	events.publish(Event{Kind: MessageEvent, Conversation: message.Conversation, Message: &message, bridge: from})
+
+	return message
+}
+
+// deliverMessage sends a message to the subscribers of its conversation, and keeps it for those
+// that are offline
+func deliverMessage(event Event) {
+	messageRouter.broadcast(*event.Message)
+	queueForOffline(*event.Message)
+}
+
+func notifyMessageWebhooks(event Event) {
+	if event.shared || event.replicated {
+		return
+	}
+
+	notifyWebhooks(WebhookEvent{Event: MessageWebhookEvent, Conversation: event.Conversation, Message: event.Message})
+}
+
+func relayMessageToBridges(event Event) {
+	if event.shared {
+		return
+	}
+
+	relayToBridges(*event.Message, event.bridge)
+}
+
+// announceMembership tells a conversation that a client joined or left it. format gets the
+// client's name and the conversation's nickname
+func announceMembership(format string) EventHandler {
+	return func(event Event) {
+		event.session.announce(event.Conversation.ID, format)
+	}
+}
+
+func notifyMembershipWebhooks(webhookEvent string) EventHandler {
+	return func(event Event) {
+		notifyWebhooks(WebhookEvent{Event: webhookEvent, Conversation: event.Conversation, User: webhookUser(event.Client)})
+	}
+}
+
+func runJoinScripts(event Event) {
+	scriptsJoined(event.session.ctx, event.Client.Name, event.Conversation.ID)
+}
+
+// announceDisconnect tells the conversations of a client that disconnected that it left them
+func announceDisconnect(event Event) {
+	for _, id := range event.session.subscribedTo() {
+		event.session.announce(id, "%s left %s (disconnected)")
+	}
+}
+
+// rememberSeen records that the client that disconnected has seen the messages of its
+// conversations so far, those that come later being unread
+func rememberSeen(event Event) {
+	for _, id := range event.session.subscribedTo() {
+		users.seenUpTo(event.Client.ID, id, messages.lastSeq(id))
+	}
+}
+
+// publishStatus tells the subscribers of the conversations of a client about its new status
+func publishStatus(event Event) {
+	conversationIDs := users.conversationsOf(event.Client.ID)
+	messageRouter.publishToAny(conversationIDs, common.StatusOperationType, common.Presence{
+		ID:     event.Client.ID,
+		Name:   event.Client.Name,
+		Status: *event.Status,
+	})
+}
+
+// publishName tells the subscribers of the conversations of a client about its new name
+func publishName(event Event) {
+	conversationIDs := users.conversationsOf(event.Client.ID)
+	messageRouter.publishToAny(conversationIDs, common.NameOperationType, common.NameChange{
+		ID:      event.Client.ID,
+		Name:    event.Client.Name,
+		OldName: event.OldName,
+	})
+}
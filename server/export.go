@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// defaultExportLimit is how many messages a page of an export has when the operation doesn't
+// say, and maxExportLimit the most it may ask for
+const (
+	defaultExportLimit = 200
+	maxExportLimit     = 1000
+)
+
+// handleExport sends a page of the history of a conversation. Starting an export is recorded in
+// the audit log, as exports are often made for compliance
+func handleExport(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	export := common.Export{}
+
+	err := json.Unmarshal(*op.Message, &export)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Export: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	conversation, ok := conversations.getByNickname(export.Nickname)
+	if !ok {
+		return nil, &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: fmt.Sprintf("conversation '%s' does not exist", export.Nickname),
+		}
+	}
+
+	err = checkAccess(conversation, s, common.ReadAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := uuid.Nil
+	if export.Cursor != "" {
+		cursor, err = uuid.Parse(export.Cursor)
+		if err != nil {
+			return nil, &common.Error{Code: common.NotFoundErrorCode, Message: "invalid export cursor"}
+		}
+	}
+
+	limit := export.Limit
+	if limit <= 0 {
+		limit = defaultExportLimit
+	}
+	limit = min(limit, maxExportLimit)
+
+	found, more, err := messages.page(ctx, conversation.ID, cursor, limit)
+	if errors.Is(err, errCursorGone) {
+		return nil, &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: "the export cursor is gone from the history, start the export over",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cursor == uuid.Nil {
+		auditLog.record(s.actor(), common.ExportOperationType, conversation.Nickname, "")
+	}
+
+	page := common.ExportPage{Nickname: conversation.Nickname, Messages: withNickname(found, conversation)}
+	if more && len(found) > 0 {
+		page.NextCursor = found[len(found)-1].ID.String()
+	}
+
+	return marshalResponse(page)
+}
+
+// exportCommand writes the whole history of a conversation to the console, as JSON by default
+func exportCommand(out io.Writer, args string, actor auditActor) error {
+	nickname, format, _ := strings.Cut(args, " ")
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = "json"
+	}
+
+	if nickname == "" || !slices.Contains(common.ExportFormats, format) {
+		return errors.New("usage: export <conversation> [json|csv]")
+	}
+
+	conversation, ok := conversations.getByNickname(nickname)
+	if !ok {
+		return fmt.Errorf("conversation '%s' does not exist", nickname)
+	}
+
+	found, _, err := messages.page(context.Background(), conversation.ID, uuid.Nil, -1)
+	if err != nil {
+		return err
+	}
+
+	auditLog.record(actor, common.ExportOperationType, conversation.Nickname, format)
+
+	return common.WriteMessages(out, format, withNickname(found, conversation))
+}
+
+// withNickname gives the messages of conversation its current nickname, as they keep the one it
+// had when they were sent
+func withNickname(found []common.Message, conversation *common.Conversation) []common.Message {
+	for i := range found {
+		found[i].Conversation = &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname}
+	}
+
+	return found
+}
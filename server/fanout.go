@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// defaultFanoutChannel is the Redis channel of the fan-out, unless the configuration says otherwise
+const defaultFanoutChannel = "tcpchat"
+
+// fanoutQueueSize is how many messages may wait to be shared with the other instances, and
+// fanoutRetryInterval how long to wait before connecting to Redis again after losing it.
+// Messages that find the queue full, or Redis down, aren't shared
+const (
+	fanoutQueueSize     = 1000
+	fanoutRetryInterval = 5 * time.Second
+)
+
+// Fanout shares the messages sent to conversations, and the conversations created, with the
+// other instances of the server using the same Redis, over its pub/sub, so that clients of any
+// of them talk to each other. Redis is a URL like redis://:password@redis.example.com:6379, or
+// rediss:// for TLS, and Channel the channel the instances share, "tcpchat" if empty. Without
+// Redis, the instance keeps to itself
+type Fanout struct {
+	Redis   string `yaml:"redis"`
+	Channel string `yaml:"channel"`
+}
+
+func (f Fanout) check() error {
+	if f.Redis == "" {
+		return nil
+	}
+
+	return checkRedisURL(f.Redis)
+}
+
+func (f Fanout) channel() string {
+	if f.Channel == "" {
+		return defaultFanoutChannel
+	}
+
+	return f.Channel
+}
+
+// instanceID tells this instance apart from the others of the fan-out, which Redis sends our
+// own messages back to
+var instanceID = uuid.New()
+
+// fanoutEnvelope is what the instances publish: a Message sent to a conversation, or a
+// Conversation created, on the instance with the ID Instance
+type fanoutEnvelope struct {
+	Instance     uuid.UUID            `json:"instance"`
+	Message      *common.Message      `json:"message,omitempty"`
+	Conversation *common.Conversation `json:"conversation,omitempty"`
+}
+
+// fanout publishes to the other instances, from an outbox of envelopes, marshaled as they're
+// queued so that the conversations and messages they're about may change meanwhile
+type fanout struct {
+	active atomic.Bool
+	outbox chan []byte
+}
+
+var sharing = &fanout{outbox: make(chan []byte, fanoutQueueSize)}
+
+// runFanout shares messages with the other instances of the fan-out of the configuration, if it
+// has one, until ctx is done
+func runFanout(ctx context.Context) {
+	config := currentConfig.fanout()
+	if config.Redis == "" || !sharing.active.CompareAndSwap(false, true) {
+		return
+	}
+
+	go sharing.publish(ctx, config)
+	go sharing.subscribe(ctx, config)
+
+	log.Printf("Sharing messages over the %s channel of Redis as instance %s\n", config.channel(), instanceID)
+}
+
+// share queues envelope to be published to the other instances
+func (f *fanout) share(envelope fanoutEnvelope) {
+	if !f.active.Load() {
+		return
+	}
+
+	envelope.Instance = instanceID
+
+	b, err := json.Marshal(envelope)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	select {
+	case f.outbox <- b:
+	default:
+		common.Errorf("Too many messages waiting to be shared with the other instances, dropping one\n")
+	}
+}
+
+// publish publishes the queued envelopes, connecting to Redis when it has to
+func (f *fanout) publish(ctx context.Context, config Fanout) {
+	var conn *redisConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var b []byte
+		select {
+		case b = <-f.outbox:
+		case <-ctx.Done():
+			return
+		}
+
+		var err error
+		if conn == nil {
+			conn, err = dialRedis(ctx, config.Redis)
+			if err != nil {
+				common.Errorf("Couldn't connect to Redis to share a message: %s\n", err.Error())
+				continue
+			}
+		}
+
+		_, err = conn.do("PUBLISH", config.channel(), string(b))
+		if err != nil {
+			common.Errorf("Couldn't share a message over Redis: %s\n", err.Error())
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// subscribe takes in what the other instances publish, connecting to Redis again when it's lost
+func (f *fanout) subscribe(ctx context.Context, config Fanout) {
+	for {
+		err := f.receive(ctx, config)
+		if ctx.Err() != nil {
+			return
+		}
+		common.Errorf("Lost, or couldn't get, the subscription to Redis, trying again in %s: %s\n", fanoutRetryInterval, err.Error())
+
+		select {
+		case <-time.After(fanoutRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receive subscribes to the channel of the fan-out, and handles what comes through it until
+// the connection is lost or ctx is done
+func (f *fanout) receive(ctx context.Context, config Fanout) error {
+	conn, err := dialRedis(ctx, config.Redis)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	err = conn.send("SUBSCRIBE", config.channel())
+	if err != nil {
+		return err
+	}
+
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+
+		// subscriptions are confirmed with ["subscribe", channel, count], and messages come as
+		// ["message", channel, payload]
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 3 {
+			return fmt.Errorf("unexpected reply to the subscription: %v", reply)
+		}
+		if values[0] != "message" {
+			continue
+		}
+
+		payload, ok := values[2].(string)
+		if !ok {
+			return errors.New("a message of the subscription has no payload")
+		}
+
+		envelope := fanoutEnvelope{}
+		err = json.Unmarshal([]byte(payload), &envelope)
+		if err != nil {
+			common.Errorf("Unmarshaling error while parsing a shared message: %s\n", err.Error())
+			continue
+		}
+
+		if envelope.Instance != instanceID {
+			receiveShared(envelope)
+		}
+	}
+}
+
+// receiveShared takes in what another instance shared. The conversations created on another
+// instance are created here too, with the same ID, unless there's one with the same nickname
+// already. Messages go to the conversation with the ID of theirs, or else with its nickname
+func receiveShared(envelope fanoutEnvelope) {
+	switch {
+	case envelope.Message != nil && envelope.Message.Conversation != nil:
+		message := *envelope.Message
+
+		conversation, ok := conversations.get(message.Conversation.ID)
+		if !ok {
+			conversation, ok = conversations.getByNickname(message.Conversation.Nickname)
+			// the signature was for the ID the conversation has on the other instance
+			message.Signature = nil
+		}
+		if !ok || conversation.Archived || conversation.Encrypted {
+			common.Debugf("Not taking in a shared message of '%s', which can't take it here\n", message.Conversation.Nickname)
+			return
+		}
+
+		message.Conversation = &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname}
+		message = messages.keep(message)
+		events.publish(Event{Kind: MessageEvent, Conversation: message.Conversation, Message: &message, shared: true})
+	case envelope.Conversation != nil:
+		conversation := *envelope.Conversation
+
+		err := conversations.addShared(&conversation)
+		if err != nil {
+			common.Debugf("Not creating the shared conversation '%s': %s\n", conversation.Nickname, err.Error())
+		}
+	}
+}
+
+// shareMessage shares the messages sent to this instance's conversations with the other
+// instances, but for those of encrypted conversations, whose keys are every instance's own
+func shareMessage(event Event) {
+	if event.shared {
+		return
+	}
+
+	conversation, ok := conversations.get(event.Conversation.ID)
+	if !ok || conversation.Encrypted {
+		return
+	}
+
+	sharing.share(fanoutEnvelope{Message: event.Message})
+}
+
+// shareConversation shares a conversation created on this instance with the other instances
+func shareConversation(conversation *common.Conversation) {
+	if conversation.Encrypted {
+		return
+	}
+
+	sharing.share(fanoutEnvelope{Conversation: conversation})
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// maxFetch is the most messages the response to a fetch has
+const maxFetch = 500
+
+// handleFetch sends the messages of a range of sequence numbers of a conversation, for clients
+// to fill the gaps they noticed. Like when broadcasting, messages of blocked users are left out
+func handleFetch(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	fetch := common.Fetch{}
+
+	err := json.Unmarshal(*op.Message, &fetch)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Fetch: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	conversation, ok := conversations.getByNickname(fetch.Nickname)
+	if !ok {
+		return nil, &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: fmt.Sprintf("conversation '%s' does not exist", fetch.Nickname),
+		}
+	}
+
+	err = checkGuestAccess(conversation, s)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAccess(conversation, s, common.ReadAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	found, next := messages.sequence(conversation.ID, fetch.From, fetch.To, maxFetch)
+	found = slices.DeleteFunc(found, func(message common.Message) bool {
+		return blocksSender(s, message)
+	})
+
+	fetch.Nickname = conversation.Nickname
+	fetch.Messages = withNickname(found, conversation)
+	fetch.Next = next
+
+	return marshalResponse(fetch)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The modes of the configuration's filter, for what happens to the messages it matches
+const (
+	RedactFilterMode = "redact"
+	BlockFilterMode  = "block"
+	FlagFilterMode   = "flag"
+)
+
+// FilterResult is what a ContentFilter decides about a message: the Text to deliver, which
+// may be redacted (left empty, the text stays as it was), and whether to Block it or Flag it
+// to the moderators, saying why in Reason
+type FilterResult struct {
+	Text   string `json:"text"`
+	Block  bool   `json:"block,omitempty"`
+	Flag   bool   `json:"flag,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// replies are the system messages scripts send, once the message is delivered
+	replies []scriptReply
+}
+
+// ContentFilter inspects the messages sent to conversations before they're delivered, e.g.
+// for a spam filter plugin. A filter with nothing to say returns the text as it is. It should
+// give up once ctx is done, when the operation sending the message took too long
+type ContentFilter interface {
+	Filter(ctx context.Context, message common.Message) (FilterResult, error)
+}
+
+// ContentFilterFunc lets ordinary functions be used as ContentFilters
+type ContentFilterFunc func(ctx context.Context, message common.Message) (FilterResult, error)
+
+func (f ContentFilterFunc) Filter(ctx context.Context, message common.Message) (FilterResult, error) {
+	return f(ctx, message)
+}
+
+var (
+	contentFiltersMu sync.RWMutex
+	// contentFilters run after the one of the configuration, in the order they were registered
+	contentFilters = []ContentFilter{}
+)
+
+// RegisterContentFilter adds f to the filters every message goes through
+func RegisterContentFilter(f ContentFilter) {
+	contentFiltersMu.Lock()
+	defer contentFiltersMu.Unlock()
+
+	contentFilters = append(contentFilters, f)
+}
+
+// filterWaitDelay is how long a filter program that was killed gets to close its output
+const filterWaitDelay = time.Second
+
+// CommandContentFilter runs an external program for every message. It gets the message as
+// JSON on stdin and prints a FilterResult as JSON on stdout, e.g.
+//
+//	{"text": "buy cheap stuff", "flag": true, "reason": "looks like spam"}
+//
+// Printing nothing leaves the message as it is
+func CommandContentFilter(path string) ContentFilter {
+	return ContentFilterFunc(func(ctx context.Context, message common.Message) (FilterResult, error) {
+		input, err := json.Marshal(message)
+		if err != nil {
+			return FilterResult{}, err
+		}
+
+		// the program is killed if it takes too long, without waiting on whatever it started
+		cmd := exec.CommandContext(ctx, path)
+		cmd.WaitDelay = filterWaitDelay
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stderr = os.Stderr
+
+		output, err := cmd.Output()
+		if err != nil {
+			return FilterResult{}, fmt.Errorf("filter command failed: %s", err.Error())
+		}
+
+		if len(bytes.TrimSpace(output)) == 0 {
+			return FilterResult{}, nil
+		}
+
+		result := FilterResult{}
+		err = json.Unmarshal(output, &result)
+		if err != nil {
+			return FilterResult{}, fmt.Errorf("filter command printed an invalid result: %s", err.Error())
+		}
+
+		return result, nil
+	})
+}
+
+// Filter is the configuration's content filter: messages with any of Words (regardless of
+// case, as whole words) or matching any of the regular expressions in Patterns are dealt with
+// according to Mode: "redact" replaces what matched with asterisks, "block" refuses the message
+// and "flag" delivers it but reports it to the moderators. With Kinds, only the messages of
+// those kinds are filtered, like actions alone
+type Filter struct {
+	Words    []string `yaml:"words"`
+	Patterns []string `yaml:"patterns"`
+	Mode     string   `yaml:"mode"`
+	Kinds    []string `yaml:"kinds"`
+}
+
+// compile turns the words and patterns of the filter into a single regular expression, or
+// nil if there are none
+func (f Filter) compile() (*regexp.Regexp, error) {
+	switch f.Mode {
+	case RedactFilterMode, BlockFilterMode, FlagFilterMode:
+	default:
+		return nil, fmt.Errorf("unknown filter mode '%s', expected redact, block or flag", f.Mode)
+	}
+
+	for _, kind := range f.Kinds {
+		if kind != common.UserMessageKind && kind != common.ActionMessageKind {
+			return nil, fmt.Errorf("unknown filter kind '%s', expected user or action", kind)
+		}
+	}
+
+	alternatives := []string{}
+	if len(f.Words) > 0 {
+		words := []string{}
+		for _, word := range f.Words {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+
+		alternatives = append(alternatives, `(?i:\b(?:`+strings.Join(words, "|")+`)\b)`)
+	}
+
+	for _, pattern := range f.Patterns {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter pattern: %s", err.Error())
+		}
+
+		alternatives = append(alternatives, "(?:"+pattern+")")
+	}
+
+	if len(alternatives) == 0 {
+		return nil, nil
+	}
+
+	return regexp.Compile(strings.Join(alternatives, "|"))
+}
+
+// configFilter is the filter of the configuration, compiled. kinds are the kinds of messages it
+// filters, all of them if empty
+type configFilter struct {
+	mode    string
+	matcher *regexp.Regexp
+	kinds   []string
+}
+
+func (cf *configFilter) Filter(ctx context.Context, message common.Message) (FilterResult, error) {
+	result := FilterResult{Text: message.Text}
+
+	if len(cf.kinds) > 0 && !slices.Contains(cf.kinds, common.KindOf(message)) {
+		return result, nil
+	}
+
+	match := cf.matcher.FindString(message.Text)
+	if match == "" {
+		return result, nil
+	}
+
+	result.Reason = fmt.Sprintf("matched the filter with '%s'", match)
+
+	switch cf.mode {
+	case RedactFilterMode:
+		result.Text = cf.matcher.ReplaceAllStringFunc(message.Text, func(s string) string {
+			return strings.Repeat("*", len([]rune(s)))
+		})
+	case BlockFilterMode:
+		result.Block = true
+	case FlagFilterMode:
+		result.Flag = true
+	}
+
+	return result, nil
+}
+
+// filterMessage runs message through the configuration's filter and the registered ones, and
+// returns what they decided together: the text once every filter had its go at it, and whether
+// any of them wants to block or flag the message
+func filterMessage(ctx context.Context, message common.Message) (FilterResult, error) {
+	filters := []ContentFilter{}
+	if cf := currentConfig.contentFilter(); cf != nil {
+		filters = append(filters, cf)
+	}
+	for _, sc := range currentConfig.loadedScripts() {
+		filters = append(filters, sc)
+	}
+
+	contentFiltersMu.RLock()
+	filters = append(filters, contentFilters...)
+	contentFiltersMu.RUnlock()
+
+	filters = append(filters, pluginFilters()...)
+
+	verdict := FilterResult{Text: message.Text}
+	reasons := []string{}
+
+	for _, f := range filters {
+		message.Text = verdict.Text
+
+		result, err := f.Filter(ctx, message)
+		if err != nil {
+			return verdict, err
+		}
+
+		if result.Text != "" {
+			verdict.Text = result.Text
+		}
+		verdict.Block = verdict.Block || result.Block
+		verdict.Flag = verdict.Flag || result.Flag
+		verdict.replies = append(verdict.replies, result.replies...)
+		if result.Reason != "" {
+			reasons = append(reasons, result.Reason)
+		}
+	}
+
+	verdict.Reason = strings.Join(reasons, "; ")
+
+	return verdict, nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/nikochiko/tcpchat/common"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/peer"
+)
+
+// The gRPC service speaks the same Operation and Response messages as the TCP protocol.
+// Instead of protobuf they are encoded as JSON, so clients have to call with the "json"
+// content-subtype, e.g. grpc.CallContentSubtype("json") in Go
+//
+//	service Chat {
+//	  rpc Chat(stream Operation) returns (stream Response);
+//	}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// chatServer is the interface implemented by the handler of the tcpchat.Chat service
+type chatServer interface{}
+
+var chatServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tcpchat.Chat",
+	HandlerType: (*chatServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Chat",
+			Handler:       handleChatStream,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// ListenGRPC serves the tcpchat.Chat gRPC service on the given network and service ("host:port")
+// until ctx is done, ending its streams then. Like Listen, it returns the error it couldn't
+// listen with. The listener is only closed by the gRPC server, once it's stopped
+func ListenGRPC(ctx context.Context, network, service string) error {
+	err := common.CheckNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	netListener, err := net.Listen(network, service)
+	if err != nil {
+		return err
+	}
+	listener := tcpListener{netListener}
+
+	// gRPC does TLS itself, for the client certificates to be in the peers of the streams
+	options := []grpc.ServerOption{}
+	if tlsConfig := serverTLSConfig("h2"); tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	grpcServer := grpc.NewServer(options...)
+	grpcServer.RegisterService(&chatServiceDesc, struct{}{})
+	context.AfterFunc(ctx, grpcServer.Stop)
+
+	fmt.Printf("Started gRPC listener on %s\n", listener.Addr())
+
+	return grpcServer.Serve(listener)
+}
+
+// grpcWriter sends responses on a gRPC server stream
+type grpcWriter struct {
+	mu     sync.Mutex
+	stream grpc.ServerStream
+	done   chan bool
+	once   sync.Once
+}
+
+func (w *grpcWriter) writeResponse(response *common.Response) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.stream.SendMsg(response)
+}
+
+// close ends the stream. The stream itself is finished when the handler returns
+func (w *grpcWriter) close() error {
+	w.once.Do(func() {
+		close(w.done)
+	})
+
+	return nil
+}
+
+func handleChatStream(srv interface{}, stream grpc.ServerStream) error {
+	writer := &grpcWriter{stream: stream, done: make(chan bool)}
+
+	if draining.isActive() {
+		draining.redirect(writer)
+		return nil
+	}
+
+	// the stream's context is done once the client goes away or the server stops
+	s := newSession(stream.Context(), writer, nil)
+	defer recoverSession(s)
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		s.addr = p.Addr
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			s.certificate = clientCertificate(&info.State)
+		}
+	}
+
+	err := s.sendChallenge()
+	if err != nil {
+		return err
+	}
+
+	operation := &common.Operation{}
+	err = stream.RecvMsg(operation)
+	if err != nil {
+		return err
+	}
+
+	err = s.handshake(operation)
+	if common.CheckErrorAndLog(err) {
+		s.writeError(err)
+		return nil
+	}
+
+	defer s.close()
+
+	operations := make(chan *common.Operation)
+	go receiveOperations(stream, operations)
+
+	for {
+		select {
+		case <-writer.done:
+			return nil
+		case operation, ok := <-operations:
+			if !ok {
+				common.Debugf("gRPC stream closed. exiting function\n")
+				return nil
+			}
+
+			err := s.handle(operation)
+			if err != nil {
+				s.writeError(err)
+				return nil
+			}
+		}
+	}
+}
+
+// receiveOperations reads operations off the stream until it is closed by the client
+func receiveOperations(stream grpc.ServerStream, operations chan *common.Operation) {
+	defer close(operations)
+
+	for {
+		operation := &common.Operation{}
+		err := stream.RecvMsg(operation)
+		if err == io.EOF {
+			return
+		}
+		if common.CheckErrorAndLog(err) {
+			return
+		}
+
+		select {
+		case operations <- operation:
+		case <-stream.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The modes of guest access, for what the clients that don't log in may do
+const (
+	ReadOnlyGuestMode  = "read_only"
+	AnonymousGuestMode = "anonymous"
+)
+
+// Guests lets the clients that don't log in to a server that requires it in anyway, as guests
+// with a new identity every time they connect, but only to the public Conversations, by
+// nickname. In the "read_only" Mode they can only read them, and in the "anonymous" one they
+// can also send messages to them. Without a Mode, those clients are refused
+type Guests struct {
+	Mode          string   `yaml:"mode"`
+	Conversations []string `yaml:"conversations"`
+}
+
+func (g Guests) check() error {
+	switch g.Mode {
+	case "":
+		return nil
+	case ReadOnlyGuestMode, AnonymousGuestMode:
+	default:
+		return fmt.Errorf("unknown guest mode '%s'", g.Mode)
+	}
+
+	if len(g.Conversations) == 0 {
+		return errors.New("guests need public conversations to go to")
+	}
+
+	return nil
+}
+
+// guestOperations are the operations guests may send. Those about conversations are further
+// limited to the public ones
+var guestOperations = map[string]bool{
+	common.ListOperationType:        true,
+	common.SubscribeOperationType:   true,
+	common.UnsubscribeOperationType: true,
+	common.MessageOperationType:     true,
+	common.FetchOperationType:       true,
+	common.SyncOperationType:        true,
+}
+
+// makeGuest gives aboutClient the identity of a guest, new for every connection so that
+// guests can't pass for anyone else
+func makeGuest(aboutClient *common.ClientAboutMe) {
+	aboutClient.ID = uuid.New()
+	aboutClient.Name = "guest-" + aboutClient.ID.String()[:6]
+	aboutClient.BoxKey = nil
+}
+
+// isPublic tells if guests may go to a conversation
+func isPublic(conversation *common.Conversation) bool {
+	return slices.Contains(currentConfig.guests().Conversations, conversation.Nickname)
+}
+
+// checkGuestOperation refuses the operations guests may not send
+func checkGuestOperation(operationType string, s *session) *common.Error {
+	if !s.guest || guestOperations[operationType] {
+		return nil
+	}
+
+	return &common.Error{
+		Code:    common.ForbiddenErrorCode,
+		Message: "guests can't do that, log in first",
+	}
+}
+
+// checkGuestAccess checks that the client of s may go to a conversation, which guests may only
+// when it's public
+func checkGuestAccess(conversation *common.Conversation, s *session) error {
+	if !s.guest || isPublic(conversation) {
+		return nil
+	}
+
+	return &common.Error{
+		Code:    common.ForbiddenErrorCode,
+		Message: fmt.Sprintf("guests can't go to '%s', log in first", conversation.Nickname),
+	}
+}
+
+// checkGuestMessage checks that the client of s may send a message to a conversation, which
+// guests may only in the anonymous mode, when it's public
+func checkGuestMessage(conversation *common.Conversation, s *session) error {
+	if s.guest && currentConfig.guests().Mode != AnonymousGuestMode {
+		return &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: "guests can only read, log in to send messages",
+		}
+	}
+
+	return checkGuestAccess(conversation, s)
+}
+
+// sendGuestNotice tells a guest where it may go
+func (s *session) sendGuestNotice() error {
+	guests := currentConfig.guests()
+
+	what := "read"
+	if guests.Mode == AnonymousGuestMode {
+		what = "read and write in"
+	}
+
+	return s.sendServerMessage(fmt.Sprintf("You're a guest as %s: you can %s %s. Log in for the rest",
+		s.client.Name, what, strings.Join(guests.Conversations, ", ")))
+}
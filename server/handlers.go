@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// operationHandler handles an operation of a session, returning the message of its response,
+// which is empty if nil. Errors with a code are sent back to the client; other errors end the
+// session
+type operationHandler func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error)
+
+// operationMiddleware wraps the handling of every operation, calling next to carry on with it,
+// or not, to refuse it
+type operationMiddleware func(next operationHandler) operationHandler
+
+// fatalError ends the session with err, even if it has a code
+type fatalError struct {
+	err error
+}
+
+func (fe fatalError) Error() string {
+	return fe.err.Error()
+}
+
+func (fe fatalError) Unwrap() error {
+	return fe.err
+}
+
+var (
+	// operationHandlers are the handlers of the operation types, those sent after the handshake
+	operationHandlers = map[string]operationHandler{}
+	// operationMiddlewares wrap the handlers, the first one on the outside
+	operationMiddlewares = []operationMiddleware{}
+	// handleOperation is dispatchOperation wrapped in the middlewares
+	handleOperation operationHandler = dispatchOperation
+)
+
+func init() {
+	registerOperation(common.CreateOperationType, withoutResponse(handleCreateConversation))
+	registerOperation(common.SubscribeOperationType, handleSubscribe)
+	registerOperation(common.UnsubscribeOperationType, withoutResponse(handleUnsubscribe))
+	registerOperation(common.TopicOperationType, handleTopic)
+	registerOperation(common.RenameOperationType, withoutResponse(handleRename))
+	registerOperation(common.ArchiveOperationType, withoutResponse(handleArchive))
+	registerOperation(common.DeleteOperationType, withoutResponse(handleDelete))
+	registerOperation(common.ACLOperationType, handleACL)
+	registerOperation(common.InviteOperationType, handleInvite)
+	registerOperation(common.JoinCodeOperationType, handleJoinCode)
+	registerOperation(common.SlowModeOperationType, withoutResponse(handleSlowMode))
+	registerOperation(common.SearchOperationType, handleSearch)
+	registerOperation(common.ExportOperationType, handleExport)
+	registerOperation(common.FetchOperationType, handleFetch)
+	registerOperation(common.SyncOperationType, handleSync)
+	registerOperation(common.KeysOperationType, func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		return handleKeys(ctx, op)
+	})
+	registerOperation(common.ConversationKeyOperationType, withoutResponse(handleConversationKey))
+	registerOperation(common.TOTPOperationType, handleTOTP)
+	registerOperation(common.SessionsOperationType, handleSessions)
+	registerOperation(common.RevokeOperationType, withoutResponse(handleRevoke))
+	registerOperation(common.AccountExportOperationType, handleAccountExport)
+	registerOperation(common.DeleteAccountOperationType, withoutResponse(handleDeleteAccount))
+	registerOperation(common.MessageOperationType, handleMessage)
+	registerOperation(common.ListOperationType, handleListConversations)
+	registerOperation(common.DigestOperationType, withoutResponse(handleDigestSettings))
+	registerOperation(common.EmailDigestOperationType, withoutResponse(handleEmailDigestSettings))
+	registerOperation(common.DrainOperationType, withoutResponse(handleDrain))
+	registerOperation(common.AnnounceOperationType, withoutResponse(handleAnnounce))
+	registerOperation(common.WhoisOperationType, handleWhois)
+	registerOperation(common.ProfileOperationType, handleProfile)
+	registerOperation(common.StatusOperationType, withoutResponse(handleStatus))
+	registerOperation(common.MembersOperationType, func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		return handleMembers(ctx, op)
+	})
+	registerOperation(common.BlockOperationType, handleBlock)
+	registerOperation(common.BlocksOperationType, func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		return handleBlocks(ctx, s)
+	})
+	registerOperation(common.ReportOperationType, withoutResponse(handleReport))
+	registerOperation(common.PrivacyOperationType, withoutResponse(handlePrivacySettings))
+	registerOperation(common.AuthOperationType, withoutResponse(handleAuth))
+	registerOperation(common.AdminOperationType, handleAdminCommand)
+	registerOperation(common.RegisterOperationType, handleRegister)
+	registerOperation(common.NameOperationType, handleName)
+
+	useOperationMiddleware(logOperations)
+	useOperationMiddleware(countOperations)
+	useOperationMiddleware(limitOperationRate)
+	useOperationMiddleware(checkGuestOperations)
+	useOperationMiddleware(checkPayloads)
+	useOperationMiddleware(timeOperationsOut)
+}
+
+// registerOperation has handler handle the operations of operationType, replacing the handler
+// it had, if any
+func registerOperation(operationType string, handler operationHandler) {
+	operationHandlers[operationType] = handler
+}
+
+// useOperationMiddleware adds middleware inside of those already used
+func useOperationMiddleware(middleware operationMiddleware) {
+	operationMiddlewares = append(operationMiddlewares, middleware)
+
+	handleOperation = dispatchOperation
+	for i := len(operationMiddlewares) - 1; i >= 0; i-- {
+		handleOperation = operationMiddlewares[i](handleOperation)
+	}
+}
+
+// withoutResponse adapts the handlers whose responses are always empty
+func withoutResponse(handler func(ctx context.Context, op *common.Operation, s *session) error) operationHandler {
+	return func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		return nil, handler(ctx, op, s)
+	}
+}
+
+// dispatchOperation has the handler of the operation's type handle it. Operations of types
+// the server doesn't know get an empty response, for clients newer than the server to carry on
+func dispatchOperation(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	handler, ok := operationHandlers[op.Type]
+	if !ok {
+		return nil, nil
+	}
+
+	return handler(ctx, op, s)
+}
+
+// logOperations logs how long operations took, and the errors they ended with
+func logOperations(next operationHandler) operationHandler {
+	return func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		start := time.Now()
+		response, err := next(ctx, op, s)
+
+		if err != nil {
+			common.Debugf("Operation %s of %v failed after %s: %s\n", op.Type, s.client, time.Since(start), err.Error())
+		} else {
+			common.Debugf("Operation %s of %v took %s\n", op.Type, s.client, time.Since(start))
+		}
+
+		return response, err
+	}
+}
+
+// countOperations counts the operations of every type, and the errors of every code, for stats
+func countOperations(next operationHandler) operationHandler {
+	return func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		operationCounts.add(op.Type)
+
+		response, err := next(ctx, op, s)
+
+		var operationErr *common.Error
+		if errors.As(err, &operationErr) && operationErr.Code != "" {
+			errorCounts.add(operationErr.Code)
+		}
+
+		return response, err
+	}
+}
+
+// limitOperationRate drops the operations that came in too fast. The client is told how long to
+// wait, and only disconnected if it keeps going over the limit regardless
+func limitOperationRate(next operationHandler) operationHandler {
+	return func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		// the configuration may have been reloaded with a new limit
+		if limit := currentConfig.rateLimit(); limit != s.limit {
+			s.limit = limit
+			s.limiter.SetLimit(limit)
+		}
+
+		ok, wait := s.limiter.Take(time.Now())
+		if !ok {
+			s.strikes++
+
+			rateLimitedErr := &common.Error{
+				Code:       common.RateLimitedErrorCode,
+				Message:    fmt.Sprintf("rate limit of %g operations per second exceeded", s.limit.Rate),
+				RetryAfter: wait.Seconds(),
+			}
+
+			if s.strikes > s.limit.Burst {
+				return nil, fatalError{rateLimitedErr}
+			}
+
+			return nil, rateLimitedErr
+		}
+
+		s.strikes = 0
+
+		return next(ctx, op, s)
+	}
+}
+
+// checkGuestOperations refuses the operations guests may not send
+func checkGuestOperations(next operationHandler) operationHandler {
+	return func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		if guestErr := checkGuestOperation(op.Type, s); guestErr != nil {
+			return nil, guestErr
+		}
+
+		return next(ctx, op, s)
+	}
+}
+
+// timeOperationsOut gives up on the operations that take longer than the configuration allows
+func timeOperationsOut(next operationHandler) operationHandler {
+	return func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		ctx, cancel := context.WithTimeout(ctx, currentConfig.operationTimeout())
+		defer cancel()
+
+		response, err := next(ctx, op, s)
+
+		// unless the session is closing anyway
+		if errors.Is(err, context.DeadlineExceeded) && s.ctx.Err() == nil {
+			err = &common.Error{Code: common.TimeoutErrorCode, Message: "the operation took too long, try again later"}
+		}
+
+		return response, err
+	}
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The HTTP transport is a fallback for networks where raw TCP is blocked:
+//
+//	POST   /sessions                    send the aboutme operation, get back {"session": "<id>"}
+//	POST   /sessions/{id}/operations    send any other operation
+//	GET    /sessions/{id}/events        receive responses, as server-sent events if the request
+//	                                    accepts text/event-stream, else as a long-polled JSON array
+//	DELETE /sessions/{id}               disconnect
+//
+// Responses to operations arrive as events, just like they would on a TCP connection. The
+// HTTP listener also serves the incoming webhooks of the configuration:
+//
+//	POST   /webhooks                    post an IncomingMessage, get back the message sent
+
+const (
+	longPollTimeout = 30 * time.Second
+	// httpSessionTimeout is how long a session may go without polling for events before it is closed
+	httpSessionTimeout = 2 * time.Minute
+	// maxQueuedResponses bounds the responses waiting for a client that doesn't poll
+	maxQueuedResponses = 1000
+)
+
+// httpWriter queues responses until the client picks them up
+type httpWriter struct {
+	mu       sync.Mutex
+	queue    []*common.Response
+	closed   bool
+	lastPoll time.Time
+	notify   chan bool
+}
+
+func newHTTPWriter() *httpWriter {
+	return &httpWriter{
+		lastPoll: time.Now(),
+		notify:   make(chan bool, 1),
+	}
+}
+
+func (w *httpWriter) writeResponse(response *common.Response) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errors.New("session is closed")
+	}
+
+	if len(w.queue) >= maxQueuedResponses {
+		return errors.New("too many responses waiting to be polled")
+	}
+
+	w.queue = append(w.queue, response)
+	w.wake()
+
+	return nil
+}
+
+func (w *httpWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	w.wake()
+
+	return nil
+}
+
+func (w *httpWriter) wake() {
+	select {
+	case w.notify <- true:
+	default:
+	}
+}
+
+// take returns the queued responses, and whether the writer has been closed
+func (w *httpWriter) take() ([]*common.Response, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	responses := w.queue
+	w.queue = nil
+	w.lastPoll = time.Now()
+
+	return responses, w.closed
+}
+
+func (w *httpWriter) idleSince() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.lastPoll
+}
+
+// httpSession ties a session to its writer. Operations are handled one at a time, like
+// they would be when read off a TCP connection
+type httpSession struct {
+	mu      sync.Mutex
+	session *session
+	writer  *httpWriter
+}
+
+type httpSessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*httpSession
+}
+
+var httpSessions = &httpSessionStore{sessions: map[string]*httpSession{}}
+
+func (hs *httpSessionStore) add(session *httpSession) string {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	id := uuid.New().String()
+	hs.sessions[id] = session
+
+	return id
+}
+
+func (hs *httpSessionStore) get(id string) (*httpSession, bool) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	session, ok := hs.sessions[id]
+
+	return session, ok
+}
+
+func (hs *httpSessionStore) remove(id string) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	delete(hs.sessions, id)
+}
+
+// expire closes sessions whose clients stopped polling, since there's no connection to notice
+// it, until ctx is done
+func (hs *httpSessionStore) expire(ctx context.Context) {
+	ticker := time.NewTicker(httpSessionTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		hs.mu.RLock()
+		expired := []string{}
+		for id, hsession := range hs.sessions {
+			if time.Since(hsession.writer.idleSince()) > httpSessionTimeout {
+				expired = append(expired, id)
+			}
+		}
+		hs.mu.RUnlock()
+
+		for _, id := range expired {
+			if hsession, ok := hs.get(id); ok {
+				log.Printf("HTTP session %s expired\n", id)
+				hsession.session.close()
+				hs.remove(id)
+			}
+		}
+	}
+}
+
+// ListenHTTP serves the HTTP fallback transport on the given network and service ("host:port")
+// until ctx is done, closing its sessions then
+func ListenHTTP(ctx context.Context, network, service string) error {
+	listener, err := listen(network, service, "http/1.1")
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /challenges", handleHTTPChallenge)
+	mux.HandleFunc("POST /sessions", func(w http.ResponseWriter, r *http.Request) {
+		handleHTTPHandshake(ctx, w, r)
+	})
+	mux.HandleFunc("POST /sessions/{id}/operations", handleHTTPOperation)
+	mux.HandleFunc("GET /sessions/{id}/events", handleHTTPEvents)
+	mux.HandleFunc("DELETE /sessions/{id}", handleHTTPDisconnect)
+	mux.HandleFunc("POST /webhooks", handleIncomingWebhook)
+
+	go httpSessions.expire(ctx)
+
+	server := &http.Server{Handler: mux}
+	context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+
+	fmt.Printf("Started HTTP listener on %s\n", listener.Addr())
+
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// handleHTTPChallenge sends a challenge, for clients with a public key to answer in the
+// handshake that starts their session
+func handleHTTPChallenge(w http.ResponseWriter, r *http.Request) {
+	writeHTTPJSON(w, http.StatusCreated, common.Challenge{Nonce: signedChallenge()})
+}
+
+// handleHTTPHandshake starts a session that lasts until ctx is done, unless its client
+// disconnects or stops polling first
+func handleHTTPHandshake(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	operation, err := decodeHTTPOperation(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writer := newHTTPWriter()
+
+	if draining.isActive() {
+		draining.redirect(writer)
+		responses, _ := writer.take()
+		writeHTTPJSON(w, http.StatusServiceUnavailable, responses)
+		return
+	}
+
+	var addr net.Addr
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		addr = tcpAddr
+	}
+
+	s := newSession(ctx, writer, addr)
+	s.certificate = clientCertificate(r.TLS)
+
+	// the challenge was handed out by an earlier request, which signed it for the session to
+	// take it as its own
+	proof := common.Proof{}
+	if operation.Message != nil {
+		json.Unmarshal(*operation.Message, &proof)
+	}
+	if checkSignedChallenge(proof.Nonce) {
+		s.challenge = proof.Nonce
+	}
+
+	err = s.handshake(operation)
+	if common.CheckErrorAndLog(err) {
+		s.close()
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id := httpSessions.add(&httpSession{session: s, writer: writer})
+
+	writeHTTPJSON(w, http.StatusCreated, map[string]string{"session": id})
+}
+
+func handleHTTPOperation(w http.ResponseWriter, r *http.Request) {
+	hsession, ok := httpSessions.get(r.PathValue("id"))
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+
+	operation, err := decodeHTTPOperation(r)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	hsession.mu.Lock()
+	defer hsession.mu.Unlock()
+
+	err = hsession.session.handle(operation)
+	if err != nil {
+		// the error is delivered as an event, like it would be over TCP
+		hsession.session.writeError(err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleHTTPEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	hsession, ok := httpSessions.get(id)
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+
+	if r.Header.Get("Accept") == "text/event-stream" {
+		streamHTTPEvents(w, r, id, hsession.writer)
+		return
+	}
+
+	// long polling: wait for at least one response, or time out with an empty list
+	responses, closed := hsession.writer.take()
+	if len(responses) == 0 && !closed {
+		select {
+		case <-hsession.writer.notify:
+		case <-time.After(longPollTimeout):
+		case <-r.Context().Done():
+			return
+		}
+
+		responses, closed = hsession.writer.take()
+	}
+
+	if closed {
+		httpSessions.remove(id)
+	}
+
+	if responses == nil {
+		responses = []*common.Response{}
+	}
+
+	writeHTTPJSON(w, http.StatusOK, responses)
+}
+
+func streamHTTPEvents(w http.ResponseWriter, r *http.Request, id string, writer *httpWriter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(longPollTimeout)
+	defer keepAlive.Stop()
+
+	for {
+		responses, closed := writer.take()
+
+		for _, response := range responses {
+			b, err := json.Marshal(response)
+			if common.CheckErrorAndLog(err) {
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", response.Status, b)
+		}
+		flusher.Flush()
+
+		if closed {
+			httpSessions.remove(id)
+			return
+		}
+
+		select {
+		case <-writer.notify:
+		case <-keepAlive.C:
+			// a comment, so proxies don't time out the stream and the session stays alive
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func handleHTTPDisconnect(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	hsession, ok := httpSessions.get(id)
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+
+	hsession.session.close()
+	httpSessions.remove(id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeHTTPOperation(r *http.Request) (*common.Operation, error) {
+	operation := common.NewOperation()
+
+	err := json.NewDecoder(r.Body).Decode(&operation)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Operation: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	return &operation, nil
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	writeHTTPJSON(w, status, newErrorResponse(err))
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	common.CheckErrorAndLog(err)
+}
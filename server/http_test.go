@@ -0,0 +1,27 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestFailedHTTPHandshakeClosesSession sends an operation other than a handshake to start a
+// session, which mustn't leave it open
+func TestFailedHTTPHandshakeClosesSession(t *testing.T) {
+	before := len(connections.all())
+
+	request := httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"type":"send"}`))
+	recorder := httptest.NewRecorder()
+	handleHTTPHandshake(context.Background(), recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusBadRequest, recorder.Body)
+	}
+
+	if after := len(connections.all()); after != before {
+		t.Errorf("%d session(s) left open after the failed handshake", after-before)
+	}
+}
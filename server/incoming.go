@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// incomingWebhookNamespace is the namespace the IDs of the bots of incoming webhooks are derived
+// from their names in, for a bot to keep its ID across restarts
+var incomingWebhookNamespace = uuid.MustParse("7f0c2b8e-4a52-4d61-9c55-3e0e2f4f9a17")
+
+// maxIncomingWebhookBody is the most bytes the body of a request to an incoming webhook may have
+const maxIncomingWebhookBody = 64 << 10
+
+// IncomingWebhook lets external systems, like CI or alerting, post messages to conversations
+// over HTTP with Token, as the bot called Name. Conversations, if set, are the nicknames of the
+// only conversations it may post to
+type IncomingWebhook struct {
+	Name          string   `yaml:"name"`
+	Token         string   `yaml:"token"`
+	Conversations []string `yaml:"conversations"`
+}
+
+func (iw IncomingWebhook) check() error {
+	if strings.TrimSpace(iw.Name) == "" || iw.Token == "" {
+		return errors.New("incoming webhooks need a name and a token")
+	}
+
+	return nil
+}
+
+// sender is the bot the webhook's messages are sent by
+func (iw IncomingWebhook) sender() *common.Sender {
+	return &common.Sender{ID: uuid.NewSHA1(incomingWebhookNamespace, []byte(iw.Name)), Name: iw.Name}
+}
+
+func (iw IncomingWebhook) mayPostTo(conversation *common.Conversation) bool {
+	if len(iw.Conversations) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(iw.Conversations, func(nickname string) bool {
+		return strings.EqualFold(nickname, conversation.Nickname)
+	})
+}
+
+// IncomingMessage is what's POSTed to /webhooks: the Text to send to the conversation with the
+// nickname Conversation, and the Token of an incoming webhook
+type IncomingMessage struct {
+	Token        string `json:"token"`
+	Conversation string `json:"conversation"`
+	Text         string `json:"text"`
+}
+
+// incomingWebhookLimits pace every incoming webhook like a client, under the server's rate limit
+type incomingWebhookLimits struct {
+	mu      sync.Mutex
+	buckets map[string]*common.TokenBucket
+}
+
+var incomingLimits = &incomingWebhookLimits{buckets: map[string]*common.TokenBucket{}}
+
+// take takes a token for the webhook called name, or returns how long until there's one
+func (il *incomingWebhookLimits) take(name string) (bool, time.Duration) {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	limit := currentConfig.rateLimit()
+
+	bucket, ok := il.buckets[name]
+	if !ok {
+		bucket = common.NewTokenBucket(limit)
+		il.buckets[name] = bucket
+	}
+	bucket.SetLimit(limit)
+
+	return bucket.Take(time.Now())
+}
+
+// handleIncomingWebhook posts the message of the request to its conversation, as the bot of the
+// incoming webhook its token is for, and responds with the message as it was stored
+func handleIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	incoming := IncomingMessage{}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIncomingWebhookBody)).Decode(&incoming)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing IncomingMessage: %s\n", err.Error())
+		writeHTTPError(w, http.StatusBadRequest, errors.New(unmarshalingError))
+		return
+	}
+
+	webhook, ok := incomingWebhookFor(incoming.Token)
+	if !ok {
+		log.Printf("Wrong incoming webhook token from %s\n", r.RemoteAddr)
+		writeHTTPError(w, http.StatusUnauthorized, &common.Error{Code: common.ForbiddenErrorCode, Message: "wrong token"})
+		return
+	}
+
+	if ok, wait := incomingLimits.take(webhook.Name); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeHTTPError(w, http.StatusTooManyRequests, &common.Error{
+			Code:       common.RateLimitedErrorCode,
+			Message:    "too many messages, slow down",
+			RetryAfter: wait.Seconds(),
+		})
+		return
+	}
+
+	message, status, err := postIncoming(webhook, incoming)
+	if err != nil {
+		writeHTTPError(w, status, err)
+		return
+	}
+
+	writeHTTPJSON(w, http.StatusCreated, message)
+}
+
+// incomingWebhookFor is the incoming webhook of the configuration with the given token
+func incomingWebhookFor(token string) (IncomingWebhook, bool) {
+	found := IncomingWebhook{}
+	ok := false
+
+	// every token is compared, for the time taken not to tell which ones are close
+	for _, webhook := range currentConfig.incomingWebhooks() {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(webhook.Token)) == 1 && !ok {
+			found, ok = webhook, true
+		}
+	}
+
+	return found, ok
+}
+
+// postIncoming sends the text of incoming to its conversation like a message from a client,
+// returning the HTTP status of the error if it can't
+func postIncoming(webhook IncomingWebhook, incoming IncomingMessage) (*common.Message, int, error) {
+	conversation, ok := conversations.getByNickname(incoming.Conversation)
+	if !ok {
+		return nil, http.StatusNotFound, &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: fmt.Sprintf("conversation '%s' does not exist", incoming.Conversation),
+		}
+	}
+
+	if !webhook.mayPostTo(conversation) {
+		return nil, http.StatusForbidden, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("%s may not post to '%s'", webhook.Name, conversation.Nickname),
+		}
+	}
+
+	if conversation.Archived {
+		return nil, http.StatusConflict, &common.Error{
+			Code:    common.ArchivedErrorCode,
+			Message: fmt.Sprintf("conversation '%s' is archived", conversation.Nickname),
+		}
+	}
+
+	// the server can't seal messages, only members can
+	if conversation.Encrypted {
+		return nil, http.StatusConflict, &common.Error{
+			Code:    common.EncryptionErrorCode,
+			Message: fmt.Sprintf("conversation '%s' is encrypted", conversation.Nickname),
+		}
+	}
+
+	text, err := cleanText(incoming.Text, currentConfig.maxMessageLength())
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	message := publishMessage(common.Message{
+		Conversation: &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname},
+		Sender:       webhook.sender(),
+		Text:         text,
+	}, nil)
+
+	common.Debugf("Incoming webhook %s posted to %s\n", webhook.Name, conversation.Nickname)
+
+	return &message, 0, nil
+}
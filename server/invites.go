@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+const (
+	// inviteCodeAlphabet leaves out the letters and digits that are easily mixed up, like O and 0
+	inviteCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	inviteCodeLength   = 6
+
+	defaultInviteExpiry = 24 * time.Hour
+	maxInviteExpiry     = 30 * 24 * time.Hour
+	maxInviteUses       = 1000
+)
+
+// invite lets whoever has its code join a conversation with some access, a number of times
+// until it expires
+type invite struct {
+	conversationID uuid.UUID
+	access         string
+	uses           int
+	expires        time.Time
+}
+
+// inviteStore keeps the invites by their codes, until they're used up or expire
+type inviteStore struct {
+	mu      sync.Mutex
+	invites map[string]*invite
+}
+
+var invites = &inviteStore{invites: make(map[string]*invite)}
+
+// add keeps inv under a new code, which it returns
+func (is *inviteStore) add(inv *invite) string {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	now := time.Now()
+	for code, known := range is.invites {
+		if now.After(known.expires) {
+			delete(is.invites, code)
+		}
+	}
+
+	for {
+		code := newInviteCode()
+		if _, taken := is.invites[code]; !taken {
+			is.invites[code] = inv
+			return code
+		}
+	}
+}
+
+// use takes one use of the invite with the given code, if it's still valid
+func (is *inviteStore) use(code string) (invite, bool) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+
+	inv, ok := is.invites[code]
+	if !ok {
+		return invite{}, false
+	}
+
+	if time.Now().After(inv.expires) {
+		delete(is.invites, code)
+		return invite{}, false
+	}
+
+	inv.uses--
+	if inv.uses <= 0 {
+		delete(is.invites, code)
+	}
+
+	return *inv, true
+}
+
+// forget drops the invites to the conversation with the given ID, when it's deleted
+func (is *inviteStore) forget(conversationID uuid.UUID) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	for code, inv := range is.invites {
+		if inv.conversationID == conversationID {
+			delete(is.invites, code)
+		}
+	}
+}
+
+func newInviteCode() string {
+	b := make([]byte, inviteCodeLength)
+	rand.Read(b)
+
+	for i := range b {
+		b[i] = inviteCodeAlphabet[int(b[i])%len(inviteCodeAlphabet)]
+	}
+
+	return string(b)
+}
+
+// handleInvite makes a code to join a conversation with, for its owner. Only the conversations
+// with an ACL take invites, as everyone can join the others anyway
+func handleInvite(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	request := common.Invite{}
+
+	err := json.Unmarshal(*op.Message, &request)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Invite: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	if request.Access == "" {
+		request.Access = common.WriteAccess
+	}
+	if !slices.Contains(common.AccessLevels, request.Access) {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("unknown access '%s', expected read, write or moderate", request.Access),
+		}
+	}
+
+	if request.Uses <= 0 {
+		request.Uses = 1
+	}
+	if request.Uses > maxInviteUses {
+		return nil, &common.Error{
+			Code:    common.LimitExceededErrorCode,
+			Message: fmt.Sprintf("an invite can't be used more than %d times", maxInviteUses),
+		}
+	}
+
+	expiry := time.Duration(request.ExpiresIn) * time.Second
+	if expiry <= 0 {
+		expiry = defaultInviteExpiry
+	}
+	if expiry > maxInviteExpiry {
+		return nil, &common.Error{
+			Code:    common.LimitExceededErrorCode,
+			Message: fmt.Sprintf("an invite can't last more than %s", maxInviteExpiry),
+		}
+	}
+
+	conversation, err := ownedConversation(request.Nickname, s, "invite others to")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conversation.ACL) == 0 {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("everyone can join '%s' already, give it an ACL first", conversation.Nickname),
+		}
+	}
+
+	expires := time.Now().Add(expiry)
+	code := invites.add(&invite{
+		conversationID: conversation.ID,
+		access:         request.Access,
+		uses:           request.Uses,
+		expires:        expires,
+	})
+
+	// the code itself stays out of the audit log, as it lets anyone in
+	auditLog.record(s.actor(), common.InviteOperationType, conversation.Nickname,
+		fmt.Sprintf("%s access, %d use(s), until %s", request.Access, request.Uses, expires.UTC().Format(time.RFC3339)))
+
+	return marshalResponse(common.Invite{
+		Nickname: conversation.Nickname,
+		Access:   request.Access,
+		Uses:     request.Uses,
+		Code:     code,
+		Expires:  expires,
+	})
+}
+
+// handleJoinCode uses up an invite to subscribe the client to its conversation, giving it the
+// access of the invite in the ACL, unless it has as much already
+func handleJoinCode(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	request := common.JoinCode{}
+
+	err := json.Unmarshal(*op.Message, &request)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing JoinCode: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	// the same error for every bad code, to not tell which ones were ever valid
+	invalid := &common.Error{Code: common.NotFoundErrorCode, Message: "no such invite, or it expired or was used up"}
+
+	inv, ok := invites.use(request.Code)
+	if !ok {
+		return nil, invalid
+	}
+
+	conversation, ok := conversations.get(inv.conversationID)
+	if !ok {
+		return nil, invalid
+	}
+
+	if !conversation.Allows(s.client.ID, inv.access) {
+		conversation, err = setAccess(conversation.Nickname, common.Sender{ID: s.client.ID, Name: s.client.Name}, inv.access, s.actor())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auditLog.record(s.actor(), common.JoinCodeOperationType, conversation.Nickname, inv.access+" access")
+
+	return subscribeTo(conversation, s)
+}
@@ -0,0 +1,874 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The IRC listener lets IRC clients, like irssi or WeeChat, chat on the server. It speaks enough
+// of the client protocol for them: conversations are channels named after their nicknames with
+// a "#" in front, and users are known by their names, with spaces made underscores.
+//
+//	NICK, USER, PASS    log in, with PASS as the password of the account called like the nick
+//	JOIN, PART          subscribe to and unsubscribe from conversations, creating missing ones
+//	PRIVMSG, NOTICE     send messages to conversations, or direct messages to users
+//	LIST, NAMES, TOPIC  list the conversations and their members, and see or set their topics
+//	PING, QUIT
+//
+// The commands are turned into operations, handled like those of any other transport, and the
+// responses into IRC messages. Other commands are answered with ERR_UNKNOWNCOMMAND, but for the
+// MODE and WHO queries clients send on their own, which get empty answers
+
+// ircServerName is the name the server goes by in the messages it sends IRC clients, and the
+// host of every user
+const ircServerName = "tcpchat"
+
+// maxIRCLine is the longest line read from IRC clients, message tags included
+const maxIRCLine = 8192
+
+// The numeric replies sent to IRC clients
+const (
+	rplWelcome           = "001"
+	rplYourHost          = "002"
+	rplCreated           = "003"
+	rplMyInfo            = "004"
+	rplUModeIs           = "221"
+	rplEndOfWho          = "315"
+	rplListStart         = "321"
+	rplList              = "322"
+	rplListEnd           = "323"
+	rplChannelModeIs     = "324"
+	rplNoTopic           = "331"
+	rplTopic             = "332"
+	rplNamReply          = "353"
+	rplEndOfNames        = "366"
+	rplMOTD              = "372"
+	rplMOTDStart         = "375"
+	rplEndOfMOTD         = "376"
+	errNoSuchNick        = "401"
+	errNoSuchChannel     = "403"
+	errUnknownCommand    = "421"
+	errNoMOTD            = "422"
+	errNoNicknameGiven   = "431"
+	errNotRegistered     = "451"
+	errNeedMoreParams    = "461"
+	errAlreadyRegistered = "462"
+)
+
+// ListenIRC serves IRC clients on the given network and service ("host:port"), over TLS if the
+// configuration has a certificate, until ctx is done
+func ListenIRC(ctx context.Context, network, service string) error {
+	listener, err := listen(network, service)
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+
+	fmt.Printf("Started IRC listener on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			common.Errorf("Error while accepting IRC connection: %s", err.Error())
+			continue
+		}
+
+		if draining.isActive() {
+			go draining.redirect(&ircWriter{conn: conn})
+			continue
+		}
+
+		go handleIRCConnection(ctx, conn)
+	}
+}
+
+// ircMessage is a line of the IRC protocol: ":prefix COMMAND params... :trailing"
+type ircMessage struct {
+	command string
+	params  []string
+}
+
+// parseIRC parses a line from a client, whose tags and prefix are ignored
+func parseIRC(line string) ircMessage {
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	message := ircMessage{}
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+
+		if message.command != "" && strings.HasPrefix(line, ":") {
+			message.params = append(message.params, line[1:])
+			break
+		}
+
+		var word string
+		word, line, _ = strings.Cut(line, " ")
+		if message.command == "" {
+			message.command = strings.ToUpper(word)
+		} else {
+			message.params = append(message.params, word)
+		}
+	}
+
+	return message
+}
+
+// ircLine formats a message from prefix, with its last parameter as the trailing one
+func ircLine(prefix, command string, params ...string) string {
+	var b strings.Builder
+	if prefix != "" {
+		b.WriteString(":" + prefix + " ")
+	}
+	b.WriteString(command)
+
+	for i, param := range params {
+		if i == len(params)-1 {
+			b.WriteString(" :" + param)
+		} else {
+			b.WriteString(" " + param)
+		}
+	}
+	b.WriteString("\r\n")
+
+	return b.String()
+}
+
+// ircName is the IRC nick of a user's name, or the channel name of a conversation's nickname
+// without its "#", which can't have spaces
+func ircName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == ',' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// ircPrefix is the prefix of the messages from the user called name
+func ircPrefix(name string) string {
+	nick := ircName(name)
+	return nick + "!" + nick + "@" + ircServerName
+}
+
+// ircConversation is the conversation of an IRC channel, whose name may have underscores where
+// the nickname has spaces
+func ircConversation(channel string) (*common.Conversation, bool) {
+	nickname := strings.TrimPrefix(channel, "#")
+
+	conversation, ok := conversations.getByNickname(nickname)
+	if !ok {
+		conversation, ok = conversations.getByNickname(strings.ReplaceAll(nickname, "_", " "))
+	}
+
+	return conversation, ok
+}
+
+// ircWriter turns responses into IRC messages on the connection of an IRC client
+type ircWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+	// nick and me are the nick and ID of the client, once it registered
+	nick string
+	me   uuid.UUID
+	// registering is set while the handshake is handled, for the direct messages from the server
+	// it sends then to make the MOTD, and motd once they did
+	registering bool
+	motd        bool
+	// parting is the channel of the unsubscribe operation being handled, whose response doesn't
+	// tell which conversation it was
+	parting string
+}
+
+func (w *ircWriter) writeResponse(response *common.Response) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lines := w.translate(response)
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return w.writeLines(lines...)
+}
+
+// writeLines writes lines to the connection, which the caller holds the lock of
+func (w *ircWriter) writeLines(lines ...string) error {
+	w.conn.SetWriteDeadline(deadline(currentConfig.tcp().WriteTimeout))
+	_, err := io.WriteString(w.conn, strings.Join(lines, ""))
+
+	return err
+}
+
+// send writes a message from prefix
+func (w *ircWriter) send(prefix, command string, params ...string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writeLines(ircLine(prefix, command, params...))
+}
+
+// reply writes a numeric reply to the client
+func (w *ircWriter) reply(numeric string, params ...string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writeLines(w.numeric(numeric, params...))
+}
+
+// numeric formats a numeric reply to the client, which the caller holds the lock of
+func (w *ircWriter) numeric(numeric string, params ...string) string {
+	return ircLine(ircServerName, numeric, append([]string{w.nickOrStar()}, params...)...)
+}
+
+func (w *ircWriter) close() error {
+	return w.conn.Close()
+}
+
+func (w *ircWriter) setParting(channel string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.parting = channel
+}
+
+func (w *ircWriter) setRegistering(registering bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.registering = registering
+}
+
+// endRegistration ends the MOTD, or says there's none, once the handshake has been handled
+func (w *ircWriter) endRegistration() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.registering = false
+	if w.motd {
+		return w.writeLines(w.numeric(rplEndOfMOTD, "End of /MOTD command."))
+	}
+
+	return w.writeLines(w.numeric(errNoMOTD, "MOTD File is missing"))
+}
+
+// translate turns a response into the IRC messages telling the client about it. The caller
+// holds the lock of the writer
+func (w *ircWriter) translate(response *common.Response) []string {
+	if response.Status == "error" {
+		if response.Error == nil {
+			return nil
+		}
+
+		// the errors that aren't about an operation end the session
+		if response.OperationType == "" {
+			return []string{ircLine("", "ERROR", response.Error.Message)}
+		}
+
+		return []string{ircLine(ircServerName, "NOTICE", w.nickOrStar(), response.Error.Message)}
+	}
+
+	if response.Message == nil {
+		return nil
+	}
+
+	switch response.OperationType {
+	case common.AboutMeOperationType:
+		me := common.ClientAboutMe{}
+		if json.Unmarshal(*response.Message, &me) != nil {
+			return nil
+		}
+
+		return w.welcome(me)
+	case common.MessageOperationType:
+		message := common.Message{}
+		if json.Unmarshal(*response.Message, &message) != nil {
+			return nil
+		}
+
+		return w.message(message)
+	case common.SubscribeOperationType:
+		conversation := common.Conversation{}
+		if json.Unmarshal(*response.Message, &conversation) != nil {
+			return nil
+		}
+
+		channel := "#" + ircName(conversation.Nickname)
+		lines := []string{ircLine(ircPrefix(w.nick), "JOIN", channel)}
+		if conversation.Topic == "" {
+			return append(lines, w.numeric(rplNoTopic, channel, "No topic is set"))
+		}
+
+		return append(lines, w.numeric(rplTopic, channel, conversation.Topic))
+	case common.UnsubscribeOperationType:
+		if w.parting == "" {
+			return nil
+		}
+
+		channel := w.parting
+		w.parting = ""
+
+		return []string{ircLine(ircPrefix(w.nick), "PART", channel)}
+	case common.MembersOperationType:
+		members := common.Members{}
+		if json.Unmarshal(*response.Message, &members) != nil {
+			return nil
+		}
+
+		channel := "#" + ircName(members.Nickname)
+		names := []string{}
+		for _, member := range members.Members {
+			names = append(names, ircName(member.Name))
+		}
+
+		return []string{
+			w.numeric(rplNamReply, "=", channel, strings.Join(names, " ")),
+			w.numeric(rplEndOfNames, channel, "End of /NAMES list."),
+		}
+	case common.ListOperationType:
+		list := []*common.Conversation{}
+		if json.Unmarshal(*response.Message, &list) != nil {
+			return nil
+		}
+
+		lines := []string{w.numeric(rplListStart, "Channel", "Users  Name")}
+		for _, conversation := range list {
+			count := strconv.Itoa(len(users.subscribers(conversation.ID)))
+			lines = append(lines, w.numeric(rplList, "#"+ircName(conversation.Nickname), count, conversation.Topic))
+		}
+
+		return append(lines, w.numeric(rplListEnd, "End of /LIST"))
+	case common.TopicOperationType:
+		conversation := common.Conversation{}
+		if json.Unmarshal(*response.Message, &conversation) != nil || conversation.Nickname == "" {
+			return nil
+		}
+
+		return []string{ircLine(ircServerName, "TOPIC", "#"+ircName(conversation.Nickname), conversation.Topic)}
+	case common.NameOperationType:
+		change := common.NameChange{}
+		if json.Unmarshal(*response.Message, &change) != nil || change.Name == "" {
+			return nil
+		}
+
+		// the response and the name operation of the conversations both tell the client
+		nick := ircName(change.Name)
+		if change.ID != w.me {
+			return []string{ircLine(ircPrefix(change.OldName), "NICK", nick)}
+		}
+		if nick == w.nick {
+			return nil
+		}
+
+		prefix := ircPrefix(w.nick)
+		w.nick = nick
+
+		return []string{ircLine(prefix, "NICK", nick)}
+	case common.MigrateOperationType:
+		migrate := common.Migrate{}
+		if json.Unmarshal(*response.Message, &migrate) != nil {
+			return nil
+		}
+
+		return []string{ircLine("", "ERROR", "This server is going down, reconnect to "+migrate.Address)}
+	}
+
+	return nil
+}
+
+func (w *ircWriter) nickOrStar() string {
+	if w.nick == "" {
+		return "*"
+	}
+
+	return w.nick
+}
+
+// welcome registers the client as me, telling it the nick it got if it's not the one it asked for
+func (w *ircWriter) welcome(me common.ClientAboutMe) []string {
+	lines := []string{}
+
+	nick := ircName(me.Name)
+	if w.nick != "" && nick != w.nick {
+		lines = append(lines, ircLine(ircPrefix(w.nick), "NICK", nick))
+	}
+	w.nick, w.me = nick, me.ID
+
+	return append(lines,
+		w.numeric(rplWelcome, "Welcome to tcpchat, "+nick),
+		w.numeric(rplYourHost, "Your host is "+ircServerName),
+		w.numeric(rplCreated, "This server speaks just enough IRC"),
+		w.numeric(rplMyInfo, ircServerName, "tcpchat", "o", "o"),
+	)
+}
+
+// message turns a message into PRIVMSGs, one for every line, or NOTICEs for those from the server
+func (w *ircWriter) message(message common.Message) []string {
+	// acknowledgements have no sender, and clients don't expect their own messages back
+	if message.Sender == nil || message.Sender.ID == w.me {
+		return nil
+	}
+
+	// the MOTD, and whatever else the server says to clients as they connect
+	if w.registering && message.Sender.ID == serverSender.ID && message.Recipient != nil {
+		lines := []string{}
+		if !w.motd {
+			lines = append(lines, w.numeric(rplMOTDStart, "- "+ircServerName+" Message of the day -"))
+			w.motd = true
+		}
+		for _, line := range strings.Split(message.Text, "\n") {
+			lines = append(lines, w.numeric(rplMOTD, "- "+line))
+		}
+
+		return lines
+	}
+
+	// the server can't read encrypted messages for IRC clients, which have no keys anyway
+	if message.Text == "" {
+		return nil
+	}
+
+	command, prefix, target := "PRIVMSG", ircPrefix(message.Sender.Name), w.nick
+	if message.Conversation != nil {
+		target = "#" + ircName(message.Conversation.Nickname)
+	}
+	if message.Sender.ID == serverSender.ID {
+		command, prefix = "NOTICE", ircServerName
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(message.Text, "\n") {
+		if line == "" {
+			continue
+		}
+		if message.Kind == common.ActionMessageKind {
+			line = "\x01ACTION " + line + "\x01"
+		}
+
+		lines = append(lines, ircLine(prefix, command, target, line))
+	}
+
+	return lines
+}
+
+// ircConn is the state of an IRC client's connection until it registered, and the session it
+// has once it did
+type ircConn struct {
+	s      *session
+	writer *ircWriter
+
+	nick     string
+	user     bool
+	password string
+	// negotiating is set while the client negotiates capabilities, which registration waits for
+	negotiating bool
+}
+
+func handleIRCConnection(ctx context.Context, conn net.Conn) {
+	writer := &ircWriter{conn: conn}
+	c := &ircConn{s: newSession(ctx, writer, conn.RemoteAddr()), writer: writer}
+	defer recoverSession(c.s)
+	defer c.s.close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 512), maxIRCLine)
+
+	for {
+		readTimeout := currentConfig.tcp().ReadTimeout
+		conn.SetReadDeadline(deadline(readTimeout))
+
+		if !scanner.Scan() {
+			err := scanner.Err()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("Closing the IRC connection of %v at %v, silent for %ds\n", c.s.client, c.s.addr, readTimeout)
+			} else if err != nil && !errors.Is(err, net.ErrClosed) {
+				common.CheckErrorAndLog(err)
+			}
+			return
+		}
+
+		message := parseIRC(scanner.Text())
+		if message.command == "" {
+			continue
+		}
+
+		var err error
+		if c.s.established.Load() {
+			err = c.handle(message)
+		} else {
+			err = c.register(message)
+		}
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			c.s.writeError(err)
+			return
+		}
+	}
+}
+
+// register handles the commands of a client that hasn't registered yet, and logs it in once it
+// sent its nick and user, and finished negotiating capabilities
+func (c *ircConn) register(message ircMessage) error {
+	switch message.command {
+	case "CAP":
+		err := c.capabilities(message)
+		if err != nil {
+			return err
+		}
+	case "PASS":
+		if len(message.params) < 1 {
+			return c.writer.reply(errNeedMoreParams, "PASS", "Not enough parameters")
+		}
+		c.password = message.params[0]
+	case "NICK":
+		if len(message.params) < 1 || message.params[0] == "" {
+			return c.writer.reply(errNoNicknameGiven, "No nickname given")
+		}
+		c.nick = message.params[0]
+	case "USER":
+		if len(message.params) < 4 {
+			return c.writer.reply(errNeedMoreParams, "USER", "Not enough parameters")
+		}
+		c.user = true
+	case "PING":
+		return c.pong(message)
+	case "QUIT":
+		return io.EOF
+	default:
+		return c.writer.reply(errNotRegistered, "You have not registered")
+	}
+
+	if c.nick == "" || !c.user || c.negotiating {
+		return nil
+	}
+
+	return c.logIn()
+}
+
+// capabilities answers CAP commands. No capabilities are supported
+func (c *ircConn) capabilities(message ircMessage) error {
+	if len(message.params) < 1 {
+		return c.writer.reply(errNeedMoreParams, "CAP", "Not enough parameters")
+	}
+
+	switch strings.ToUpper(message.params[0]) {
+	case "LS":
+		c.negotiating = !c.s.established.Load()
+		return c.writer.send(ircServerName, "CAP", "*", "LS", "")
+	case "REQ":
+		c.negotiating = !c.s.established.Load()
+		requested := ""
+		if len(message.params) > 1 {
+			requested = message.params[1]
+		}
+		return c.writer.send(ircServerName, "CAP", "*", "NAK", requested)
+	case "END":
+		c.negotiating = false
+	}
+
+	return nil
+}
+
+// logIn sends the handshake of the client, as a user called like its nick
+func (c *ircConn) logIn() error {
+	login := common.Login{}
+	if c.password != "" {
+		login = common.Login{Username: c.nick, Password: c.password}
+	}
+
+	b, err := json.Marshal(struct {
+		common.ClientAboutMe
+		common.Login
+		common.Device
+	}{common.ClientAboutMe{ID: uuid.New(), Name: c.nick}, login, common.Device{Client: "IRC"}})
+	if err != nil {
+		return err
+	}
+
+	aboutMe := json.RawMessage(b)
+
+	c.writer.mu.Lock()
+	c.writer.nick = ircName(c.nick)
+	c.writer.mu.Unlock()
+
+	c.writer.setRegistering(true)
+	err = c.s.handshake(&common.Operation{Type: common.AboutMeOperationType, Message: &aboutMe})
+	if err != nil {
+		return err
+	}
+
+	return c.writer.endRegistration()
+}
+
+// handle handles a command of a registered client. A non-nil error means the session should
+// be ended, with io.EOF for the client quitting
+func (c *ircConn) handle(message ircMessage) error {
+	params := message.params
+
+	switch message.command {
+	case "PING":
+		return c.pong(message)
+	case "PONG":
+		return nil
+	case "QUIT":
+		return io.EOF
+	case "CAP":
+		return c.capabilities(message)
+	case "NICK":
+		if len(params) < 1 {
+			return c.writer.reply(errNoNicknameGiven, "No nickname given")
+		}
+		return c.s.handle(&common.Operation{Type: common.NameOperationType, Message: ircOperationMessage(common.NameChange{Name: params[0]})})
+	case "USER", "PASS":
+		return c.writer.reply(errAlreadyRegistered, "You may not reregister")
+	case "JOIN":
+		if len(params) < 1 {
+			return c.writer.reply(errNeedMoreParams, "JOIN", "Not enough parameters")
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			err := c.join(channel)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "PART":
+		if len(params) < 1 {
+			return c.writer.reply(errNeedMoreParams, "PART", "Not enough parameters")
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			err := c.part(channel)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			return c.writer.reply(errNeedMoreParams, message.command, "Not enough parameters")
+		}
+		for _, target := range strings.Split(params[0], ",") {
+			err := c.privmsg(target, params[1])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "LIST":
+		return c.s.handle(&common.Operation{Type: common.ListOperationType, Message: ircOperationMessage(struct{}{})})
+	case "NAMES":
+		if len(params) < 1 {
+			return c.writer.reply(rplEndOfNames, "*", "End of /NAMES list.")
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			err := c.names(channel)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "TOPIC":
+		if len(params) < 1 {
+			return c.writer.reply(errNeedMoreParams, "TOPIC", "Not enough parameters")
+		}
+		return c.topic(params[0], params[1:])
+	case "MODE":
+		if len(params) < 1 {
+			return c.writer.reply(errNeedMoreParams, "MODE", "Not enough parameters")
+		}
+		if strings.HasPrefix(params[0], "#") {
+			return c.writer.reply(rplChannelModeIs, params[0], "+")
+		}
+		return c.writer.reply(rplUModeIs, "+")
+	case "WHO":
+		mask := "*"
+		if len(params) > 0 {
+			mask = params[0]
+		}
+		return c.writer.reply(rplEndOfWho, mask, "End of /WHO list.")
+	}
+
+	return c.writer.reply(errUnknownCommand, message.command, "Unknown command")
+}
+
+func (c *ircConn) pong(message ircMessage) error {
+	token := ircServerName
+	if len(message.params) > 0 {
+		token = message.params[0]
+	}
+
+	return c.writer.send(ircServerName, "PONG", ircServerName, token)
+}
+
+// join subscribes to the conversation of channel, creating it first if it doesn't exist, and
+// sends the names of its members
+func (c *ircConn) join(channel string) error {
+	if !strings.HasPrefix(channel, "#") || len(channel) < 2 {
+		return c.writer.reply(errNoSuchChannel, channel, "No such channel")
+	}
+
+	conversation, ok := ircConversation(channel)
+	if !ok {
+		err := c.s.handle(&common.Operation{
+			Type:    common.CreateOperationType,
+			Message: ircOperationMessage(common.Conversation{Nickname: strings.TrimPrefix(channel, "#")}),
+		})
+		if err != nil {
+			return err
+		}
+
+		// the client was told why it couldn't be created
+		conversation, ok = ircConversation(channel)
+		if !ok {
+			return nil
+		}
+	}
+
+	err := c.s.handle(&common.Operation{
+		Type:    common.SubscribeOperationType,
+		Message: ircOperationMessage(common.Conversation{Nickname: conversation.Nickname}),
+	})
+	if err != nil || !c.s.isSubscribed(conversation.ID) {
+		return err
+	}
+
+	return c.names(channel)
+}
+
+func (c *ircConn) part(channel string) error {
+	conversation, ok := ircConversation(channel)
+	if !ok {
+		return c.writer.reply(errNoSuchChannel, channel, "No such channel")
+	}
+
+	c.writer.setParting("#" + ircName(conversation.Nickname))
+	defer c.writer.setParting("")
+
+	return c.s.handle(&common.Operation{
+		Type:    common.UnsubscribeOperationType,
+		Message: ircOperationMessage(common.Conversation{Nickname: conversation.Nickname}),
+	})
+}
+
+func (c *ircConn) names(channel string) error {
+	conversation, ok := ircConversation(channel)
+	if !ok {
+		return c.writer.reply(rplEndOfNames, channel, "End of /NAMES list.")
+	}
+
+	return c.s.handle(&common.Operation{
+		Type:    common.MembersOperationType,
+		Message: ircOperationMessage(common.Members{Nickname: conversation.Nickname}),
+	})
+}
+
+// topic tells the topic of the conversation of channel, or sets it to the first of args
+func (c *ircConn) topic(channel string, args []string) error {
+	conversation, ok := ircConversation(channel)
+	if !ok {
+		return c.writer.reply(errNoSuchChannel, channel, "No such channel")
+	}
+
+	if len(args) == 0 {
+		if conversation.Topic == "" {
+			return c.writer.reply(rplNoTopic, channel, "No topic is set")
+		}
+		return c.writer.reply(rplTopic, channel, conversation.Topic)
+	}
+
+	return c.s.handle(&common.Operation{
+		Type:    common.TopicOperationType,
+		Message: ircOperationMessage(common.Topic{Nickname: conversation.Nickname, Topic: &args[0]}),
+	})
+}
+
+// privmsg sends text to the conversation of target if it's a channel, or to the user called
+// target, preferring one that's online
+func (c *ircConn) privmsg(target, text string) error {
+	message := common.Message{Text: text}
+
+	// CTCP messages, but for actions, mean nothing to the other clients
+	if strings.HasPrefix(text, "\x01") {
+		action, ok := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+		if !ok {
+			return nil
+		}
+		message = common.Message{Text: action, Kind: common.ActionMessageKind}
+	}
+
+	if strings.HasPrefix(target, "#") {
+		conversation, ok := ircConversation(target)
+		if !ok {
+			return c.writer.reply(errNoSuchChannel, target, "No such channel")
+		}
+		message.Conversation = &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname}
+	} else {
+		recipient, ok := ircUser(target)
+		if !ok {
+			return c.writer.reply(errNoSuchNick, target, "No such nick")
+		}
+		message.Recipient = &recipient
+	}
+
+	return c.s.handle(&common.Operation{Type: common.MessageOperationType, Message: ircOperationMessage(message)})
+}
+
+// ircUser is the user whose nick is nick, preferring one that's online
+func ircUser(nick string) (common.Sender, bool) {
+	found := users.named(nick)
+	if spaced := strings.ReplaceAll(nick, "_", " "); spaced != nick {
+		found = append(found, users.named(spaced)...)
+	}
+
+	if len(found) == 0 {
+		return common.Sender{}, false
+	}
+
+	for _, u := range found {
+		if messageRouter.isOnline(u.sender.ID) {
+			return u.sender, true
+		}
+	}
+
+	return found[0].sender, true
+}
+
+// ircOperationMessage is the message of an operation made from an IRC command
+func ircOperationMessage(v interface{}) *json.RawMessage {
+	b, _ := json.Marshal(v)
+	message := json.RawMessage(b)
+
+	return &message
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// defaultGroupFilter finds the groups of a user in most directories, whether they list their
+// members as member or uniqueMember
+const defaultGroupFilter = "(|(member={dn})(uniqueMember={dn}))"
+
+// ldapTimeout is the longest the server waits for the directory
+const ldapTimeout = 10 * time.Second
+
+// LDAP checks the names and passwords clients log in with against a directory, by binding as
+// UserDN with {username} replaced by the name. Roles maps the DNs of groups to the roles of
+// their members, which are looked up under GroupBase with GroupFilter, {dn} standing for the
+// user's DN, bound as BindDN when it's set and as the user otherwise. With Roles, only users
+// in one of its groups may log in, those with the "admin" role as admins. When Required,
+// clients that don't log in are refused, unless they're trusted for being local
+type LDAP struct {
+	URL          string            `yaml:"url"`
+	UserDN       string            `yaml:"user_dn"`
+	BindDN       string            `yaml:"bind_dn"`
+	BindPassword string            `yaml:"bind_password"`
+	GroupBase    string            `yaml:"group_base"`
+	GroupFilter  string            `yaml:"group_filter"`
+	Roles        map[string]string `yaml:"roles"`
+	Required     bool              `yaml:"required"`
+}
+
+func (l LDAP) check() error {
+	if l.URL == "" {
+		if l.UserDN != "" || len(l.Roles) > 0 || l.Required {
+			return errors.New("LDAP needs the url of the directory")
+		}
+
+		return nil
+	}
+
+	if !strings.Contains(l.UserDN, "{username}") {
+		return errors.New("the user_dn of LDAP needs a {username} to replace")
+	}
+
+	if len(l.Roles) > 0 && l.GroupBase == "" {
+		return errors.New("the roles of LDAP need a group_base to look for groups under")
+	}
+
+	for group := range l.Roles {
+		_, err := ldap.ParseDN(group)
+		if err != nil {
+			return fmt.Errorf("LDAP role group '%s': %s", group, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// ldapDirectory is the AuthProvider of the LDAP settings of the configuration
+type ldapDirectory struct {
+	config LDAP
+}
+
+func (d *ldapDirectory) Authenticate(ctx context.Context, name, password string) (Account, error) {
+	// directories take binds without a password as anonymous ones, which always succeed
+	if name == "" || password == "" {
+		return Account{}, ErrInvalidCredentials
+	}
+
+	conn, err := ldap.DialURL(d.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return Account{}, err
+	}
+	defer conn.Close()
+
+	conn.SetTimeout(ldapTimeout)
+
+	// closing the connection makes whatever's waiting on the directory give up
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	userDN := strings.ReplaceAll(d.config.UserDN, "{username}", ldap.EscapeDN(name))
+
+	err = conn.Bind(userDN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return Account{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Account{}, err
+	}
+
+	account := Account{Name: name}
+	if len(d.config.Roles) == 0 {
+		return account, nil
+	}
+
+	if d.config.BindDN != "" {
+		err = conn.Bind(d.config.BindDN, d.config.BindPassword)
+		if err != nil {
+			return Account{}, fmt.Errorf("couldn't bind to look up groups: %s", err.Error())
+		}
+	}
+
+	account.Roles, err = d.roles(conn, userDN)
+	if err != nil {
+		return Account{}, err
+	}
+
+	if len(account.Roles) == 0 {
+		return Account{}, ErrNoRole
+	}
+
+	return account, nil
+}
+
+// roles looks up the groups of the user with the DN userDN, and returns the roles they map to
+func (d *ldapDirectory) roles(conn *ldap.Conn, userDN string) ([]string, error) {
+	filter := d.config.GroupFilter
+	if filter == "" {
+		filter = defaultGroupFilter
+	}
+	filter = strings.ReplaceAll(filter, "{dn}", ldap.EscapeFilter(userDN))
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		d.config.GroupBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(ldapTimeout.Seconds()), false, filter, []string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't look up groups: %s", err.Error())
+	}
+
+	roles := []string{}
+	for _, entry := range result.Entries {
+		groupDN, err := ldap.ParseDN(entry.DN)
+		if err != nil {
+			continue
+		}
+
+		for group, role := range d.config.Roles {
+			// check guarantees the groups of the configuration parse
+			configured, _ := ldap.ParseDN(group)
+			if groupDN.EqualFold(configured) && !slices.Contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return roles, nil
+}
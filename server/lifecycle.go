@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// timeoutCheckInterval is how often the connections are checked for timeouts
+const timeoutCheckInterval = time.Second
+
+// connectionRegistry keeps every open session, from the moment its client connects (before
+// the handshake, unlike the router) until it's closed
+type connectionRegistry struct {
+	mu       sync.Mutex
+	sessions map[uuid.UUID]*session
+}
+
+var connections = &connectionRegistry{sessions: map[uuid.UUID]*session{}}
+
+func (cr *connectionRegistry) add(s *session) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.sessions[s.id] = s
+}
+
+func (cr *connectionRegistry) remove(s *session) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	delete(cr.sessions, s.id)
+}
+
+// all returns the open sessions, oldest first
+func (cr *connectionRegistry) all() []*session {
+	cr.mu.Lock()
+	sessions := make([]*session, 0, len(cr.sessions))
+	for _, s := range cr.sessions {
+		sessions = append(sessions, s)
+	}
+	cr.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].connectedAt.Before(sessions[j].connectedAt)
+	})
+
+	return sessions
+}
+
+func (cr *connectionRegistry) get(id uuid.UUID) (*session, bool) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	s, ok := cr.sessions[id]
+	return s, ok
+}
+
+// enforceTimeouts closes the sessions whose clients didn't introduce themselves within the
+// handshake timeout, and those that went without an operation for longer than the idle
+// timeout, until ctx is done
+func (cr *connectionRegistry) enforceTimeouts(ctx context.Context) {
+	ticker := time.NewTicker(timeoutCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		handshakeTimeout := currentConfig.handshakeTimeout()
+		idleTimeout := currentConfig.idleTimeout()
+
+		for _, s := range cr.all() {
+			switch {
+			case !s.established.Load():
+				if time.Since(s.connectedAt) > handshakeTimeout {
+					log.Printf("Closing the connection from %v, which didn't finish its handshake in %s\n", s.addr, handshakeTimeout)
+					s.writeError(errors.New("you took too long to introduce yourself"))
+				}
+			case idleTimeout > 0 && s.idleFor() > idleTimeout:
+				log.Printf("Closing the session of %v at %v, idle for %s\n", s.client, s.addr, idleTimeout)
+				s.writeError(&common.Error{
+					Code:    common.IdleTimeoutErrorCode,
+					Message: fmt.Sprintf("disconnected after %s without any operation", idleTimeout),
+				})
+			}
+		}
+	}
+}
+
+// touch records that the client of s just did something
+func (s *session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleFor is how long the client of s hasn't done anything for
+func (s *session) idleFor() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+// listConnectionsCommand lists every open connection, including those still in their handshake
+func listConnectionsCommand(out io.Writer, args string, actor auditActor) error {
+	sessions := connections.all()
+	if len(sessions) == 0 {
+		fmt.Fprintln(out, "No clients connected")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tSESSION\tADDRESS\tCONNECTED\tIDLE\tSUBSCRIPTIONS\tCLIENT")
+	for _, s := range sessions {
+		connected := time.Since(s.connectedAt).Round(time.Second)
+		idle := s.idleFor().Round(time.Second)
+
+		if !s.established.Load() {
+			fmt.Fprintf(w, "(handshake)\t-\t%s\t%v\t%s ago\t%s\t-\t-\n", s.id, s.addr, connected, idle)
+			continue
+		}
+
+		s.mu.Lock()
+		subscriptions := len(s.subscriptions)
+		s.mu.Unlock()
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s ago\t%s\t%d\t%s\n", s.client.Name, s.client.ID, s.id, s.addr,
+			connected, idle, subscriptions, s.device.Client)
+	}
+
+	return w.Flush()
+}
+
+// closeCommand force-closes a connection, whether or not its client finished its handshake.
+// Unlike revoke, the client may reconnect
+func closeCommand(out io.Writer, args string, actor auditActor) error {
+	id, err := uuid.Parse(args)
+	if err != nil {
+		return errors.New("usage: close <session id>")
+	}
+
+	s, ok := connections.get(id)
+	if !ok {
+		return fmt.Errorf("no connection %s", id)
+	}
+
+	target := fmt.Sprint(s.addr)
+	if s.established.Load() {
+		target = s.client.Name
+	}
+
+	auditLog.record(actor, "close", target, s.id.String())
+	s.writeError(errors.New("disconnected by the server's operator"))
+	fmt.Fprintf(out, "Closed the connection of %s\n", target)
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// defaultListLimit is how many conversations a page of the list has when the list doesn't say,
+// and maxListLimit the most it may ask for
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// handleListConversations responds with the conversations the list asks for, leaving out those
+// guests may not see. Lists with a limit or a cursor get a page of them, and the others all of
+// them, as clients from before pages expect
+func handleListConversations(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	list := common.List{}
+
+	err := json.Unmarshal(*op.Message, &list)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing List: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	prefix := strings.ToLower(list.Prefix)
+	found := slices.DeleteFunc(conversations.all(), func(conversation *common.Conversation) bool {
+		return !strings.HasPrefix(strings.ToLower(conversation.Nickname), prefix) ||
+			(s.guest && !isPublic(conversation))
+	})
+
+	found = describeConversations(found, s)
+	sortConversations(found, list.Sort)
+
+	if list.Limit == 0 && list.Cursor == "" {
+		return marshalResponse(found)
+	}
+
+	// the cursor is the ID of the last conversation of the previous page
+	if list.Cursor != "" {
+		cursor, err := uuid.Parse(list.Cursor)
+		if err != nil {
+			return nil, &common.Error{Code: common.NotFoundErrorCode, Message: "invalid list cursor"}
+		}
+
+		i := slices.IndexFunc(found, func(conversation *common.Conversation) bool {
+			return conversation.ID == cursor
+		})
+		if i < 0 {
+			return nil, &common.Error{
+				Code:    common.NotFoundErrorCode,
+				Message: "the list cursor's conversation is gone, start the list over",
+			}
+		}
+
+		found = found[i+1:]
+	}
+
+	limit := list.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	limit = min(limit, maxListLimit)
+
+	page := common.ConversationPage{Conversations: found}
+	if len(found) > limit {
+		page.Conversations = found[:limit]
+		page.NextCursor = found[limit-1].ID.String()
+	}
+
+	return marshalResponse(page)
+}
+
+// describeConversations returns copies of the conversations with their activity: how many are
+// subscribed, when the latest message was sent, and how many messages are unread for the client
+// of s. Those the session is subscribed to come as they're sent, and have none unread
+func describeConversations(list []*common.Conversation, s *session) []*common.Conversation {
+	u, _ := users.get(s.client.ID)
+
+	described := make([]*common.Conversation, len(list))
+	for i, conversation := range list {
+		// a copy, as the stored conversation is shared
+		c := *conversation
+		c.Members = len(users.subscribers(c.ID))
+		c.LastMessage = messages.lastTime(c.ID)
+
+		if seen, ok := u.seen[c.ID]; ok && !s.isSubscribed(c.ID) {
+			c.Unread = messages.lastSeq(c.ID) - min(seen, messages.lastSeq(c.ID))
+		}
+
+		described[i] = &c
+	}
+
+	return described
+}
+
+// sortConversations sorts the described conversations in the order of a list, leaving them in the order
+// they were created if it has none, and for those that come out even
+func sortConversations(list []*common.Conversation, order string) {
+	switch order {
+	case common.ListSortName:
+		slices.SortStableFunc(list, func(a, b *common.Conversation) int {
+			return strings.Compare(strings.ToLower(a.Nickname), strings.ToLower(b.Nickname))
+		})
+	case common.ListSortActivity:
+		slices.SortStableFunc(list, func(a, b *common.Conversation) int {
+			return b.LastMessage.Compare(a.LastMessage)
+		})
+	case common.ListSortMembers:
+		slices.SortStableFunc(list, func(a, b *common.Conversation) int {
+			return b.Members - a.Members
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// maxReasonLength is the most characters the reason of a report may have, the rest is cut off
+const maxReasonLength = 300
+
+// report is a message a user flagged to the moderators
+type report struct {
+	id       int
+	message  common.Message
+	reporter common.Sender
+	reason   string
+	time     time.Time
+}
+
+// moderationQueue keeps the reports the moderators haven't resolved yet
+type moderationQueue struct {
+	mu      sync.Mutex
+	lastID  int
+	reports map[int]*report
+}
+
+var reports = &moderationQueue{reports: map[int]*report{}}
+
+func (mq *moderationQueue) add(message common.Message, reporter common.Sender, reason string) *report {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.lastID++
+	r := &report{id: mq.lastID, message: message, reporter: reporter, reason: reason, time: time.Now()}
+	mq.reports[r.id] = r
+
+	return r
+}
+
+// open returns the unresolved reports, oldest first
+func (mq *moderationQueue) open() []*report {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	list := []*report{}
+	for _, r := range mq.reports {
+		list = append(list, r)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].id < list[j].id
+	})
+
+	return list
+}
+
+// resolve takes a report off the queue, along with the other reports of the same message
+func (mq *moderationQueue) resolve(id int) (*report, bool) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	r, ok := mq.reports[id]
+	if !ok {
+		return nil, false
+	}
+
+	for otherID, other := range mq.reports {
+		if other.message.ID == r.message.ID {
+			delete(mq.reports, otherID)
+		}
+	}
+
+	return r, true
+}
+
+// rewrite lets f change every open report, dropping those it doesn't keep
+func (mq *moderationQueue) rewrite(f func(r *report) bool) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	for id, r := range mq.reports {
+		if !f(r) {
+			delete(mq.reports, id)
+		}
+	}
+}
+
+func handleReport(ctx context.Context, op *common.Operation, s *session) error {
+	flag := common.Report{}
+
+	err := json.Unmarshal(*op.Message, &flag)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Report: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	message, ok := messages.get(flag.MessageID)
+	if !ok {
+		return &common.Error{Code: common.NotFoundErrorCode, Message: "there is no such message to report"}
+	}
+
+	r := reports.add(message, common.Sender{ID: s.client.ID, Name: s.client.Name}, cleanLine(flag.Reason, maxReasonLength))
+	log.Printf("%v reported message %s by %v (report %d)\n", s.client, message.ID, message.Sender, r.id)
+	notifyWebhooks(WebhookEvent{Event: ReportWebhookEvent, Conversation: message.Conversation, Message: &message,
+		User: webhookUser(r.reporter), Details: r.reason})
+
+	return nil
+}
+
+func listReportsCommand(out io.Writer, args string, actor auditActor) error {
+	list := reports.open()
+	if len(list) == 0 {
+		fmt.Fprintln(out, "No reports to review")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tREPORTED\tBY\tCONVERSATION\tSENDER\tREASON\tTEXT")
+	for _, r := range list {
+		fmt.Fprintf(w, "%d\t%s ago\t%s\t%s\t%s\t%s\t%s\n", r.id, time.Since(r.time).Round(time.Second),
+			r.reporter.Name, r.message.Conversation.Nickname, r.message.Sender.Name, r.reason, excerpt(r.message.Text))
+	}
+
+	return w.Flush()
+}
+
+// resolveCommand acts on a report: dismiss it, delete the message, warn its sender or ban them
+func resolveCommand(out io.Writer, args string, actor auditActor) error {
+	usage := errors.New("usage: resolve <report id> dismiss|delete|warn|ban")
+
+	idArg, action := firstWord(args)
+	id, err := strconv.Atoi(idArg)
+	if err != nil {
+		return usage
+	}
+
+	switch action {
+	case "dismiss", "delete", "warn", "ban":
+	default:
+		return usage
+	}
+
+	r, ok := reports.resolve(id)
+	if !ok {
+		return fmt.Errorf("there is no open report %d", id)
+	}
+
+	sender := *r.message.Sender
+
+	switch action {
+	case "delete":
+		messages.remove(r.message.ID)
+		if conversation, ok := conversations.get(r.message.Conversation.ID); ok {
+			messageRouter.broadcast(common.Message{
+				Conversation: &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname},
+				Sender:       &serverSender,
+				Text:         fmt.Sprintf("A message by %s was removed by the moderators", sender.Name),
+				Timestamp:    time.Now(),
+				Kind:         common.SystemMessageKind,
+			})
+		}
+	case "warn":
+		sendDirectFromServer(sender, fmt.Sprintf("The moderators warn you about your message in %s: %s",
+			r.message.Conversation.Nickname, excerpt(r.message.Text)))
+	case "ban":
+		ban(sender)
+	}
+
+	auditLog.record(actor, "resolve", sender.Name, fmt.Sprintf("report %d: %s", r.id, action))
+	notifyWebhooks(WebhookEvent{Event: ResolveWebhookEvent, Conversation: r.message.Conversation, Message: &r.message,
+		User: webhookUser(sender), Actor: actor.name, Details: action})
+	fmt.Fprintf(out, "Resolved report %d: %s\n", r.id, action)
+
+	return nil
+}
+
+func banCommand(out io.Writer, args string, actor auditActor) error {
+	senders, err := findUsers(args)
+	if err != nil {
+		return err
+	}
+
+	for _, sender := range senders {
+		ban(sender)
+		auditLog.record(actor, "ban", sender.Name, sender.ID.String())
+		notifyWebhooks(WebhookEvent{Event: BanWebhookEvent, User: webhookUser(sender), Actor: actor.name})
+	}
+
+	fmt.Fprintf(out, "Banned %d user(s)\n", len(senders))
+
+	return nil
+}
+
+func unbanCommand(out io.Writer, args string, actor auditActor) error {
+	senders, err := findUsers(args)
+	if err != nil {
+		return err
+	}
+
+	for _, sender := range senders {
+		users.setBanned(sender, false)
+		auditLog.record(actor, "unban", sender.Name, sender.ID.String())
+		notifyWebhooks(WebhookEvent{Event: UnbanWebhookEvent, User: webhookUser(sender), Actor: actor.name})
+	}
+
+	fmt.Fprintf(out, "Unbanned %d user(s)\n", len(senders))
+
+	return nil
+}
+
+// ban keeps sender from connecting again, and disconnects it
+func ban(sender common.Sender) {
+	users.setBanned(sender, true)
+
+	for _, s := range connectedSessions() {
+		if s.client.ID == sender.ID {
+			s.writeError(&common.Error{Code: common.BannedErrorCode, Message: "you are banned from this server"})
+		}
+	}
+}
+
+// sendDirectFromServer sends text to every session of recipient, as a direct message from the server
+func sendDirectFromServer(recipient common.Sender, text string) {
+	messageRouter.sendDirect(common.Message{
+		Recipient: &recipient,
+		Sender:    &serverSender,
+		Text:      text,
+		Timestamp: time.Now(),
+	})
+}
+
+// excerpt is the first line of text, cut short to fit in a table
+func excerpt(text string) string {
+	line, _, cut := strings.Cut(text, "\n")
+	if runes := []rune(line); len(runes) > 60 {
+		line, cut = string(runes[:60]), true
+	}
+
+	if cut {
+		line += "…"
+	}
+
+	return line
+}
+
+// firstWord splits args into its first word and the rest
+func firstWord(args string) (first string, rest string) {
+	first, rest, _ = strings.Cut(strings.TrimSpace(args), " ")
+
+	return first, strings.TrimSpace(rest)
+}
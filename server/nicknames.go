@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nikochiko/tcpchat/common"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNicknameLength is the most characters the nickname of a conversation, or the name of a
+// user, may have
+const maxNicknameLength = 32
+
+// nicknamePunctuation are the characters nicknames may have other than letters, digits and spaces
+const nicknamePunctuation = "-_.'@+"
+
+// normalizeNickname returns the nickname of a conversation, or the name of a user (what is
+// "nickname" or "name"), the way the server keeps it: in Unicode normal form C, without spaces
+// around it, and with a single space where it had several. Nicknames that are empty, longer than
+// maxNicknameLength or with characters other than letters, digits, spaces and
+// nicknamePunctuation are refused
+func normalizeNickname(nickname string, what string) (string, error) {
+	nickname = strings.Join(strings.Fields(norm.NFC.String(nickname)), " ")
+
+	if nickname == "" {
+		return "", &common.Error{
+			Code:    common.InvalidNicknameErrorCode,
+			Message: fmt.Sprintf("the %s can't be empty", what),
+		}
+	}
+
+	if length := utf8.RuneCountInString(nickname); length > maxNicknameLength {
+		return "", &common.Error{
+			Code:    common.InvalidNicknameErrorCode,
+			Message: fmt.Sprintf("%s '%s' is %d characters long, the most allowed is %d", what, nickname, length, maxNicknameLength),
+		}
+	}
+
+	for _, r := range nickname {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) && r != ' ' &&
+			!strings.ContainsRune(nicknamePunctuation, r) {
+			return "", &common.Error{
+				Code: common.InvalidNicknameErrorCode,
+				Message: fmt.Sprintf("%s '%s' can't have %q, only letters, digits, spaces and %s",
+					what, nickname, r, nicknamePunctuation),
+			}
+		}
+	}
+
+	return nickname, nil
+}
+
+// nicknameKey is what tells nicknames apart, whatever their case and the form their characters
+// are in: "Lunch" and "lunch", or "ｌｕｎｃｈ", are the same nickname
+func nicknameKey(nickname string) string {
+	nickname = strings.Join(strings.Fields(nickname), " ")
+
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(nickname)))
+}
+
+// nicknameTaken is the error for a nickname another conversation, or user, already has
+func nicknameTaken(nickname string, what string) error {
+	return &common.Error{
+		Code:    common.NicknameTakenErrorCode,
+		Message: fmt.Sprintf("%s '%s' is taken", what, nickname),
+	}
+}
+
+// builtinReservedNames are the names no user may connect with, whatever the configuration: that
+// of the server, which sends the system messages, and of its admin
+var builtinReservedNames = []string{serverSender.Name, "admin"}
+
+// checkName refuses the name of a client connecting if it's reserved, registered by another
+// user, or the name of another user that's connected, in any case. Other connections of the same
+// user may have it
+func checkName(aboutClient *common.ClientAboutMe) error {
+	key := nicknameKey(aboutClient.Name)
+
+	for _, reserved := range slices.Concat(builtinReservedNames, currentConfig.reservedNames()) {
+		if nicknameKey(reserved) == key {
+			return &common.Error{
+				Code:    common.NicknameTakenErrorCode,
+				Message: fmt.Sprintf("name '%s' is reserved", aboutClient.Name),
+			}
+		}
+	}
+
+	if id, ok := users.registeredBy(aboutClient.Name); ok && id != aboutClient.ID {
+		return &common.Error{
+			Code:    common.NicknameTakenErrorCode,
+			Message: fmt.Sprintf("name '%s' is registered by another user", aboutClient.Name),
+		}
+	}
+
+	for _, s := range connectedSessions() {
+		if s.client.ID != aboutClient.ID && nicknameKey(s.client.Name) == key {
+			return nicknameTaken(aboutClient.Name, "name")
+		}
+	}
+
+	return nil
+}
+
+// handleRegister registers the name of the session's client, or releases the name it registered
+func handleRegister(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	registration := common.Registration{}
+
+	err := json.Unmarshal(*op.Message, &registration)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Registration: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	// a name is only as safe as the identity it's registered to
+	if s.certificate == nil && !s.loggedIn && len(s.client.PublicKey) == 0 {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: "only users with a public key, a login or a certificate may register their name",
+		}
+	}
+
+	u, _ := users.get(s.client.ID)
+	registration.Name = u.registeredName
+
+	if registration.Registered {
+		registration.Name = s.client.Name
+		err = users.register(s.client.ID, s.client.Name)
+	} else {
+		err = users.register(s.client.ID, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalResponse(registration)
+}
+
+// handleName changes the name of the session's client, and tells the conversations it's in.
+// The other sessions of the user keep the name they had until they reconnect
+func handleName(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	change := common.NameChange{}
+
+	err := json.Unmarshal(*op.Message, &change)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing NameChange: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	// the names of those who logged in are their account's
+	if s.certificate != nil || s.loggedIn {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: "your name is the one of your login, and can't be changed",
+		}
+	}
+
+	name, err := normalizeNickname(change.Name, "name")
+	if err != nil {
+		return nil, err
+	}
+
+	renamed := *s.client
+	renamed.Name = name
+
+	// the name may change its case alone
+	if nicknameKey(name) != nicknameKey(s.client.Name) {
+		err = checkName(&renamed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	oldName := s.client.Name
+	s.client = &renamed
+	users.rename(renamed.ID, name)
+
+	events.publish(Event{Kind: NameEvent, Client: *s.sender(), OldName: oldName, session: s})
+
+	return marshalResponse(common.NameChange{ID: renamed.ID, Name: name, OldName: oldName})
+}
+
+// releaseCommand releases a registered name, for anyone to connect with it again
+func releaseCommand(out io.Writer, args string, actor auditActor) error {
+	name := strings.TrimSpace(args)
+
+	id, ok := users.registeredBy(name)
+	if !ok {
+		return fmt.Errorf("no one registered the name '%s'", name)
+	}
+
+	err := users.register(id, "")
+	if err != nil {
+		return err
+	}
+
+	auditLog.record(actor, "release", name, id.String())
+	fmt.Fprintf(out, "Released %s\n", name)
+
+	return nil
+}
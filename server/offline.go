@@ -0,0 +1,110 @@
+package server
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// offlineQueue keeps the messages sent to users while they weren't connected, to deliver them
+// when they come back. Every user's queue holds the configuration's max_offline_messages at
+// most, dropping the oldest ones once full
+type offlineQueue struct {
+	mu     sync.Mutex
+	queues map[uuid.UUID][]common.Message
+}
+
+var offlineMessages = &offlineQueue{queues: map[uuid.UUID][]common.Message{}}
+
+// add queues message for the user with the given ID
+func (q *offlineQueue) add(id uuid.UUID, message common.Message) {
+	max := currentConfig.maxOfflineMessages()
+	if max <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := append(q.queues[id], message)
+	if len(queue) > max {
+		queue = queue[len(queue)-max:]
+	}
+
+	q.queues[id] = queue
+}
+
+// take returns the messages queued for the user with the given ID, oldest first, and empties
+// its queue
+func (q *offlineQueue) take(id uuid.UUID) []common.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue := q.queues[id]
+	delete(q.queues, id)
+
+	return queue
+}
+
+// queued returns a copy of the messages queued for the user with the given ID, oldest first
+func (q *offlineQueue) queued(id uuid.UUID) []common.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return slices.Clone(q.queues[id])
+}
+
+// rewrite replaces every queued message by what f returns for it, dropping those f doesn't keep
+func (q *offlineQueue) rewrite(f func(message common.Message) (common.Message, bool)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for id, queue := range q.queues {
+		kept := []common.Message{}
+		for _, message := range queue {
+			if rewritten, keep := f(message); keep {
+				kept = append(kept, rewritten)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(q.queues, id)
+		} else {
+			q.queues[id] = kept
+		}
+	}
+}
+
+// queueForOffline queues message for the users subscribed to its conversation that aren't
+// connected, except for its sender, those who blocked it and those its ACL doesn't let read it
+func queueForOffline(message common.Message) {
+	conversation, ok := conversations.get(message.Conversation.ID)
+	if !ok {
+		return
+	}
+
+	online := onlineUsers()
+
+	for _, id := range users.subscribers(message.Conversation.ID) {
+		if online[id] || id == message.Sender.ID || users.blocks(id, message.Sender.ID) ||
+			!conversation.Allows(id, common.ReadAccess) {
+			continue
+		}
+
+		offlineMessages.add(id, message)
+	}
+}
+
+// onlineUsers are the IDs of the users with at least one session
+func onlineUsers() map[uuid.UUID]bool {
+	online := map[uuid.UUID]bool{}
+	messageRouter.forEach(func(s *session) {
+		if s.client != nil {
+			online[s.client.ID] = true
+		}
+	})
+
+	return online
+}
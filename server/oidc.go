@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// OIDC delegates authentication to an OpenID Connect provider. Clients log in with Issuer,
+// and present the ID token they get for ClientID in their handshake. They're then known by
+// the token's subject, under the name in its NameClaim ("preferred_username" by default).
+// When Required, clients without a token are refused, unless they're trusted for being local
+type OIDC struct {
+	Issuer    string `yaml:"issuer"`
+	ClientID  string `yaml:"client_id"`
+	NameClaim string `yaml:"name_claim"`
+	Required  bool   `yaml:"required"`
+}
+
+// oidcNamespace is the namespace of the IDs derived from the issuers and subjects of ID tokens
+var oidcNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/nikochiko/tcpchat/oidc"))
+
+// jwksRefreshInterval is the least time between two fetches of the keys of a provider, as
+// tokens signed with keys it doesn't have yet make it fetch them again
+const jwksRefreshInterval = time.Minute
+
+// oidcHTTPClient is used to fetch the configuration and keys of providers
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProvider is what's known of the provider of an issuer: the keys it signs tokens with,
+// by their ID, and when they were fetched
+type oidcProvider struct {
+	issuer    string
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// oidcProviders caches the providers by issuer, across reloads of the configuration
+type oidcProviders struct {
+	mu        sync.Mutex
+	providers map[string]*oidcProvider
+}
+
+var oidcCache = &oidcProviders{providers: map[string]*oidcProvider{}}
+
+// key returns the key with the given ID of the provider of issuer, fetching the provider's keys
+// when they aren't known yet or don't have it
+func (op *oidcProviders) key(ctx context.Context, issuer, id string) (crypto.PublicKey, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	provider, ok := op.providers[issuer]
+	if !ok {
+		provider = &oidcProvider{issuer: issuer}
+		op.providers[issuer] = provider
+	}
+
+	if key, ok := provider.keys[id]; ok {
+		return key, nil
+	}
+
+	if time.Since(provider.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("no key %q for %s", id, issuer)
+	}
+
+	keys, err := fetchKeys(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.keys = keys
+	provider.fetchedAt = time.Now()
+
+	key, ok := keys[id]
+	if !ok {
+		return nil, fmt.Errorf("no key %q for %s", id, issuer)
+	}
+
+	return key, nil
+}
+
+// fetchKeys gets the keys of the provider of issuer, from the JWKS of its discovery document
+func fetchKeys(ctx context.Context, issuer string) (map[string]crypto.PublicKey, error) {
+	discovery := struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+
+	err := getJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("the provider of %s says it's %s", issuer, discovery.Issuer)
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+
+	err = getJSON(ctx, discovery.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	return keys, nil
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := oidcHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// idTokenClaims are the claims of ID tokens the server looks at. Audience is a string or a list
+type idTokenClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	Expiry    int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+// verifyIDToken checks that token is an ID token of config's issuer for its client, signed
+// with one of the issuer's keys and not expired, and returns its claims
+func verifyIDToken(ctx context.Context, config OIDC, token string) (idTokenClaims, map[string]interface{}, error) {
+	claims := idTokenClaims{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, nil, errors.New("malformed token")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return claims, nil, err
+	}
+
+	key, err := oidcCache.key(ctx, config.Issuer, header.Kid)
+	if err != nil {
+		return claims, nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return claims, nil, errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return claims, nil, errors.New("invalid signature")
+		}
+	default:
+		return claims, nil, errors.New("unsupported key")
+	}
+
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return claims, nil, err
+	}
+
+	all := map[string]interface{}{}
+	err = decodeSegment(parts[1], &all)
+	if err != nil {
+		return claims, nil, err
+	}
+
+	audiences := []string{}
+	if json.Unmarshal(claims.Audience, &audiences) != nil {
+		audience := ""
+		json.Unmarshal(claims.Audience, &audience)
+		audiences = []string{audience}
+	}
+
+	// a minute of leeway, for clocks that are a bit off
+	now := time.Now().Unix()
+	switch {
+	case claims.Issuer != config.Issuer:
+		return claims, nil, fmt.Errorf("the token is from %s", claims.Issuer)
+	case !slices.Contains(audiences, config.ClientID):
+		return claims, nil, errors.New("the token is for another client")
+	case claims.Expiry+60 < now:
+		return claims, nil, errors.New("the token expired")
+	case claims.NotBefore-60 > now:
+		return claims, nil, errors.New("the token isn't valid yet")
+	case claims.Subject == "":
+		return claims, nil, errors.New("the token has no subject")
+	}
+
+	return claims, all, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// logInWithToken makes the identity of aboutClient the one of the subject of its ID token,
+// or refuses it when the token isn't valid
+func (s *session) logInWithToken(ctx context.Context, aboutClient *common.ClientAboutMe, token string) (bool, error) {
+	config := currentConfig.oidc()
+
+	claims, all, err := verifyIDToken(ctx, config, token)
+	if err != nil {
+		log.Printf("Refused the ID token of %v from %v: %s\n", aboutClient, s.addr, err.Error())
+		return false, &common.Error{Code: common.LoginRequiredErrorCode, Message: "your login isn't valid: " + err.Error()}
+	}
+
+	nameClaim := config.NameClaim
+	if nameClaim == "" {
+		nameClaim = "preferred_username"
+	}
+
+	name, _ := all[nameClaim].(string)
+	if name == "" {
+		name = claims.Subject
+	}
+
+	aboutClient.ID = uuid.NewSHA1(oidcNamespace, []byte(claims.Issuer+"\n"+claims.Subject))
+	aboutClient.Name = name
+
+	return true, nil
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// maxNameLength is the most characters the names an operation refers to, of conversations,
+// users, codes and the like, may have
+const maxNameLength = 100
+
+// payloadCheck strictly decodes the message of an operation, and checks the fields it has. It
+// returns an *common.Error with the invalid_payload code, naming the field that's wrong
+type payloadCheck func(message json.RawMessage) error
+
+// payloadChecks are the checks of the messages of the operation types that have one. Types
+// without a check are left to their handler
+var payloadChecks = map[string]payloadCheck{
+	common.CreateOperationType: payload(func(c *common.Conversation) error {
+		return maxLength("nickname", c.Nickname, maxNameLength)
+	}),
+	common.SubscribeOperationType:   payload(conversationNickname),
+	common.UnsubscribeOperationType: payload(conversationNickname),
+	common.DeleteOperationType:      payload(conversationNickname),
+	common.TopicOperationType: payload(func(t *common.Topic) error {
+		return nickname(t.Nickname)
+	}),
+	common.RenameOperationType: payload(func(r *common.Rename) error {
+		return firstError(nickname(r.Nickname), required("new_nickname", r.NewNickname),
+			maxLength("new_nickname", r.NewNickname, maxNameLength))
+	}),
+	common.ArchiveOperationType: payload(func(a *common.Archive) error {
+		return nickname(a.Nickname)
+	}),
+	common.ACLOperationType: payload(func(a *common.ACL) error {
+		return firstError(nickname(a.Nickname), maxLength("user", a.User, maxNameLength))
+	}),
+	common.InviteOperationType: payload(func(i *common.Invite) error {
+		return nickname(i.Nickname)
+	}),
+	common.JoinCodeOperationType: payload(func(j *common.JoinCode) error {
+		return firstError(required("code", j.Code), maxLength("code", j.Code, maxNameLength))
+	}),
+	common.SlowModeOperationType: payload(func(sm *common.SlowMode) error {
+		return nickname(sm.Nickname)
+	}),
+	common.SearchOperationType: payload(func(s *common.Search) error {
+		if !slices.Contains([]string{"", common.UserMessageKind, common.ActionMessageKind, common.SystemMessageKind}, s.Kind) {
+			return invalidPayload("kind", fmt.Sprintf("kind should be %s, %s or %s", common.UserMessageKind, common.ActionMessageKind, common.SystemMessageKind))
+		}
+
+		return nil
+	}),
+	common.ExportOperationType: payload(func(e *common.Export) error {
+		return nickname(e.Nickname)
+	}),
+	common.FetchOperationType: payload(func(f *common.Fetch) error {
+		return nickname(f.Nickname)
+	}),
+	common.SyncOperationType: payload(noCheck[common.Sync]),
+	common.KeysOperationType: payload(func(k *common.Keys) error {
+		return firstError(required("name", k.Name), maxLength("name", k.Name, maxNameLength))
+	}),
+	common.ConversationKeyOperationType: payload(func(ck *common.ConversationKey) error {
+		return requiredID("conversation", ck.Conversation)
+	}),
+	common.TOTPOperationType: payload(func(t *common.TOTP) error {
+		return required("action", t.Action)
+	}),
+	common.SessionsOperationType: payload(noCheck[common.Sessions]),
+	common.RevokeOperationType: payload(func(r *common.Revoke) error {
+		return requiredID("session", r.Session)
+	}),
+	common.AccountExportOperationType: payload(noCheck[common.AccountExport]),
+	common.DeleteAccountOperationType: payload(func(da *common.DeleteAccount) error {
+		return required("confirm", da.Confirm)
+	}),
+	common.MessageOperationType: payload(func(m *common.Message) error {
+		// only the server sends system messages
+		if !slices.Contains([]string{"", common.UserMessageKind, common.ActionMessageKind}, m.Kind) {
+			return invalidPayload("kind", fmt.Sprintf("kind should be %s or %s", common.UserMessageKind, common.ActionMessageKind))
+		}
+
+		// direct messages have a recipient instead
+		if m.Recipient != nil {
+			return requiredID("recipient.id", m.Recipient.ID)
+		}
+		if m.Conversation == nil {
+			return invalidPayload("conversation", "conversation is required")
+		}
+
+		return requiredID("conversation.id", m.Conversation.ID)
+	}),
+	common.ListOperationType: payload(func(l *common.List) error {
+		if !slices.Contains([]string{"", common.ListSortName, common.ListSortActivity, common.ListSortMembers}, l.Sort) {
+			return invalidPayload("sort", fmt.Sprintf("sort should be %s, %s or %s", common.ListSortName, common.ListSortActivity, common.ListSortMembers))
+		}
+		if l.Limit < 0 {
+			return invalidPayload("limit", "limit can't be negative")
+		}
+
+		return maxLength("prefix", l.Prefix, maxNameLength)
+	}),
+	common.DigestOperationType:      payload(noCheck[common.DigestSettings]),
+	common.EmailDigestOperationType: payload(noCheck[common.EmailDigestSettings]),
+	common.DrainOperationType:       payload(noCheck[common.Drain]),
+	common.AnnounceOperationType: payload(func(a *common.Announcement) error {
+		return firstError(required("text", a.Text), maxLength("conversation", a.Conversation, maxNameLength))
+	}),
+	common.WhoisOperationType: payload(func(w *common.Whois) error {
+		return firstError(required("name", w.Name), maxLength("name", w.Name, maxNameLength))
+	}),
+	common.ProfileOperationType: payload(noCheck[common.Profile]),
+	common.StatusOperationType:  payload(noCheck[common.Status]),
+	common.MembersOperationType: payload(func(m *common.Members) error {
+		return nickname(m.Nickname)
+	}),
+	common.BlockOperationType: payload(func(b *common.Block) error {
+		return firstError(required("user", b.User), maxLength("user", b.User, maxNameLength))
+	}),
+	common.ReportOperationType: payload(func(r *common.Report) error {
+		return requiredID("message_id", r.MessageID)
+	}),
+	common.PrivacyOperationType: payload(noCheck[common.PrivacySettings]),
+	common.AuthOperationType: payload(func(a *common.Auth) error {
+		return required("token", a.Token)
+	}),
+	common.RegisterOperationType: payload(noCheck[common.Registration]),
+	common.NameOperationType: payload(func(n *common.NameChange) error {
+		return firstError(required("name", n.Name), maxLength("name", n.Name, maxNameLength))
+	}),
+	common.AdminOperationType: payload(func(a *common.AdminCommand) error {
+		return required("command", a.Command)
+	}),
+}
+
+// checkPayloads refuses the operations whose message doesn't pass the check of their type,
+// before their handler sees it
+func checkPayloads(next operationHandler) operationHandler {
+	return func(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+		if check, ok := payloadChecks[op.Type]; ok {
+			err := check(*op.Message)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return next(ctx, op, s)
+	}
+}
+
+// payload makes the check of the messages that decode to a T: they may not have fields a T
+// doesn't have, nor anything after them, and then have to pass check
+func payload[T any](check func(*T) error) payloadCheck {
+	return func(message json.RawMessage) error {
+		v := new(T)
+
+		decoder := json.NewDecoder(bytes.NewReader(message))
+		decoder.DisallowUnknownFields()
+
+		err := decoder.Decode(v)
+		if err != nil {
+			return decodingError[T](message, err)
+		}
+
+		if decoder.More() {
+			return invalidPayload("", "the message has more after it")
+		}
+
+		return check(v)
+	}
+}
+
+// noCheck is the check of the messages that only have to decode
+func noCheck[T any](*T) error {
+	return nil
+}
+
+// decodingError turns the error of decoding message into a T into one naming the field that's
+// wrong, when it can be told
+func decodingError[T any](message json.RawMessage, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return invalidPayload(typeErr.Field, fmt.Sprintf("%s should be a %s, not a %s", typeErr.Field, typeErr.Type, typeErr.Value))
+	}
+
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field, _ = strconv.Unquote(field)
+		return invalidPayload(field, fmt.Sprintf("there is no field %s", field))
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return invalidPayload("", fmt.Sprintf("the message isn't valid JSON: %s", err.Error()))
+	}
+
+	// values that decode themselves, like IDs, don't say which field they were, which is found
+	// by decoding the fields one at a time
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal(message, &fields) == nil {
+		for name, value := range fields {
+			one, _ := json.Marshal(map[string]json.RawMessage{name: value})
+			if json.Unmarshal(one, new(T)) != nil {
+				return invalidPayload(name, fmt.Sprintf("%s isn't valid: %s", name, err.Error()))
+			}
+		}
+	}
+
+	return invalidPayload("", fmt.Sprintf("the message isn't valid: %s", err.Error()))
+}
+
+// firstError returns the first of errs that isn't nil, that of the first field that's wrong
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func invalidPayload(field, message string) *common.Error {
+	return &common.Error{Code: common.InvalidPayloadErrorCode, Message: message, Field: field}
+}
+
+// conversationNickname checks the operations that only need the nickname of a conversation
+func conversationNickname(c *common.Conversation) error {
+	return nickname(c.Nickname)
+}
+
+// nickname checks the nickname of the conversation an operation is about
+func nickname(value string) error {
+	return firstError(required("nickname", value), maxLength("nickname", value, maxNameLength))
+}
+
+func required(field, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return invalidPayload(field, fmt.Sprintf("%s is required", field))
+	}
+
+	return nil
+}
+
+func requiredID(field string, id uuid.UUID) error {
+	if id == uuid.Nil {
+		return invalidPayload(field, fmt.Sprintf("%s is required", field))
+	}
+
+	return nil
+}
+
+func maxLength(field, value string, max int) error {
+	if length := utf8.RuneCountInString(value); length > max {
+		return invalidPayload(field, fmt.Sprintf("%s is %d characters long, the most allowed is %d", field, length, max))
+	}
+
+	return nil
+}
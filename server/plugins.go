@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"plugin"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// Plugin adds behavior to the server without forking it. Plugins are loaded from the
+// configuration, as Go plugins or sidecar programs, or registered with RegisterPlugin by
+// programs that embed the server. PluginBase has hooks that do nothing, for plugins to only
+// implement the ones they need
+type Plugin interface {
+	// Commands are the names of the commands OnCommand handles, without their "/"
+	Commands() []string
+	// OnConnect is called with every client whose handshake went through, before it's told so.
+	// Returning a *common.Error refuses the client with it; other errors are logged, and let the
+	// client in, so that a broken plugin doesn't lock everyone out
+	OnConnect(ctx context.Context, client common.Sender) error
+	// OnMessage is called with every message sent to a conversation before it's delivered, like
+	// a ContentFilter, and may change, block or flag it
+	OnMessage(ctx context.Context, message common.Message) (FilterResult, error)
+	// OnCommand runs the plugin's commands, registered with RegisterCommand. Its reply, if any,
+	// is sent to the conversation as a system message, instead of the command
+	OnCommand(ctx context.Context, command Command) (string, error)
+}
+
+// PluginBase implements the hooks of Plugin doing nothing
+type PluginBase struct{}
+
+func (PluginBase) Commands() []string {
+	return nil
+}
+
+func (PluginBase) OnConnect(ctx context.Context, client common.Sender) error {
+	return nil
+}
+
+func (PluginBase) OnMessage(ctx context.Context, message common.Message) (FilterResult, error) {
+	return FilterResult{Text: message.Text}, nil
+}
+
+func (PluginBase) OnCommand(ctx context.Context, command Command) (string, error) {
+	return "", nil
+}
+
+// PluginConfig loads a plugin: Go is the path of a Go plugin (built with -buildmode=plugin)
+// exporting a "New" function that returns the Plugin, and Command a program to run as a
+// sidecar, with its arguments
+type PluginConfig struct {
+	Go      string   `yaml:"go"`
+	Command []string `yaml:"command"`
+}
+
+func (pc PluginConfig) check() error {
+	if (pc.Go == "") == (len(pc.Command) == 0) {
+		return errors.New("plugins need either the path of a Go plugin or a command")
+	}
+
+	return nil
+}
+
+func (pc PluginConfig) equal(other PluginConfig) bool {
+	return pc.Go == other.Go && slices.Equal(pc.Command, other.Command)
+}
+
+var (
+	pluginsMu sync.RWMutex
+	// plugins are called in the order they were loaded
+	plugins = []Plugin{}
+)
+
+// RegisterPlugin adds p to the plugins of the server, and its commands to those of the server
+func RegisterPlugin(p Plugin) {
+	pluginsMu.Lock()
+	plugins = append(plugins, p)
+	pluginsMu.Unlock()
+
+	for _, name := range p.Commands() {
+		RegisterCommand(name, func(ctx context.Context, command Command) (CommandResult, error) {
+			reply, err := p.OnCommand(ctx, command)
+			return CommandResult{Text: reply, System: true}, err
+		})
+	}
+}
+
+func registeredPlugins() []Plugin {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	return slices.Clone(plugins)
+}
+
+// LoadPlugins loads the plugins of the configuration, starting the sidecars
+func LoadPlugins() error {
+	for _, config := range currentConfig.get().Plugins {
+		var p Plugin
+		var err error
+		if config.Go != "" {
+			p, err = openGoPlugin(config.Go)
+		} else {
+			p, err = startSidecar(config.Command)
+		}
+		if err != nil {
+			return err
+		}
+
+		RegisterPlugin(p)
+	}
+
+	return nil
+}
+
+// openGoPlugin opens the Go plugin at path, where plugins are supported
+func openGoPlugin(path string) (Plugin, error) {
+	opened, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open plugin %s: %s", path, err.Error())
+	}
+
+	symbol, err := opened.Lookup("New")
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s has no New function", path)
+	}
+
+	newPlugin, ok := symbol.(func() Plugin)
+	if !ok {
+		return nil, fmt.Errorf("the New function of plugin %s should be a func() server.Plugin", path)
+	}
+
+	log.Printf("Loaded plugin %s\n", path)
+
+	return newPlugin(), nil
+}
+
+// pluginConnect calls the OnConnect hooks of the plugins with client, returning the first
+// refusal
+func pluginConnect(ctx context.Context, client common.Sender) error {
+	for _, p := range registeredPlugins() {
+		err := p.OnConnect(ctx, client)
+
+		var refusal *common.Error
+		if errors.As(err, &refusal) {
+			return refusal
+		}
+		if err != nil {
+			common.Errorf("A plugin failed on the connection of %v: %s\n", client, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// pluginFilter has a plugin's OnMessage hook filter messages
+type pluginFilter struct {
+	plugin Plugin
+}
+
+func (pf pluginFilter) Filter(ctx context.Context, message common.Message) (FilterResult, error) {
+	return pf.plugin.OnMessage(ctx, message)
+}
+
+func pluginFilters() []ContentFilter {
+	filters := []ContentFilter{}
+	for _, p := range registeredPlugins() {
+		filters = append(filters, pluginFilter{p})
+	}
+
+	return filters
+}
+
+// sidecarRestartDelay is how long a sidecar that exited waits before it's started again
+const sidecarRestartDelay = 5 * time.Second
+
+// sidecar is a plugin running as another process, which speaks JSON-RPC 1.0 on its standard
+// input and output, for the methods Plugin.Commands, Plugin.OnConnect, Plugin.OnMessage and
+// Plugin.OnCommand. Their params are a Commands, a common.Sender, a common.Message and a
+// Command, and their results, a list of names, a SidecarConnect, a FilterResult and a
+// SidecarReply. Sidecars that exit are started again
+type sidecar struct {
+	command  []string
+	commands []string
+
+	mu        sync.Mutex
+	client    *rpc.Client
+	startedAt time.Time
+}
+
+// SidecarConnect is the result of Plugin.OnConnect: the message to refuse the client with, if any
+type SidecarConnect struct {
+	Refuse string `json:"refuse,omitempty"`
+}
+
+// SidecarReply is the result of Plugin.OnCommand: the text to reply with, if any
+type SidecarReply struct {
+	Text string `json:"text,omitempty"`
+}
+
+// sidecarIO is the standard input and output of a sidecar as one connection
+type sidecarIO struct {
+	io.ReadCloser
+	stdin io.WriteCloser
+}
+
+func (sio sidecarIO) Write(p []byte) (int, error) {
+	return sio.stdin.Write(p)
+}
+
+func (sio sidecarIO) Close() error {
+	sio.stdin.Close()
+	return sio.ReadCloser.Close()
+}
+
+func startSidecar(command []string) (*sidecar, error) {
+	sc := &sidecar{command: command}
+
+	err := sc.start()
+	if err != nil {
+		return nil, err
+	}
+
+	err = sc.call(context.Background(), "Plugin.Commands", struct{}{}, &sc.commands)
+	if err != nil {
+		return nil, fmt.Errorf("sidecar %s didn't tell its commands: %s", command[0], err.Error())
+	}
+
+	log.Printf("Started sidecar %s\n", strings.Join(command, " "))
+
+	return sc, nil
+}
+
+// start runs the sidecar's program. The caller holds its lock, but for the first start
+func (sc *sidecar) start() error {
+	cmd := exec.Command(sc.command[0], sc.command[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("couldn't start sidecar %s: %s", sc.command[0], err.Error())
+	}
+
+	// reap it when it exits, which it should once its standard input closes
+	go cmd.Wait()
+
+	sc.client = jsonrpc.NewClient(sidecarIO{ReadCloser: stdout, stdin: stdin})
+	sc.startedAt = time.Now()
+
+	return nil
+}
+
+// call calls method of the sidecar, starting it again first if it exited
+func (sc *sidecar) call(ctx context.Context, method string, args, reply interface{}) error {
+	sc.mu.Lock()
+	client := sc.client
+	sc.mu.Unlock()
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if errors.Is(call.Error, rpc.ErrShutdown) || errors.Is(call.Error, io.ErrUnexpectedEOF) {
+		sc.restart(client)
+	}
+
+	return call.Error
+}
+
+// restart starts the sidecar again if client is still its client, and it's been up for a while
+func (sc *sidecar) restart(client *rpc.Client) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.client != client || time.Since(sc.startedAt) < sidecarRestartDelay {
+		return
+	}
+
+	client.Close()
+	common.Errorf("Sidecar %s exited, starting it again\n", sc.command[0])
+
+	err := sc.start()
+	if err != nil {
+		common.Errorf("%s\n", err.Error())
+	}
+}
+
+func (sc *sidecar) Commands() []string {
+	return sc.commands
+}
+
+func (sc *sidecar) OnConnect(ctx context.Context, client common.Sender) error {
+	result := SidecarConnect{}
+
+	err := sc.call(ctx, "Plugin.OnConnect", client, &result)
+	if err != nil {
+		return err
+	}
+
+	if result.Refuse != "" {
+		return &common.Error{Code: common.ForbiddenErrorCode, Message: result.Refuse}
+	}
+
+	return nil
+}
+
+func (sc *sidecar) OnMessage(ctx context.Context, message common.Message) (FilterResult, error) {
+	result := FilterResult{}
+	err := sc.call(ctx, "Plugin.OnMessage", message, &result)
+
+	return result, err
+}
+
+func (sc *sidecar) OnCommand(ctx context.Context, command Command) (string, error) {
+	reply := SidecarReply{}
+	err := sc.call(ctx, "Plugin.OnCommand", command, &reply)
+
+	return reply.Text, err
+}
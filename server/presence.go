@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// handleStatus sets the status of the session's user, and tells the subscribers of its
+// conversations about it
+func handleStatus(ctx context.Context, op *common.Operation, s *session) error {
+	status := common.Status{}
+
+	err := json.Unmarshal(*op.Message, &status)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Status: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	status.Text = cleanLine(status.Text, maxStatusLength)
+
+	users.setStatus(s.client.ID, status)
+	events.publish(Event{Kind: StatusEvent, Client: *s.sender(), Status: &status, session: s})
+
+	return nil
+}
+
+// handleMembers lists the online subscribers of a conversation, with their status
+func handleMembers(ctx context.Context, op *common.Operation) (*json.RawMessage, error) {
+	members := common.Members{}
+
+	err := json.Unmarshal(*op.Message, &members)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Members: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	conversation, ok := conversations.getByNickname(members.Nickname)
+	if !ok {
+		err := fmt.Sprintf("conversation '%s' does not exist", members.Nickname)
+		return nil, errors.New(err)
+	}
+
+	seen := map[uuid.UUID]bool{}
+	members.Members = []common.UserInfo{}
+	for _, s := range connectedSessions() {
+		if seen[s.client.ID] || !s.isSubscribed(conversation.ID) {
+			continue
+		}
+		seen[s.client.ID] = true
+
+		members.Members = append(members.Members, common.UserInfo{
+			ID:     s.client.ID,
+			Name:   s.client.Name,
+			Online: true,
+			Status: users.status(s.client.ID),
+		})
+	}
+
+	sort.Slice(members.Members, func(i, j int) bool {
+		return members.Members[i].Name < members.Members[j].Name
+	})
+
+	return marshalResponse(members)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisDialTimeout is how long connecting to Redis may take, and maxRedisBulkLength the longest
+// string it may send us
+const (
+	redisDialTimeout   = 10 * time.Second
+	maxRedisBulkLength = 16 << 20
+)
+
+// redisError is an error reply of Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to a Redis server, speaking just enough of its protocol (RESP) for
+// pub/sub
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// checkRedisURL checks a URL like redis://:password@redis.example.com:6379, or rediss:// for TLS
+func checkRedisURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return fmt.Errorf("redis URL '%s' should be like redis://:password@host:6379, or rediss:// for TLS", rawURL)
+	}
+
+	return nil
+}
+
+// dialRedis connects to the Redis server of rawURL, and logs in with the password of the URL,
+// and its username, if it has them
+func dialRedis(ctx context.Context, rawURL string) (*redisConn, error) {
+	err := checkRedisURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	u, _ := url.Parse(rawURL)
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+
+	var conn net.Conn
+	if u.Scheme == "rediss" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if username := u.User.Username(); username != "" {
+			args = []string{"AUTH", username, password}
+		}
+
+		_, err = rc.do(args...)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// send sends a command, without waiting for its reply
+func (rc *redisConn) send(args ...string) error {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := rc.conn.Write(b.Bytes())
+	return err
+}
+
+// do sends a command and reads its reply
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	err := rc.send(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.read()
+}
+
+// read reads a reply: a string for simple and bulk strings, an int64 for integers, an
+// []interface{} for arrays and nil for null ones. Error replies are returned as a redisError
+func (rc *redisConn) read() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxRedisBulkLength {
+			return nil, fmt.Errorf("redis: invalid bulk string length '%s'", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(rc.reader, b)
+		if err != nil {
+			return nil, err
+		}
+
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length '%s'", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		values := make([]interface{}, 0, n)
+		for range n {
+			value, err := rc.read()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("redis: unexpected reply '%s'", line)
+}
+
+func (rc *redisConn) Close() error {
+	return rc.conn.Close()
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// routerShards is how many shards the router spreads the sessions over, for sessions coming and
+// going, and deliveries to some, not to hold up the others
+const routerShards = 32
+
+// routerShard holds some of the sessions, with the ones listening on every conversation
+type routerShard struct {
+	mu          sync.RWMutex
+	sessions    map[*session]bool
+	subscribers map[uuid.UUID]map[*session]bool
+}
+
+// router delivers messages to every session subscribed to the message's conversation,
+// regardless of the transport the session is connected over
+type router struct {
+	shards [routerShards]routerShard
+}
+
+var messageRouter = newRouter()
+
+func newRouter() *router {
+	r := &router{}
+	for i := range r.shards {
+		r.shards[i].sessions = map[*session]bool{}
+		r.shards[i].subscribers = map[uuid.UUID]map[*session]bool{}
+	}
+
+	return r
+}
+
+// shard is the shard s belongs in, picked by its (random) session ID
+func (r *router) shard(s *session) *routerShard {
+	return &r.shards[binary.BigEndian.Uint32(s.id[:4])%routerShards]
+}
+
+func (r *router) register(s *session) {
+	shard := r.shard(s)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.sessions[s] = true
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.subscriptions {
+		shard.addSubscriber(id, s)
+	}
+}
+
+func (r *router) unregister(s *session) {
+	shard := r.shard(s)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	delete(shard.sessions, s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.subscriptions {
+		shard.removeSubscriber(id, s)
+	}
+}
+
+// subscribed adds s to the subscribers of a conversation, once it was added to its
+// subscriptions. Sessions that aren't registered get theirs added by register
+func (r *router) subscribed(s *session, conversationID uuid.UUID) {
+	shard := r.shard(s)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.sessions[s] {
+		shard.addSubscriber(conversationID, s)
+	}
+}
+
+// unsubscribed removes s from the subscribers of a conversation
+func (r *router) unsubscribed(s *session, conversationID uuid.UUID) {
+	shard := r.shard(s)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.removeSubscriber(conversationID, s)
+}
+
+func (shard *routerShard) addSubscriber(conversationID uuid.UUID, s *session) {
+	subscribers, ok := shard.subscribers[conversationID]
+	if !ok {
+		subscribers = map[*session]bool{}
+		shard.subscribers[conversationID] = subscribers
+	}
+
+	subscribers[s] = true
+}
+
+func (shard *routerShard) removeSubscriber(conversationID uuid.UUID, s *session) {
+	subscribers := shard.subscribers[conversationID]
+
+	delete(subscribers, s)
+	if len(subscribers) == 0 {
+		delete(shard.subscribers, conversationID)
+	}
+}
+
+func (r *router) count() int {
+	count := 0
+	for i := range r.shards {
+		shard := &r.shards[i]
+
+		shard.mu.RLock()
+		count += len(shard.sessions)
+		shard.mu.RUnlock()
+	}
+
+	return count
+}
+
+// forEach calls f with every session
+func (r *router) forEach(f func(s *session)) {
+	for i := range r.shards {
+		shard := &r.shards[i]
+
+		shard.mu.RLock()
+		for s := range shard.sessions {
+			f(s)
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+// sessionsWhere returns the sessions for which wanted is true. Writing to them is left for after
+// the shards are unlocked, for a slow client not to hold up sessions coming and going
+func (r *router) sessionsWhere(wanted func(s *session) bool) []*session {
+	sessions := []*session{}
+	r.forEach(func(s *session) {
+		if wanted(s) {
+			sessions = append(sessions, s)
+		}
+	})
+
+	return sessions
+}
+
+// sendToAll sends response to every session, e.g. for server-wide notices. It's delivered by
+// the delivery workers, after whatever was published to several conversations before
+func (r *router) sendToAll(response *common.Response) {
+	sessions := r.sessionsWhere(func(s *session) bool { return true })
+	if len(sessions) == 0 {
+		return
+	}
+
+	deliveries.submit(uuid.Nil, delivery{shared: &sharedResponse{response: response}, operationType: response.OperationType, sessions: sessions})
+}
+
+// isOnline tells if the client with the given ID has at least one open session
+func (r *router) isOnline(id uuid.UUID) bool {
+	online := false
+	r.forEach(func(s *session) {
+		if s.client.ID == id {
+			online = true
+		}
+	})
+
+	return online
+}
+
+// sendDirect delivers a direct message to every session of its recipient, or queues it for
+// when the recipient connects again
+func (r *router) sendDirect(message common.Message) {
+	shared, err := newSharedResponse(common.MessageOperationType, message)
+	if err != nil {
+		common.Errorf("error while marshaling message: %s\n", err.Error())
+		return
+	}
+
+	online := false
+	sessions := r.sessionsWhere(func(s *session) bool {
+		if s.client.ID != message.Recipient.ID {
+			return false
+		}
+		online = true
+
+		return !blocksSender(s, message)
+	})
+
+	// the direct messages to a user are delivered in order, in a lane of their own
+	if len(sessions) > 0 {
+		deliveries.submit(message.Recipient.ID, delivery{shared: shared, operationType: common.MessageOperationType, sessions: sessions})
+	}
+
+	// the recipient gets it when it connects again
+	if !online && !users.blocks(message.Recipient.ID, message.Sender.ID) {
+		offlineMessages.add(message.Recipient.ID, message)
+	}
+}
+
+// broadcast sends message to all sessions listening on its conversation, except for those of
+// the users that blocked its sender, or that its ACL doesn't let read it
+func (r *router) broadcast(message common.Message) {
+	conversation, ok := conversations.get(message.Conversation.ID)
+
+	r.publishIf(message.Conversation.ID, []uuid.UUID{message.Conversation.ID}, func(s *session) bool {
+		return !blocksSender(s, message) && (!ok || canAccess(conversation, s, common.ReadAccess))
+	}, common.MessageOperationType, message)
+}
+
+// publish sends v, as a response of the given operation type, to all sessions listening on a conversation
+func (r *router) publish(conversationID uuid.UUID, operationType string, v interface{}) {
+	r.publishIf(conversationID, []uuid.UUID{conversationID}, nil, operationType, v)
+}
+
+// publishToAny is like publish, for the sessions listening on any of several conversations.
+// Every session gets v once, however many of the conversations it listens on. What's published
+// to several conversations is delivered in order with each other, rather than with what's
+// published to each of them
+func (r *router) publishToAny(conversationIDs []uuid.UUID, operationType string, v interface{}) {
+	r.publishIf(uuid.Nil, conversationIDs, nil, operationType, v)
+}
+
+// publishIf sends v, as a response of the given operation type, to the sessions listening on
+// any of the conversations for which wanted is true, or all of them if wanted is nil. v is
+// encoded once for all of them. The sessions are picked right away, and v is delivered to them
+// by the delivery workers, after whatever was published before with the same lane
+func (r *router) publishIf(lane uuid.UUID, conversationIDs []uuid.UUID, wanted func(s *session) bool, operationType string, v interface{}) {
+	shared, err := newSharedResponse(operationType, v)
+	if err != nil {
+		common.Errorf("error while marshaling %s: %s\n", operationType, err.Error())
+		return
+	}
+
+	sessions := []*session{}
+	for i := range r.shards {
+		shard := &r.shards[i]
+
+		shard.mu.RLock()
+		shard.eachSubscriberOfAny(conversationIDs, func(s *session) {
+			if wanted == nil || wanted(s) {
+				sessions = append(sessions, s)
+			}
+		})
+		shard.mu.RUnlock()
+	}
+
+	if len(sessions) == 0 {
+		return
+	}
+
+	deliveries.submit(lane, delivery{shared: shared, operationType: operationType, sessions: sessions})
+}
+
+// eachSubscriberOfAny calls f with the sessions of the shard listening on any of the
+// conversations, each once. The shard must be locked
+func (shard *routerShard) eachSubscriberOfAny(conversationIDs []uuid.UUID, f func(s *session)) {
+	if len(conversationIDs) == 1 {
+		for s := range shard.subscribers[conversationIDs[0]] {
+			f(s)
+		}
+
+		return
+	}
+
+	seen := map[*session]bool{}
+	for _, id := range conversationIDs {
+		for s := range shard.subscribers[id] {
+			if !seen[s] {
+				seen[s] = true
+				f(s)
+			}
+		}
+	}
+}
+
+// frameWriter is a responseWriter that can also send responses encoded as frames already, for
+// those going to many sessions to be encoded only once
+type frameWriter interface {
+	writeFrame(frame []byte) error
+}
+
+// sharedResponse is a response going to many sessions. It's encoded into a frame the first time
+// it's written to a frameWriter, and that same frame is written to every other one
+type sharedResponse struct {
+	response *common.Response
+	once     sync.Once
+	frame    []byte
+	err      error
+}
+
+func newSharedResponse(operationType string, v interface{}) (*sharedResponse, error) {
+	responseBytes, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	responseJSON := json.RawMessage(responseBytes)
+	response := newOKResponse(&responseJSON, operationType)
+
+	return &sharedResponse{response: &response}, nil
+}
+
+func (sr *sharedResponse) writeTo(w responseWriter) error {
+	fw, ok := w.(frameWriter)
+	if !ok {
+		return w.writeResponse(sr.response)
+	}
+
+	sr.once.Do(func() {
+		sr.frame, sr.err = common.EncodeFrame(sr.response)
+	})
+	if sr.err != nil {
+		return sr.err
+	}
+
+	return fw.writeFrame(sr.frame)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// discardWriter encodes responses like tcpWriter does, without sending them anywhere
+type discardWriter struct{}
+
+func (discardWriter) writeResponse(response *common.Response) error {
+	return common.WriteFrame(io.Discard, response)
+}
+
+func (discardWriter) writeFrame(frame []byte) error {
+	_, err := io.Discard.Write(frame)
+	return err
+}
+
+func (discardWriter) close() error {
+	return nil
+}
+
+func benchmarkSession(writer responseWriter, name string) *session {
+	s := newSession(context.Background(), writer, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	s.client = &common.ClientAboutMe{ID: uuid.New(), Name: name}
+	// there's no connection behind it to list or time out
+	connections.remove(s)
+
+	return s
+}
+
+func benchmarkMessage(conversation *common.Conversation) common.Message {
+	return common.Message{
+		Conversation: conversation,
+		Sender:       &common.Sender{ID: uuid.New(), Name: "alice"},
+		Text:         "hello there, how is everyone doing today?",
+		Timestamp:    time.Now(),
+	}
+}
+
+// waitWriter marks every response written to it as done in a wait group
+type waitWriter struct {
+	wg *sync.WaitGroup
+}
+
+func (w waitWriter) writeResponse(response *common.Response) error {
+	w.wg.Done()
+	return nil
+}
+
+func (w waitWriter) writeFrame(frame []byte) error {
+	w.wg.Done()
+	return nil
+}
+
+func (w waitWriter) close() error {
+	return nil
+}
+
+// BenchmarkRouterFanOut measures publishing a message to a conversation, which hands it over
+// to the delivery workers
+func BenchmarkRouterFanOut(b *testing.B) {
+	for _, subscribers := range []int{1, 10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("subscribers=%d", subscribers), func(b *testing.B) {
+			r := newRouter()
+			conversation := &common.Conversation{ID: uuid.New(), Nickname: "general"}
+
+			for i := 0; i < subscribers; i++ {
+				s := benchmarkSession(discardWriter{}, fmt.Sprintf("user%d", i))
+				s.subscriptions[conversation.ID] = true
+				r.register(s)
+			}
+
+			message := benchmarkMessage(conversation)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				r.broadcast(message)
+			}
+		})
+	}
+}
+
+// BenchmarkRouterDelivery measures publishing a message to a conversation until every
+// subscriber got it
+func BenchmarkRouterDelivery(b *testing.B) {
+	for _, subscribers := range []int{1, 10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("subscribers=%d", subscribers), func(b *testing.B) {
+			r := newRouter()
+			conversation := &common.Conversation{ID: uuid.New(), Nickname: "general"}
+
+			var delivered sync.WaitGroup
+			for i := 0; i < subscribers; i++ {
+				s := benchmarkSession(waitWriter{&delivered}, fmt.Sprintf("user%d", i))
+				s.subscriptions[conversation.ID] = true
+				r.register(s)
+			}
+
+			message := benchmarkMessage(conversation)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				delivered.Add(subscribers)
+				r.broadcast(message)
+				delivered.Wait()
+			}
+		})
+	}
+}
+
+// BenchmarkRouterDeliveryUnderLoad measures delivering a message to a conversation with one
+// subscriber while another one, with a thousand subscribers, is flooded with messages
+func BenchmarkRouterDeliveryUnderLoad(b *testing.B) {
+	r := newRouter()
+	busy := &common.Conversation{ID: uuid.New(), Nickname: "busy"}
+	quiet := &common.Conversation{ID: uuid.New(), Nickname: "quiet"}
+
+	for i := 0; i < 1000; i++ {
+		s := benchmarkSession(discardWriter{}, fmt.Sprintf("user%d", i))
+		s.subscriptions[busy.ID] = true
+		r.register(s)
+	}
+
+	var delivered sync.WaitGroup
+	s := benchmarkSession(waitWriter{&delivered}, "alice")
+	s.subscriptions[quiet.ID] = true
+	r.register(s)
+
+	stop := make(chan bool)
+	var flooding sync.WaitGroup
+	flooding.Go(func() {
+		message := benchmarkMessage(busy)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				r.broadcast(message)
+			}
+		}
+	})
+	defer flooding.Wait()
+	defer close(stop)
+
+	message := benchmarkMessage(quiet)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		delivered.Add(1)
+		r.broadcast(message)
+		delivered.Wait()
+	}
+}
+
+// blockingWriter never gets a response through, like a client that stopped reading
+type blockingWriter struct {
+	closed chan bool
+}
+
+func (w blockingWriter) writeResponse(response *common.Response) error {
+	<-w.closed
+	return nil
+}
+
+func (w blockingWriter) close() error {
+	close(w.closed)
+	return nil
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	r := newRouter()
+	conversation := &common.Conversation{ID: uuid.New(), Nickname: "general"}
+
+	slow := benchmarkSession(blockingWriter{make(chan bool)}, "slow")
+	slow.subscriptions[conversation.ID] = true
+	r.register(slow)
+	defer r.unregister(slow)
+
+	var delivered sync.WaitGroup
+	fast := benchmarkSession(waitWriter{&delivered}, "fast")
+	fast.subscriptions[conversation.ID] = true
+	r.register(fast)
+	defer r.unregister(fast)
+
+	message := benchmarkMessage(conversation)
+
+	done := make(chan bool)
+	go func() {
+		// the fast subscriber keeps up with every message, the slow one with none
+		for i := 0; i < maxQueuedDeliveries+2; i++ {
+			delivered.Add(1)
+			r.broadcast(message)
+			delivered.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the slow subscriber held up the fast one")
+	}
+
+	select {
+	case <-slow.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the slow subscriber wasn't disconnected once its queue was full")
+	}
+}
+
+func TestSendDirectDoesntWaitForTheRecipient(t *testing.T) {
+	r := newRouter()
+
+	stuck := benchmarkSession(blockingWriter{make(chan bool)}, "stuck")
+	r.register(stuck)
+	defer stuck.close()
+
+	message := benchmarkMessage(nil)
+	message.Conversation = nil
+	message.Recipient = &common.Sender{ID: stuck.client.ID, Name: stuck.client.Name}
+
+	done := make(chan bool)
+	go func() {
+		// the first is being written while the others wait in the queue
+		for i := 0; i < 3; i++ {
+			r.sendDirect(message)
+		}
+
+		// sessions come and go while the recipient is stuck
+		other := benchmarkSession(discardWriter{}, "other")
+		r.register(other)
+		r.unregister(other)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a recipient that doesn't read held up the router")
+	}
+}
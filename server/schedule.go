@@ -0,0 +1,470 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The tasks a Job may run
+const (
+	AnnounceTask = "announce"
+	PruneTask    = "prune"
+	StatsTask    = "stats"
+)
+
+// Job is a task the server runs on a schedule. Cron is when, as a cron expression of the minute,
+// hour, day of the month, month and day of the week, like "0 9 * * 1-5" for 9:00 on weekdays, or
+// one of @hourly, @daily, @weekly and @monthly, in the server's time zone. Task is what it runs:
+// "announce" sends Text to Conversation, or to everyone without one, "prune" removes the
+// messages older than KeepDays days from the history, and "stats" logs how busy the server is
+type Job struct {
+	Name         string `yaml:"name"`
+	Cron         string `yaml:"cron"`
+	Task         string `yaml:"task"`
+	Text         string `yaml:"text"`
+	Conversation string `yaml:"conversation"`
+	KeepDays     int    `yaml:"keep_days"`
+}
+
+func (j Job) check() error {
+	if !commandNamePattern.MatchString(j.Name) {
+		return fmt.Errorf("job '%s' should be named with lowercase letters, digits, '-' and '_'", j.Name)
+	}
+
+	_, err := parseCron(j.Cron)
+	if err != nil {
+		return fmt.Errorf("job %s: %s", j.Name, err.Error())
+	}
+
+	switch j.Task {
+	case AnnounceTask:
+		if j.Text == "" {
+			return fmt.Errorf("job %s has nothing to announce", j.Name)
+		}
+	case PruneTask:
+		if j.KeepDays <= 0 {
+			return fmt.Errorf("job %s should keep at least a day of history", j.Name)
+		}
+	case StatsTask:
+	default:
+		return fmt.Errorf("job %s has an unknown task '%s', expected announce, prune or stats", j.Name, j.Task)
+	}
+
+	return nil
+}
+
+// run runs the task of the job, on behalf of actor
+func (j Job) run(actor auditActor) error {
+	switch j.Task {
+	case AnnounceTask:
+		return announceFor(actor, common.Announcement{Text: j.Text, Conversation: j.Conversation})
+	case PruneTask:
+		pruned := messages.prune(time.Now().AddDate(0, 0, -j.KeepDays))
+		auditLog.record(actor, PruneTask, "history", fmt.Sprintf("%d messages older than %d days", pruned, j.KeepDays))
+		log.Printf("Pruned %d messages older than %d days from the history\n", pruned, j.KeepDays)
+	case StatsTask:
+		log.Printf("Stats: %d connections, %d users seen, %d conversations, %d messages, %d pending deliveries; events: %s; operations: %s; errors: %s\n",
+			messageRouter.count(), users.count(), len(conversations.all()), messages.count(), deliveries.pending(),
+			eventCounts, operationCounts, errorCounts)
+	}
+
+	return nil
+}
+
+// scheduler runs the jobs of the configuration, and those added from the admin console, which
+// last until the server stops
+type scheduler struct {
+	mu    sync.Mutex
+	added []Job
+	// lastRuns are when the jobs last ran, by name
+	lastRuns map[string]time.Time
+}
+
+var schedule = &scheduler{lastRuns: map[string]time.Time{}}
+
+// jobs are the jobs of the configuration, then the added ones
+func (sc *scheduler) jobs() []Job {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return slices.Concat(currentConfig.jobs(), sc.added)
+}
+
+func (sc *scheduler) find(name string) (Job, bool) {
+	for _, job := range sc.jobs() {
+		if job.Name == name {
+			return job, true
+		}
+	}
+
+	return Job{}, false
+}
+
+func (sc *scheduler) add(job Job) error {
+	err := job.check()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sc.find(job.Name); ok {
+		return fmt.Errorf("there's a job called %s already", job.Name)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.added = append(sc.added, job)
+
+	return nil
+}
+
+// remove removes an added job. Those of the configuration are removed from it
+func (sc *scheduler) remove(name string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	n := len(sc.added)
+	sc.added = slices.DeleteFunc(sc.added, func(job Job) bool {
+		return job.Name == name
+	})
+
+	return len(sc.added) < n
+}
+
+func (sc *scheduler) ran(name string, at time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.lastRuns[name] = at
+}
+
+func (sc *scheduler) lastRun(name string) (time.Time, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	at, ok := sc.lastRuns[name]
+	return at, ok
+}
+
+// runSchedule runs the jobs whose time has come at the start of every minute, until ctx is done
+func (sc *scheduler) runSchedule(ctx context.Context) {
+	for {
+		now := time.Now()
+		select {
+		case now = <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		case <-ctx.Done():
+			return
+		}
+
+		// the timer may fire a little early or late, the minute it's for is the nearest one
+		now = now.Round(time.Minute)
+
+		for _, job := range sc.jobs() {
+			cron, err := parseCron(job.Cron)
+			if err != nil || !cron.matches(now) {
+				continue
+			}
+
+			sc.ran(job.Name, now)
+			err = job.run(schedulerActor)
+			if err != nil {
+				common.Errorf("Job %s failed: %s\n", job.Name, err.Error())
+			}
+		}
+	}
+}
+
+// schedulerActor is who the jobs run on behalf of, in the audit log
+var schedulerActor = auditActor{name: "scheduler"}
+
+// cronSchedule is a parsed cron expression: the minutes, hours, days of the month, months and
+// days of the week it matches, as bit sets
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// anyDay and anyWeekday are set for "*" in the days of the month, and of the week. As in
+	// cron, when both are restricted, days matching either of them match
+	anyDay, anyWeekday bool
+}
+
+// cronShorthands are the expressions that stand for common schedules
+var cronShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses a cron expression of five fields, each "*", a number, a range like "1-5", a
+// step like "*/15" or "0-30/10", or a list of them like "0,30"
+func parseCron(expression string) (cronSchedule, error) {
+	if shorthand, ok := cronShorthands[expression]; ok {
+		expression = shorthand
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression '%s' should have 5 fields: minute, hour, day of month, month and day of week", expression)
+	}
+
+	cron := cronSchedule{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+
+	ranges := []struct {
+		field    *uint64
+		name     string
+		min, max int
+	}{
+		{&cron.minutes, "minute", 0, 59},
+		{&cron.hours, "hour", 0, 23},
+		{&cron.days, "day of month", 1, 31},
+		{&cron.months, "month", 1, 12},
+		// 7 is Sunday too
+		{&cron.weekdays, "day of week", 0, 7},
+	}
+
+	for i, r := range ranges {
+		set, err := parseCronField(fields[i], r.min, r.max)
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("invalid %s '%s' in cron expression '%s': %s", r.name, fields[i], expression, err.Error())
+		}
+		*r.field = set
+	}
+
+	if cron.weekdays&(1<<7) != 0 {
+		cron.weekdays |= 1
+	}
+
+	return cron, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		span, stepText, stepped := strings.Cut(part, "/")
+
+		step := 1
+		if stepped {
+			var err error
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step < 1 {
+				return 0, errors.New("the step should be a positive number")
+			}
+		}
+
+		from, to := min, max
+		if span != "*" {
+			first, last, isRange := strings.Cut(span, "-")
+
+			var err error
+			from, err = strconv.Atoi(first)
+			if err != nil {
+				return 0, errors.New("expected *, a number or a range")
+			}
+
+			to = from
+			if isRange {
+				to, err = strconv.Atoi(last)
+				if err != nil {
+					return 0, errors.New("expected *, a number or a range")
+				}
+			} else if stepped {
+				// "5/15" is every 15 from 5 on
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("should be between %d and %d", min, max)
+		}
+
+		for n := from; n <= to; n += step {
+			set |= 1 << n
+		}
+	}
+
+	return set, nil
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	return c.minutes&(1<<t.Minute()) != 0 && c.hours&(1<<t.Hour()) != 0 &&
+		c.months&(1<<int(t.Month())) != 0 && c.matchesDay(t)
+}
+
+func (c cronSchedule) matchesDay(t time.Time) bool {
+	day := c.days&(1<<t.Day()) != 0
+	weekday := c.weekdays&(1<<int(t.Weekday())) != 0
+
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+// cronHorizon is how far ahead next looks, as expressions like "0 0 30 2 *" never match
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+// next is the first minute after t the schedule matches, false if there's none in cronHorizon
+func (c cronSchedule) next(t time.Time) (time.Time, bool) {
+	end := t.Add(cronHorizon)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(end) {
+		switch {
+		case c.months&(1<<int(t.Month())) == 0 || !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// scheduleCommand lists the jobs, adds and removes jobs, and runs them right away
+func scheduleCommand(out io.Writer, args string, actor auditActor) error {
+	usage := errors.New("usage: schedule [add <name> <cron> announce [<conversation>|*] <text> | add <name> <cron> prune <days> | add <name> <cron> stats | remove <name> | run <name>]")
+
+	action, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	rest = strings.TrimSpace(rest)
+
+	switch action {
+	case "":
+		return listJobs(out)
+	case "add":
+		job, err := parseJob(rest)
+		if err != nil {
+			return fmt.Errorf("%s\n%s", err.Error(), usage.Error())
+		}
+
+		err = schedule.add(job)
+		if err != nil {
+			return err
+		}
+
+		auditLog.record(actor, "schedule", job.Name, job.Cron+" "+job.Task)
+		fmt.Fprintf(out, "Scheduled %s\n", job.Name)
+	case "remove":
+		if !schedule.remove(rest) {
+			return fmt.Errorf("no job %s was added, those of the configuration are removed from it", rest)
+		}
+
+		auditLog.record(actor, "unschedule", rest, "")
+		fmt.Fprintf(out, "Removed %s\n", rest)
+	case "run":
+		job, ok := schedule.find(rest)
+		if !ok {
+			return fmt.Errorf("no job %s", rest)
+		}
+
+		schedule.ran(job.Name, time.Now())
+		err := job.run(actor)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Ran %s\n", job.Name)
+	default:
+		return usage
+	}
+
+	return nil
+}
+
+// parseJob parses a job of the schedule command, like "standup 0 9 * * 1-5 announce general
+// Stand-up in 5 minutes"
+func parseJob(args string) (Job, error) {
+	fields := strings.Fields(args)
+	if len(fields) < 3 {
+		return Job{}, errors.New("a job needs a name, a cron expression and a task")
+	}
+
+	job := Job{Name: fields[0]}
+
+	// the shorthands are a single field, the expressions five
+	cronFields := 1
+	if !strings.HasPrefix(fields[1], "@") {
+		cronFields = 5
+	}
+	if len(fields) < 2+cronFields {
+		return Job{}, errors.New("a job needs a name, a cron expression and a task")
+	}
+
+	job.Cron = strings.Join(fields[1:1+cronFields], " ")
+	job.Task = fields[1+cronFields]
+	taskArgs := fields[2+cronFields:]
+
+	switch job.Task {
+	case AnnounceTask:
+		if len(taskArgs) < 2 {
+			return Job{}, errors.New("announce needs a conversation, or * for everyone, and a text")
+		}
+
+		if taskArgs[0] != "*" {
+			job.Conversation = taskArgs[0]
+		}
+		job.Text = strings.Join(taskArgs[1:], " ")
+	case PruneTask:
+		if len(taskArgs) != 1 {
+			return Job{}, errors.New("prune needs the days of history to keep")
+		}
+
+		days, err := strconv.Atoi(taskArgs[0])
+		if err != nil {
+			return Job{}, errors.New("prune needs the days of history to keep")
+		}
+		job.KeepDays = days
+	}
+
+	return job, nil
+}
+
+func listJobs(out io.Writer) error {
+	jobs := schedule.jobs()
+	if len(jobs) == 0 {
+		fmt.Fprintln(out, "No jobs scheduled")
+		return nil
+	}
+
+	now := time.Now()
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCRON\tTASK\tLAST RUN\tNEXT RUN")
+	for _, job := range jobs {
+		last := "never"
+		if at, ok := schedule.lastRun(job.Name); ok {
+			last = at.Format(time.DateTime)
+		}
+
+		next := "never"
+		if cron, err := parseCron(job.Cron); err == nil {
+			if at, ok := cron.next(now); ok {
+				next = at.Format(time.DateTime)
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", job.Name, job.Cron, job.Task, last, next)
+	}
+
+	return w.Flush()
+}
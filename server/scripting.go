@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// scriptMaxSteps is how many steps of computation a script may take on every event, so that a
+// loop that never ends doesn't hang the messages of everyone
+const scriptMaxSteps = 1_000_000
+
+// scriptRepliesKey is where the replies of the event being handled are kept on the thread
+const scriptRepliesKey = "replies"
+
+// script is a Starlark script of the scripts directory. It's called on events with the
+// functions it defines, on_message(message) and on_join(user, conversation), one event at a time.
+// Scripts can't read files, reach the network or run programs: all they have is the language
+// and what builtins gives them
+type script struct {
+	name    string
+	globals starlark.StringDict
+
+	// mu keeps events from changing state at the same time
+	mu sync.Mutex
+	// state is kept across the events, until the configuration is reloaded
+	state *starlark.Dict
+}
+
+// scriptReply is a system message a script sends to a conversation
+type scriptReply struct {
+	conversation string
+	text         string
+}
+
+// scriptVerdict is what block(reason) and flag(reason) return, for on_message to return
+type scriptVerdict struct {
+	block  bool
+	reason string
+}
+
+func (sv scriptVerdict) String() string {
+	if sv.block {
+		return fmt.Sprintf("block(%q)", sv.reason)
+	}
+
+	return fmt.Sprintf("flag(%q)", sv.reason)
+}
+
+func (sv scriptVerdict) Type() string {
+	return "verdict"
+}
+
+func (sv scriptVerdict) Freeze() {}
+
+func (sv scriptVerdict) Truth() starlark.Bool {
+	return starlark.True
+}
+
+func (sv scriptVerdict) Hash() (uint32, error) {
+	return 0, errors.New("unhashable type: verdict")
+}
+
+// loadScripts runs the scripts of dir, the files ending in .star, in the order of their names
+func loadScripts(dir string) ([]*script, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the scripts: %s", err.Error())
+	}
+
+	scripts := []*script{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".star") {
+			continue
+		}
+
+		sc := &script{name: entry.Name(), state: starlark.NewDict(0)}
+
+		path := filepath.Join(dir, entry.Name())
+		sc.globals, err = starlark.ExecFileOptions(&syntax.FileOptions{While: true, Recursion: true},
+			sc.thread(), path, nil, sc.builtins())
+		if err != nil {
+			return nil, fmt.Errorf("script %s failed: %s", path, err.Error())
+		}
+
+		scripts = append(scripts, sc)
+	}
+
+	return scripts, nil
+}
+
+func (sc *script) thread() *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: sc.name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("Script %s: %s\n", sc.name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+
+	return thread
+}
+
+// builtins are all the script gets from the server:
+//
+//	reply(conversation, text)  sends text to the conversation, by nickname, as a system message
+//	block(reason="")           for on_message to return, refusing the message
+//	flag(reason="")            for on_message to return, reporting the message to the moderators
+//	randint(a, b)              a random integer between a and b, both included
+//	state                      a dict kept across events
+func (sc *script) builtins() starlark.StringDict {
+	return starlark.StringDict{
+		"reply":   starlark.NewBuiltin("reply", scriptReplyBuiltin),
+		"block":   starlark.NewBuiltin("block", scriptVerdictBuiltin(true)),
+		"flag":    starlark.NewBuiltin("flag", scriptVerdictBuiltin(false)),
+		"randint": starlark.NewBuiltin("randint", scriptRandintBuiltin),
+		"state":   sc.state,
+	}
+}
+
+func scriptReplyBuiltin(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var conversation, text string
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "conversation", &conversation, "text", &text)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, ok := thread.Local(scriptRepliesKey).(*[]scriptReply)
+	if !ok {
+		return nil, errors.New("reply: only on_message and on_join can reply")
+	}
+
+	*replies = append(*replies, scriptReply{conversation: conversation, text: text})
+
+	return starlark.None, nil
+}
+
+func scriptVerdictBuiltin(block bool) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		reason := ""
+		err := starlark.UnpackArgs(fn.Name(), args, kwargs, "reason?", &reason)
+		if err != nil {
+			return nil, err
+		}
+
+		return scriptVerdict{block: block, reason: reason}, nil
+	}
+}
+
+func scriptRandintBuiltin(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var a, b int
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs, "a", &a, "b", &b)
+	if err != nil {
+		return nil, err
+	}
+
+	if a > b {
+		return nil, fmt.Errorf("randint: %d is more than %d", a, b)
+	}
+
+	return starlark.MakeInt(a + rand.IntN(b-a+1)), nil
+}
+
+// call calls the function of the script named fn, if it has one, with args, returning what it
+// returned and the replies it made. It gives up once ctx is done
+func (sc *script) call(ctx context.Context, fn string, args starlark.Tuple) (starlark.Value, []scriptReply, error) {
+	f, ok := sc.globals[fn]
+	if !ok {
+		return starlark.None, nil, nil
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	replies := []scriptReply{}
+	thread := sc.thread()
+	thread.SetLocal(scriptRepliesKey, &replies)
+
+	stop := context.AfterFunc(ctx, func() {
+		thread.Cancel(ctx.Err().Error())
+	})
+	defer stop()
+
+	result, err := starlark.Call(thread, f, args, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("script %s: %s", sc.name, err.Error())
+	}
+
+	return result, replies, nil
+}
+
+// Filter has the script's on_message see the message. It returns nothing to leave the message
+// alone, the text to deliver instead, or what block() or flag() return
+func (sc *script) Filter(ctx context.Context, message common.Message) (FilterResult, error) {
+	sender, conversation := "", ""
+	if message.Sender != nil {
+		sender = message.Sender.Name
+	}
+	if message.Conversation != nil {
+		conversation = message.Conversation.Nickname
+	}
+
+	arg := starlarkstruct.FromStringDict(starlark.String("message"), starlark.StringDict{
+		"text":         starlark.String(message.Text),
+		"sender":       starlark.String(sender),
+		"conversation": starlark.String(conversation),
+		"kind":         starlark.String(common.KindOf(message)),
+	})
+
+	value, replies, err := sc.call(ctx, "on_message", starlark.Tuple{arg})
+	if err != nil {
+		return FilterResult{}, err
+	}
+
+	result := FilterResult{Text: message.Text, replies: replies}
+	switch value := value.(type) {
+	case starlark.NoneType:
+	case starlark.String:
+		result.Text = string(value)
+	case scriptVerdict:
+		result.Block = value.block
+		result.Flag = !value.block
+		result.Reason = value.reason
+	default:
+		return result, fmt.Errorf("script %s: on_message returned a %s", sc.name, value.Type())
+	}
+
+	return result, nil
+}
+
+// scriptsJoined has the scripts' on_join know that the user named name joined a conversation
+func scriptsJoined(ctx context.Context, name string, conversationID uuid.UUID) {
+	conversation, ok := conversations.get(conversationID)
+	// the server keeps out of encrypted conversations
+	if !ok || conversation.Encrypted {
+		return
+	}
+
+	for _, sc := range currentConfig.loadedScripts() {
+		_, replies, err := sc.call(ctx, "on_join", starlark.Tuple{starlark.String(name), starlark.String(conversation.Nickname)})
+		if err != nil {
+			common.Errorf("%s\n", err.Error())
+			continue
+		}
+
+		sendScriptReplies(replies)
+	}
+}
+
+// sendScriptReplies sends the replies of scripts to the conversations they're for
+func sendScriptReplies(replies []scriptReply) {
+	for _, reply := range replies {
+		conversation, ok := conversations.getByNickname(reply.conversation)
+		if !ok || conversation.Archived || conversation.Encrypted || reply.text == "" {
+			continue
+		}
+
+		sendSystemMessage(conversation, reply.text)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// defaultSearchLimit is how many messages a page of search results has when the search doesn't
+// say, and maxSearchLimit the most it may ask for
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// handleSearch finds the messages of the history that match the search, leaving out those of
+// deleted conversations, of those the session's client may not read and of the users it blocked
+func handleSearch(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	search := common.Search{}
+
+	err := json.Unmarshal(*op.Message, &search)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Search: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	conversationID := uuid.Nil
+	if search.Conversation != "" {
+		conversation, ok := conversations.getByNickname(search.Conversation)
+		if !ok {
+			return nil, &common.Error{
+				Code:    common.NotFoundErrorCode,
+				Message: fmt.Sprintf("conversation '%s' does not exist", search.Conversation),
+			}
+		}
+
+		conversationID = conversation.ID
+	}
+
+	cursor := uuid.Nil
+	if search.Cursor != "" {
+		cursor, err = uuid.Parse(search.Cursor)
+		if err != nil {
+			return nil, &common.Error{Code: common.NotFoundErrorCode, Message: "invalid search cursor"}
+		}
+	}
+
+	limit := search.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+
+	text := strings.ToLower(search.Text)
+
+	match := func(message common.Message) bool {
+		if message.Conversation == nil || message.Sender == nil {
+			return false
+		}
+		if conversationID != uuid.Nil && message.Conversation.ID != conversationID {
+			return false
+		}
+		if search.Sender != "" && message.Sender.Name != search.Sender {
+			return false
+		}
+		if search.After != nil && !message.Timestamp.After(*search.After) {
+			return false
+		}
+		if search.Before != nil && !message.Timestamp.Before(*search.Before) {
+			return false
+		}
+		if text != "" && !strings.Contains(strings.ToLower(message.Text), text) {
+			return false
+		}
+		if search.Kind != "" && common.KindOf(message) != search.Kind {
+			return false
+		}
+		if conversation, exists := conversations.get(message.Conversation.ID); !exists || !canAccess(conversation, s, common.ReadAccess) {
+			return false
+		}
+
+		return !blocksSender(s, message)
+	}
+
+	found, more, err := messages.search(ctx, match, cursor, limit)
+	if errors.Is(err, errCursorGone) {
+		return nil, &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: "the search cursor is gone from the history, start the search over",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := common.SearchResults{Messages: []common.Message{}}
+	for _, message := range found {
+		// messages keep the nickname their conversation had when they were sent
+		conversation, ok := conversations.get(message.Conversation.ID)
+		if !ok {
+			// deleted since it matched
+			continue
+		}
+
+		message.Conversation = &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname}
+		results.Messages = append(results.Messages, message)
+	}
+
+	if more && len(found) > 0 {
+		results.NextCursor = found[len(found)-1].ID.String()
+	}
+
+	return marshalResponse(results)
+}
@@ -2,14 +2,19 @@ package server
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strconv"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/nikochiko/tcpchat/common"
@@ -19,110 +24,196 @@ const (
 	unmarshalingError = "Error while unmarshaling data. Please check again"
 )
 
-var conversationIDs = map[uuid.UUID]bool{}
-var conversations = []*common.Conversation{}
-var conversationsByNickname = map[string]*common.Conversation{}
+// wireTracer logs the frames of every TCP connection, when set by TraceWire
+var wireTracer *common.WireTracer
 
-var messagesChannel = make(chan common.Message)
+// TraceWire has the frames of the TCP connections served from now on logged by t
+func TraceWire(t *common.WireTracer) {
+	wireTracer = t
+}
+
+// Listen starts listening on the given service ("host:port") for TCP connections, over TLS
+// if the configuration has a certificate. network is one of common.Networks. Once ctx is done,
+// it stops listening, closes the connections and returns when they've been handled
+func Listen(ctx context.Context, network, service string) error {
+	err := common.CheckNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	listener, err := listen(network, service)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Started listening on %s\n", listener.Addr())
+
+	return Serve(ctx, listener)
+}
+
+// Serve serves the clients that connect through listener, like Listen does once it's listening.
+// It takes any listener, like a common.PipeListener to serve clients in the same process
+func Serve(ctx context.Context, listener net.Listener) error {
+	if injectedChaos.enabled() {
+		log.Printf("Chaos is on: responses will be delayed, cut, garbled and dropped on purpose\n")
+	}
+
+	err := joinCluster(ctx)
+	if err != nil {
+		return err
+	}
 
-// Listen starts listening on the given service ("host:port") for TCP connections
-func Listen(service string) error {
-	laddr, err := net.ResolveTCPAddr("tcp4", service)
-	common.CheckError(err)
+	go runDigests(ctx)
+	go runEmailDigests(ctx)
+	go runBridges(ctx)
+	go runFanout(ctx)
+	go connections.enforceTimeouts(ctx)
+	go schedule.runSchedule(ctx)
 
-	listener, err := net.ListenTCP("tcp", laddr)
-	common.CheckError(err)
+	go func() {
+		select {
+		case <-draining.done:
+		case <-ctx.Done():
+		}
+		listener.Close()
+	}()
 
-	fmt.Printf("Started listening on %s\n", laddr)
+	var handled sync.WaitGroup
 
-	// start listening indefinitely
+	// listen until the server has been drained or shut down
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-draining.done:
+				return nil
+			case <-ctx.Done():
+				handled.Wait()
+				return nil
+			default:
+			}
+
 			// we don't want to stop the server now, so just log and continue
-			log.Printf("Error while accepting connection: %s", err.Error())
+			common.Errorf("Error while accepting connection: %s", err.Error())
 
 			continue
 		}
 
-		go handleConnection(conn)
+		if draining.isActive() {
+			go draining.redirect(&tcpWriter{conn: conn})
+			continue
+		}
+
+		handled.Go(func() {
+			handleConnection(ctx, conn)
+		})
 	}
 }
 
-func handleConnection(conn net.Conn) {
+// tcpWriter writes responses as frames on a TCP connection
+type tcpWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *tcpWriter) writeResponse(response *common.Response) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.conn.SetWriteDeadline(deadline(currentConfig.tcp().WriteTimeout))
+
+	return common.WriteFrame(w.conn, response)
+}
+
+func (w *tcpWriter) writeFrame(frame []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.conn.SetWriteDeadline(deadline(currentConfig.tcp().WriteTimeout))
+	_, err := w.conn.Write(frame)
+
+	return err
+}
+
+func (w *tcpWriter) close() error {
+	return w.conn.Close()
+}
+
+func handleConnection(ctx context.Context, conn net.Conn) {
+	// the TLS connection, for the client's certificate, is under the tracing
+	tlsConn, isTLS := conn.(*tls.Conn)
+	// the trace is of what goes on the wire, faults included
+	conn = injectedChaos.wrap(wireTracer.Trace(conn))
+
+	s := newSession(ctx, &tcpWriter{conn: conn}, conn.RemoteAddr())
+	s.local = isLoopback(conn.RemoteAddr())
+	defer recoverSession(s)
+
+	err := s.sendChallenge()
+	if err != nil {
+		return
+	}
+
 	connReader := bufio.NewReader(conn)
 	request, err := common.ReadUntil(connReader, common.EOFBytes)
+	// closed before the handshake, e.g. for taking too long
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return
+	}
 	if common.CheckErrorAndLog(err) {
-		writeErrorResponse(conn, "Some error occurred")
+		s.writeError(errors.New("Some error occurred"))
 		return
 	}
 
 	operation, err := getOperation(request)
 	if common.CheckErrorAndLog(err) {
-		writeErrorResponse(conn, err.Error())
+		s.writeError(err)
 		return
 	}
 
-	aboutClient, err := ParseClientAboutMe(*operation.Message)
-	if common.CheckErrorAndLog(err) {
-		writeErrorResponse(conn, err.Error())
-		return
+	// the TLS handshake is done by the first read
+	if isTLS {
+		state := tlsConn.ConnectionState()
+		s.certificate = clientCertificate(&state)
 	}
 
-	err = sendAboutMeResponse(conn, aboutClient)
+	err = s.handshake(operation)
 	if common.CheckErrorAndLog(err) {
-		writeErrorResponse(conn, err.Error())
+		s.writeError(err)
 		return
 	}
 
-	log.Printf("New connection received from client: %v\n", aboutClient)
-
-	conversationsToListenOn := map[uuid.UUID]bool{}
-
-	quit := make(chan bool)
-	go subscribeToMessages(conn, conversationsToListenOn, quit)
-	defer func() {
-		quit <- true
-	}()
+	defer s.close()
 
 	for {
-		request, err := common.ReadUntil(connReader, common.EOFBytes)
-		if err == io.EOF {
-			log.Printf("connection closed. exiting function\n")
+		readTimeout := currentConfig.tcp().ReadTimeout
+		conn.SetReadDeadline(deadline(readTimeout))
+
+		frame, err := common.ReadFrame(connReader)
+		// closed by the client, or by the session itself (io.ErrClosedPipe for in-process ones)
+		if err == io.EOF || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+			common.Debugf("connection closed. exiting function\n")
 			break
-		} else {
-			common.CheckErrorAndLog(err)
 		}
-
-		operation, err := getOperation(request)
-		if common.CheckErrorAndLog(err) {
-			writeErrorResponse(conn, err.Error())
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("Closing the connection of %v at %v, silent for %ds\n", s.client, s.addr, readTimeout)
 			break
 		}
-
-		emptyJSON := json.RawMessage("{}")
-		var response = &emptyJSON
-
-		switch operation.Type {
-		case common.CreateOperationType:
-			err = handleCreateConversation(operation)
-		case common.SubscribeOperationType:
-			err = handleSubscribe(operation, conversationsToListenOn)
-		case common.MessageOperationType:
-			response, err = handleMessage(operation)
-		case common.ListOperationType:
-			response, err = handleListConversations(operation)
+		if common.CheckErrorAndLog(err) {
+			break
 		}
 
-		if err != nil {
-			writeErrorResponse(conn, err.Error())
+		// the operation has its own copy of the message, so the frame can go back to the pool
+		operation, err := getOperation(frame.Bytes())
+		frame.Release()
+		if common.CheckErrorAndLog(err) {
+			s.writeError(err)
 			break
 		}
 
-		err = writeOKResponse(conn, response, operation.Type)
-
+		err = s.handle(operation)
 		if err != nil {
-			writeErrorResponse(conn, err.Error())
+			s.writeError(err)
 			break
 		}
 	}
@@ -130,191 +221,547 @@ func handleConnection(conn net.Conn) {
 	return
 }
 
-func subscribeToMessages(conn net.Conn, conversationsToListenOn map[uuid.UUID]bool, quit chan bool) {
-	for {
-		select {
-		case <-quit:
-			return
-		case message := <-messagesChannel:
-			if conversationsToListenOn[message.Conversation.ID] {
-				responseBytes, err := json.Marshal(message)
-				if err != nil {
-					log.Printf("error while marshaling message: %s\n", err.Error())
-
-					// let's continue listening for other messages
-					continue
-				}
-
-				responseJSON := json.RawMessage(responseBytes)
-				writeOKResponse(conn, &responseJSON, common.MessageOperationType)
-			}
-		}
+// deadline is the deadline of an I/O that may take the given number of seconds, or none for zero
+func deadline(seconds int) time.Time {
+	if seconds == 0 {
+		return time.Time{}
 	}
+
+	return time.Now().Add(time.Duration(seconds) * time.Second)
 }
 
-func sendAboutMeResponse(conn net.Conn, aboutClient *common.ClientAboutMe) error {
-	b, err := json.Marshal(aboutClient)
+// sendAboutMeResponse answers the handshake of aboutClient, telling it about the rate limit and
+// how many queued messages are about to follow
+func sendAboutMeResponse(s *session, aboutClient *common.ClientAboutMe, queued int) error {
+	response, err := aboutMeResponse(aboutClient, queued)
 	if err != nil {
-		log.Printf("Error: %s\n", err.Error())
 		return err
 	}
 
+	return s.writer.writeResponse(response)
+}
+
+// aboutMeResponse is the response to the handshake of aboutClient, with the rate limit
+func aboutMeResponse(aboutClient *common.ClientAboutMe, queued int) (*common.Response, error) {
+	b, err := json.Marshal(aboutClient)
+	if err != nil {
+		common.Errorf("Error: %s\n", err.Error())
+		return nil, err
+	}
+
 	jsonAboutClient := json.RawMessage(b)
 
-	writeOKResponse(conn, &jsonAboutClient, common.AboutMeOperationType)
+	response := newOKResponse(&jsonAboutClient, common.AboutMeOperationType)
+	limit := currentConfig.rateLimit()
+	response.RateLimit = &limit
+	response.Queued = queued
 
-	return nil
+	return &response, nil
 }
 
-func handleCreateConversation(op *common.Operation) error {
+func handleCreateConversation(ctx context.Context, op *common.Operation, s *session) error {
 	conversation := &common.Conversation{}
 
 	err := json.Unmarshal(*op.Message, conversation)
 	if err != nil {
-		log.Printf("Unmarshaling error while parsing Conversation: %s\n", err.Error())
+		common.Errorf("Unmarshaling error while parsing Conversation: %s\n", err.Error())
 		return errors.New(unmarshalingError)
 	}
 
-	conversation.ID = uuid.New()
+	// the store gives the conversations without a nickname one
+	if conversation.Nickname != "" {
+		conversation.Nickname, err = normalizeNickname(conversation.Nickname, "nickname")
+		if err != nil {
+			return err
+		}
+	}
 
-	if conversation.Nickname == "" {
-		conversation.Nickname = strconv.Itoa(len(conversations))
+	// whoever creates a conversation owns it, and the rest is up to the owner later on
+	conversation.Owner = s.client.ID
+	conversation.Moderators = nil
+	conversation.Topic = cleanTopic(conversation.Topic)
+
+	limits := currentConfig.limits()
+	if s.admin {
+		limits = Limits{}
 	}
 
-	if _, ok := conversationsByNickname[conversation.Nickname]; ok {
-		err := fmt.Sprintf("conversation with nickname '%s' already exists", conversation.Nickname)
-		return errors.New(err)
+	err = conversations.addWithin(conversation, limits)
+	if err != nil {
+		return err
 	}
 
-	conversations = append(conversations, conversation)
-	conversationIDs[conversation.ID] = true
-	conversationsByNickname[conversation.Nickname] = conversation
+	auditLog.record(s.actor(), common.CreateOperationType, conversation.Nickname, "")
+	shareConversation(conversation)
+	announceConversation(conversation)
 
 	return nil
 }
 
-func handleListConversations(op *common.Operation) (*json.RawMessage, error) {
-	emptyJSON := json.RawMessage("{}")
+// handleSubscribe subscribes the session to a conversation, responding with the
+// conversation so that the client can show its topic, and catch up from its LastSeq
+func handleSubscribe(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	inputConversation := &common.Conversation{}
+
+	err := json.Unmarshal(*op.Message, inputConversation)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Conversation: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	nickname := inputConversation.Nickname
+	conversation, ok := conversations.getByNickname(nickname)
+	if !ok {
+		err := fmt.Sprintf("conversation '%s' does not exist", nickname)
+		return nil, errors.New(err)
+	}
+
+	return subscribeTo(conversation, s)
+}
+
+// subscribeTo subscribes the session to conversation if it may, and responds like subscribe
+func subscribeTo(conversation *common.Conversation, s *session) (*json.RawMessage, error) {
+	err := checkGuestAccess(conversation, s)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkAccess(conversation, s, common.ReadAccess)
+	if err != nil {
+		return nil, err
+	}
 
-	conversationsJSON, err := json.Marshal(conversations)
+	err = checkCanDecrypt(conversation, s)
 	if err != nil {
-		return &emptyJSON, err
+		return nil, err
 	}
 
-	responseMessage := json.RawMessage(conversationsJSON)
+	maxSubscribers := currentConfig.limits().MaxSubscribers
+	if s.admin {
+		maxSubscribers = 0
+	}
+
+	joined := !slices.Contains(users.subscribers(conversation.ID), s.client.ID)
+	if !users.subscribedWithin(s.client.ID, conversation.ID, maxSubscribers) {
+		return nil, &common.Error{
+			Code:    common.LimitExceededErrorCode,
+			Message: fmt.Sprintf("'%s' can't have more than %d subscribers", conversation.Nickname, maxSubscribers),
+		}
+	}
+
+	s.subscribe(conversation.ID)
 
-	return &responseMessage, err
+	if conversation.Encrypted {
+		conversationKeys.subscribed(conversation, s, joined)
+	}
+
+	// a copy, as the stored conversation is shared
+	subscribed := *conversation
+	subscribed.LastSeq = messages.lastSeq(conversation.ID)
+
+	return marshalResponse(subscribed)
 }
 
-func handleSubscribe(op *common.Operation, conversationsToListenOn map[uuid.UUID]bool) error {
+func handleUnsubscribe(ctx context.Context, op *common.Operation, s *session) error {
 	inputConversation := &common.Conversation{}
 
 	err := json.Unmarshal(*op.Message, inputConversation)
 	if err != nil {
-		log.Printf("Unmarshaling error while parsing Conversation: %s\n", err.Error())
+		common.Errorf("Unmarshaling error while parsing Conversation: %s\n", err.Error())
 		return errors.New(unmarshalingError)
 	}
 
-	nickname := inputConversation.Nickname
-	conversation, ok := conversationsByNickname[nickname]
+	conversation, ok := conversations.getByNickname(inputConversation.Nickname)
 	if !ok {
-		err := fmt.Sprintf("conversation '%s' does not exist", nickname)
+		err := fmt.Sprintf("conversation '%s' does not exist", inputConversation.Nickname)
 		return errors.New(err)
 	}
 
-	convID := conversation.ID
-	conversationsToListenOn[convID] = true
+	left := slices.Contains(users.subscribers(conversation.ID), s.client.ID)
+	s.unsubscribe(conversation.ID)
+
+	if conversation.Encrypted && left {
+		conversationKeys.membersChanged(conversation)
+	}
 
 	return nil
 }
 
-func handleMessage(op *common.Operation) (*json.RawMessage, error) {
-	message := json.RawMessage("{}")
-	convMessage := common.Message{}
+// handleTopic responds with the conversation of the topic operation, after changing its
+// topic if the operation has one and the client may do so
+func handleTopic(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	topic := &common.Topic{}
 
-	err := json.Unmarshal(*op.Message, &convMessage)
+	err := json.Unmarshal(*op.Message, topic)
 	if err != nil {
-		log.Printf("Unmarshaling error while parsing Message: %s\n", err.Error())
-		return &message, errors.New(unmarshalingError)
+		common.Errorf("Unmarshaling error while parsing Topic: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	conversation, ok := conversations.getByNickname(topic.Nickname)
+	if !ok {
+		err := fmt.Sprintf("conversation '%s' does not exist", topic.Nickname)
+		return nil, errors.New(err)
 	}
 
-	log.Printf("Got message: %s\n", string(*op.Message))
+	if topic.Topic == nil {
+		return marshalResponse(conversation)
+	}
 
-	messagesChannel <- convMessage
+	if !conversation.CanModerate(s.client.ID) && !s.admin {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("only the owner or a moderator of '%s' can set its topic", conversation.Nickname),
+		}
+	}
 
-	return &message, nil
+	conversation, err = conversations.update(conversation.Nickname, func(c *common.Conversation) {
+		c.Topic = cleanTopic(*topic.Topic)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog.record(s.actor(), common.TopicOperationType, conversation.Nickname, conversation.Topic)
+	messageRouter.publish(conversation.ID, common.TopicOperationType, conversation)
+
+	// subscribers get the conversation with the new topic from publish already
+	if s.isSubscribed(conversation.ID) {
+		emptyJSON := json.RawMessage("{}")
+		return &emptyJSON, nil
+	}
+
+	return marshalResponse(conversation)
 }
 
-// ParseClientAboutMe parses the data first sent by Client to introduce themselves
-func ParseClientAboutMe(b []byte) (*common.ClientAboutMe, error) {
-	aboutClient := &common.ClientAboutMe{ID: uuid.New()}
+// ownedConversation returns the conversation with the given nickname if the session's client
+// owns it, or is an admin, so that it may do action to it
+func ownedConversation(nickname string, s *session, action string) (*common.Conversation, error) {
+	conversation, ok := conversations.getByNickname(nickname)
+	if !ok {
+		err := fmt.Sprintf("conversation '%s' does not exist", nickname)
+		return nil, errors.New(err)
+	}
 
-	log.Printf("got about me: %s\n", string(b))
+	if conversation.Owner != s.client.ID && !s.admin {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("only the owner of '%s' can %s it", nickname, action),
+		}
+	}
 
-	err := json.Unmarshal(b, aboutClient)
+	return conversation, nil
+}
+
+func handleRename(ctx context.Context, op *common.Operation, s *session) error {
+	rename := &common.Rename{}
+
+	err := json.Unmarshal(*op.Message, rename)
 	if err != nil {
-		log.Printf("Unmarshaling error while parsing ClientAboutMe: %s\n", err.Error())
-		return aboutClient, errors.New(unmarshalingError)
+		common.Errorf("Unmarshaling error while parsing Rename: %s\n", err.Error())
+		return errors.New(unmarshalingError)
 	}
 
-	return aboutClient, nil
+	rename.NewNickname, err = normalizeNickname(rename.NewNickname, "nickname")
+	if err != nil {
+		return err
+	}
+
+	_, err = ownedConversation(rename.Nickname, s, "rename")
+	if err != nil {
+		return err
+	}
+
+	conversation, err := conversations.update(rename.Nickname, func(c *common.Conversation) {
+		c.Nickname = rename.NewNickname
+	})
+	if err != nil {
+		return err
+	}
+
+	auditLog.record(s.actor(), common.RenameOperationType, rename.Nickname, "to "+conversation.Nickname)
+	messageRouter.publish(conversation.ID, common.RenameOperationType, rename)
+
+	return nil
 }
 
-func getOperation(b []byte) (*common.Operation, error) {
-	operation := &common.Operation{}
+func handleArchive(ctx context.Context, op *common.Operation, s *session) error {
+	archive := &common.Archive{}
 
-	err := json.Unmarshal(b, operation)
+	err := json.Unmarshal(*op.Message, archive)
 	if err != nil {
-		log.Printf("Unmarshaling error while parsing Operation: %s\n", err.Error())
-		return operation, errors.New(unmarshalingError)
+		common.Errorf("Unmarshaling error while parsing Archive: %s\n", err.Error())
+		return errors.New(unmarshalingError)
 	}
 
-	return operation, nil
+	_, err = ownedConversation(archive.Nickname, s, "archive")
+	if err != nil {
+		return err
+	}
+
+	conversation, err := conversations.update(archive.Nickname, func(c *common.Conversation) {
+		c.Archived = archive.Archived
+	})
+	if err != nil {
+		return err
+	}
+
+	action := "unarchive"
+	if archive.Archived {
+		action = common.ArchiveOperationType
+	}
+	auditLog.record(s.actor(), action, conversation.Nickname, "")
+	messageRouter.publish(conversation.ID, common.ArchiveOperationType, conversation)
+
+	return nil
 }
 
-func writeErrorResponse(conn net.Conn, s string) {
-	defer conn.Close()
+func handleDelete(ctx context.Context, op *common.Operation, s *session) error {
+	inputConversation := &common.Conversation{}
+
+	err := json.Unmarshal(*op.Message, inputConversation)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Conversation: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	_, err = ownedConversation(inputConversation.Nickname, s, "delete")
+	if err != nil {
+		return err
+	}
+
+	conversation, err := conversations.remove(inputConversation.Nickname)
+	if err != nil {
+		return err
+	}
+
+	slowMode.forget(conversation.ID)
+	membership.forget(conversation.ID)
+	conversationKeys.forget(conversation.ID)
+	invites.forget(conversation.ID)
+
+	auditLog.record(s.actor(), common.DeleteOperationType, conversation.Nickname, "")
+	messageRouter.publish(conversation.ID, common.DeleteOperationType, conversation)
 
-	errorMessage := common.Error{Message: s}
-	response := common.NewResponse()
-	response.Status = "error"
-	response.Error = &errorMessage
+	return nil
+}
 
-	responseBytes, err := json.Marshal(response)
+// marshalResponse turns v into the message of an OK response
+func marshalResponse(v interface{}) (*json.RawMessage, error) {
+	b, err := json.Marshal(v)
 	if err != nil {
-		log.Printf("Got another error while writing one error: %s", err.Error())
+		return nil, err
 	}
 
-	conn.Write(responseBytes)
-	conn.Write(common.EOFBytes)
-	conn.Close()
+	message := json.RawMessage(b)
+
+	return &message, nil
 }
 
-func writeOKResponse(conn net.Conn, message *json.RawMessage, operationType string) error {
-	response := common.NewResponse()
-	response.Status = "ok"
+func handleMessage(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	message := json.RawMessage("{}")
+	convMessage := common.Message{}
+
+	err := json.Unmarshal(*op.Message, &convMessage)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Message: %s\n", err.Error())
+		return &message, errors.New(unmarshalingError)
+	}
+
+	common.Debugf("Got message: %s\n", string(*op.Message))
+
+	// the key is between the client and us, and a key we've seen means the client sent the
+	// message again without knowing that it went through the first time
+	key := convMessage.Key
+	convMessage.Key = ""
+	if key != "" && messageKeys.seen(s.client.ID, key) {
+		return marshalResponse(common.MessageAck{Key: key})
+	}
+
+	if convMessage.Recipient != nil {
+		if s.guest {
+			return &message, &common.Error{Code: common.ForbiddenErrorCode, Message: "guests can't send direct messages, log in first"}
+		}
 
-	if operationType != "" {
-		response.OperationType = operationType
+		return handleDirect(ctx, convMessage, key, s)
 	}
 
-	if !bytes.Equal(*message, []byte{}) {
-		response.Message = message
+	if convMessage.Conversation == nil {
+		return &message, errors.New("message has no conversation")
 	}
 
-	log.Printf("Message: %s\n", string(*message))
+	conversation, ok := conversations.get(convMessage.Conversation.ID)
+	if !ok {
+		return &message, &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: fmt.Sprintf("conversation '%s' does not exist", convMessage.Conversation.Nickname),
+		}
+	}
 
-	responseBytes, err := json.Marshal(response)
+	if conversation.Archived {
+		return &message, &common.Error{
+			Code:    common.ArchivedErrorCode,
+			Message: fmt.Sprintf("conversation '%s' is archived", conversation.Nickname),
+		}
+	}
+
+	err = checkGuestMessage(conversation, s)
 	if err != nil {
-		log.Printf("Got an error while marshaling an OK response: %s", err.Error())
-		err := errors.New("Something went wrong")
-		return err
+		return &message, err
 	}
 
-	_, err = conn.Write(append(responseBytes, common.EOFBytes...))
+	err = checkAccess(conversation, s, common.WriteAccess)
 	if err != nil {
-		return err
+		return &message, err
+	}
+
+	// the client may know the conversation by an old nickname
+	convMessage.Conversation = &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname}
+	// the sender is whoever is on this session, whatever the client says, so that reports and
+	// moderators get it right
+	convMessage.Sender = s.sender()
+	convMessage.Kind = common.KindOf(convMessage)
+
+	signedText := convMessage.Text
+	err = checkSignature(&convMessage, s)
+	if err != nil {
+		return &message, err
+	}
+
+	switch {
+	case conversation.Encrypted:
+		err = checkSealed(&convMessage, conversation)
+	case len(convMessage.Box) > 0:
+		err = &common.Error{
+			Code:    common.EncryptionErrorCode,
+			Message: fmt.Sprintf("conversation '%s' isn't encrypted", conversation.Nickname),
+		}
+	default:
+		convMessage.Text, err = cleanText(convMessage.Text, currentConfig.maxMessageLength())
+	}
+	if err != nil {
+		return &message, err
+	}
+
+	err = checkSlowMode(conversation, s)
+	if err != nil {
+		return &message, err
+	}
+
+	// commands are run instead of delivered, which they can't be in encrypted conversations,
+	// where the server can't read them
+	if !conversation.Encrypted {
+		result, ran, err := runCommand(ctx, convMessage)
+		if err != nil {
+			return &message, err
+		}
+
+		if ran && result.System {
+			if result.Text != "" {
+				sendSystemMessage(conversation, result.Text)
+			}
+			if key != "" {
+				messageKeys.remember(s.client.ID, key)
+			}
+
+			return marshalResponse(common.MessageAck{Key: key})
+		}
+
+		if ran {
+			convMessage.Text, err = cleanText(result.Text, currentConfig.maxMessageLength())
+			if err != nil {
+				return &message, err
+			}
+
+			convMessage.Kind = common.UserMessageKind
+			if result.Action {
+				convMessage.Kind = common.ActionMessageKind
+			}
+		}
+	}
+
+	// the server can't read encrypted messages, let alone filter them
+	verdict := FilterResult{}
+	if !conversation.Encrypted {
+		verdict, err = filterMessage(ctx, convMessage)
+	}
+	if err != nil {
+		// a broken filter shouldn't stop the chat, so the message goes through as it is
+		common.Errorf("Error while filtering a message from %v: %s\n", s.client, err.Error())
+	} else {
+		if verdict.Block {
+			sendScriptReplies(verdict.replies)
+			return &message, &common.Error{
+				Code:    common.FilteredErrorCode,
+				Message: "message was blocked by the server's content filter",
+			}
+		}
+
+		convMessage.Text = verdict.Text
+	}
+
+	if convMessage.Text != signedText {
+		convMessage.Signature = nil
+	}
+
+	convMessage = publishMessage(convMessage, nil)
+	if verdict.Flag {
+		reports.add(convMessage, serverSender, verdict.Reason)
+		notifyWebhooks(WebhookEvent{Event: ReportWebhookEvent, Conversation: convMessage.Conversation, Message: &convMessage,
+			User: webhookUser(serverSender), Details: verdict.Reason})
+	}
+	sendScriptReplies(verdict.replies)
+
+	if key != "" {
+		messageKeys.remember(s.client.ID, key)
+	}
+
+	return marshalResponse(common.MessageAck{Key: key})
+}
+
+// ParseClientAboutMe parses the data first sent by Client to introduce themselves
+func ParseClientAboutMe(b []byte) (*common.ClientAboutMe, error) {
+	aboutClient := &common.ClientAboutMe{ID: uuid.New()}
+
+	common.Debugf("got about me: %s\n", string(b))
+
+	err := json.Unmarshal(b, aboutClient)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing ClientAboutMe: %s\n", err.Error())
+		return aboutClient, errors.New(unmarshalingError)
+	}
+
+	return aboutClient, nil
+}
+
+func getOperation(b []byte) (*common.Operation, error) {
+	operation := &common.Operation{}
+
+	err := json.Unmarshal(b, operation)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Operation: %s\n", err.Error())
+		return operation, errors.New(unmarshalingError)
+	}
+
+	return operation, nil
+}
+
+// checkOperation refuses the operations without a message, which every handler expects, like
+// the ones with a message that doesn't parse
+func checkOperation(operation *common.Operation) error {
+	if operation.Message == nil {
+		common.Errorf("Operation %q came without a message\n", operation.Type)
+		return errors.New(unmarshalingError)
 	}
 
 	return nil
 }
+
+// recoverSession closes the session whose handling panicked, leaving the others and the server
+// running. It must be deferred by the function handling the session
+func recoverSession(s *session) {
+	if r := recover(); r != nil {
+		log.Printf("Closing the session of %v at %v after a panic: %v\n%s", s.client, s.addr, r, debug.Stack())
+		s.writeError(errors.New("Something went wrong"))
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// pipeClient speaks the protocol over a pipe made by a common.PipeListener
+type pipeClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	sender *common.Sender
+}
+
+func dialPipe(t *testing.T, listener *common.PipeListener, name string) *pipeClient {
+	t.Helper()
+
+	conn, err := listener.Dial("pipe", "")
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	c := &pipeClient{t: t, conn: conn, reader: bufio.NewReader(conn), sender: &common.Sender{ID: uuid.New(), Name: name}}
+
+	// every session starts with a challenge, before the client introduces itself
+	c.expect(common.ChallengeOperationType, nil)
+
+	return c
+}
+
+func (c *pipeClient) send(operationType string, v interface{}) {
+	c.t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	raw := json.RawMessage(b)
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	err = common.WriteFrame(c.conn, common.Operation{Type: operationType, Message: &raw})
+	if err != nil {
+		c.t.Fatalf("send %s: %s", operationType, err)
+	}
+}
+
+// expect reads responses until the next one to an operation of the given type, which must be
+// ok, and decodes its message into v unless it's nil
+func (c *pipeClient) expect(operationType string, v interface{}) {
+	c.t.Helper()
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		frame, err := common.ReadUntil(c.reader, common.EOFBytes)
+		if err != nil {
+			c.t.Fatalf("expected a response to %s: %s", operationType, err)
+		}
+
+		response := common.Response{}
+		err = json.Unmarshal(frame, &response)
+		if err != nil {
+			c.t.Fatalf("response isn't JSON: %s: %q", err, frame)
+		}
+
+		if response.Status != "ok" {
+			c.t.Fatalf("expected %s to be ok, got %s: %+v", operationType, response.Status, response.Error)
+		}
+		if response.OperationType != operationType {
+			continue
+		}
+
+		if v != nil {
+			err = json.Unmarshal(*response.Message, v)
+			if err != nil {
+				c.t.Fatalf("response to %s: %s", operationType, err)
+			}
+		}
+
+		return
+	}
+}
+
+func (c *pipeClient) handshake() {
+	c.t.Helper()
+
+	c.send(common.AboutMeOperationType, common.ClientAboutMe{ID: c.sender.ID, Name: c.sender.Name})
+	c.expect(common.AboutMeOperationType, nil)
+}
+
+func (c *pipeClient) subscribe(nickname string) *common.Conversation {
+	c.t.Helper()
+
+	conversation := &common.Conversation{}
+	c.send(common.SubscribeOperationType, common.Conversation{Nickname: nickname})
+	c.expect(common.SubscribeOperationType, conversation)
+
+	return conversation
+}
+
+// drain reads whatever comes, like a client would, until the server closes the connection.
+// The error it reads that with is sent on the returned channel, nil for io.EOF
+func (c *pipeClient) drain() <-chan error {
+	closed := make(chan error, 1)
+
+	go func() {
+		for {
+			c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			_, err := common.ReadUntil(c.reader, common.EOFBytes)
+			if errors.Is(err, io.EOF) {
+				closed <- nil
+				return
+			}
+			if err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	return closed
+}
+
+// lockedBuffer is a bytes.Buffer the logs of several goroutines can go to
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// TestServeOverPipe runs the server on a PipeListener, delivering a message between two clients
+// connected in the same process, and shuts it down with a client in the middle of its handshake
+// and the others established, whose pipes the sessions close themselves. Reading from a pipe
+// closed on its own end fails with io.ErrClosedPipe, which isn't an error to log
+func TestServeOverPipe(t *testing.T) {
+	logs := &lockedBuffer{}
+	common.SetLogOutput(logs)
+	defer common.SetLogOutput(os.Stderr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener := common.NewPipeListener()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, listener)
+	}()
+
+	alice := dialPipe(t, listener, "alice")
+	alice.handshake()
+	bob := dialPipe(t, listener, "bob")
+	bob.handshake()
+
+	nickname := fmt.Sprintf("pipe-%s", uuid.New().String()[:8])
+	alice.send(common.CreateOperationType, common.Conversation{Nickname: nickname})
+	alice.expect(common.CreateOperationType, nil)
+
+	conversation := alice.subscribe(nickname)
+	bob.subscribe(nickname)
+
+	alice.send(common.MessageOperationType, common.Message{Conversation: conversation, Sender: alice.sender, Text: "hello bob"})
+
+	// past the notices of the server, like that of bob joining
+	message := common.Message{}
+	for message.Sender == nil || message.Sender.ID != alice.sender.ID {
+		bob.expect(common.MessageOperationType, &message)
+	}
+	if message.Text != "hello bob" {
+		t.Fatalf("bob got %q from alice, want %q", message.Text, "hello bob")
+	}
+
+	// carol only got the challenge when the server shuts down
+	carol := dialPipe(t, listener, "carol")
+
+	clients := []<-chan error{alice.drain(), bob.drain(), carol.drain()}
+
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve returned %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve didn't return once shut down")
+	}
+
+	for _, closed := range clients {
+		err := <-closed
+		if err != nil {
+			t.Errorf("expected the connection to be closed: %s", err)
+		}
+	}
+
+	if strings.Contains(logs.String(), io.ErrClosedPipe.Error()) {
+		t.Errorf("closing the pipes was logged as an error:\n%s", logs)
+	}
+}
@@ -0,0 +1,472 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// responseWriter sends responses to a client over a particular transport (TCP, gRPC, ...)
+type responseWriter interface {
+	writeResponse(response *common.Response) error
+	close() error
+}
+
+// session is the transport independent state of a connected client
+type session struct {
+	// id tells the sessions of a user apart, for it to revoke them
+	id     uuid.UUID
+	client *common.ClientAboutMe
+	writer responseWriter
+	addr   net.Addr
+	// certificate is the verified certificate the client presented, if client certificates
+	// are required, which it's known by instead of the identity it introduces itself with
+	certificate *x509.Certificate
+	// connectedAt is when the client connected, and device what it says it connects with
+	connectedAt time.Time
+	device      common.Device
+	// local is set for clients connected over raw TCP from the server's own host
+	local bool
+	// challenge is the nonce of the challenge the session was opened with, until the handshake
+	// answers it. It's only used by the goroutine handling the handshake
+	challenge []byte
+
+	// limit, limiter and strikes are only used by the goroutine handling the session's operations
+	limit   common.RateLimit
+	limiter *common.TokenBucket
+	strikes int
+	// admin is set once the client authenticated with the admin token, or logged in to an
+	// account with the admin role, and is likewise only used by the goroutine handling the
+	// session's operations
+	admin bool
+	// account is the name of the account the client logged in to with a password, and roles
+	// are its roles
+	account string
+	roles   []string
+	// loggedIn is set for clients that logged in to an account, with a password or an ID token
+	loggedIn bool
+	// guest is set for clients let in without logging in, to the public conversations alone
+	guest bool
+
+	mu            sync.Mutex
+	subscriptions map[uuid.UUID]bool
+
+	// queue holds what the delivery workers delivered to the session, for writeQueued to write
+	// to the client
+	queue chan queuedResponse
+
+	// lastActive is when the client last sent an operation, in Unix nanoseconds, and
+	// established is set once its handshake succeeded, and client and device were set
+	lastActive  atomic.Int64
+	established atomic.Bool
+
+	// ctx is done once the session is closed, cancelling what its operations were doing
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// newSession starts the session of a client connected over writer. It is closed when ctx is
+// done, e.g. when the server shuts down
+func newSession(ctx context.Context, writer responseWriter, addr net.Addr) *session {
+	limit := currentConfig.rateLimit()
+
+	s := &session{
+		id:            uuid.New(),
+		writer:        writer,
+		addr:          addr,
+		connectedAt:   time.Now(),
+		limit:         limit,
+		limiter:       common.NewTokenBucket(limit),
+		subscriptions: map[uuid.UUID]bool{},
+		queue:         make(chan queuedResponse, maxQueuedDeliveries),
+	}
+	s.touch()
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	context.AfterFunc(s.ctx, s.close)
+	connections.add(s)
+	go s.writeQueued()
+
+	return s
+}
+
+// handshake processes the first operation of a session, where the client introduces itself
+func (s *session) handshake(operation *common.Operation) error {
+	s.touch()
+
+	err := checkOperation(operation)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, currentConfig.operationTimeout())
+	defer cancel()
+
+	aboutClient, err := ParseClientAboutMe(*operation.Message)
+	if err != nil {
+		return err
+	}
+
+	loggedIn := false
+	if s.certificate != nil {
+		err = certify(aboutClient, s.certificate)
+	} else {
+		login := common.Login{}
+		json.Unmarshal(*operation.Message, &login)
+		loggedIn, err = s.logIn(ctx, aboutClient, login)
+	}
+	if err != nil {
+		return err
+	}
+	s.loggedIn = loggedIn
+
+	if s.guest {
+		makeGuest(aboutClient)
+	}
+
+	aboutClient.Name, err = normalizeNickname(aboutClient.Name, "name")
+	if err != nil {
+		return err
+	}
+
+	err = checkName(aboutClient)
+	if err != nil {
+		return err
+	}
+
+	if users.isBanned(aboutClient.ID) {
+		log.Printf("Refused banned client %v from %v\n", aboutClient, s.addr)
+		return &common.Error{Code: common.BannedErrorCode, Message: "you are banned from this server"}
+	}
+
+	if len(aboutClient.PublicKey) != 0 && len(aboutClient.PublicKey) != ed25519.PublicKeySize {
+		return &common.Error{Code: common.KeyMismatchErrorCode, Message: "public keys are ed25519 keys"}
+	}
+
+	if len(aboutClient.BoxKey) != 0 && len(aboutClient.BoxKey) != boxKeySize {
+		return &common.Error{Code: common.KeyMismatchErrorCode, Message: "box keys are X25519 keys"}
+	}
+
+	// the public key is no secret, as it goes along with every message, so the client proves
+	// it has its private key by signing the nonce of its challenge
+	if len(aboutClient.PublicKey) != 0 {
+		proof := common.Proof{}
+		json.Unmarshal(*operation.Message, &proof)
+
+		if !s.answersChallenge(proof.Nonce) || !common.VerifyProof(aboutClient.PublicKey, proof) {
+			log.Printf("Refused client %v from %v, which didn't prove it has the private key of its public key\n", aboutClient, s.addr)
+			return &common.Error{Code: common.KeyMismatchErrorCode, Message: "sign the nonce of the server's challenge with the private key of your public key"}
+		}
+	}
+
+	// the certificate or login proves who the client is, whatever key it signs with, and
+	// guests are someone new every time
+	authenticated := s.certificate != nil || loggedIn
+	if !authenticated && !s.guest {
+		if isDerivedID(aboutClient.ID) || users.authenticates(aboutClient.ID) {
+			log.Printf("Refused client %v from %v, whose ID belongs to an account\n", aboutClient, s.addr)
+			return &common.Error{Code: common.LoginRequiredErrorCode, Message: "this id belongs to an account, log in to use it"}
+		}
+
+		if !users.takesKey(aboutClient.ID, aboutClient.PublicKey) {
+			log.Printf("Refused client %v from %v, whose ID has another key\n", aboutClient, s.addr)
+			return &common.Error{Code: common.KeyMismatchErrorCode, Message: "this id belongs to another public key"}
+		}
+	}
+
+	err = pluginConnect(s.ctx, common.Sender(*aboutClient))
+	if err != nil {
+		log.Printf("A plugin refused client %v from %v: %s\n", aboutClient, s.addr, err.Error())
+		return err
+	}
+
+	err = connectionCount.acquire(s, aboutClient.ID, currentConfig.limits())
+	if err != nil {
+		log.Printf("Refused client %v from %v: %s\n", aboutClient, s.addr, err.Error())
+		return err
+	}
+
+	queued := offlineMessages.take(aboutClient.ID)
+
+	err = sendAboutMeResponse(s, aboutClient, len(queued))
+	if err != nil {
+		connectionCount.release(s)
+		return err
+	}
+
+	json.Unmarshal(*operation.Message, &s.device)
+	s.device.Client = cleanLine(s.device.Client, maxDeviceLength)
+
+	s.client = aboutClient
+	users.connected(aboutClient, authenticated)
+	messageRouter.register(s)
+	s.established.Store(true)
+
+	log.Printf("New connection received from client: %v\n", aboutClient)
+	events.publish(Event{Kind: ConnectEvent, Client: *s.sender(), session: s})
+
+	err = s.sendMOTD()
+	if err != nil {
+		return err
+	}
+
+	if s.guest {
+		err = s.sendGuestNotice()
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.sendQueued(queued)
+}
+
+// sendQueued sends the messages kept for the client while it wasn't connected
+func (s *session) sendQueued(queued []common.Message) error {
+	for _, message := range queued {
+		b, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+
+		jsonMessage := json.RawMessage(b)
+
+		err = s.writeOK(&jsonMessage, common.MessageOperationType)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendMOTD sends the message of the day, if there is one, as a direct message from the server
+func (s *session) sendMOTD() error {
+	motd := currentConfig.motd()
+	if motd == "" {
+		return nil
+	}
+
+	return s.sendServerMessage(motd)
+}
+
+// sendServerMessage sends the client a direct message from the server
+func (s *session) sendServerMessage(text string) error {
+	b, err := json.Marshal(common.Message{
+		Recipient: &common.Sender{ID: s.client.ID, Name: s.client.Name},
+		Sender:    &serverSender,
+		Text:      text,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	message := json.RawMessage(b)
+
+	return s.writeOK(&message, common.MessageOperationType)
+}
+
+// handle executes a single operation, with the middlewares and the handler of its type, and
+// writes back its response. A non-nil error means the session should be ended
+func (s *session) handle(operation *common.Operation) error {
+	s.touch()
+
+	err := checkOperation(operation)
+	if err != nil {
+		return err
+	}
+
+	response, err := handleOperation(s.ctx, operation, s)
+
+	var fatal fatalError
+	if errors.As(err, &fatal) {
+		return fatal.err
+	}
+
+	// errors with a code are about the operation alone, and the client can carry on after them
+	var operationErr *common.Error
+	if errors.As(err, &operationErr) && operationErr.Code != "" {
+		return s.reject(operation, operationErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if response == nil {
+		emptyJSON := json.RawMessage("{}")
+		response = &emptyJSON
+	}
+
+	return s.writeOK(response, operation.Type)
+}
+
+// close cancels what the session's operations were doing, removes it from the router, publishes
+// that the client disconnected, and closes the underlying transport. Only the first call does anything
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		connections.remove(s)
+		messageRouter.unregister(s)
+		connectionCount.release(s)
+
+		if s.established.Load() {
+			events.publish(Event{Kind: DisconnectEvent, Client: *s.sender(), session: s})
+		}
+
+		s.writer.close()
+	})
+}
+
+func (s *session) subscribe(conversationID uuid.UUID) {
+	s.mu.Lock()
+	subscribed := s.subscriptions[conversationID]
+	s.subscriptions[conversationID] = true
+	s.mu.Unlock()
+
+	messageRouter.subscribed(s, conversationID)
+	users.subscribed(s.client.ID, conversationID)
+
+	if !subscribed {
+		s.publishMembership(JoinEvent, conversationID)
+	}
+}
+
+func (s *session) unsubscribe(conversationID uuid.UUID) {
+	s.mu.Lock()
+	subscribed := s.subscriptions[conversationID]
+	delete(s.subscriptions, conversationID)
+	s.mu.Unlock()
+
+	messageRouter.unsubscribed(s, conversationID)
+	users.unsubscribed(s.client.ID, conversationID)
+
+	if subscribed {
+		s.publishMembership(LeaveEvent, conversationID)
+	}
+}
+
+// announce sends a system message to a conversation about the session's client. format gets
+// the client's name and the conversation's nickname
+func (s *session) announce(conversationID uuid.UUID, format string) {
+	conversation, ok := conversations.get(conversationID)
+	if !ok || s.client == nil {
+		return
+	}
+
+	message := common.Message{
+		Conversation: &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname},
+		Sender:       &serverSender,
+		Text:         fmt.Sprintf(format, s.client.Name, conversation.Nickname),
+		Timestamp:    time.Now(),
+		Kind:         common.SystemMessageKind,
+	}
+
+	membership.record(s.client.ID, message)
+	messageRouter.broadcast(message)
+}
+
+// publishMembership publishes that the session's client joined or left a conversation
+func (s *session) publishMembership(kind string, conversationID uuid.UUID) {
+	conversation, ok := conversations.get(conversationID)
+	if !ok || s.client == nil {
+		return
+	}
+
+	events.publish(Event{
+		Kind:         kind,
+		Client:       *s.sender(),
+		Conversation: &common.Conversation{ID: conversation.ID, Nickname: conversation.Nickname},
+		session:      s,
+	})
+}
+
+// subscribedTo returns the IDs of the conversations the session is subscribed to
+func (s *session) subscribedTo() []uuid.UUID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Collect(maps.Keys(s.subscriptions))
+}
+
+// sender is the session's client as the sender of its messages, with its keys
+func (s *session) sender() *common.Sender {
+	return &common.Sender{ID: s.client.ID, Name: s.client.Name, PublicKey: s.client.PublicKey, BoxKey: s.client.BoxKey}
+}
+
+func (s *session) isSubscribed(conversationID uuid.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.subscriptions[conversationID]
+}
+
+// reject tells the client that operation failed with err, without ending the session
+func (s *session) reject(operation *common.Operation, err *common.Error) error {
+	response := newErrorResponse(err)
+	response.OperationType = operation.Type
+
+	return s.writer.writeResponse(&response)
+}
+
+func (s *session) writeOK(message *json.RawMessage, operationType string) error {
+	response := newOKResponse(message, operationType)
+
+	return s.writer.writeResponse(&response)
+}
+
+// writeError sends an error response to the client and closes the session
+func (s *session) writeError(err error) {
+	response := newErrorResponse(err)
+
+	writeErr := s.writer.writeResponse(&response)
+	// the error may well be that the session was closed, with nothing left to write to
+	if writeErr != nil && s.ctx.Err() == nil {
+		common.Errorf("Got another error while writing one error: %s", writeErr.Error())
+	}
+
+	s.close()
+}
+
+func newOKResponse(message *json.RawMessage, operationType string) common.Response {
+	response := common.NewResponse()
+	response.Status = "ok"
+
+	if operationType != "" {
+		response.OperationType = operationType
+	}
+
+	if !bytes.Equal(*message, []byte{}) {
+		response.Message = message
+	}
+
+	common.Debugf("Message: %s\n", string(*message))
+
+	return response
+}
+
+// newErrorResponse builds an error response, keeping the code and details of a *common.Error
+func newErrorResponse(err error) common.Response {
+	errorMessage := &common.Error{Message: err.Error()}
+	errors.As(err, &errorMessage)
+
+	response := common.NewResponse()
+	response.Status = "error"
+	response.Error = errorMessage
+
+	return response
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// channelWriter hands responses over to whoever reads the channel
+type channelWriter chan *common.Response
+
+func (w channelWriter) writeResponse(response *common.Response) error {
+	w <- response
+	return nil
+}
+
+func (w channelWriter) close() error {
+	return nil
+}
+
+// BenchmarkMessageLatency measures a message operation from being handled by the sender's
+// session to being delivered to the receiver's
+func BenchmarkMessageLatency(b *testing.B) {
+	conversation := &common.Conversation{Nickname: fmt.Sprintf("bench-%s", uuid.New())}
+	err := conversations.add(conversation)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	sender := benchmarkSession(discardWriter{}, "alice")
+	received := make(channelWriter, 1)
+	receiver := benchmarkSession(received, "bob")
+	receiver.subscriptions[conversation.ID] = true
+
+	messageRouter.register(sender)
+	messageRouter.register(receiver)
+	defer messageRouter.unregister(sender)
+	defer messageRouter.unregister(receiver)
+
+	// no rate limit for the sender, we want to measure how fast messages can go
+	sender.limiter = common.NewTokenBucket(common.RateLimit{})
+
+	messageJSON, err := json.Marshal(benchmarkMessage(conversation))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	raw := json.RawMessage(messageJSON)
+	operation := &common.Operation{Type: common.MessageOperationType, Message: &raw}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := sender.handle(operation)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		<-received
+	}
+}
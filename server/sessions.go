@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// sessionInfo describes s for the client of asker
+func sessionInfo(s, asker *session) common.SessionInfo {
+	return common.SessionInfo{
+		ID:          s.id,
+		User:        common.Sender{ID: s.client.ID, Name: s.client.Name},
+		Address:     s.addr.String(),
+		ConnectedAt: s.connectedAt,
+		Client:      s.device.Client,
+		Current:     s == asker,
+	}
+}
+
+// handleSessions lists the sessions of the client's user, or of every user for admins
+func handleSessions(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	request := common.Sessions{}
+
+	err := json.Unmarshal(*op.Message, &request)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Sessions: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	if request.All && !s.privileged() {
+		return nil, &common.Error{Code: common.ForbiddenErrorCode, Message: "only admins may list the sessions of every user"}
+	}
+
+	response := common.Sessions{All: request.All, Sessions: []common.SessionInfo{}}
+	for _, other := range connectedSessions() {
+		if request.All || other.client.ID == s.client.ID {
+			response.Sessions = append(response.Sessions, sessionInfo(other, s))
+		}
+	}
+
+	return marshalResponse(response)
+}
+
+// handleRevoke closes one of the sessions of the client's user, or any session for admins
+func handleRevoke(ctx context.Context, op *common.Operation, s *session) error {
+	revoke := common.Revoke{}
+
+	err := json.Unmarshal(*op.Message, &revoke)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Revoke: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	for _, other := range connectedSessions() {
+		if other.id != revoke.Session {
+			continue
+		}
+
+		if other.client.ID != s.client.ID {
+			if !s.privileged() {
+				break
+			}
+
+			auditLog.record(s.actor(), common.RevokeOperationType, other.client.Name, other.id.String())
+		}
+
+		revokeSession(other)
+
+		return nil
+	}
+
+	return &common.Error{Code: common.NotFoundErrorCode, Message: fmt.Sprintf("no session %s", revoke.Session)}
+}
+
+// revokeSession tells the client of s its session was revoked, so that it doesn't reconnect,
+// and closes it
+func revokeSession(s *session) {
+	log.Printf("Revoked session %s of %v at %v\n", s.id, s.client, s.addr)
+
+	s.writeError(&common.Error{Code: common.SessionRevokedErrorCode, Message: "this session was revoked"})
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// maxSlowMode is the longest wait between messages a conversation can be set to
+const maxSlowMode = 6 * time.Hour
+
+// slowModeTracker remembers when each user last sent a message to each conversation in slow mode
+type slowModeTracker struct {
+	mu       sync.Mutex
+	lastSent map[uuid.UUID]map[uuid.UUID]time.Time
+}
+
+var slowMode = &slowModeTracker{lastSent: map[uuid.UUID]map[uuid.UUID]time.Time{}}
+
+// take records a message from userID to the conversation if interval has passed since their
+// previous one, and otherwise returns how much longer they have to wait
+func (t *slowModeTracker) take(conversationID, userID uuid.UUID, interval time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	senders, ok := t.lastSent[conversationID]
+	if !ok {
+		senders = map[uuid.UUID]time.Time{}
+		t.lastSent[conversationID] = senders
+	}
+
+	if wait := senders[userID].Add(interval).Sub(now); wait > 0 {
+		return wait
+	}
+
+	senders[userID] = now
+
+	return 0
+}
+
+// forget drops what's known about the conversation, when its slow mode changes or it's deleted
+func (t *slowModeTracker) forget(conversationID uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.lastSent, conversationID)
+}
+
+// checkSlowMode returns a slow mode error if the session's client has to wait before sending
+// another message to the conversation. The owner, moderators and admins are never slowed down
+func checkSlowMode(conversation *common.Conversation, s *session) error {
+	if conversation.SlowMode <= 0 || conversation.CanModerate(s.client.ID) || s.admin {
+		return nil
+	}
+
+	wait := slowMode.take(conversation.ID, s.client.ID, time.Duration(conversation.SlowMode)*time.Second)
+	if wait <= 0 {
+		return nil
+	}
+
+	return &common.Error{
+		Code: common.SlowModeErrorCode,
+		Message: fmt.Sprintf("'%s' is in slow mode: wait %s before sending another message",
+			conversation.Nickname, wait.Round(time.Second)),
+		RetryAfter: wait.Seconds(),
+	}
+}
+
+func handleSlowMode(ctx context.Context, op *common.Operation, s *session) error {
+	settings := &common.SlowMode{}
+
+	err := json.Unmarshal(*op.Message, settings)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing SlowMode: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	conversation, ok := conversations.getByNickname(settings.Nickname)
+	if !ok {
+		return &common.Error{
+			Code:    common.NotFoundErrorCode,
+			Message: fmt.Sprintf("conversation '%s' does not exist", settings.Nickname),
+		}
+	}
+
+	if !conversation.CanModerate(s.client.ID) && !s.admin {
+		return &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("only the owner or a moderator of '%s' can set its slow mode", conversation.Nickname),
+		}
+	}
+
+	if settings.Seconds < 0 || time.Duration(settings.Seconds)*time.Second > maxSlowMode {
+		return &common.Error{
+			Code:    common.InvalidSlowModeErrorCode,
+			Message: fmt.Sprintf("slow mode has to be between 0 and %d seconds", int(maxSlowMode.Seconds())),
+		}
+	}
+
+	conversation, err = conversations.update(conversation.Nickname, func(c *common.Conversation) {
+		c.SlowMode = settings.Seconds
+	})
+	if err != nil {
+		return err
+	}
+
+	slowMode.forget(conversation.ID)
+
+	auditLog.record(s.actor(), common.SlowModeOperationType, conversation.Nickname, strconv.Itoa(conversation.SlowMode))
+	messageRouter.publish(conversation.ID, common.SlowModeOperationType, conversation)
+
+	return nil
+}
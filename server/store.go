@@ -0,0 +1,1008 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// conversationStore keeps all the conversations known to the server. It is shared by every transport
+type conversationStore struct {
+	mu   sync.RWMutex
+	byID map[uuid.UUID]*common.Conversation
+	list []*common.Conversation
+	// byNickname has the conversations by the nicknameKey of their nickname
+	byNickname map[string]*common.Conversation
+}
+
+var conversations = newConversationStore()
+
+func newConversationStore() *conversationStore {
+	return &conversationStore{
+		byID:       map[uuid.UUID]*common.Conversation{},
+		list:       []*common.Conversation{},
+		byNickname: map[string]*common.Conversation{},
+	}
+}
+
+// add assigns an ID (and a nickname, if missing) to conversation and stores it
+func (cs *conversationStore) add(conversation *common.Conversation) error {
+	return cs.addWithin(conversation, Limits{})
+}
+
+// addWithin adds conversation like add does, unless the server already has the most
+// conversations of limits, or its owner already owns the most it may
+func (cs *conversationStore) addWithin(conversation *common.Conversation, limits Limits) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if limits.MaxConversations > 0 && len(cs.list) >= limits.MaxConversations {
+		return &common.Error{
+			Code:    common.LimitExceededErrorCode,
+			Message: fmt.Sprintf("the server can't have more than %d conversations", limits.MaxConversations),
+		}
+	}
+
+	if limits.MaxConversationsPerUser > 0 {
+		owned := 0
+		for _, c := range cs.list {
+			if c.Owner == conversation.Owner {
+				owned++
+			}
+		}
+
+		if owned >= limits.MaxConversationsPerUser {
+			return &common.Error{
+				Code:    common.LimitExceededErrorCode,
+				Message: fmt.Sprintf("you can't own more than %d conversations", limits.MaxConversationsPerUser),
+			}
+		}
+	}
+
+	conversation.ID = uuid.New()
+
+	// conversations without a nickname get the first of conversation-1, conversation-2, ...
+	// that's free, counting on from how many conversations there are
+	for n := len(cs.list) + 1; conversation.Nickname == ""; n++ {
+		nickname := fmt.Sprintf("conversation-%d", n)
+		if _, taken := cs.byNickname[nicknameKey(nickname)]; !taken {
+			conversation.Nickname = nickname
+		}
+	}
+
+	if _, ok := cs.byNickname[nicknameKey(conversation.Nickname)]; ok {
+		return nicknameTaken(conversation.Nickname, "nickname")
+	}
+
+	cs.list = append(cs.list, conversation)
+	cs.byID[conversation.ID] = conversation
+	cs.byNickname[nicknameKey(conversation.Nickname)] = conversation
+
+	return nil
+}
+
+// addShared stores a conversation another instance of the server shared, with the ID it has
+// there, unless there's a conversation with its nickname, or ID, already
+func (cs *conversationStore) addShared(conversation *common.Conversation) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.byNickname[nicknameKey(conversation.Nickname)]; ok {
+		return nicknameTaken(conversation.Nickname, "nickname")
+	}
+
+	if _, ok := cs.byID[conversation.ID]; ok || conversation.ID == uuid.Nil {
+		return fmt.Errorf("conversation %s is here already", conversation.ID)
+	}
+
+	cs.list = append(cs.list, conversation)
+	cs.byID[conversation.ID] = conversation
+	cs.byNickname[nicknameKey(conversation.Nickname)] = conversation
+
+	return nil
+}
+
+// all returns a snapshot of all the conversations in the order they were created
+func (cs *conversationStore) all() []*common.Conversation {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	list := make([]*common.Conversation, len(cs.list))
+	copy(list, cs.list)
+
+	return list
+}
+
+// update replaces the conversation with the given nickname by a copy that f changed, and
+// returns the copy. Conversations are replaced rather than changed, as the old ones may still
+// be read by whoever got them before. The nickname may change too, as long as it's not taken
+func (cs *conversationStore) update(nickname string, f func(conversation *common.Conversation)) (*common.Conversation, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	old, ok := cs.byNickname[nicknameKey(nickname)]
+	if !ok {
+		return nil, fmt.Errorf("conversation '%s' does not exist", nickname)
+	}
+
+	conversation := *old
+	f(&conversation)
+
+	// it may change its nickname's case alone
+	if nicknameKey(conversation.Nickname) != nicknameKey(old.Nickname) {
+		if _, taken := cs.byNickname[nicknameKey(conversation.Nickname)]; taken {
+			return nil, nicknameTaken(conversation.Nickname, "nickname")
+		}
+
+		delete(cs.byNickname, nicknameKey(old.Nickname))
+	}
+
+	cs.byNickname[nicknameKey(conversation.Nickname)] = &conversation
+	cs.byID[conversation.ID] = &conversation
+	for i, c := range cs.list {
+		if c == old {
+			cs.list[i] = &conversation
+		}
+	}
+
+	return &conversation, nil
+}
+
+// remove deletes the conversation with the given nickname, returning it
+func (cs *conversationStore) remove(nickname string) (*common.Conversation, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	conversation, ok := cs.byNickname[nicknameKey(nickname)]
+	if !ok {
+		return nil, fmt.Errorf("conversation '%s' does not exist", nickname)
+	}
+
+	delete(cs.byNickname, nicknameKey(nickname))
+	delete(cs.byID, conversation.ID)
+	cs.list = slices.DeleteFunc(cs.list, func(c *common.Conversation) bool {
+		return c == conversation
+	})
+
+	return conversation, nil
+}
+
+func (cs *conversationStore) get(id uuid.UUID) (*common.Conversation, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	conversation, ok := cs.byID[id]
+
+	return conversation, ok
+}
+
+func (cs *conversationStore) getByNickname(nickname string) (*common.Conversation, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	conversation, ok := cs.byNickname[nicknameKey(nickname)]
+
+	return conversation, ok
+}
+
+// messageStore keeps the history of all messages sent through the server
+type messageStore struct {
+	mu       sync.RWMutex
+	messages []common.Message
+	// lastSeqs are the Seq of the latest message of every conversation, and lastTimes its Timestamp
+	lastSeqs  map[uuid.UUID]uint64
+	lastTimes map[uuid.UUID]time.Time
+}
+
+var messages = newMessageStore()
+
+func newMessageStore() *messageStore {
+	return &messageStore{lastSeqs: map[uuid.UUID]uint64{}, lastTimes: map[uuid.UUID]time.Time{}}
+}
+
+// add gives message an ID, the next Seq of its conversation, timestamps it and appends it to
+// the history
+func (ms *messageStore) add(message common.Message) common.Message {
+	message.ID = uuid.New()
+	message.Timestamp = time.Now()
+
+	return ms.keep(message)
+}
+
+// keep appends message to the history with the ID and timestamp it has, like those of the
+// messages other instances share, giving it the next Seq of its conversation
+func (ms *messageStore) keep(message common.Message) common.Message {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if message.Conversation != nil {
+		ms.lastSeqs[message.Conversation.ID]++
+		message.Seq = ms.lastSeqs[message.Conversation.ID]
+		ms.lastTimes[message.Conversation.ID] = message.Timestamp
+	}
+
+	ms.insert(message)
+
+	return message
+}
+
+// insert puts message in the history after the messages sent before or with it, for it to stay
+// in the order they were sent in when other instances share messages older than the latest ones.
+// The mutex must be held
+func (ms *messageStore) insert(message common.Message) {
+	n := len(ms.messages)
+	if n == 0 || !message.Timestamp.Before(ms.messages[n-1].Timestamp) {
+		ms.messages = append(ms.messages, message)
+		return
+	}
+
+	i := sort.Search(n, func(i int) bool {
+		return ms.messages[i].Timestamp.After(message.Timestamp)
+	})
+	ms.messages = slices.Insert(ms.messages, i, message)
+}
+
+// replicate appends message to the history as the node of the cluster owning its conversation
+// stored it, with its ID, timestamp and Seq
+func (ms *messageStore) replicate(message common.Message) common.Message {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if message.Conversation != nil {
+		id := message.Conversation.ID
+		ms.lastSeqs[id] = max(ms.lastSeqs[id], message.Seq)
+		if message.Timestamp.After(ms.lastTimes[id]) {
+			ms.lastTimes[id] = message.Timestamp
+		}
+	}
+
+	ms.insert(message)
+
+	return message
+}
+
+// skipTo has the next message of the conversation numbered after seq, if it isn't already, for
+// the numbering to go on from where another node of the cluster left it
+func (ms *messageStore) skipTo(conversationID uuid.UUID, seq uint64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.lastSeqs[conversationID] = max(ms.lastSeqs[conversationID], seq)
+}
+
+// lastSeq is the Seq of the latest message of the conversation, 0 if it has none
+func (ms *messageStore) lastSeq(conversationID uuid.UUID) uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.lastSeqs[conversationID]
+}
+
+// lastTime is when the latest message of the conversation was sent, zero if it has none
+func (ms *messageStore) lastTime(conversationID uuid.UUID) time.Time {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return ms.lastTimes[conversationID]
+}
+
+// sequence returns up to limit of the messages of the conversation whose Seq are from to to,
+// oldest first. next is the Seq to continue from when there were more, or 0
+func (ms *messageStore) sequence(conversationID uuid.UUID, from, to uint64, limit int) (found []common.Message, next uint64) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	found = []common.Message{}
+	for _, message := range ms.messages {
+		if message.Conversation == nil || message.Conversation.ID != conversationID ||
+			message.Seq < from || message.Seq > to {
+			continue
+		}
+
+		found = append(found, message)
+	}
+
+	// the history is in the order messages were sent in, which shared ones can number differently
+	slices.SortStableFunc(found, func(a, b common.Message) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+
+	if limit >= 0 && len(found) > limit {
+		return found[:limit], found[limit].Seq
+	}
+
+	return found, 0
+}
+
+func (ms *messageStore) count() int {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	return len(ms.messages)
+}
+
+// get returns the message with the given ID
+func (ms *messageStore) get(id uuid.UUID) (common.Message, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// the latest messages are the most likely to be asked for
+	for i := len(ms.messages) - 1; i >= 0; i-- {
+		if ms.messages[i].ID == id {
+			return ms.messages[i], true
+		}
+	}
+
+	return common.Message{}, false
+}
+
+// remove deletes the message with the given ID from the history
+func (ms *messageStore) remove(id uuid.UUID) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.messages = slices.DeleteFunc(ms.messages, func(message common.Message) bool {
+		return message.ID == id
+	})
+}
+
+// prune removes the messages sent before t from the history, returning how many there were
+func (ms *messageStore) prune(t time.Time) int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	n := len(ms.messages)
+	ms.messages = slices.DeleteFunc(ms.messages, func(message common.Message) bool {
+		return message.Timestamp.Before(t)
+	})
+
+	return n - len(ms.messages)
+}
+
+// rewrite replaces every message of the history by what f returns for it, deleting those f
+// doesn't keep
+func (ms *messageStore) rewrite(f func(message common.Message) (common.Message, bool)) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	kept := ms.messages[:0]
+	for _, message := range ms.messages {
+		if rewritten, keep := f(message); keep {
+			kept = append(kept, rewritten)
+		}
+	}
+
+	clear(ms.messages[len(kept):])
+	ms.messages = kept
+}
+
+// errCursorGone is returned for cursors that aren't in the history (anymore)
+var errCursorGone = errors.New("the cursor is gone from the history")
+
+// scanCheckInterval is how many messages are scanned between checks that the scan wasn't
+// cancelled
+const scanCheckInterval = 1024
+
+// search returns up to limit of the messages that match, newest first, starting after the message
+// with the ID cursor unless it's uuid.Nil. more tells if there are other matches after those.
+// It fails with errCursorGone if the cursor isn't in the history, or when ctx is done
+func (ms *messageStore) search(ctx context.Context, match func(message common.Message) bool, cursor uuid.UUID, limit int) (found []common.Message, more bool, err error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	i := len(ms.messages) - 1
+	if cursor != uuid.Nil {
+		for i >= 0 && ms.messages[i].ID != cursor {
+			i--
+		}
+		if i < 0 {
+			return nil, false, errCursorGone
+		}
+		i--
+	}
+
+	found = []common.Message{}
+	for scanned := 0; i >= 0; i, scanned = i-1, scanned+1 {
+		if scanned%scanCheckInterval == 0 && ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+
+		if !match(ms.messages[i]) {
+			continue
+		}
+
+		if len(found) == limit {
+			return found, true, nil
+		}
+
+		found = append(found, ms.messages[i])
+	}
+
+	return found, false, nil
+}
+
+// page returns up to limit (or all, if it's negative) of the messages of the conversation with
+// the given ID, oldest first, starting after the message with the ID cursor unless it's
+// uuid.Nil. more and err are like search's
+func (ms *messageStore) page(ctx context.Context, conversationID uuid.UUID, cursor uuid.UUID, limit int) (found []common.Message, more bool, err error) {
+	return ms.pageWhere(ctx, func(message common.Message) bool {
+		return message.Conversation != nil && message.Conversation.ID == conversationID
+	}, cursor, limit)
+}
+
+// pageWhere is like page, for the messages that match instead of those of a conversation
+func (ms *messageStore) pageWhere(ctx context.Context, match func(message common.Message) bool, cursor uuid.UUID, limit int) (found []common.Message, more bool, err error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	i := 0
+	if cursor != uuid.Nil {
+		for i < len(ms.messages) && ms.messages[i].ID != cursor {
+			i++
+		}
+		if i == len(ms.messages) {
+			return nil, false, errCursorGone
+		}
+		i++
+	}
+
+	found = []common.Message{}
+	for scanned := 0; i < len(ms.messages); i, scanned = i+1, scanned+1 {
+		if scanned%scanCheckInterval == 0 && ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+
+		if !match(ms.messages[i]) {
+			continue
+		}
+
+		if len(found) == limit {
+			return found, true, nil
+		}
+
+		found = append(found, ms.messages[i])
+	}
+
+	return found, false, nil
+}
+
+// since returns the messages sent after t, oldest first
+func (ms *messageStore) since(t time.Time) []common.Message {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	// messages are stored in the order they were sent, so search for the first one after t
+	i := sort.Search(len(ms.messages), func(i int) bool {
+		return ms.messages[i].Timestamp.After(t)
+	})
+
+	found := make([]common.Message, len(ms.messages)-i)
+	copy(found, ms.messages[i:])
+
+	return found
+}
+
+// user is what the server remembers about a client across its connections
+type user struct {
+	sender          common.Sender
+	lastConnect     time.Time
+	previousConnect time.Time
+	conversations   map[uuid.UUID]bool
+	// seen is the Seq of the latest message of every conversation of the user when one of its
+	// connections was last subscribed to it, for what came since to be unread
+	seen       map[uuid.UUID]uint64
+	digest     bool
+	lastDigest time.Time
+	// email is where the user's email digests go, if it wants them, and lastEmail when the
+	// last one was sent
+	email     string
+	lastEmail time.Time
+	hidden    bool
+	// registeredName is the name the user registered, for no one else to connect with it
+	registeredName string
+	profile        common.Profile
+	status         common.Status
+	// blocked are the users this one blocked, by ID
+	blocked map[uuid.UUID]common.Sender
+	banned  bool
+	// authenticated is set once the user connected by logging in or with a client certificate,
+	// which it has to do from then on
+	authenticated bool
+}
+
+// blockList is who u blocks, sorted by name
+func (u *user) blockList() []common.Sender {
+	senders := []common.Sender{}
+	for _, sender := range u.blocked {
+		senders = append(senders, sender)
+	}
+
+	sort.Slice(senders, func(i, j int) bool {
+		return senders[i].Name < senders[j].Name
+	})
+
+	return senders
+}
+
+// copy returns a copy of u that can be used without holding the store's lock
+func (u *user) copy() user {
+	userCopy := *u
+	userCopy.conversations = map[uuid.UUID]bool{}
+	for id := range u.conversations {
+		userCopy.conversations[id] = true
+	}
+	userCopy.blocked = maps.Clone(u.blocked)
+	userCopy.seen = maps.Clone(u.seen)
+
+	return userCopy
+}
+
+// userStore keeps track of every client that has connected to the server
+type userStore struct {
+	mu    sync.RWMutex
+	users map[uuid.UUID]*user
+}
+
+var users = &userStore{users: map[uuid.UUID]*user{}}
+
+// connected records a new connection from the client, authenticated if it logged in or
+// presented a client certificate. What clients that didn't made of the ID before it first
+// connected that way is forgotten, and a key it once connected with stays pinned
+func (us *userStore) connected(aboutClient *common.ClientAboutMe, authenticated bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	u, ok := us.users[aboutClient.ID]
+	if !ok || (authenticated && !u.authenticated) {
+		u = &user{conversations: map[uuid.UUID]bool{}, blocked: map[uuid.UUID]common.Sender{}, seen: map[uuid.UUID]uint64{}}
+		us.users[aboutClient.ID] = u
+	}
+
+	publicKey := u.sender.PublicKey
+	u.sender = common.Sender(*aboutClient)
+	if len(u.sender.PublicKey) == 0 {
+		u.sender.PublicKey = publicKey
+	}
+	u.authenticated = u.authenticated || authenticated
+	u.status = common.Status{}
+	u.previousConnect = u.lastConnect
+	u.lastConnect = time.Now()
+}
+
+// get returns a copy of the user with the given ID
+func (us *userStore) get(id uuid.UUID) (user, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	if u, ok := us.users[id]; ok {
+		return u.copy(), true
+	}
+
+	return user{}, false
+}
+
+// remove forgets the user with the given ID, but for its ban if it's banned. The users that
+// blocked it keep blocking its ID, without its name
+func (us *userStore) remove(id uuid.UUID) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok && u.banned {
+		us.users[id] = &user{
+			sender:        common.Sender{ID: id, Name: deletedUserName},
+			conversations: map[uuid.UUID]bool{},
+			blocked:       map[uuid.UUID]common.Sender{},
+			seen:          map[uuid.UUID]uint64{},
+			banned:        true,
+		}
+	} else {
+		delete(us.users, id)
+	}
+
+	for _, other := range us.users {
+		if _, ok := other.blocked[id]; ok {
+			other.blocked[id] = common.Sender{ID: id, Name: deletedUserName}
+		}
+	}
+}
+
+func (us *userStore) count() int {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	return len(us.users)
+}
+
+// subscribed records that a connection of the user subscribed to the conversation, which has
+// it seen every message of the conversation so far
+func (us *userStore) subscribed(id uuid.UUID, conversationID uuid.UUID) {
+	lastSeq := messages.lastSeq(conversationID)
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		u.conversations[conversationID] = true
+		u.seen[conversationID] = lastSeq
+	}
+}
+
+// seenUpTo records that the user has seen the messages of the conversation up to Seq lastSeq,
+// if it's still subscribed to it
+func (us *userStore) seenUpTo(id uuid.UUID, conversationID uuid.UUID, lastSeq uint64) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok && u.conversations[conversationID] {
+		u.seen[conversationID] = max(u.seen[conversationID], lastSeq)
+	}
+}
+
+// subscribedWithin records that the user subscribed to the conversation unless max users are
+// subscribed to it already, and tells if the user may subscribe. Zero max means no limit
+func (us *userStore) subscribedWithin(id uuid.UUID, conversationID uuid.UUID, max int) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	u, ok := us.users[id]
+	if !ok {
+		return true
+	}
+
+	if max > 0 && !u.conversations[conversationID] {
+		subscribers := 0
+		for _, other := range us.users {
+			if other.conversations[conversationID] {
+				subscribers++
+			}
+		}
+
+		if subscribers >= max {
+			return false
+		}
+	}
+
+	u.conversations[conversationID] = true
+
+	return true
+}
+
+// subscribers are the IDs of the users subscribed to the conversation, connected or not
+func (us *userStore) subscribers(conversationID uuid.UUID) []uuid.UUID {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	ids := []uuid.UUID{}
+	for id, u := range us.users {
+		if u.conversations[conversationID] {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func (us *userStore) unsubscribed(id uuid.UUID, conversationID uuid.UUID) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		delete(u.conversations, conversationID)
+		delete(u.seen, conversationID)
+	}
+}
+
+func (us *userStore) setHidden(id uuid.UUID, hidden bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		u.hidden = hidden
+	}
+}
+
+// updateProfile sets the fields of update that aren't nil on the user's profile, and returns
+// the resulting profile
+func (us *userStore) updateProfile(id uuid.UUID, update common.Profile) common.Profile {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	u, ok := us.users[id]
+	if !ok {
+		return update
+	}
+
+	if update.AvatarURL != nil {
+		u.profile.AvatarURL = update.AvatarURL
+	}
+	if update.Bio != nil {
+		u.profile.Bio = update.Bio
+	}
+
+	return u.profile
+}
+
+// setStatus sets the user's status, if the server knows the user
+func (us *userStore) setStatus(id uuid.UUID, status common.Status) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		u.status = status
+	}
+}
+
+// conversationsOf returns the IDs of the conversations the user is subscribed to
+func (us *userStore) conversationsOf(id uuid.UUID) []uuid.UUID {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	u, ok := us.users[id]
+	if !ok {
+		return nil
+	}
+
+	conversationIDs := []uuid.UUID{}
+	for conversationID := range u.conversations {
+		conversationIDs = append(conversationIDs, conversationID)
+	}
+
+	return conversationIDs
+}
+
+func (us *userStore) status(id uuid.UUID) common.Status {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	if u, ok := us.users[id]; ok {
+		return u.status
+	}
+
+	return common.Status{}
+}
+
+// setBlocked blocks or unblocks the senders for the user, and returns who it blocks now
+func (us *userStore) setBlocked(id uuid.UUID, senders []common.Sender, blocked bool) []common.Sender {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	u, ok := us.users[id]
+	if !ok {
+		return nil
+	}
+
+	for _, sender := range senders {
+		if blocked {
+			u.blocked[sender.ID] = sender
+		} else {
+			delete(u.blocked, sender.ID)
+		}
+	}
+
+	return u.blockList()
+}
+
+// sender returns the ID and name the user last connected with
+func (us *userStore) sender(id uuid.UUID) (common.Sender, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	if u, ok := us.users[id]; ok {
+		return u.sender, true
+	}
+
+	return common.Sender{}, false
+}
+
+// setBanned bans or unbans the user with the given ID from the server, remembering it even
+// if it never connected
+func (us *userStore) setBanned(sender common.Sender, banned bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	u, ok := us.users[sender.ID]
+	if !ok {
+		u = &user{sender: sender, conversations: map[uuid.UUID]bool{}, blocked: map[uuid.UUID]common.Sender{}, seen: map[uuid.UUID]uint64{}}
+		us.users[sender.ID] = u
+	}
+
+	u.banned = banned
+}
+
+func (us *userStore) isBanned(id uuid.UUID) bool {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	u, ok := us.users[id]
+
+	return ok && u.banned
+}
+
+// authenticates tells if the user with the given ID has to log in or present its client
+// certificate to connect, having done so before
+func (us *userStore) authenticates(id uuid.UUID) bool {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	u, ok := us.users[id]
+
+	return ok && u.authenticated
+}
+
+// takesKey tells if a client with the given ID may connect with key: the first key seen for an
+// ID is the only one it may use afterwards, and IDs that never had one may connect without
+func (us *userStore) takesKey(id uuid.UUID, key []byte) bool {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	u, ok := us.users[id]
+	if !ok || len(u.sender.PublicKey) == 0 {
+		return true
+	}
+
+	return bytes.Equal(u.sender.PublicKey, key)
+}
+
+// blocked returns who the user blocks
+func (us *userStore) blocked(id uuid.UUID) []common.Sender {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	if u, ok := us.users[id]; ok {
+		return u.blockList()
+	}
+
+	return nil
+}
+
+// blocks tells whether the user blocked sender
+func (us *userStore) blocks(id uuid.UUID, sender uuid.UUID) bool {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	u, ok := us.users[id]
+	if !ok {
+		return false
+	}
+
+	_, blocked := u.blocked[sender]
+
+	return blocked
+}
+
+// rename changes the name of the user
+func (us *userStore) rename(id uuid.UUID, name string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		u.sender.Name = name
+	}
+}
+
+// register has the user register name, releasing the one it had, unless another user
+// registered it already. An empty name releases the user's name
+func (us *userStore) register(id uuid.UUID, name string) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	key := nicknameKey(name)
+	for otherID, other := range us.users {
+		if name != "" && otherID != id && nicknameKey(other.registeredName) == key {
+			return nicknameTaken(name, "name")
+		}
+	}
+
+	if u, ok := us.users[id]; ok {
+		u.registeredName = name
+	}
+
+	return nil
+}
+
+// registeredBy returns the ID of the user that registered name, in any case
+func (us *userStore) registeredBy(name string) (uuid.UUID, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	key := nicknameKey(name)
+	for id, u := range us.users {
+		if u.registeredName != "" && nicknameKey(u.registeredName) == key {
+			return id, true
+		}
+	}
+
+	return uuid.Nil, false
+}
+
+// named returns copies of the users called name, in any case
+func (us *userStore) named(name string) []user {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	key := nicknameKey(name)
+	found := []user{}
+	for _, u := range us.users {
+		if nicknameKey(u.sender.Name) == key {
+			found = append(found, u.copy())
+		}
+	}
+
+	return found
+}
+
+func (us *userStore) setDigest(id uuid.UUID, enabled bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		u.digest = enabled
+	}
+}
+
+// withDigest returns copies of the users that opted in to the digest
+func (us *userStore) withDigest() []user {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	found := []user{}
+	for _, u := range us.users {
+		if u.digest {
+			found = append(found, u.copy())
+		}
+	}
+
+	return found
+}
+
+func (us *userStore) digestSent(id uuid.UUID, t time.Time) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		u.lastDigest = t
+	}
+}
+
+func (us *userStore) setEmail(id uuid.UUID, address string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		u.email = address
+	}
+}
+
+// withEmail returns copies of the users that want email digests
+func (us *userStore) withEmail() []user {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	found := []user{}
+	for _, u := range us.users {
+		if u.email != "" {
+			found = append(found, u.copy())
+		}
+	}
+
+	return found
+}
+
+func (us *userStore) emailSent(id uuid.UUID, t time.Time) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if u, ok := us.users[id]; ok {
+		u.lastEmail = t
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// TestSinceWithSharedMessages keeps messages of another instance sent before the latest ones,
+// which since must still find
+func TestSinceWithSharedMessages(t *testing.T) {
+	ms := newMessageStore()
+	conversation := &common.Conversation{ID: uuid.New(), Nickname: "general"}
+
+	start := time.Now()
+	ms.add(common.Message{Conversation: conversation, Text: "local"})
+
+	shared := common.Message{ID: uuid.New(), Conversation: conversation, Text: "shared", Timestamp: start.Add(-time.Minute)}
+	ms.keep(shared)
+
+	found := ms.since(start.Add(-2 * time.Minute))
+	if len(found) != 2 || found[0].Text != "shared" || found[1].Text != "local" {
+		t.Errorf("since = %v, want the shared message then the local one", found)
+	}
+
+	found = ms.since(start.Add(-time.Second))
+	if len(found) != 1 || found[0].Text != "local" {
+		t.Errorf("since = %v, want only the local message", found)
+	}
+}
+
+// TestReplicateInOrder replicates messages of the cluster out of order, which since and sequence
+// must return in order
+func TestReplicateInOrder(t *testing.T) {
+	ms := newMessageStore()
+	conversation := &common.Conversation{ID: uuid.New(), Nickname: "general"}
+
+	start := time.Now()
+	for _, seq := range []uint64{2, 3, 1} {
+		ms.replicate(common.Message{ID: uuid.New(), Conversation: conversation, Seq: seq, Timestamp: start.Add(time.Duration(seq) * time.Second)})
+	}
+
+	found := ms.since(start)
+	if len(found) != 3 || found[0].Seq != 1 || found[1].Seq != 2 || found[2].Seq != 3 {
+		t.Errorf("since = %v, want the messages in the order they were sent", found)
+	}
+
+	found, next := ms.sequence(conversation.ID, 1, 3, 2)
+	if len(found) != 2 || found[0].Seq != 1 || found[1].Seq != 2 || next != 3 {
+		t.Errorf("sequence = %v, %d, want the first two messages, then 3", found, next)
+	}
+}
+
+func BenchmarkStoreAppend(b *testing.B) {
+	ms := newMessageStore()
+	message := benchmarkMessage(&common.Conversation{ID: uuid.New(), Nickname: "general"})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ms.add(message)
+	}
+}
+
+// BenchmarkStoreQuery looks up the last 100 of 100000 stored messages
+func BenchmarkStoreQuery(b *testing.B) {
+	ms := newMessageStore()
+	message := benchmarkMessage(&common.Conversation{ID: uuid.New(), Nickname: "general"})
+
+	var since time.Time
+	for i := 0; i < 100000; i++ {
+		stored := ms.add(message)
+		if i == 100000-100 {
+			since = stored.Timestamp
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ms.since(since)
+	}
+}
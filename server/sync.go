@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// maxMembershipEvents is how many of the latest joins and leaves of every conversation are kept
+// for the clients syncing after reconnecting
+const maxMembershipEvents = 100
+
+// membershipEvent is a user joining or leaving a conversation, with the system message sent
+// to the conversation about it
+type membershipEvent struct {
+	userID  uuid.UUID
+	message common.Message
+}
+
+// membershipLog keeps the latest joins and leaves of every conversation, as the system messages
+// about them aren't kept in the history
+type membershipLog struct {
+	mu     sync.Mutex
+	events map[uuid.UUID][]membershipEvent
+}
+
+var membership = &membershipLog{events: map[uuid.UUID][]membershipEvent{}}
+
+// record keeps message, about the user with the given ID joining or leaving its conversation
+func (ml *membershipLog) record(userID uuid.UUID, message common.Message) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	id := message.Conversation.ID
+	events := append(ml.events[id], membershipEvent{userID: userID, message: message})
+	if len(events) > maxMembershipEvents {
+		events = events[len(events)-maxMembershipEvents:]
+	}
+
+	ml.events[id] = events
+}
+
+// since returns the messages about the joins and leaves of a conversation after t, oldest
+// first, leaving out those for which skip is true
+func (ml *membershipLog) since(conversationID uuid.UUID, t time.Time, skip func(userID uuid.UUID) bool) []common.Message {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	found := []common.Message{}
+	for _, event := range ml.events[conversationID] {
+		if event.message.Timestamp.After(t) && !skip(event.userID) {
+			found = append(found, event.message)
+		}
+	}
+
+	return found
+}
+
+func (ml *membershipLog) forget(conversationID uuid.UUID) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	delete(ml.events, conversationID)
+}
+
+// forgetUser drops the joins and leaves of the user with the given ID
+func (ml *membershipLog) forgetUser(userID uuid.UUID) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	for id, events := range ml.events {
+		ml.events[id] = slices.DeleteFunc(events, func(event membershipEvent) bool {
+			return event.userID == userID
+		})
+	}
+}
+
+// handleSync subscribes a client that reconnected to the conversations it was subscribed to,
+// and responds with what changed while it was away. Conversations it may no longer subscribe
+// to, because of the limits or their ACL, are left out of Subscribed
+func handleSync(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	state := common.Sync{}
+
+	err := json.Unmarshal(*op.Message, &state)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Sync: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	delta := common.SyncDelta{}
+
+	for _, conversation := range conversations.all() {
+		if !slices.Contains(state.Known, conversation.ID) && checkGuestAccess(conversation, s) == nil {
+			delta.New = append(delta.New, conversation)
+		}
+	}
+
+	for _, id := range state.Known {
+		if _, ok := conversations.get(id); !ok {
+			delta.Gone = append(delta.Gone, id)
+		}
+	}
+
+	maxSubscribers := currentConfig.limits().MaxSubscribers
+	if s.admin {
+		maxSubscribers = 0
+	}
+
+	for id, lastSeq := range state.Subscriptions {
+		conversation, ok := conversations.get(id)
+		if !ok {
+			if !slices.Contains(delta.Gone, id) {
+				delta.Gone = append(delta.Gone, id)
+			}
+			continue
+		}
+
+		if checkGuestAccess(conversation, s) != nil || !canAccess(conversation, s, common.ReadAccess) ||
+			checkCanDecrypt(conversation, s) != nil {
+			continue
+		}
+
+		joined := !slices.Contains(users.subscribers(conversation.ID), s.client.ID)
+		if !users.subscribedWithin(s.client.ID, conversation.ID, maxSubscribers) {
+			continue
+		}
+
+		// joins and leaves are taken before subscribing, which is one of them
+		if !state.Since.IsZero() {
+			delta.Membership = append(delta.Membership, membership.since(conversation.ID, state.Since, func(userID uuid.UUID) bool {
+				return userID == s.client.ID || users.blocks(s.client.ID, userID)
+			})...)
+		}
+
+		s.subscribe(conversation.ID)
+
+		if conversation.Encrypted {
+			conversationKeys.subscribed(conversation, s, joined)
+		}
+
+		// a copy, as the stored conversation is shared
+		subscribed := *conversation
+		subscribed.LastSeq = messages.lastSeq(conversation.ID)
+		delta.Subscribed = append(delta.Subscribed, &subscribed)
+
+		if lastSeq >= subscribed.LastSeq {
+			continue
+		}
+
+		missed, _ := messages.sequence(conversation.ID, lastSeq+1, subscribed.LastSeq, maxFetch)
+		missed = slices.DeleteFunc(missed, func(message common.Message) bool {
+			return blocksSender(s, message)
+		})
+		delta.Missed = append(delta.Missed, withNickname(missed, conversation)...)
+	}
+
+	return marshalResponse(delta)
+}
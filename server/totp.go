@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+const (
+	// totpStep is how long a one-time code lasts, and totpSkew how many steps before or after
+	// the current one are accepted too, for clocks that are a bit off
+	totpStep = 30 * time.Second
+	totpSkew = 1
+	// maxTOTPFailures wrong codes in a row lock logging in to an account for totpLockout, so
+	// that codes can't be guessed
+	maxTOTPFailures = 5
+	totpLockout     = 5 * time.Minute
+)
+
+// totpSecret is the two-factor authentication of an account: its secret, which is only used
+// for logging in once a code from it confirmed it, and the last step a code was used for, so
+// that a code can't be used twice
+type totpSecret struct {
+	secret      []byte
+	confirmed   bool
+	lastStep    int64
+	failures    int
+	lockedUntil time.Time
+}
+
+// totpStore keeps the TOTP secrets of accounts, by their ID
+type totpStore struct {
+	mu      sync.Mutex
+	secrets map[uuid.UUID]*totpSecret
+}
+
+var totpSecrets = &totpStore{secrets: map[uuid.UUID]*totpSecret{}}
+
+// enabled tells if logging in to the account with the given ID needs a one-time code
+func (ts *totpStore) enabled(id uuid.UUID) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	secret, ok := ts.secrets[id]
+
+	return ok && secret.confirmed
+}
+
+// enroll makes a new secret for the account with the given ID, replacing the one it was
+// enrolling with before. Accounts that have one already must disable it first
+func (ts *totpStore) enroll(id uuid.UUID) ([]byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if existing, ok := ts.secrets[id]; ok && existing.confirmed {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: "two-factor authentication is on already: turn it off first",
+		}
+	}
+
+	ts.secrets[id] = &totpSecret{secret: secret}
+
+	return secret, nil
+}
+
+// verify checks a code of the secret of the account with the given ID, confirming the secret
+func (ts *totpStore) verify(id uuid.UUID, code string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	secret, ok := ts.secrets[id]
+	if !ok {
+		return &common.Error{Code: common.NotFoundErrorCode, Message: "enroll first"}
+	}
+
+	now := time.Now()
+	if now.Before(secret.lockedUntil) {
+		return &common.Error{
+			Code:       common.TOTPRequiredErrorCode,
+			Message:    "too many wrong one-time codes, try again later",
+			RetryAfter: secret.lockedUntil.Sub(now).Seconds(),
+		}
+	}
+
+	current := now.Unix() / int64(totpStep.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > secret.lastStep && hmac.Equal([]byte(totpCode(secret.secret, step)), []byte(code)) {
+			secret.lastStep = step
+			secret.failures = 0
+			secret.confirmed = true
+			return nil
+		}
+	}
+
+	secret.failures++
+	if secret.failures >= maxTOTPFailures {
+		secret.failures = 0
+		secret.lockedUntil = now.Add(totpLockout)
+	}
+
+	return &common.Error{Code: common.TOTPRequiredErrorCode, Message: "wrong one-time code"}
+}
+
+// disable turns two-factor authentication off for the account with the given ID
+func (ts *totpStore) disable(id uuid.UUID) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	delete(ts.secrets, id)
+}
+
+// totpCode is the six digit code of secret for a step, as in RFC 6238
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
+
+// checkTOTP checks the one-time code of a client logging in to an account with two-factor
+// authentication
+func checkTOTP(id uuid.UUID, login common.Login) error {
+	if !totpSecrets.enabled(id) {
+		return nil
+	}
+
+	if login.TOTPCode == "" {
+		return &common.Error{
+			Code:    common.TOTPRequiredErrorCode,
+			Message: "this account needs a one-time code from your authenticator app",
+		}
+	}
+
+	return totpSecrets.verify(id, login.TOTPCode)
+}
+
+// handleTOTP sets up two-factor authentication for the password account the client logged in to
+func handleTOTP(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	request := common.TOTP{}
+
+	err := json.Unmarshal(*op.Message, &request)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing TOTP: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	if s.account == "" {
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: "only accounts logged in to with a password have two-factor authentication",
+		}
+	}
+
+	response := common.TOTP{Action: request.Action}
+	switch request.Action {
+	case common.TOTPEnrollAction:
+		secret, err := totpSecrets.enroll(s.client.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		response.Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+		response.URI = (&url.URL{
+			Scheme:   "otpauth",
+			Host:     "totp",
+			Path:     "/tcpchat:" + s.account,
+			RawQuery: url.Values{"secret": {response.Secret}, "issuer": {"tcpchat"}}.Encode(),
+		}).String()
+	case common.TOTPConfirmAction:
+		err := totpSecrets.verify(s.client.ID, request.Code)
+		if err != nil {
+			return nil, err
+		}
+
+		response.Enabled = true
+		auditLog.record(s.actor(), common.TOTPOperationType, s.account, "enabled")
+	case common.TOTPDisableAction:
+		if totpSecrets.enabled(s.client.ID) {
+			err := totpSecrets.verify(s.client.ID, request.Code)
+			if err != nil {
+				return nil, err
+			}
+
+			auditLog.record(s.actor(), common.TOTPOperationType, s.account, "disabled")
+		}
+
+		totpSecrets.disable(s.client.ID)
+	default:
+		return nil, &common.Error{
+			Code:    common.ForbiddenErrorCode,
+			Message: fmt.Sprintf("unknown action '%s'", request.Action),
+		}
+	}
+
+	return marshalResponse(response)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// maxTopicLength is the most characters a conversation's topic may have, and maxStatusLength
+// the most the text of a user's status may have. The rest is cut off
+const (
+	maxTopicLength  = 300
+	maxStatusLength = 100
+)
+
+// maxDeviceLength is the most characters the client a session says it connects with may have
+const maxDeviceLength = 100
+
+// maxBioLength and maxAvatarURLLength are the most characters the fields of a profile may have
+const (
+	maxBioLength       = 500
+	maxAvatarURLLength = 2048
+)
+
+// cleanText makes the text of a message safe to pass on to other clients: invalid UTF-8 and
+// control characters other than newlines and tabs are dropped. Messages left without any
+// text, or with more than maxLength characters, are refused
+func cleanText(text string, maxLength int) (string, error) {
+	text = stripControls(text, true)
+
+	if strings.TrimSpace(text) == "" {
+		return "", &common.Error{
+			Code:    common.EmptyMessageErrorCode,
+			Message: "message is empty",
+		}
+	}
+
+	if length := utf8.RuneCountInString(text); length > maxLength {
+		return "", &common.Error{
+			Code:    common.MessageTooLongErrorCode,
+			Message: fmt.Sprintf("message is %d characters long, the most allowed is %d", length, maxLength),
+		}
+	}
+
+	return text, nil
+}
+
+// cleanTopic makes a topic a single line of at most maxTopicLength characters
+func cleanTopic(topic string) string {
+	return cleanLine(topic, maxTopicLength)
+}
+
+// cleanLine makes text a single line of at most maxLength characters
+func cleanLine(text string, maxLength int) string {
+	text = strings.TrimSpace(stripControls(text, false))
+	if runes := []rune(text); len(runes) > maxLength {
+		text = string(runes[:maxLength])
+	}
+
+	return text
+}
+
+// cleanProfile checks the fields of a profile being set: the avatar has to be an http(s) URL,
+// and the bio a single line. Empty fields are fine, they clear what was set before
+func cleanProfile(profile common.Profile) (common.Profile, error) {
+	if profile.Bio != nil {
+		bio := strings.TrimSpace(stripControls(*profile.Bio, false))
+		if length := utf8.RuneCountInString(bio); length > maxBioLength {
+			return profile, &common.Error{
+				Code:    common.InvalidProfileErrorCode,
+				Message: fmt.Sprintf("bio is %d characters long, the most allowed is %d", length, maxBioLength),
+			}
+		}
+
+		profile.Bio = &bio
+	}
+
+	if profile.AvatarURL != nil {
+		avatarURL := strings.TrimSpace(*profile.AvatarURL)
+
+		if avatarURL != "" {
+			parsed, err := url.Parse(avatarURL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+				len(avatarURL) > maxAvatarURLLength {
+				return profile, &common.Error{
+					Code:    common.InvalidProfileErrorCode,
+					Message: fmt.Sprintf("avatar should be an http(s) URL of at most %d characters", maxAvatarURLLength),
+				}
+			}
+		}
+
+		profile.AvatarURL = &avatarURL
+	}
+
+	return profile, nil
+}
+
+// stripControls drops invalid UTF-8 and control characters from text, except for newlines
+// and tabs if keepLines is set
+func stripControls(text string, keepLines bool) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && !(keepLines && (r == '\n' || r == '\t')) {
+			return -1
+		}
+
+		return r
+	}, strings.ToValidUTF8(text, ""))
+}
+
+// checkSignature checks the signature of a message from the client of s, whose Sender must be
+// set already. Clients with a key sign all their messages, and the signature of the others is
+// dropped
+func checkSignature(message *common.Message, s *session) error {
+	if len(s.client.PublicKey) == 0 {
+		message.Signature = nil
+		return nil
+	}
+
+	if !common.Verify(*message) {
+		return &common.Error{
+			Code:    common.InvalidSignatureErrorCode,
+			Message: "the message's signature doesn't match your public key",
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikochiko/tcpchat/common"
+)
+
+// The events webhooks are told about
+const (
+	MessageWebhookEvent = "message"
+	JoinWebhookEvent    = "join"
+	LeaveWebhookEvent   = "leave"
+	// ReportWebhookEvent is sent for messages reported by users or flagged by the content filter,
+	// and ResolveWebhookEvent when the moderators resolve a report
+	ReportWebhookEvent  = "report"
+	ResolveWebhookEvent = "resolve"
+	BanWebhookEvent     = "ban"
+	UnbanWebhookEvent   = "unban"
+	KickWebhookEvent    = "kick"
+)
+
+var webhookEvents = []string{
+	MessageWebhookEvent, JoinWebhookEvent, LeaveWebhookEvent, ReportWebhookEvent,
+	ResolveWebhookEvent, BanWebhookEvent, UnbanWebhookEvent, KickWebhookEvent,
+}
+
+// The headers of the requests to webhooks. The signature is the hex encoded HMAC-SHA256 of the
+// body with the webhook's secret, prefixed with "sha256=", and the delivery ID stays the same
+// when a delivery is retried, for receivers to skip the ones they already got
+const (
+	webhookEventHeader     = "X-Tcpchat-Event"
+	webhookDeliveryHeader  = "X-Tcpchat-Delivery"
+	webhookSignatureHeader = "X-Tcpchat-Signature"
+)
+
+// webhookRetryDelays are how long a delivery that failed waits before every retry, after which
+// it's dropped
+var webhookRetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// webhookWorkers is how many deliveries are made at a time, and webhookQueueSize how many may
+// wait for one. Events that find the queue full are dropped
+const (
+	webhookWorkers   = 4
+	webhookQueueSize = 1000
+)
+
+var webhookHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook is a URL the server POSTs events to, as WebhookEvent JSON objects. Conversations and
+// Events, if set, are the nicknames of the conversations and the events it wants; the events
+// that aren't about a conversation, like bans, are sent whatever the conversations. With a
+// Secret, requests are signed for the receiver to check they come from the server
+type Webhook struct {
+	URL           string   `yaml:"url"`
+	Secret        string   `yaml:"secret"`
+	Conversations []string `yaml:"conversations"`
+	Events        []string `yaml:"events"`
+}
+
+func (w Webhook) check() error {
+	parsed, err := url.Parse(w.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook URL '%s' should be an http or https URL", w.URL)
+	}
+
+	for _, event := range w.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return fmt.Errorf("unknown webhook event '%s', expected one of %s", event, strings.Join(webhookEvents, ", "))
+		}
+	}
+
+	return nil
+}
+
+// wants tells whether the webhook is interested in event
+func (w Webhook) wants(event WebhookEvent) bool {
+	if len(w.Events) > 0 && !slices.Contains(w.Events, event.Event) {
+		return false
+	}
+
+	if len(w.Conversations) == 0 || event.Conversation == nil {
+		return true
+	}
+
+	return slices.ContainsFunc(w.Conversations, func(nickname string) bool {
+		return strings.EqualFold(nickname, event.Conversation.Nickname)
+	})
+}
+
+// WebhookEvent is what webhooks are sent: an Event about a Conversation, a Message or a User,
+// with the Actor that did it for moderation events and Details like the reason of a report
+type WebhookEvent struct {
+	Event        string               `json:"event"`
+	Time         time.Time            `json:"time"`
+	Conversation *common.Conversation `json:"conversation,omitempty"`
+	Message      *common.Message      `json:"message,omitempty"`
+	User         *common.Sender       `json:"user,omitempty"`
+	Actor        string               `json:"actor,omitempty"`
+	Details      string               `json:"details,omitempty"`
+}
+
+// webhookDelivery is an event on its way to a webhook
+type webhookDelivery struct {
+	id      uuid.UUID
+	webhook Webhook
+	event   string
+	body    []byte
+	// attempt is how many times the delivery failed already
+	attempt int
+}
+
+var (
+	webhookQueue     = make(chan *webhookDelivery, webhookQueueSize)
+	startWebhookOnce sync.Once
+)
+
+// notifyWebhooks sends event to the webhooks of the configuration that want it, in the
+// background
+func notifyWebhooks(event WebhookEvent) {
+	webhooks := currentConfig.webhooks()
+	if len(webhooks) == 0 {
+		return
+	}
+
+	event.Time = time.Now()
+
+	body, err := json.Marshal(event)
+	if common.CheckErrorAndLog(err) {
+		return
+	}
+
+	startWebhookOnce.Do(func() {
+		for range webhookWorkers {
+			go deliverWebhooks()
+		}
+	})
+
+	for _, webhook := range webhooks {
+		if webhook.wants(event) {
+			queueWebhook(&webhookDelivery{id: uuid.New(), webhook: webhook, event: event.Event, body: body})
+		}
+	}
+}
+
+func queueWebhook(delivery *webhookDelivery) {
+	select {
+	case webhookQueue <- delivery:
+	default:
+		common.Errorf("Too many webhook deliveries waiting, dropping a %s event for %s\n", delivery.event, delivery.webhook.URL)
+	}
+}
+
+func deliverWebhooks() {
+	for delivery := range webhookQueue {
+		err := delivery.post()
+		if err == nil {
+			continue
+		}
+
+		if delivery.attempt >= len(webhookRetryDelays) {
+			common.Errorf("Giving up on delivering a %s event to %s: %s\n", delivery.event, delivery.webhook.URL, err.Error())
+			continue
+		}
+
+		log.Printf("Couldn't deliver a %s event to %s, retrying: %s\n", delivery.event, delivery.webhook.URL, err.Error())
+
+		// retried later, without holding up the worker
+		delay := webhookRetryDelays[delivery.attempt]
+		delivery.attempt++
+		time.AfterFunc(delay, func() {
+			queueWebhook(delivery)
+		})
+	}
+}
+
+// post makes the request of the delivery. Responses other than 2xx are errors
+func (d *webhookDelivery) post() error {
+	request, err := http.NewRequest(http.MethodPost, d.webhook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookEventHeader, d.event)
+	request.Header.Set(webhookDeliveryHeader, d.id.String())
+	if d.webhook.Secret != "" {
+		request.Header.Set(webhookSignatureHeader, signWebhook(d.webhook.Secret, d.body))
+	}
+
+	response, err := webhookHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("got %s", response.Status)
+	}
+
+	return nil
+}
+
+// signWebhook is the signature of body with secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookUser is sender as webhooks are told about it, without its keys
+func webhookUser(sender common.Sender) *common.Sender {
+	return &common.Sender{ID: sender.ID, Name: sender.Name}
+}
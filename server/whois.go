@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nikochiko/tcpchat/common"
+)
+
+func handleWhois(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	whois := common.Whois{}
+
+	err := json.Unmarshal(*op.Message, &whois)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Whois: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	// the earliest connection of every online user, as they may be connected more than once
+	online := map[uuid.UUID]time.Time{}
+	for _, session := range connectedSessions() {
+		if _, ok := online[session.client.ID]; !ok {
+			online[session.client.ID] = session.connectedAt
+		}
+	}
+
+	whois.Users = []common.UserInfo{}
+	for _, u := range users.named(whois.Name) {
+		connectedAt, isOnline := online[u.sender.ID]
+
+		info := common.UserInfo{
+			ID:      u.sender.ID,
+			Name:    u.sender.Name,
+			Online:  isOnline,
+			Hidden:  u.hidden,
+			Profile: u.profile,
+			Status:  u.status,
+		}
+
+		// hidden users still see themselves in full, and so do admins
+		if u.hidden && u.sender.ID != s.client.ID && !s.admin {
+			whois.Users = append(whois.Users, info)
+			continue
+		}
+
+		if isOnline {
+			info.ConnectedAt = &connectedAt
+		}
+
+		for id := range u.conversations {
+			if conversation, ok := conversations.get(id); ok {
+				info.Conversations = append(info.Conversations, conversation.Nickname)
+			}
+		}
+		sort.Strings(info.Conversations)
+
+		whois.Users = append(whois.Users, info)
+	}
+
+	if len(whois.Users) == 0 {
+		return nil, &common.Error{Code: common.NotFoundErrorCode, Message: "no user called " + whois.Name + " has been here"}
+	}
+
+	return marshalResponse(whois)
+}
+
+func handleProfile(ctx context.Context, op *common.Operation, s *session) (*json.RawMessage, error) {
+	profile := common.Profile{}
+
+	err := json.Unmarshal(*op.Message, &profile)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing Profile: %s\n", err.Error())
+		return nil, errors.New(unmarshalingError)
+	}
+
+	profile, err = cleanProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalResponse(users.updateProfile(s.client.ID, profile))
+}
+
+func handlePrivacySettings(ctx context.Context, op *common.Operation, s *session) error {
+	settings := common.PrivacySettings{}
+
+	err := json.Unmarshal(*op.Message, &settings)
+	if err != nil {
+		common.Errorf("Unmarshaling error while parsing PrivacySettings: %s\n", err.Error())
+		return errors.New(unmarshalingError)
+	}
+
+	users.setHidden(s.client.ID, settings.Hidden)
+
+	return nil
+}